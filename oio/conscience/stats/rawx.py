@@ -25,6 +25,8 @@ class RawxStat(HttpStat):
             ("counter", "req.hits",   "stat.total_reqpersec"),
             ("counter", "req.time",   "stat.total_avreqtime"),
             ("config",  "service_id", "tag.service_id"),
+            ("gauge",   "space.inodes_idle", "stat.inodes"),
+            ("config",  "health",     "tag.health"),
     ]
 
     def configure(self):
@@ -64,7 +66,7 @@ class RawxStat(HttpStat):
         for stat_key in RawxStat.rawx_stat_keys:
             http_key = " ".join(stat_key[:2])
             if http_key in self._cur_http_stats:
-                if stat_key[0] == 'config':
+                if stat_key[0] in ('config', 'gauge'):
                     output[stat_key[2]] = self._cur_http_stats[http_key]
                 elif stat_key[0] == 'counter':
                     if stat_key[1].startswith('req.hits'):
@@ -0,0 +1,121 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The networks allowed to use the service, by class of request, for the
+deployments whose storage network isn't segmented: acl_read for the GET,
+HEAD and OPTIONS, acl_write for the other methods, acl_admin for the
+runtime settings and the snapshots, whatever their method. Each is a list
+of networks (CIDR) or addresses separated by commas, e.g. the subnet of
+the proxies for the writes:
+
+	acl_write  10.0.1.0/24,10.0.2.17
+
+An empty list allows everyone. A client outside the list is refused with a
+403, before its request is authenticated or served.
+*/
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+var errACLDenied = errors.New("Client network not allowed")
+
+// The networks allowed, nil for everyone
+type aclList []*net.IPNet
+
+var (
+	aclRead  aclList
+	aclWrite aclList
+	aclAdmin aclList
+)
+
+func parseACL(v string) (aclList, error) {
+	var acl aclList
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, errors.New("Invalid address: " + item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			acl = append(acl, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		acl = append(acl, network)
+	}
+	return acl, nil
+}
+
+func (acl aclList) allows(ip net.IP) bool {
+	if acl == nil {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, network := range acl {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// The list applying to the request
+func (rr *rawxRequest) aclOf() aclList {
+	if isAdminPath(rr.req.URL.Path) {
+		return aclAdmin
+	}
+	switch rr.req.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return aclRead
+	}
+	return aclWrite
+}
+
+// Tells if the client may send the request, as far as its network is concerned
+func (rr *rawxRequest) checkACL() error {
+	acl := rr.aclOf()
+	if acl == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(rr.req.RemoteAddr)
+	if err != nil {
+		host = rr.req.RemoteAddr
+	}
+	if !acl.allows(net.ParseIP(host)) {
+		atomic.AddUint64(&counters.ACLRefused, 1)
+		return errACLDenied
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseACL(t *testing.T) {
+	cases := []struct {
+		acl     string
+		fails   bool
+		allowed []string
+		denied  []string
+	}{
+		{"", false, []string{"10.0.0.1", "::1"}, nil},
+		{" , ", false, []string{"10.0.0.1"}, nil},
+		{"10.0.1.0/24", false, []string{"10.0.1.0", "10.0.1.255"}, []string{"10.0.2.1", "::1"}},
+		{"10.0.1.0/24, 10.0.2.17", false,
+			[]string{"10.0.1.7", "10.0.2.17", "::ffff:10.0.2.17"}, []string{"10.0.2.18"}},
+		{"fd00::/8,::1", false, []string{"fd12::1", "::1"}, []string{"fe80::1", "127.0.0.1"}},
+		{"10.0.1.0/33", true, nil, nil},
+		{"10.0.1.300", true, nil, nil},
+		{"proxy.local", true, nil, nil},
+	}
+	for _, tc := range cases {
+		acl, err := parseACL(tc.acl)
+		if (err != nil) != tc.fails {
+			t.Errorf("%q: error %v", tc.acl, err)
+			continue
+		}
+		for _, ip := range tc.allowed {
+			if !acl.allows(net.ParseIP(ip)) {
+				t.Errorf("%q: %s denied", tc.acl, ip)
+			}
+		}
+		for _, ip := range tc.denied {
+			if acl.allows(net.ParseIP(ip)) {
+				t.Errorf("%q: %s allowed", tc.acl, ip)
+			}
+		}
+	}
+}
+
+func TestCheckACL(t *testing.T) {
+	defer func(read, write, admin aclList) {
+		aclRead, aclWrite, aclAdmin = read, write, admin
+	}(aclRead, aclWrite, aclAdmin)
+	aclRead = nil
+	aclWrite, _ = parseACL("10.0.1.0/24")
+	aclAdmin, _ = parseACL("10.0.9.1")
+
+	cases := []struct {
+		method string
+		path   string
+		remote string
+		err    error
+	}{
+		{"GET", "/CHUNK", "10.0.2.1:6000", nil},
+		{"PUT", "/CHUNK", "10.0.1.2:6000", nil},
+		{"PUT", "/CHUNK", "10.0.2.1:6000", errACLDenied},
+		{"DELETE", "/CHUNK", "[::1]:6000", errACLDenied},
+		{"PUT", "/CHUNK", "garbage", errACLDenied},
+		{"GET", adminConfigPath, "10.0.1.2:6000", errACLDenied},
+		{"POST", "/snapshot", "10.0.9.1:6000", nil},
+		{"POST", "/snapshot", "10.0.1.2:6000", errACLDenied},
+	}
+	for _, tc := range cases {
+		rr := rawxRequest{req: httptest.NewRequest(tc.method, tc.path, nil)}
+		rr.req.RemoteAddr = tc.remote
+		if err := rr.checkACL(); err != tc.err {
+			t.Errorf("%s %s from %s: error %v, expected %v",
+				tc.method, tc.path, tc.remote, err, tc.err)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The runtime settings, read with GET /admin/config and changed with a POST of
+the new values, applied at once without any restart:
+
+	{"log_level": "info", "client_bandwidth": 10485760,
+	 "client_rate": 200, "client_rate_burst": 400,
+	 "max_concurrent_get": 64, "max_concurrent_put": 32,
+	 "compression": "zstd", "read_only": true, "maintenance": false,
+	 "event_agent": "beanstalk://10.0.0.1:6014"}
+
+Only the settings present are changed, all of them or none when one is
+invalid. The read-only and maintenance flags, and the compression, are
+those of the volume addressed, the others are shared by the volumes of the
+service, cf. maintenance.go. The new event_agent is reloaded like upon a
+SIGHUP, and sticks over the reloads. The changes last until the service
+restarts, each of them is logged along with who asked for it.
+
+The API requires auth_tokens_file, and a token with the ADMIN scope (or *),
+even to read the settings. The repair of a chunk and the snapshots are
+admin verbs too, cf. resync.go and snapshot.go.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"log/syslog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const adminConfigPath = "/admin/config"
+
+var errNotReloadable = errors.New("Notifier not reloadable")
+
+// Protects the settings that can't be changed atomically
+var adminLock sync.RWMutex
+
+var (
+	adminEventAgent   string
+	currentEventAgent string
+)
+
+var logLevelNames = map[string]syslog.Priority{
+	"err":     syslog.LOG_ERR,
+	"warning": syslog.LOG_WARNING,
+	"notice":  syslog.LOG_NOTICE,
+	"info":    syslog.LOG_INFO,
+	"debug":   syslog.LOG_DEBUG,
+}
+
+type adminSettings struct {
+	LogLevel         string `json:"log_level"`
+	ClientBandwidth  int64  `json:"client_bandwidth"`
+	ClientRate       int64  `json:"client_rate"`
+	ClientRateBurst  int64  `json:"client_rate_burst"`
+	MaxConcurrentGet int64  `json:"max_concurrent_get"`
+	MaxConcurrentPut int64  `json:"max_concurrent_put"`
+	Compression      string `json:"compression"`
+	ReadOnly         bool   `json:"read_only"`
+	Maintenance      bool   `json:"maintenance"`
+	EventAgent       string `json:"event_agent"`
+}
+
+// The settings to change, nil for those left untouched
+type adminChanges struct {
+	LogLevel         *string `json:"log_level"`
+	ClientBandwidth  *int64  `json:"client_bandwidth"`
+	ClientRate       *int64  `json:"client_rate"`
+	ClientRateBurst  *int64  `json:"client_rate_burst"`
+	MaxConcurrentGet *int64  `json:"max_concurrent_get"`
+	MaxConcurrentPut *int64  `json:"max_concurrent_put"`
+	Compression      *string `json:"compression"`
+	ReadOnly         *bool   `json:"read_only"`
+	Maintenance      *bool   `json:"maintenance"`
+	EventAgent       *string `json:"event_agent"`
+}
+
+func isAdminPath(path string) bool {
+	path = "/" + strings.TrimLeft(path, "/")
+	return path == adminConfigPath || path == "/snapshot" ||
+		strings.HasPrefix(path, adminResyncPrefix)
+}
+
+func eventAgentOverride() string {
+	adminLock.RLock()
+	defer adminLock.RUnlock()
+	return adminEventAgent
+}
+
+func setEventAgent(agent string) {
+	adminLock.Lock()
+	defer adminLock.Unlock()
+	currentEventAgent = agent
+}
+
+func logLevelName() string {
+	for name, severity := range logLevelNames {
+		if severity == logSeverity {
+			return name
+		}
+	}
+	return ""
+}
+
+func (rr *rawxRequest) volume() *fileRepository {
+	if repo, ok := rr.rawx.repo.(*chunkRepository); ok {
+		return &repo.sub
+	}
+	return nil
+}
+
+func (rr *rawxRequest) adminSettings() adminSettings {
+	adminLock.RLock()
+	defer adminLock.RUnlock()
+	settings := adminSettings{
+		LogLevel:         logLevelName(),
+		ClientBandwidth:  atomic.LoadInt64(&clientBandwidth),
+		ClientRate:       atomic.LoadInt64(&clientRate),
+		ClientRateBurst:  atomic.LoadInt64(&clientRateBurst),
+		MaxConcurrentGet: atomic.LoadInt64(&maxConcurrentGet),
+		MaxConcurrentPut: atomic.LoadInt64(&maxConcurrentPut),
+		Compression:      rr.rawx.compression,
+		EventAgent:       currentEventAgent,
+	}
+	if fr := rr.volume(); fr != nil {
+		settings.ReadOnly = atomic.LoadInt32(&fr.readOnly) != 0
+		settings.Maintenance = atomic.LoadInt32(&fr.maintenance) != 0
+	}
+	return settings
+}
+
+// Checks every change before applying any
+func (rr *rawxRequest) validateChanges(changes *adminChanges) error {
+	if changes.LogLevel != nil {
+		if _, ok := logLevelNames[*changes.LogLevel]; !ok {
+			return errors.New("Unexpected log_level")
+		}
+	}
+	if changes.ClientBandwidth != nil && *changes.ClientBandwidth < 0 {
+		return errors.New("Negative client_bandwidth")
+	}
+	if changes.ClientRate != nil && *changes.ClientRate < 0 {
+		return errors.New("Negative client_rate")
+	}
+	if changes.ClientRateBurst != nil && *changes.ClientRateBurst < 0 {
+		return errors.New("Negative client_rate_burst")
+	}
+	if changes.MaxConcurrentGet != nil && *changes.MaxConcurrentGet < 0 {
+		return errors.New("Negative max_concurrent_get")
+	}
+	if changes.MaxConcurrentPut != nil && *changes.MaxConcurrentPut < 0 {
+		return errors.New("Negative max_concurrent_put")
+	}
+	if changes.Compression != nil && !compressionManaged(*changes.Compression) {
+		return errors.New("Unexpected compression")
+	}
+	if changes.ReadOnly != nil && rr.volume() == nil {
+		return errors.New("No volume to turn read-only")
+	}
+	if changes.Maintenance != nil && rr.volume() == nil {
+		return errors.New("No volume to put in maintenance")
+	}
+	if changes.EventAgent != nil {
+		if *changes.EventAgent == "" {
+			return errors.New("Empty event_agent")
+		}
+		if _, ok := rr.rawx.notifier.(reloader); !ok {
+			return errNotReloadable
+		}
+	}
+	return nil
+}
+
+// Tells who changed what, from what
+func (rr *rawxRequest) audit(name string, from, to interface{}) {
+	atomic.AddUint64(&counters.AdminChanges, 1)
+	LogNotice("Admin %s=[%v] (was [%v]) by %s reqid=%s",
+		name, to, from, rr.req.RemoteAddr, rr.reqid)
+}
+
+func (rr *rawxRequest) applyChanges(changes *adminChanges) error {
+	before := rr.adminSettings()
+
+	// The notifier first, the only change that may still fail
+	if changes.EventAgent != nil {
+		adminLock.Lock()
+		previous := adminEventAgent
+		adminEventAgent = *changes.EventAgent
+		adminLock.Unlock()
+		if err := rr.rawx.notifier.(reloader).reload(); err != nil {
+			adminLock.Lock()
+			adminEventAgent = previous
+			adminLock.Unlock()
+			return err
+		}
+		rr.audit("event_agent", before.EventAgent, *changes.EventAgent)
+	}
+	if changes.LogLevel != nil {
+		initVerbosity(logLevelNames[*changes.LogLevel])
+		rr.audit("log_level", before.LogLevel, *changes.LogLevel)
+	}
+	if changes.ClientBandwidth != nil {
+		clientBuckets.reconfigure(func() {
+			atomic.StoreInt64(&clientBandwidth, *changes.ClientBandwidth)
+		})
+		if *changes.ClientBandwidth > 0 {
+			clientBuckets.Start()
+		}
+		rr.audit("client_bandwidth", before.ClientBandwidth, *changes.ClientBandwidth)
+	}
+	if changes.ClientRate != nil || changes.ClientRateBurst != nil {
+		clientRates.reconfigure(func() {
+			if changes.ClientRate != nil {
+				atomic.StoreInt64(&clientRate, *changes.ClientRate)
+			}
+			if changes.ClientRateBurst != nil {
+				atomic.StoreInt64(&clientRateBurst, *changes.ClientRateBurst)
+			}
+		})
+		if atomic.LoadInt64(&clientRate) > 0 {
+			clientRates.Start()
+		}
+		if changes.ClientRate != nil {
+			rr.audit("client_rate", before.ClientRate, *changes.ClientRate)
+		}
+		if changes.ClientRateBurst != nil {
+			rr.audit("client_rate_burst", before.ClientRateBurst, *changes.ClientRateBurst)
+		}
+	}
+	if changes.MaxConcurrentGet != nil {
+		atomic.StoreInt64(&maxConcurrentGet, *changes.MaxConcurrentGet)
+		rr.audit("max_concurrent_get", before.MaxConcurrentGet, *changes.MaxConcurrentGet)
+	}
+	if changes.MaxConcurrentPut != nil {
+		atomic.StoreInt64(&maxConcurrentPut, *changes.MaxConcurrentPut)
+		rr.audit("max_concurrent_put", before.MaxConcurrentPut, *changes.MaxConcurrentPut)
+	}
+	if changes.Compression != nil {
+		adminLock.Lock()
+		rr.rawx.compression = *changes.Compression
+		adminLock.Unlock()
+		rr.audit("compression", before.Compression, *changes.Compression)
+	}
+	if changes.ReadOnly != nil {
+		var flag int32
+		if *changes.ReadOnly {
+			flag = 1
+		}
+		atomic.StoreInt32(&rr.volume().readOnly, flag)
+		rr.audit("read_only", before.ReadOnly, *changes.ReadOnly)
+	}
+	if changes.Maintenance != nil {
+		var flag int32
+		if *changes.Maintenance {
+			flag = 1
+		}
+		atomic.StoreInt32(&rr.volume().maintenance, flag)
+		rr.audit("maintenance", before.Maintenance, *changes.Maintenance)
+	}
+	return nil
+}
+
+func (rr *rawxRequest) replySettings() {
+	body, err := json.Marshal(rr.adminSettings())
+	if err != nil {
+		rr.replyError(err)
+		return
+	}
+	rr.rep.Header().Set("Content-Type", "application/json")
+	rr.replyCode(http.StatusOK)
+	rr.rep.Write(body)
+	rr.bytesOut = uint64(len(body))
+}
+
+func (rr *rawxRequest) changeSettings() {
+	var changes adminChanges
+	decoder := json.NewDecoder(rr.req.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&changes); err != nil {
+		rr.drain()
+		setError(rr.rep, err)
+		rr.replyCode(http.StatusBadRequest)
+		return
+	}
+	if err := rr.validateChanges(&changes); err != nil {
+		setError(rr.rep, err)
+		rr.replyCode(http.StatusBadRequest)
+		return
+	}
+	if err := rr.applyChanges(&changes); err != nil {
+		LogWarning("Admin change refused: %v", err)
+		rr.replyError(err)
+		return
+	}
+	rr.replySettings()
+}
+
+func (rr *rawxRequest) serveAdmin(rep http.ResponseWriter, req *http.Request) {
+	var spent uint64
+	if err := rr.authenticateAdmin(); err != nil {
+		rr.drain()
+		rr.replyError(err)
+		spent = IncrementStatReqOther(rr)
+	} else {
+		switch req.Method {
+		case "GET":
+			rr.drain()
+			rr.replySettings()
+			spent = IncrementStatReqInfo(rr)
+		case "POST":
+			rr.changeSettings()
+			spent = IncrementStatReqOther(rr)
+		default:
+			rr.drain()
+			rr.replyCode(http.StatusMethodNotAllowed)
+			spent = IncrementStatReqOther(rr)
+		}
+	}
+
+	if isVerbose() {
+		LogHttp(AccessLogEvent{
+			status:    rr.status,
+			timeSpent: spent,
+			bytesIn:   rr.bytesIn,
+			bytesOut:  rr.bytesOut,
+			method:    rr.req.Method,
+			local:     rr.rawx.url,
+			peer:      rr.req.RemoteAddr,
+			path:      rr.req.URL.Path,
+			reqId:     rr.reqid,
+		})
+	}
+}
@@ -0,0 +1,202 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The appends to an existing chunk, with PATCH /<CHUNKID>: the body of the
+request is written at the end of the chunk, then its hash and its size are
+updated in its attributes (and those of the metachunk, when the chunk is
+the whole metachunk). The final hash of the chunk may be sent in the
+X-oio-Chunk-Meta-Chunk-Hash header, the append is undone when it doesn't
+match. An If-Match on the ETag of the chunk prevents concurrent appends
+from interleaving.
+
+Only the chunks stored as is may be appended: neither compressed, nor
+encrypted, nor packed in a slab, nor offloaded, nor in the cold tier, and
+without any other hard link. The others are answered with a 409. A
+"storage.chunk.new" event tells the new hash and size of the chunk.
+*/
+
+import (
+	"encoding/hex"
+	"errors"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+var (
+	errAppendUnsupported  = errors.New("Chunk not appendable")
+	errPreconditionFailed = errors.New("Precondition failed")
+)
+
+// Serializes the modifications of the same chunk
+var chunkLocks [64]sync.Mutex
+
+func chunkLock(name string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return &chunkLocks[h.Sum32()%uint32(len(chunkLocks))]
+}
+
+// Opens the chunk to write at its end, with a way to update its attributes
+func (fr *fileRepository) openAppend(name string) (*os.File, decorable, error) {
+	if fr.slabEntry(name) != nil {
+		return nil, nil, errAppendUnsupported
+	}
+	relPath := fr.locate(name)
+	var st syscall.Stat_t
+	if err := syscall.Fstatat(fr.rootFd, relPath, &st, 0); err != nil {
+		return nil, nil, err
+	}
+	if st.Nlink > 1 {
+		return nil, nil, errAppendUnsupported
+	}
+	fd, err := syscall.Openat(fr.rootFd, relPath, openFlagsWOnly|syscall.O_APPEND, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	fr.expect(name)
+	return os.NewFile(uintptr(fd), relPath), &realLinkOp{relPath: relPath, repo: fr}, nil
+}
+
+func (rr *rawxRequest) appendChunk() {
+	repo, ok := rr.rawx.repo.(*chunkRepository)
+	if !ok {
+		rr.drain()
+		rr.replyError(errAppendUnsupported)
+		return
+	}
+	if err := repo.sub.writable(); err != nil {
+		rr.drain()
+		rr.replyError(err)
+		return
+	}
+	repo.sub.waitThawed()
+
+	lock := chunkLock(rr.chunkID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := rr.appendData(repo); err != nil {
+		rr.drain()
+		rr.replyError(err)
+		return
+	}
+	atomic.AddUint64(&counters.AppendedChunks, 1)
+	rr.chunk.fillHeadersLight(rr.rep.Header())
+	rr.replyCode(http.StatusOK)
+	NotifyNew(rr.rawx, rr.reqid, &rr.chunk)
+}
+
+func (rr *rawxRequest) appendData(repo *chunkRepository) error {
+	if !repo.sub.exists(rr.chunkID) {
+		return os.ErrNotExist
+	}
+	r, err := repo.sub.get(rr.chunkID)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err = rr.chunk.loadAttr(r, rr.chunkID); err != nil {
+		return err
+	}
+	if _, ok := r.(*realFileReader); !ok || offloadedKey(r) != "" ||
+		!rr.chunk.clearSeekable() || rr.chunk.encryption != "" {
+		return errAppendUnsupported
+	}
+	if rr.checkPreconditions() != 0 {
+		return errPreconditionFailed
+	}
+	if err = rr.capUpload(rr.chunk.size); err != nil {
+		return err
+	}
+	if idx := rr.quotas(); idx != nil {
+		if err = idx.check(rr.chunk.ContainerID, rr.req.ContentLength); err != nil {
+			return err
+		}
+	}
+
+	// The hashes are resumed from the data already there
+	h, err := rr.chunk.newHash()
+	if err != nil {
+		return err
+	}
+	var th *treeHasher
+	var sink io.Writer = h
+	if tree, _ := loadHashTree(r); tree != nil {
+		th = makeTreeHasher(tree.blockSize)
+		sink = io.MultiWriter(h, th)
+	}
+	if _, err = copyPooled(sink, io.LimitReader(r, rr.chunk.size)); err != nil {
+		return err
+	}
+
+	f, attrs, err := repo.sub.openAppend(rr.chunkID)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	before, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	undo := func(err error) error {
+		if e := f.Truncate(before); e != nil {
+			LogError("Append to %s not undone: %v", rr.chunkID, e)
+		}
+		return err
+	}
+
+	n, err := copyPooled(io.MultiWriter(f, sink), rr.req.Body)
+	rr.bytesIn += uint64(n)
+	if err == nil && repo.sub.syncFile {
+		err = f.Sync()
+	}
+	if err != nil {
+		return undo(err)
+	}
+	hash := strings.ToUpper(hex.EncodeToString(h.Sum(nil)))
+	if expected := rr.req.Header.Get(HeaderNameChunkChecksum); expected != "" && !strings.EqualFold(expected, hash) {
+		return undo(errChecksumMismatch)
+	}
+
+	// The metachunk is the chunk itself, when not erasure coded
+	size := strconv.FormatInt(rr.chunk.size+n, 10)
+	if rr.chunk.MetachunkSize == rr.chunk.ChunkSize && strings.EqualFold(rr.chunk.MetachunkHash, rr.chunk.ChunkHash) {
+		rr.chunk.MetachunkSize, rr.chunk.MetachunkHash = size, hash
+	}
+	rr.chunk.ChunkSize, rr.chunk.ChunkHash = size, hash
+	rr.chunk.size += n
+	if th != nil {
+		rr.chunk.hashTree = th.sum().encode()
+	}
+	if err = rr.chunk.saveAttr(attrs); err != nil {
+		return undo(err)
+	}
+	if idx := rr.quotas(); idx != nil {
+		idx.add(rr.chunk.ContainerID, n, 0)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The authentication of the requests modifying the volume, as a defense in
+depth against the stray clients of the storage network. With auth_tokens_file,
+the requests other than GET, HEAD and OPTIONS must carry one of the tokens of
+the file in an "Authorization: Bearer <TOKEN>" header, and the token must be
+allowed to use the method. The file tells a token per line, with the methods
+it may use ("*" for all, "ADMIN" for the runtime settings):
+
+	<TOKEN> PUT,POST,COPY
+	<TOKEN> DELETE
+	<TOKEN> ADMIN
+
+A request without a token is answered with a 401, a token unknown or not
+allowed to use the method with a 403.
+*/
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	authScopeAll   = "*"
+	authScopeAdmin = "ADMIN"
+)
+
+var (
+	errAuthMissing   = errors.New("Authentication required")
+	errAuthForbidden = errors.New("Token not allowed")
+	errAdminDisabled = errors.New("Admin API disabled without auth_tokens_file")
+)
+
+// The methods allowed for each token, by the SHA-256 of the token so that
+// the lookup doesn't depend on the content of the token.
+var authTokens map[[sha256.Size]byte]map[string]bool
+
+func loadAuthTokens(path string) (map[[sha256.Size]byte]map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tokens := make(map[[sha256.Size]byte]map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.New("Invalid token line, expected <TOKEN> <METHODS>")
+		}
+		scopes := make(map[string]bool)
+		for _, method := range strings.Split(fields[1], ",") {
+			scopes[strings.ToUpper(strings.TrimSpace(method))] = true
+		}
+		tokens[sha256.Sum256([]byte(fields[0]))] = scopes
+	}
+	if err = scanner.Err(); err == nil && len(tokens) == 0 {
+		err = errors.New("No token in " + path)
+	}
+	return tokens, err
+}
+
+// Tells if the request may be served, as far as its token is concerned
+func (rr *rawxRequest) authenticate() error {
+	if isAdminPath(rr.req.URL.Path) {
+		// Checked by the admin handler, whatever the method
+		return nil
+	}
+	if authTokens == nil {
+		return nil
+	}
+	switch rr.req.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return nil
+	}
+	token, ok := hasPrefix(rr.req.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		atomic.AddUint64(&counters.AuthRefused, 1)
+		return errAuthMissing
+	}
+	scopes, ok := authTokens[sha256.Sum256([]byte(strings.TrimSpace(token)))]
+	if !ok || !(scopes[rr.req.Method] || scopes[authScopeAll]) {
+		atomic.AddUint64(&counters.AuthRefused, 1)
+		return errAuthForbidden
+	}
+	return nil
+}
+
+// Tells if the request may change the runtime settings, even to read them
+func (rr *rawxRequest) authenticateAdmin() error {
+	if authTokens == nil {
+		return errAdminDisabled
+	}
+	token, ok := hasPrefix(rr.req.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		atomic.AddUint64(&counters.AuthRefused, 1)
+		return errAuthMissing
+	}
+	scopes, ok := authTokens[sha256.Sum256([]byte(strings.TrimSpace(token)))]
+	if !ok || !(scopes[authScopeAdmin] || scopes[authScopeAll]) {
+		atomic.AddUint64(&counters.AuthRefused, 1)
+		return errAuthForbidden
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadAuthTokens(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		fails   bool
+		scopes  map[string][]string
+	}{
+		{"empty", "", true, nil},
+		{"comments only", "# nothing\n\n", true, nil},
+		{"one field", "secret\n", true, nil},
+		{"three fields", "secret PUT DELETE\n", true, nil},
+		{"tokens", "# the proxies\nproxy PUT,post,COPY\n\n  admin ADMIN\nroot *\n", false,
+			map[string][]string{
+				"proxy": {"PUT", "POST", "COPY"},
+				"admin": {"ADMIN"},
+				"root":  {"*"},
+			}},
+	}
+	dir := t.TempDir()
+	for _, tc := range cases {
+		path := filepath.Join(dir, "tokens")
+		if err := ioutil.WriteFile(path, []byte(tc.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		tokens, err := loadAuthTokens(path)
+		if (err != nil) != tc.fails {
+			t.Errorf("%s: error %v", tc.name, err)
+			continue
+		}
+		if tc.fails {
+			continue
+		}
+		if len(tokens) != len(tc.scopes) {
+			t.Errorf("%s: %d tokens, expected %d", tc.name, len(tokens), len(tc.scopes))
+		}
+		for token, methods := range tc.scopes {
+			scopes := tokens[sha256.Sum256([]byte(token))]
+			if len(scopes) != len(methods) {
+				t.Errorf("%s: %s has the scopes %v, expected %v", tc.name, token, scopes, methods)
+			}
+			for _, method := range methods {
+				if !scopes[method] {
+					t.Errorf("%s: %s not allowed to %s", tc.name, token, method)
+				}
+			}
+		}
+	}
+
+	if _, err := loadAuthTokens(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("missing file: error %v", err)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	defer func(tokens map[[sha256.Size]byte]map[string]bool) {
+		authTokens = tokens
+	}(authTokens)
+	authTokens = map[[sha256.Size]byte]map[string]bool{
+		sha256.Sum256([]byte("writer")): {"PUT": true, "POST": true},
+		sha256.Sum256([]byte("admin")):  {authScopeAdmin: true},
+		sha256.Sum256([]byte("root")):   {authScopeAll: true},
+	}
+
+	cases := []struct {
+		method string
+		path   string
+		auth   string
+		err    error
+	}{
+		{"GET", "/CHUNK", "", nil},
+		{"HEAD", "/CHUNK", "Bearer unknown", nil},
+		{"PUT", "/CHUNK", "", errAuthMissing},
+		{"PUT", "/CHUNK", "Basic writer", errAuthMissing},
+		{"PUT", "/CHUNK", "Bearer ", errAuthMissing},
+		{"PUT", "/CHUNK", "Bearer writer", nil},
+		{"DELETE", "/CHUNK", "Bearer writer", errAuthForbidden},
+		{"DELETE", "/CHUNK", "Bearer unknown", errAuthForbidden},
+		{"DELETE", "/CHUNK", "Bearer root", nil},
+		{"PUT", "/CHUNK", "Bearer admin", errAuthForbidden},
+		// The admin paths are authenticated by their handlers
+		{"POST", adminConfigPath, "", nil},
+	}
+	for _, tc := range cases {
+		rr := rawxRequest{req: httptest.NewRequest(tc.method, tc.path, nil)}
+		if tc.auth != "" {
+			rr.req.Header.Set("Authorization", tc.auth)
+		}
+		if err := rr.authenticate(); err != tc.err {
+			t.Errorf("%s %s %q: error %v, expected %v", tc.method, tc.path, tc.auth, err, tc.err)
+		}
+	}
+
+	admins := []struct {
+		auth string
+		err  error
+	}{
+		{"", errAuthMissing},
+		{"Bearer writer", errAuthForbidden},
+		{"Bearer admin", nil},
+		{"Bearer root", nil},
+	}
+	for _, tc := range admins {
+		rr := rawxRequest{req: httptest.NewRequest("POST", "/snapshot", nil)}
+		if tc.auth != "" {
+			rr.req.Header.Set("Authorization", tc.auth)
+		}
+		if err := rr.authenticateAdmin(); err != tc.err {
+			t.Errorf("admin %q: error %v, expected %v", tc.auth, err, tc.err)
+		}
+	}
+
+	authTokens = nil
+	rr := rawxRequest{req: httptest.NewRequest("POST", "/snapshot", nil)}
+	if err := rr.authenticateAdmin(); err != errAdminDisabled {
+		t.Errorf("admin without tokens: error %v", err)
+	}
+}
@@ -30,6 +30,12 @@ import (
 const (
 	defaultPriority uint64 = 1 << 31
 	defaultTTR      uint64 = 120
+	defaultTube            = "default"
+
+	// How long a whole command (request + reply) might take
+	defaultCmdTimeout = 5 * time.Second
+	// How long the TCP connection establishment might take
+	defaultDialTimeout = 2 * time.Second
 )
 
 var (
@@ -66,6 +72,16 @@ type Beanstalkd struct {
 	conn      net.Conn
 	addr      string
 	bufReader *bufio.Reader
+	timeout   time.Duration
+
+	// The tube currently used and the set of tubes currently watched.
+	// They survive a reconnection so that they can be replayed.
+	used    string
+	watched map[string]bool
+	// Tells if the server-side state matches `used` and `watched`.
+	// Any I/O error (including timeouts) leaves the connection in an
+	// unknown state, and the cache becomes unreliable until Reconnect().
+	synced bool
 }
 
 type Job struct {
@@ -77,7 +93,7 @@ func itoa(i int) string    { return strconv.Itoa(i) }
 func utoa(i uint64) string { return strconv.FormatUint(i, 10) }
 
 func DialBeanstalkd(addr string) (*Beanstalkd, error) {
-	conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+	conn, err := net.DialTimeout("tcp", addr, defaultDialTimeout)
 	if err != nil {
 		return nil, err
 	}
@@ -86,20 +102,76 @@ func DialBeanstalkd(addr string) (*Beanstalkd, error) {
 	beanstalkd.conn = conn
 	beanstalkd.addr = addr
 	beanstalkd.bufReader = bufio.NewReader(conn)
+	beanstalkd.timeout = defaultCmdTimeout
+	// A fresh connection uses and watches the default tube
+	beanstalkd.used = defaultTube
+	beanstalkd.watched = map[string]bool{defaultTube: true}
+	beanstalkd.synced = true
 	return beanstalkd, nil
 }
 
 func (beanstalkd *Beanstalkd) Close() {
 	_, _ = beanstalkd.sendAll([]byte("quit \r\n"))
+	beanstalkd.closeConn()
+}
+
+func (beanstalkd *Beanstalkd) closeConn() {
 	if beanstalkd.conn != nil {
 		err := beanstalkd.conn.Close()
 		if err != nil {
 			LogWarning("Failed to close the cnx to beanstalkd: %s", err.Error())
 		}
+		beanstalkd.conn = nil
+	}
+	beanstalkd.synced = false
+}
+
+// Synced tells if the connection is in a known state. When it is not,
+// Reconnect() should be called before any other command.
+func (beanstalkd *Beanstalkd) Synced() bool {
+	return beanstalkd.conn != nil && beanstalkd.synced
+}
+
+// Reconnect drops the current connection, opens a new one to the same
+// endpoint, then replays the tubes that were used and watched.
+func (beanstalkd *Beanstalkd) Reconnect() error {
+	beanstalkd.closeConn()
+	conn, err := net.DialTimeout("tcp", beanstalkd.addr, defaultDialTimeout)
+	if err != nil {
+		return err
 	}
+	beanstalkd.conn = conn
+	beanstalkd.bufReader = bufio.NewReader(conn)
+
+	if beanstalkd.used != defaultTube {
+		if err = beanstalkd.use(beanstalkd.used); err != nil {
+			return err
+		}
+	}
+	for tubename := range beanstalkd.watched {
+		if tubename != defaultTube {
+			if err = beanstalkd.watch(tubename); err != nil {
+				return err
+			}
+		}
+	}
+	beanstalkd.synced = true
+	return nil
 }
 
+// Watch adds the tube to the watch list, unless it is already watched.
 func (beanstalkd *Beanstalkd) Watch(tubename string) error {
+	if beanstalkd.synced && beanstalkd.watched[tubename] {
+		return nil
+	}
+	if err := beanstalkd.watch(tubename); err != nil {
+		return err
+	}
+	beanstalkd.watched[tubename] = true
+	return nil
+}
+
+func (beanstalkd *Beanstalkd) watch(tubename string) error {
 	cmd := strings.Builder{}
 	cmd.Grow(len(tubename) + 16)
 	cmd.WriteString("watch ")
@@ -118,7 +190,20 @@ func (beanstalkd *Beanstalkd) Watch(tubename string) error {
 	return nil
 }
 
+// Use makes the tube the target of the subsequent Put(), unless it is
+// already the case.
 func (beanstalkd *Beanstalkd) Use(tubename string) error {
+	if beanstalkd.synced && beanstalkd.used == tubename {
+		return nil
+	}
+	if err := beanstalkd.use(tubename); err != nil {
+		return err
+	}
+	beanstalkd.used = tubename
+	return nil
+}
+
+func (beanstalkd *Beanstalkd) use(tubename string) error {
 	cmd := strings.Builder{}
 	cmd.Grow(len(tubename) + 16)
 	cmd.WriteString("use ")
@@ -169,9 +254,10 @@ func (beanstalkd *Beanstalkd) Delete(id uint64) error {
 	return beanstalkd.sendCommandAndCheck(cmd.String(), expected)
 }
 
+// Blocks until a job is ready, without any deadline
 func (beanstalkd *Beanstalkd) Reserve() (*Job, error) {
 	command := "reserve\r\n"
-	resp, err := beanstalkd.sendCommand(command)
+	resp, err := beanstalkd.sendCommandWithin(command, 0)
 	if err != nil {
 		return nil, err
 	}
@@ -239,13 +325,28 @@ func (beanstalkd *Beanstalkd) sendCommandAndCheck(command, expected string) erro
 }
 
 func (beanstalkd *Beanstalkd) sendCommand(command string) (string, error) {
+	return beanstalkd.sendCommandWithin(command, beanstalkd.timeout)
+}
+
+// Sends the command then reads its reply, within the timeout (none if 0)
+func (beanstalkd *Beanstalkd) sendCommandWithin(command string, timeout time.Duration) (string, error) {
+	if beanstalkd.conn != nil {
+		deadline := time.Time{}
+		if timeout > 0 {
+			deadline = time.Now().Add(timeout)
+		}
+		_ = beanstalkd.conn.SetDeadline(deadline)
+	}
+
 	_, err := beanstalkd.sendAll([]byte(command))
 	if err != nil {
+		beanstalkd.synced = false
 		return "", err
 	}
 
 	resp, err := beanstalkd.bufReader.ReadString('\n')
 	if err != nil {
+		beanstalkd.synced = false
 		return "", err
 	}
 	return resp, nil
@@ -0,0 +1,34 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build blake3
+
+package main
+
+/*
+The BLAKE3 hash of the chunks, the strongest and still fast. It requires a
+binary built with the "blake3" tag, that pulls zeebo/blake3.
+*/
+
+import (
+	"hash"
+
+	"github.com/zeebo/blake3"
+)
+
+func newBlake3() (hash.Hash, error) {
+	return blake3.New(), nil
+}
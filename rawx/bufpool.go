@@ -0,0 +1,85 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The buffers of the transfers are recycled through pools, one per size class
+(powers of two from bufferClassMin to bufferClassMax), so that thousands of
+concurrent PUT and GET don't allocate then collect as many buffers. A buffer
+is taken from the smallest class that fits the size asked, and goes back to
+its class once released. The sizes beyond the largest class are allocated.
+*/
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	bufferClassMin = 2 * 1024
+	bufferClassMax = 8 * 1024 * 1024
+	// From 2^11 to 2^23 bytes
+	bufferClassCount = 13
+
+	// Size of the buffers used to copy (or hash) the chunks read
+	downloadBufferSize = 64 * 1024
+)
+
+var bufferPools [bufferClassCount]sync.Pool
+
+// Returns the index of the smallest class holding size bytes, -1 if none
+func bufferClass(size int) int {
+	class := 0
+	for s := bufferClassMin; s < size; s <<= 1 {
+		class++
+	}
+	if class >= bufferClassCount {
+		return -1
+	}
+	return class
+}
+
+// Returns a buffer of the given length, to be released with putBuffer()
+func getBuffer(size int) []byte {
+	class := bufferClass(size)
+	if class < 0 {
+		return make([]byte, size)
+	}
+	if b, ok := bufferPools[class].Get().(*[]byte); ok {
+		return (*b)[:size]
+	}
+	atomic.AddUint64(&counters.BuffersAllocated, 1)
+	return make([]byte, size, bufferClassMin<<uint(class))
+}
+
+// Gives the buffer back to its pool, it mustn't be used anymore
+func putBuffer(b []byte) {
+	class := bufferClass(cap(b))
+	if class < 0 || cap(b) != bufferClassMin<<uint(class) {
+		return
+	}
+	b = b[:0]
+	bufferPools[class].Put(&b)
+}
+
+// io.Copy() with a pooled buffer, when neither dst nor src provide theirs
+func copyPooled(dst io.Writer, src io.Reader) (int64, error) {
+	buf := getBuffer(downloadBufferSize)
+	defer putBuffer(buf)
+	return io.CopyBuffer(dst, src, buf)
+}
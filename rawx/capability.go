@@ -0,0 +1,135 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The capabilities of the filesystem of each volume are probed upon the
+startup, on scratch files at the root of the volume, then reported:
+
+	Volume /srv/vol0: xattr=yes reflink=no punch_hole=yes tmpfile=yes fallocate=yes
+
+The options requiring a missing capability are turned into the nearest
+setting available, with a warning, instead of failing upon the first
+operation concerned:
+
+  - no xattr: the attributes are saved in sidecar files
+  - no reflink: the COPY operations make hard links
+  - no hole punching: the space of the deleted chunks isn't discarded
+  - no fallocate: the space of the uploads isn't preallocated
+
+The volumes that can't be written, e.g. mounted read-only, aren't probed.
+*/
+
+import (
+	"strconv"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+const capabilityProbe = ".probe"
+
+type volumeCapabilities struct {
+	xattr     bool
+	reflink   bool
+	punchHole bool
+	tmpfile   bool
+	fallocate bool
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func (caps volumeCapabilities) String() string {
+	return "xattr=" + yesNo(caps.xattr) +
+		" reflink=" + yesNo(caps.reflink) +
+		" punch_hole=" + yesNo(caps.punchHole) +
+		" tmpfile=" + yesNo(caps.tmpfile) +
+		" fallocate=" + yesNo(caps.fallocate)
+}
+
+// Tries each capability on scratch files, removed before returning
+func (fr *fileRepository) probeCapabilities() (volumeCapabilities, error) {
+	var caps volumeCapabilities
+	path := capabilityProbe + "." + strconv.Itoa(syscall.Getpid())
+	fd, err := syscall.Openat(fr.rootFd, path,
+		syscall.O_CREAT|syscall.O_EXCL|syscall.O_RDWR|syscall.O_CLOEXEC, 0600)
+	if err != nil {
+		return caps, err
+	}
+	defer syscall.Unlinkat(fr.rootFd, path, 0)
+	defer syscall.Close(fd)
+
+	caps.xattr = syscall.Fsetxattr(fd, "user.rawx.probe", []byte("1"), 0) == nil
+	caps.fallocate = syscall.Fallocate(fd, syscall.FALLOC_FL_KEEP_SIZE, 0, sparseBlock) == nil
+
+	block := make([]byte, 2*sparseBlock)
+	if _, err = syscall.Pwrite(fd, block, 0); err != nil {
+		return caps, err
+	}
+	caps.punchHole = syscall.Fallocate(fd,
+		syscall.FALLOC_FL_PUNCH_HOLE|syscall.FALLOC_FL_KEEP_SIZE, 0, sparseBlock) == nil
+
+	clonePath := path + ".clone"
+	cfd, err := syscall.Openat(fr.rootFd, clonePath,
+		syscall.O_CREAT|syscall.O_EXCL|syscall.O_RDWR|syscall.O_CLOEXEC, 0600)
+	if err == nil {
+		caps.reflink = syscall.IoctlFileClone(cfd, fd) == nil
+		syscall.Close(cfd)
+		syscall.Unlinkat(fr.rootFd, clonePath, 0)
+	}
+
+	if tfd, err := syscall.Openat(fr.rootFd, ".",
+		syscall.O_TMPFILE|syscall.O_RDWR|syscall.O_CLOEXEC, 0600); err == nil {
+		caps.tmpfile = true
+		syscall.Close(tfd)
+	}
+	return caps, nil
+}
+
+// Probes the volume, then turns off what it doesn't support
+func (fr *fileRepository) adaptToCapabilities() {
+	caps, err := fr.probeCapabilities()
+	if err != nil {
+		LogWarning("Volume %s not probed: %v", fr.root, err)
+		return
+	}
+	LogInfo("Volume %s: %s", fr.root, caps)
+
+	if !caps.xattr && !fr.sidecar {
+		LogWarning("No xattr on %s, the attributes are saved in sidecars", fr.root)
+		fr.sidecar = true
+	}
+	if !caps.reflink {
+		if fr.copyMode == copyModeReflink {
+			LogWarning("No reflink on %s, the copies are hard links", fr.root)
+			fr.copyMode = copyModeLink
+		}
+		fr.noReflink = 1
+	}
+	if !caps.punchHole && fr.discard == discardPunch {
+		LogWarning("No hole punching on %s, the space freed isn't discarded", fr.root)
+		fr.discard = discardOff
+	}
+	if !caps.fallocate && fr.fallocate != configFallocateNone {
+		LogWarning("No fallocate on %s, the space isn't preallocated", fr.root)
+		fr.fallocate = configFallocateNone
+	}
+}
@@ -0,0 +1,96 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The algorithm of the hash of each chunk: md5 (the historical one), sha256,
+blake3 (only with a binary built with the "blake3" tag) or xxh64. The proxy
+selects it upon PUT with the X-oio-Chunk-Meta-Chunk-Hash-Algo header, e.g.
+according to the storage policy: xxh64 for the ephemeral data, sha256 for
+the archives. Without the header, the chunk is hashed with
+checksum_algorithm, md5 by default.
+
+The algorithm is saved in the attributes of the chunk (nothing for md5), so
+that the GET, the scrubber and the HEAD with a hash check verify the chunk
+with the algorithm it was hashed with, whatever the configuration.
+*/
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"strings"
+)
+
+const (
+	hashAlgoMD5    = "md5"
+	hashAlgoSHA256 = "sha256"
+	hashAlgoBlake3 = "blake3"
+	hashAlgoXXH64  = "xxh64"
+)
+
+var errBlake3NotBuilt = errors.New("BLAKE3 support not compiled in (build tag blake3)")
+
+// The algorithm of the chunks uploaded without any, "" standing for md5
+var defaultHashAlgo = ""
+
+// Normalizes the name of the algorithm, md5 being implicit
+func parseHashAlgo(v string) (string, error) {
+	switch algo := strings.ToLower(strings.TrimSpace(v)); algo {
+	case "", hashAlgoMD5:
+		return "", nil
+	case hashAlgoSHA256, hashAlgoXXH64:
+		return algo, nil
+	case hashAlgoBlake3:
+		if _, err := newBlake3(); err != nil {
+			return "", err
+		}
+		return algo, nil
+	}
+	return "", errInvalidHeader
+}
+
+func makeChunkHash(algo string) (hash.Hash, error) {
+	switch algo {
+	case "", hashAlgoMD5:
+		return md5.New(), nil
+	case hashAlgoSHA256:
+		return sha256.New(), nil
+	case hashAlgoBlake3:
+		return newBlake3()
+	case hashAlgoXXH64:
+		return newXXH64(), nil
+	}
+	return nil, errors.New("Unexpected hash algorithm: " + algo)
+}
+
+// How many hexadecimal characters the hashes of the algorithm have
+func hashHexSize(algo string) int {
+	switch algo {
+	case hashAlgoSHA256, hashAlgoBlake3:
+		return 64
+	case hashAlgoXXH64:
+		return 16
+	}
+	return 32
+}
+
+// The hash the chunk was hashed with
+func (chunk *chunkInfo) newHash() (hash.Hash, error) {
+	return makeChunkHash(chunk.hashAlgo)
+}
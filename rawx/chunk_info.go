@@ -18,6 +18,7 @@ package main
 
 import (
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"net/http"
@@ -26,6 +27,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 )
 
@@ -47,6 +49,19 @@ type chunkInfo struct {
 
 	compression string
 	size        int64
+	// The ID of the zstd dictionary, if any
+	compressionDict string
+	// The hash tree of the clear data, if sealed
+	hashTree string
+	// The algorithm of ChunkHash, empty for md5
+	hashAlgo string
+	// The key of the upload, to recognize its retries
+	idempotencyKey string
+
+	// How the chunk is encrypted, with which key, and its salt
+	encryption     string
+	encryptionKey  string
+	encryptionSalt string
 }
 
 func returnError(err error, message string) error {
@@ -97,6 +112,13 @@ func (chunk *chunkInfo) saveAttr(out decorable) error {
 		{AttrNameContentStgPol, &chunk.ContentStgPol},
 		{AttrNameOioVersion, &chunk.OioVersion},
 		{AttrNameCompression, &chunk.compression},
+		{AttrNameCompressionDict, &chunk.compressionDict},
+		{AttrNameEncryption, &chunk.encryption},
+		{AttrNameEncryptionKey, &chunk.encryptionKey},
+		{AttrNameEncryptionSalt, &chunk.encryptionSalt},
+		{AttrNameHashTree, &chunk.hashTree},
+		{AttrNameHashAlgo, &chunk.hashAlgo},
+		{AttrNameIdempotencyKey, &chunk.idempotencyKey},
 	}
 	for _, hs := range detailedAttrs {
 		if err := setAttr(hs.key, *(hs.ptr)); err != nil {
@@ -151,7 +173,8 @@ func (chunk *chunkInfo) loadFullPath(getter func(string, string) (string, error)
 }
 
 func (chunk *chunkInfo) loadAttr(inChunk fileReader, chunkID string) error {
-	buf := make([]byte, 2048, 2048)
+	buf := getBuffer(2048)
+	defer putBuffer(buf)
 	getAttr := func(k string) (string, error) {
 		l, err := inChunk.getAttr(k, buf)
 		if l <= 0 || err != nil {
@@ -171,6 +194,12 @@ func (chunk *chunkInfo) loadAttr(inChunk fileReader, chunkID string) error {
 		{AttrNameChunkSize, &chunk.ChunkSize},
 		{AttrNameOioVersion, &chunk.OioVersion},
 		{AttrNameCompression, &chunk.compression},
+		{AttrNameCompressionDict, &chunk.compressionDict},
+		{AttrNameEncryption, &chunk.encryption},
+		{AttrNameEncryptionKey, &chunk.encryptionKey},
+		{AttrNameEncryptionSalt, &chunk.encryptionSalt},
+		{AttrNameHashAlgo, &chunk.hashAlgo},
+		{AttrNameIdempotencyKey, &chunk.idempotencyKey},
 	}
 
 	contentFullpath, err := getAttr(AttrNameFullPrefix + chunkID)
@@ -356,6 +385,17 @@ func (chunk *chunkInfo) retrieveHeaders(headers *http.Header, chunkID string) er
 		}
 	}
 
+	chunk.hashAlgo = defaultHashAlgo
+	if v := headers.Get(HeaderNameChunkHashAlgo); v != "" {
+		algo, err := parseHashAlgo(v)
+		if err != nil {
+			return returnError(err, HeaderNameChunkHashAlgo)
+		}
+		chunk.hashAlgo = algo
+	}
+	if err := chunk.retrieveIdempotencyKey(headers); err != nil {
+		return err
+	}
 	chunk.ChunkHash = headers.Get(HeaderNameChunkChecksum)
 	if chunk.ChunkHash != "" {
 		if !isHexaString(chunk.ChunkHash, 0) {
@@ -404,13 +444,17 @@ func (chunk *chunkInfo) retrieveTrailers(trailers *http.Header, ul *uploadInfo)
 		}
 	}
 
-	trailerChunkHash := trailers.Get(HeaderNameChunkChecksum)
+	trailerChunkHash, err := trailerChecksum(trailers, chunk.hashAlgo)
+	if err != nil {
+		return err
+	}
 	if trailerChunkHash != "" {
 		chunk.ChunkHash = strings.ToUpper(trailerChunkHash)
 	}
 	if chunk.ChunkHash != "" {
 		if !strings.EqualFold(chunk.ChunkHash, ul.hash) {
-			return returnError(errInvalidHeader, HeaderNameChunkChecksum)
+			atomic.AddUint64(&counters.ChecksumMismatches, 1)
+			return returnError(errChecksumMismatch, HeaderNameChunkChecksum)
 		}
 	} else {
 		chunk.ChunkHash = ul.hash
@@ -431,6 +475,44 @@ func (chunk *chunkInfo) retrieveTrailers(trailers *http.Header, ul *uploadInfo)
 	return nil
 }
 
+// The hash of the chunk sent in a trailer, by the clients that only know it
+// once the body is sent: X-oio-Chunk-Meta-Chunk-Hash in hexadecimal, or the
+// standard Content-MD5 or Digest (md5=... or sha-256=...) in base64 when
+// the chunk is hashed with the same algorithm.
+func trailerChecksum(trailers *http.Header, algo string) (string, error) {
+	if v := trailers.Get(HeaderNameChunkChecksum); v != "" {
+		if !isHexaString(v, 0) {
+			return "", returnError(errInvalidHeader, HeaderNameChunkChecksum)
+		}
+		return v, nil
+	}
+	encoded, prefix := "", "md5="
+	switch algo {
+	case "":
+		encoded = trailers.Get(HeaderNameContentMD5)
+	case hashAlgoSHA256:
+		prefix = "sha-256="
+	default:
+		return "", nil
+	}
+	if encoded == "" {
+		for _, digest := range strings.Split(trailers.Get(HeaderNameDigest), ",") {
+			digest = strings.TrimSpace(digest)
+			if len(digest) > len(prefix) && strings.EqualFold(digest[:len(prefix)], prefix) {
+				encoded = digest[len(prefix):]
+			}
+		}
+	}
+	if encoded == "" {
+		return "", nil
+	}
+	bin, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(bin)*2 != hashHexSize(algo) {
+		return "", returnError(errInvalidHeader, HeaderNameContentMD5)
+	}
+	return hex.EncodeToString(bin), nil
+}
+
 func setHeader(headers http.Header, k, v string) {
 	if len(v) > 0 {
 		headers.Set(k, v)
@@ -451,13 +533,17 @@ func (chunk *chunkInfo) fillHeaders(headers http.Header) {
 	setHeader(headers, HeaderNameMetachunkSize, chunk.MetachunkSize)
 	setHeader(headers, HeaderNameChunkPosition, chunk.ChunkPosition)
 	setHeader(headers, HeaderNameChunkChecksum, chunk.ChunkHash)
+	setHeader(headers, HeaderNameChunkHashAlgo, chunk.hashAlgo)
 	setHeader(headers, HeaderNameChunkSize, chunk.ChunkSize)
 	setHeader(headers, HeaderNameXattrVersion, chunk.OioVersion)
+	setHeader(headers, "ETag", chunk.etag())
 }
 
 // Fill the headers of the reply with the chunk info calculated by the rawx
 func (chunk *chunkInfo) fillHeadersLight(headers http.Header) {
 	setHeader(headers, HeaderNameChunkChecksum, chunk.ChunkHash)
+	setHeader(headers, HeaderNameChunkHashAlgo, chunk.hashAlgo)
 	setHeader(headers, HeaderNameChunkSize, chunk.ChunkSize)
 	setHeader(headers, HeaderNameXattrVersion, chunk.OioVersion)
+	setHeader(headers, "ETag", chunk.etag())
 }
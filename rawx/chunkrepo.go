@@ -27,10 +27,22 @@ import (
 
 type chunkRepository struct {
 	sub fileRepository
+	// Optional cold tier, where the chunks not accessed for a while are
+	// demoted. The chunks remain reachable with the same name.
+	cold *fileRepository
+	// The accounting of the containers, nil without quotas
+	quotas *quotaIndex
 }
 
 func (cr *chunkRepository) getAttr(name, key string, value []byte) (int, error) {
-	return cr.sub.getAttr(name, key, value)
+	if err := cr.sub.readable(); err != nil {
+		return 0, err
+	}
+	n, err := cr.sub.getAttr(name, key, value)
+	if cr.cold != nil && os.IsNotExist(err) {
+		return cr.cold.getAttr(name, key, value)
+	}
+	return n, err
 }
 
 func (cr *chunkRepository) lock(ns, url string) error {
@@ -38,7 +50,15 @@ func (cr *chunkRepository) lock(ns, url string) error {
 }
 
 func (cr *chunkRepository) del(name string) error {
+	if err := cr.sub.writable(); err != nil {
+		return err
+	}
+	cr.sub.frozen.RLock()
+	defer cr.sub.frozen.RUnlock()
 	err := cr.sub.del(name)
+	if cr.cold != nil && (err == os.ErrNotExist || os.IsNotExist(err)) {
+		err = cr.cold.del(name)
+	}
 	if err == nil {
 		return nil
 	} else if err != os.ErrNotExist && !os.IsNotExist(err) {
@@ -49,9 +69,15 @@ func (cr *chunkRepository) del(name string) error {
 }
 
 func (cr *chunkRepository) get(name string) (fileReader, error) {
+	if err := cr.sub.readable(); err != nil {
+		return nil, err
+	}
 	r, err := cr.sub.get(name)
+	if cr.cold != nil && (err == os.ErrNotExist || os.IsNotExist(err)) {
+		r, err = cr.cold.get(name)
+	}
 	if err == nil {
-		return r, nil
+		return wrapOffloaded(r), nil
 	} else if err != os.ErrNotExist && !os.IsNotExist(err) {
 		return nil, err
 	} else {
@@ -59,10 +85,61 @@ func (cr *chunkRepository) get(name string) (fileReader, error) {
 	}
 }
 
+// Marks the data of the chunk as read, so that it stays on the fast tier.
+// The other accesses (e.g. HEAD, the checks) leave it untouched.
+func (cr *chunkRepository) touch(name string) {
+	if cr.cold != nil {
+		cr.sub.touch(name)
+	}
+}
+
 func (cr *chunkRepository) put(name string) (fileWriter, error) {
+	if err := cr.sub.writable(); err != nil {
+		return nil, err
+	}
+	cr.sub.waitThawed()
+	if cr.cold != nil && cr.cold.exists(name) {
+		return nil, os.ErrExist
+	}
 	return cr.sub.put(name)
 }
 
+func (cr *chunkRepository) quarantine(name, reason string) error {
+	err := cr.sub.quarantine(name, reason)
+	if cr.cold != nil && os.IsNotExist(err) {
+		err = cr.cold.quarantine(name, reason)
+	}
+	return err
+}
+
+func (cr *chunkRepository) quarantined() ([]quarantinedChunk, error) {
+	chunks, err := cr.sub.quarantined()
+	if err == nil && cr.cold != nil {
+		var cold []quarantinedChunk
+		if cold, err = cr.cold.quarantined(); err == nil {
+			chunks = append(chunks, cold...)
+		}
+	}
+	return chunks, err
+}
+
 func (cr *chunkRepository) link(fromName, toName string) (linkOperation, error) {
+	if err := cr.sub.writable(); err != nil {
+		return nil, err
+	}
+	cr.sub.waitThawed()
+	if cr.cold != nil && !cr.sub.exists(fromName) && cr.cold.exists(fromName) {
+		return cr.cold.link(fromName, toName)
+	}
 	return cr.sub.link(fromName, toName)
 }
+
+// Loads the attributes of the chunk, without keeping it open
+func (cr *chunkRepository) loadInfo(name string, chunk *chunkInfo) error {
+	r, err := cr.get(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return chunk.loadAttr(r, name)
+}
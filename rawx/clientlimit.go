@@ -0,0 +1,222 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The bandwidth of each client, capped at client_bandwidth bytes per second
+for the bodies of its requests and of the replies, all its connections
+together, so that a single client doesn't monopolize the disk and the
+network of the service. The client is known by its IP address, or with
+client_bandwidth_key set to "token" by its bearer token (cf. auth.go), then
+by its IP address when it has none.
+
+The requests of each client are also capped at client_rate per second, with
+bursts of client_rate_burst requests, the client being known as told by
+client_rate_key. Beyond, the request is refused with a 429 and a
+Retry-After, so that a client retrying in a loop doesn't take the service
+down. The /info requests of the conscience-agent are never refused.
+
+Both limits might be changed at runtime, cf. admin.go. The buckets of the
+clients idle for a while are forgotten. The throttled
+replies are written by steps, without sendfile().
+*/
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const clientBucketIdle = 5 * time.Minute
+
+// The limits are read atomically, they might be changed at runtime
+var (
+	clientBandwidth    int64
+	clientBandwidthKey = "ip"
+	clientBuckets      = makeClientRegistry(func() *tokenBucket {
+		return makeBandwidth(int(atomic.LoadInt64(&clientBandwidth)))
+	})
+
+	clientRate      int64
+	clientRateBurst int64
+	clientRateKey   = "ip"
+	clientRates     = makeClientRegistry(func() *tokenBucket {
+		return makeTokenBucket(float64(atomic.LoadInt64(&clientRate)),
+			float64(atomic.LoadInt64(&clientRateBurst)))
+	})
+)
+
+var errRateLimited = errors.New("Too many requests from the client")
+
+type clientBucket struct {
+	tb   *tokenBucket
+	last time.Time
+}
+
+type clientRegistry struct {
+	lock    sync.Mutex
+	buckets map[string]*clientBucket
+	started sync.Once
+	// Builds the bucket of a new client
+	newBucket func() *tokenBucket
+}
+
+func makeClientRegistry(newBucket func() *tokenBucket) *clientRegistry {
+	return &clientRegistry{buckets: make(map[string]*clientBucket), newBucket: newBucket}
+}
+
+func (reg *clientRegistry) get(key string) *tokenBucket {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	b, ok := reg.buckets[key]
+	if !ok {
+		b = &clientBucket{tb: reg.newBucket()}
+		reg.buckets[key] = b
+	}
+	b.last = time.Now()
+	return b.tb
+}
+
+// Changes the settings of every client, the current ones included
+func (reg *clientRegistry) reconfigure(apply func()) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	apply()
+	reg.buckets = make(map[string]*clientBucket)
+}
+
+// Forgets the clients idle for a while, periodically
+func (reg *clientRegistry) Start() {
+	reg.started.Do(reg.evict)
+}
+
+func (reg *clientRegistry) evict() {
+	go func() {
+		for {
+			time.Sleep(clientBucketIdle)
+			reg.lock.Lock()
+			for key, b := range reg.buckets {
+				if time.Since(b.last) > clientBucketIdle {
+					delete(reg.buckets, key)
+				}
+			}
+			reg.lock.Unlock()
+		}
+	}()
+}
+
+// Who the request is accounted to, by its token or by its IP address
+func (rr *rawxRequest) clientKey(by string) string {
+	if by == "token" {
+		if token, ok := hasPrefix(rr.req.Header.Get("Authorization"), "Bearer "); ok && token != "" {
+			sum := sha256.Sum256([]byte(strings.TrimSpace(token)))
+			return "token:" + string(sum[:])
+		}
+	}
+	host, _, err := net.SplitHostPort(rr.req.RemoteAddr)
+	if err != nil {
+		host = rr.req.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+type throttledBody struct {
+	io.ReadCloser
+	tb *tokenBucket
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	if len(p) > throttleStep {
+		p = p[:throttleStep]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.tb.wait(float64(n))
+	}
+	return n, err
+}
+
+type throttledWriter struct {
+	http.ResponseWriter
+	tb *tokenBucket
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > throttleStep {
+			n = throttleStep
+		}
+		w.tb.wait(float64(n))
+		nw, err := w.ResponseWriter.Write(p[:n])
+		total += nw
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+	}
+	return total, nil
+}
+
+func (w *throttledWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Throttles the bodies of the request and of the reply, if configured so
+func (rr *rawxRequest) throttleClient() {
+	if atomic.LoadInt64(&clientBandwidth) <= 0 {
+		return
+	}
+	tb := clientBuckets.get(rr.clientKey(clientBandwidthKey))
+	if rr.req.Body != nil {
+		rr.req.Body = &throttledBody{ReadCloser: rr.req.Body, tb: tb}
+	}
+	rr.rep = &throttledWriter{ResponseWriter: rr.rep, tb: tb}
+}
+
+// Tells if the client sent too many requests lately
+func (rr *rawxRequest) overRated() bool {
+	if atomic.LoadInt64(&clientRate) <= 0 || rr.req.URL.Path == "/info" {
+		return false
+	}
+	if clientRates.get(rr.clientKey(clientRateKey)).allow(1) {
+		return false
+	}
+	atomic.AddUint64(&counters.RateLimited, 1)
+	return true
+}
+
+// Refuses the request until the client earned a request again
+func (rr *rawxRequest) replyRateLimited() {
+	rr.req.Close = true
+	setError(rr.rep, errRateLimited)
+	retry := 1
+	if rate := atomic.LoadInt64(&clientRate); rate > 0 {
+		retry = int(math.Ceil(1 / float64(rate)))
+	}
+	rr.rep.Header().Set("Retry-After", strconv.Itoa(retry))
+	rr.replyCode(http.StatusTooManyRequests)
+}
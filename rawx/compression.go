@@ -0,0 +1,271 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The compression of the chunks. The algorithm used is saved in the
+attributes of each chunk, so that the decompression upon GET doesn't depend
+on the current configuration.
+
+When the RAWX is allowed to compress, the proxy may select the algorithm
+for each chunk with the X-oio-compression header, according to the storage
+policy of the content: e.g. lz4 for the latency-sensitive policies, zstd
+for the archives, "off" for the data already compressed.
+
+The compression is skipped for the chunks announced smaller than
+compression_min_size. When compression_min_saving is set, the beginning of
+the chunk is compressed first as a sample, and the whole chunk is stored
+raw when the sample doesn't shrink enough. The formats known to be already
+compressed are detected beforehand, cf. incompressible.go.
+
+The small chunks compressed with zstd might also use a dictionary trained
+on the volume, cf. dictionary.go.
+*/
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/lzw"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// How many bytes are compressed to decide if the chunk is worth compressing
+const compressionSampleSize = 128 * 1024
+
+// The level of the zstd compression, in the zstd scale (1-22)
+var compressionZstdLevel = 3
+
+// The announced size (in bytes) below which a chunk is not compressed
+var compressionMinSize int64 = 0
+
+// The minimal saving (in percents of the sample) for a chunk to be stored
+// compressed, 0 to always compress.
+var compressionMinSaving = 0
+
+func compressionManaged(algo string) bool {
+	switch algo {
+	case "", compressionOff, compressionZlib, compressionDeflate,
+		compressionLzw, compressionZstd, compressionLz4:
+		return true
+	}
+	return false
+}
+
+func makeCompressor(algo string, d *zstdDict, out io.Writer) (io.WriteCloser, error) {
+	switch algo {
+	case compressionZlib:
+		return zlib.NewWriter(out), nil
+	case compressionDeflate:
+		return flate.NewWriter(out, 1)
+	case compressionLzw:
+		return lzw.NewWriter(out, lzw.MSB, 8), nil
+	case compressionZstd:
+		options := []zstd.EOption{
+			zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(compressionZstdLevel)),
+			zstd.WithEncoderConcurrency(1),
+			zstd.WithLowerEncoderMem(true),
+		}
+		if d != nil {
+			options = append(options, zstd.WithEncoderDict(d.data))
+		}
+		return zstd.NewWriter(out, options...)
+	case compressionLz4:
+		return lz4.NewWriter(out), nil
+	case "", compressionOff:
+		return nil, nil
+	default:
+		return nil, errCompressionNotManaged
+	}
+}
+
+func makeDecompressor(algo string, d *zstdDict, in io.Reader) (io.ReadCloser, error) {
+	switch algo {
+	case compressionZlib:
+		return zlib.NewReader(in)
+	case compressionLzw:
+		return lzw.NewReader(in, lzw.MSB, 8), nil
+	case compressionDeflate:
+		return flate.NewReader(in), nil
+	case compressionZstd:
+		options := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+		if d != nil {
+			options = append(options, zstd.WithDecoderDicts(d.data))
+		}
+		dec, err := zstd.NewReader(in, options...)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	case compressionLz4:
+		return ioutil.NopCloser(lz4.NewReader(in)), nil
+	case "", compressionOff:
+		return nil, nil
+	default:
+		return nil, errCompressionNotManaged
+	}
+}
+
+// Tells which algorithm to use for the chunk uploaded, the proxy might
+// override the algorithm configured when the RAWX is allowed to compress.
+func (rr *rawxRequest) compressionAlgorithm() (string, error) {
+	adminLock.RLock()
+	algo := rr.rawx.compression
+	adminLock.RUnlock()
+	if algo == "" || algo == compressionOff {
+		return algo, nil
+	}
+	if v := rr.req.Header.Get(HeaderNameCompression); v != "" {
+		if !compressionManaged(v) {
+			return "", errInvalidHeader
+		}
+		algo = v
+	}
+	if rr.req.ContentLength >= 0 && rr.req.ContentLength < compressionMinSize {
+		algo = compressionOff
+	}
+	if GetBool(rr.req.Header.Get(HeaderNameIncompressible), false) {
+		algo = compressionOff
+	}
+	return algo, nil
+}
+
+// Compresses a chunk, unless its sample proves the compression useless.
+// The algorithm finally used is known once the writer is closed.
+type chunkCompressor struct {
+	algo   string
+	dict   *zstdDict
+	out    io.Writer
+	sample []byte
+	// The actual destination, once decided
+	w io.Writer
+}
+
+func makeChunkCompressor(algo string, d *zstdDict, out io.Writer) (*chunkCompressor, error) {
+	if !compressionManaged(algo) {
+		return nil, errCompressionNotManaged
+	}
+	cc := &chunkCompressor{algo: algo, dict: d, out: out}
+	if algo == "" || algo == compressionOff {
+		return cc, cc.decide(false)
+	}
+	if compressionMinSaving > 0 {
+		cc.sample = make([]byte, 0, compressionSampleSize)
+	} else if compressionDetect {
+		cc.sample = make([]byte, 0, incompressibleSampleSize)
+	} else {
+		return cc, cc.decide(true)
+	}
+	return cc, nil
+}
+
+func (cc *chunkCompressor) decide(compress bool) error {
+	if !compress {
+		cc.algo = compressionOff
+		cc.dict = nil
+		cc.w = cc.out
+		return nil
+	}
+	z, err := makeCompressor(cc.algo, cc.dict, cc.out)
+	if err == nil {
+		cc.w = z
+	}
+	return err
+}
+
+// Compresses the sample aside, then decides how the chunk is stored
+func (cc *chunkCompressor) decideFromSample() error {
+	if compressionDetect && incompressible(cc.sample) {
+		atomic.AddUint64(&counters.CompressSkipped, 1)
+		return cc.writeSample(false)
+	}
+	if compressionMinSaving <= 0 {
+		return cc.writeSample(true)
+	}
+
+	var bb bytes.Buffer
+	z, err := makeCompressor(cc.algo, cc.dict, &bb)
+	if err != nil {
+		return err
+	}
+	if _, err = z.Write(cc.sample); err == nil {
+		err = z.Close()
+	}
+	if err != nil {
+		return err
+	}
+	saving := 100 - (bb.Len()*100)/(len(cc.sample)+1)
+	return cc.writeSample(saving >= compressionMinSaving)
+}
+
+// Decides how the chunk is stored, then stores the sample
+func (cc *chunkCompressor) writeSample(compress bool) error {
+	if err := cc.decide(compress); err != nil {
+		return err
+	}
+	_, err := cc.w.Write(cc.sample)
+	cc.sample = nil
+	return err
+}
+
+func (cc *chunkCompressor) Write(p []byte) (int, error) {
+	if cc.w != nil {
+		return cc.w.Write(p)
+	}
+	room := cap(cc.sample) - len(cc.sample)
+	if len(p) < room {
+		cc.sample = append(cc.sample, p...)
+		return len(p), nil
+	}
+	cc.sample = append(cc.sample, p[:room]...)
+	if err := cc.decideFromSample(); err != nil {
+		return 0, err
+	}
+	n, err := cc.w.Write(p[room:])
+	return room + n, err
+}
+
+func (cc *chunkCompressor) Close() error {
+	if cc.w == nil {
+		if err := cc.decideFromSample(); err != nil {
+			return err
+		}
+	}
+	if z, ok := cc.w.(io.WriteCloser); ok && cc.algo != compressionOff {
+		return z.Close()
+	}
+	return nil
+}
+
+// The algorithm actually used to store the chunk
+func (cc *chunkCompressor) algorithm() string {
+	return cc.algo
+}
+
+// The ID of the dictionary actually used, empty without any
+func (cc *chunkCompressor) dictionary() string {
+	if cc.dict == nil {
+		return ""
+	}
+	return strconv.FormatUint(uint64(cc.dict.id), 10)
+}
@@ -0,0 +1,105 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The caps on the concurrency: at most max_concurrent_get GET (and HEAD) of
+chunks at once, max_concurrent_put PUT (and PATCH), and max_connections
+connections opened to the service (0 for no limit). Beyond them the request
+is refused with a 503 and a Retry-After of concurrency_retry_after seconds,
+rather than the volume thrashing under the load. A refused upload isn't
+drained, its connection is closed.
+
+The current concurrency is exported by /stat as gauges, whatever the caps.
+*/
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+var (
+	maxConcurrentGet      int64
+	maxConcurrentPut      int64
+	maxConnections        int64
+	concurrencyRetryAfter = 1
+)
+
+var errTooBusy = errors.New("Too many requests in progress")
+
+// How many requests and connections are in progress
+var concurrency struct {
+	get   int64
+	put   int64
+	conns int64
+}
+
+// Admits the chunk request, then tells how to release it
+func (rr *rawxRequest) admit() (func(), error) {
+	var gauge *int64
+	var max int64
+	switch rr.req.Method {
+	case "GET", "HEAD":
+		gauge, max = &concurrency.get, atomic.LoadInt64(&maxConcurrentGet)
+	case "PUT", "PATCH":
+		gauge, max = &concurrency.put, atomic.LoadInt64(&maxConcurrentPut)
+	default:
+		return func() {}, nil
+	}
+	if n := atomic.AddInt64(gauge, 1); max > 0 && n > max {
+		atomic.AddInt64(gauge, -1)
+		atomic.AddUint64(&counters.ConcurrencyRefused, 1)
+		return nil, errTooBusy
+	}
+	return func() { atomic.AddInt64(gauge, -1) }, nil
+}
+
+// Tells if the connection of the request is one too many
+func (rr *rawxRequest) overConnected() bool {
+	if maxConnections <= 0 || atomic.LoadInt64(&concurrency.conns) <= maxConnections {
+		return false
+	}
+	atomic.AddUint64(&counters.ConcurrencyRefused, 1)
+	return true
+}
+
+// Refuses the request for now, to be retried later
+func (rr *rawxRequest) replyBusy(err error) {
+	rr.req.Close = true
+	setError(rr.rep, err)
+	rr.rep.Header().Set("Retry-After", strconv.Itoa(concurrencyRetryAfter))
+	rr.replyCode(http.StatusServiceUnavailable)
+}
+
+// Counts the connections opened, along with the former hook, if any
+func trackConnections(srv *http.Server) {
+	previous := srv.ConnState
+	srv.ConnState = func(cnx net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			atomic.AddInt64(&concurrency.conns, 1)
+		case http.StateClosed, http.StateHijacked:
+			atomic.AddInt64(&concurrency.conns, -1)
+		}
+		if previous != nil {
+			previous(cnx, state)
+		}
+	}
+}
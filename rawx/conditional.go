@@ -0,0 +1,154 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The conditional requests. The hash of the chunk is its strong ETag, replied
+upon PUT, GET and HEAD. If-Match and If-None-Match are honored upon GET,
+HEAD and DELETE: a GET or a HEAD whose If-None-Match matches is answered
+with a 304, any other failed precondition with a 412. A chunk without hash
+only matches "*".
+
+A DELETE also honors If-Unmodified-Since (unless If-Match is present), so
+that a caller only deletes the generation of the chunk it knows: a chunk
+written again since then, or whose date is unknown, isn't deleted. The
+conditional DELETE holds the lock of the chunk from the check to the
+removal.
+
+The downloads resume with a Range and an If-Range telling the ETag or the
+Last-Modified of the part already received: the range is only honored when
+the chunk still matches exactly (by its strong ETag, or at the second), the
+whole chunk is replied otherwise. A range beyond the end of the chunk is
+answered with a 416, whose Content-Range tells the size of the chunk.
+*/
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+func (chunk *chunkInfo) etag() string {
+	if chunk.ChunkHash == "" {
+		return ""
+	}
+	return "\"" + strings.ToUpper(chunk.ChunkHash) + "\""
+}
+
+// Tells if the ETag is in the list, the weak tags only match when weak is
+// set.
+func etagListed(list, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = candidate[2:]
+		}
+		if etag != "" && strings.EqualFold(candidate, etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Tells the status replied when a precondition fails, 0 when they all hold
+func (rr *rawxRequest) checkPreconditions() int {
+	etag := rr.chunk.etag()
+	if v := rr.req.Header.Get("If-Match"); v != "" && !etagListed(v, etag, false) {
+		return http.StatusPreconditionFailed
+	}
+	if v := rr.req.Header.Get("If-None-Match"); v != "" && etagListed(v, etag, true) {
+		if rr.req.Method == "GET" || rr.req.Method == "HEAD" {
+			return http.StatusNotModified
+		}
+		return http.StatusPreconditionFailed
+	}
+	return 0
+}
+
+func (rr *rawxRequest) conditional() bool {
+	return rr.req.Header.Get("If-Match") != "" || rr.req.Header.Get("If-None-Match") != "" ||
+		(rr.req.Method == "DELETE" && rr.req.Header.Get("If-Unmodified-Since") != "")
+}
+
+// Tells if the chunk wasn't written since the date of If-Unmodified-Since
+func (rr *rawxRequest) unmodifiedSince() (bool, error) {
+	v := rr.req.Header.Get("If-Unmodified-Since")
+	if v == "" || rr.req.Header.Get("If-Match") != "" {
+		return true, nil
+	}
+	date, err := http.ParseTime(v)
+	if err != nil {
+		// An invalid date is ignored
+		return true, nil
+	}
+	in, err := rr.rawx.repo.get(rr.chunkID)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+	mtime, ok := lastModified(in)
+	return ok && !mtime.After(date), nil
+}
+
+// Replies the failed precondition, if any, then tells if it did
+func (rr *rawxRequest) replyPreconditions() bool {
+	status := rr.checkPreconditions()
+	if status == 0 {
+		return false
+	}
+	setHeader(rr.rep.Header(), "ETag", rr.chunk.etag())
+	rr.replyCode(status)
+	return true
+}
+
+// Tells when the chunk changed, neither the slabs nor the offloaded chunks
+// know it.
+func lastModified(in fileReader) (time.Time, bool) {
+	if r, ok := in.(*realFileReader); ok {
+		if fi, err := r.f.Stat(); err == nil {
+			return fi.ModTime().UTC().Truncate(time.Second), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Tells if the Range applies, as far as If-Range is concerned
+func (rr *rawxRequest) ifRangeHolds(in fileReader) bool {
+	v := strings.TrimSpace(rr.req.Header.Get("If-Range"))
+	switch {
+	case v == "":
+		return true
+	case strings.HasPrefix(v, "W/"):
+		// Never a strong match
+		return false
+	case strings.HasPrefix(v, "\""):
+		etag := rr.chunk.etag()
+		return etag != "" && strings.EqualFold(v, etag)
+	}
+	date, err := http.ParseTime(v)
+	if err != nil {
+		return false
+	}
+	mtime, ok := lastModified(in)
+	return ok && mtime.Equal(date)
+}
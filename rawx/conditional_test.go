@@ -0,0 +1,140 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+const testChunkHash = "0123456789abcdef0123456789abcdef"
+
+func TestEtagListed(t *testing.T) {
+	etag := `"0123456789ABCDEF0123456789ABCDEF"`
+	cases := []struct {
+		list  string
+		etag  string
+		weak  bool
+		match bool
+	}{
+		{"*", "", false, true},
+		{"*", etag, false, true},
+		{etag, etag, false, true},
+		{`"0123456789abcdef0123456789abcdef"`, etag, false, true},
+		{`"other", ` + etag, etag, false, true},
+		{`"other"`, etag, false, false},
+		{"W/" + etag, etag, false, false},
+		{"W/" + etag, etag, true, true},
+		{etag, "", false, false},
+		{"", etag, false, false},
+	}
+	for _, tc := range cases {
+		if match := etagListed(tc.list, tc.etag, tc.weak); match != tc.match {
+			t.Errorf("etagListed(%q, %q, %v) = %v", tc.list, tc.etag, tc.weak, match)
+		}
+	}
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	etag := `"0123456789ABCDEF0123456789ABCDEF"`
+	cases := []struct {
+		method string
+		header string
+		value  string
+		hash   string
+		status int
+		isCond bool
+	}{
+		{"GET", "", "", testChunkHash, 0, false},
+		{"GET", "If-Match", etag, testChunkHash, 0, true},
+		{"GET", "If-Match", `"other"`, testChunkHash, http.StatusPreconditionFailed, true},
+		{"GET", "If-Match", "W/" + etag, testChunkHash, http.StatusPreconditionFailed, true},
+		{"GET", "If-Match", "*", "", 0, true},
+		{"GET", "If-Match", etag, "", http.StatusPreconditionFailed, true},
+		{"GET", "If-None-Match", etag, testChunkHash, http.StatusNotModified, true},
+		{"HEAD", "If-None-Match", "W/" + etag, testChunkHash, http.StatusNotModified, true},
+		{"GET", "If-None-Match", `"other"`, testChunkHash, 0, true},
+		{"DELETE", "If-None-Match", "*", testChunkHash, http.StatusPreconditionFailed, true},
+		{"DELETE", "If-Match", etag, testChunkHash, 0, true},
+		{"DELETE", "If-Unmodified-Since", "Mon, 02 Jan 2006 15:04:05 GMT", testChunkHash, 0, true},
+		{"GET", "If-Unmodified-Since", "Mon, 02 Jan 2006 15:04:05 GMT", testChunkHash, 0, false},
+	}
+	for _, tc := range cases {
+		rr := rawxRequest{
+			req:   httptest.NewRequest(tc.method, "/"+testChunkHash, nil),
+			chunk: chunkInfo{ChunkHash: tc.hash},
+		}
+		if tc.header != "" {
+			rr.req.Header.Set(tc.header, tc.value)
+		}
+		if status := rr.checkPreconditions(); status != tc.status {
+			t.Errorf("%s %s: %q: status %d, expected %d",
+				tc.method, tc.header, tc.value, status, tc.status)
+		}
+		if isCond := rr.conditional(); isCond != tc.isCond {
+			t.Errorf("%s %s: %q: conditional %v, expected %v",
+				tc.method, tc.header, tc.value, isCond, tc.isCond)
+		}
+	}
+}
+
+func TestIfRangeHolds(t *testing.T) {
+	f, err := ioutil.TempFile("", "rawx-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	mtime := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	if err = os.Chtimes(f.Name(), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	in := &realFileReader{f: f}
+
+	cases := []struct {
+		ifRange string
+		hash    string
+		holds   bool
+	}{
+		{"", testChunkHash, true},
+		{`"0123456789ABCDEF0123456789ABCDEF"`, testChunkHash, true},
+		{`"0123456789abcdef0123456789abcdef"`, testChunkHash, true},
+		{`"other"`, testChunkHash, false},
+		{`"0123456789ABCDEF0123456789ABCDEF"`, "", false},
+		{`W/"0123456789ABCDEF0123456789ABCDEF"`, testChunkHash, false},
+		{mtime.Format(http.TimeFormat), testChunkHash, true},
+		{mtime.Add(time.Second).Format(http.TimeFormat), testChunkHash, false},
+		{mtime.Add(-time.Second).Format(http.TimeFormat), testChunkHash, false},
+		{"not a date", testChunkHash, false},
+	}
+	for _, tc := range cases {
+		rr := rawxRequest{
+			req:   httptest.NewRequest("GET", "/"+testChunkHash, nil),
+			chunk: chunkInfo{ChunkHash: tc.hash},
+		}
+		if tc.ifRange != "" {
+			rr.req.Header.Set("If-Range", tc.ifRange)
+		}
+		if holds := rr.ifRangeHolds(in); holds != tc.holds {
+			t.Errorf("If-Range %q: %v, expected %v", tc.ifRange, holds, tc.holds)
+		}
+	}
+}
@@ -61,6 +61,7 @@ var loadedOpts = map[string]string{
 	"compression":      "compression",
 	"compress":         "compression",
 	"fallocate":        "fallocate",
+	"fallocate_extent": "fallocate_extent",
 	"tcp_keepalive":    "tcp_keepalive",
 	"checksum":         "checksum",
 	"buffer_size":      "buffer_size",
@@ -71,7 +72,188 @@ var loadedOpts = map[string]string{
 	"timeout_read_request": "timeout_read_request",
 	"timeout_write_reply":  "timeout_write_reply",
 	"timeout_idle":         "timeout_idle",
-	"headers_buffer_size":  "headers_buffer_size",
+
+	// Reuse of the connections
+	"max_requests_per_connection": "max_requests_per_connection",
+	"max_idle_connections":        "max_idle_connections",
+	"conn_reap_interval":          "conn_reap_interval",
+	"headers_buffer_size":         "headers_buffer_size",
+	"watch_volume":                "watch_volume",
+	"shutdown_timeout":            "shutdown_timeout",
+
+	// Concurrency caps
+	"max_concurrent_get":      "max_concurrent_get",
+	"max_concurrent_put":      "max_concurrent_put",
+	"max_connections":         "max_connections",
+	"concurrency_retry_after": "concurrency_retry_after",
+	"client_bandwidth":        "client_bandwidth",
+	"client_bandwidth_key":    "client_bandwidth_key",
+	"client_rate":             "client_rate",
+	"client_rate_burst":       "client_rate_burst",
+	"client_rate_key":         "client_rate_key",
+	"priority_queue_depth":    "priority_queue_depth",
+	"priority_latency":        "priority_latency",
+	"priority_interval":       "priority_interval",
+	"priority_policy":         "priority_policy",
+
+	// Timeouts by method
+	"timeout_get_read":       "timeout_get_read",
+	"timeout_get_write":      "timeout_get_write",
+	"timeout_get_idle":       "timeout_get_idle",
+	"timeout_get_request":    "timeout_get_request",
+	"timeout_put_read":       "timeout_put_read",
+	"timeout_put_write":      "timeout_put_write",
+	"timeout_put_idle":       "timeout_put_idle",
+	"timeout_put_request":    "timeout_put_request",
+	"timeout_delete_read":    "timeout_delete_read",
+	"timeout_delete_write":   "timeout_delete_write",
+	"timeout_delete_idle":    "timeout_delete_idle",
+	"timeout_delete_request": "timeout_delete_request",
+
+	// TLS and HTTP/2
+	"tls_cert_file":                "tls_cert_file",
+	"tls_key_file":                 "tls_key_file",
+	"tls_ca_file":                  "tls_ca_file",
+	"tls_client_auth":              "tls_client_auth",
+	"tls_ciphers":                  "tls_ciphers",
+	"tls_min_version":              "tls_min_version",
+	"tls_reload_interval":          "tls_reload_interval",
+	"presign_key_file":             "presign_key_file",
+	"presign_required":             "presign_required",
+	"presign_max_ttl":              "presign_max_ttl",
+	"auth_tokens_file":             "auth_tokens_file",
+	"acl_read":                     "acl_read",
+	"acl_write":                    "acl_write",
+	"acl_admin":                    "acl_admin",
+	"http2":                        "http2",
+	"http2_cleartext":              "http2_cleartext",
+	"http2_max_concurrent_streams": "http2_max_concurrent_streams",
+	"http2_conn_window":            "http2_conn_window",
+	"http2_stream_window":          "http2_stream_window",
+	"quic_port":                    "quic_port",
+	"quic_cert_file":               "quic_cert_file",
+	"quic_key_file":                "quic_key_file",
+
+	// Events
+	"event_agent":                  "event_agent",
+	"events_fanout":                "events_fanout",
+	"events_max_attempts":          "events_max_attempts",
+	"events_retry_delay":           "events_retry_delay",
+	"events_dead_letter":           "events_dead_letter",
+	"events_rate_limit":            "events_rate_limit",
+	"events_rate_burst":            "events_rate_burst",
+	"events_sampling":              "events_sampling",
+	"events_compression":           "events_compression",
+	"events_compression_threshold": "events_compression_threshold",
+	"events_hmac_secret":           "events_hmac_secret",
+	"events_tube_shards":           "events_tube_shards",
+	"events_sync_delete":           "events_sync_delete",
+	"events_sync_put":              "events_sync_put",
+	"events_dedup_window":          "events_dedup_window",
+	"events_dedup_size":            "events_dedup_size",
+	"events_syslog_facility":       "events_syslog_facility",
+	"events_syslog_sd_id":          "events_syslog_sd_id",
+	"events_file_max_size":         "events_file_max_size",
+	"events_file_keep":             "events_file_keep",
+	"events_file_compress":         "events_file_compress",
+	"events_wal":                   "events_wal",
+	"events_wal_segment_size":      "events_wal_segment_size",
+	"events_wal_fsync":             "events_wal_fsync",
+	// Storage
+	"volumes":                         "volumes",
+	"tier_cold_dir":                   "tier_cold_dir",
+	"tier_demote_after":               "tier_demote_after",
+	"tier_scan_interval":              "tier_scan_interval",
+	"rebalance_threshold":             "rebalance_threshold",
+	"rebalance_rate":                  "rebalance_rate",
+	"rebalance_interval":              "rebalance_interval",
+	"direct_upload":                   "direct_upload",
+	"attr_store":                      "attr_store",
+	"hash_migrate_from":               "hash_migrate_from",
+	"copy_mode":                       "copy_mode",
+	"trash_retention":                 "trash_retention",
+	"trash_purge_interval":            "trash_purge_interval",
+	"moved_retention":                 "moved_retention",
+	"moved_purge_interval":            "moved_purge_interval",
+	"maintenance":                     "maintenance",
+	"discard":                         "discard",
+	"discard_interval":                "discard_interval",
+	"readahead_window":                "readahead_window",
+	"readahead_min_size":              "readahead_min_size",
+	"mmap_min_size":                   "mmap_min_size",
+	"mmap_max_size":                   "mmap_max_size",
+	"read_bandwidth":                  "read_bandwidth",
+	"write_bandwidth":                 "write_bandwidth",
+	"health_interval":                 "health_interval",
+	"health_failures":                 "health_failures",
+	"health_max_io_errors":            "health_max_io_errors",
+	"s3_offload":                      "s3_offload",
+	"s3_region":                       "s3_region",
+	"s3_offload_after":                "s3_offload_after",
+	"s3_offload_interval":             "s3_offload_interval",
+	"s3_rehydrate":                    "s3_rehydrate",
+	"chunk_format":                    "chunk_format",
+	"upload_journal":                  "upload_journal",
+	"fsync_policy":                    "fsync_policy",
+	"fsync_group_interval":            "fsync_group_interval",
+	"session_timeout":                 "session_timeout",
+	"session_max":                     "session_max",
+	"txn_timeout":                     "txn_timeout",
+	"txn_max_open":                    "txn_max_open",
+	"txn_max_members":                 "txn_max_members",
+	"dedup":                           "dedup",
+	"dedup_sweep_interval":            "dedup_sweep_interval",
+	"sparse":                          "sparse",
+	"snapshot_command":                "snapshot_command",
+	"snapshot_post_command":           "snapshot_post_command",
+	"snapshot_timeout":                "snapshot_timeout",
+	"chunk_format_convert":            "chunk_format_convert",
+	"slab_max_chunk_size":             "slab_max_chunk_size",
+	"slab_size":                       "slab_size",
+	"slab_compact_ratio":              "slab_compact_ratio",
+	"slab_compact_interval":           "slab_compact_interval",
+	"proxy":                           "proxy",
+	"space_high_watermark":            "space_high_watermark",
+	"space_low_watermark":             "space_low_watermark",
+	"space_inodes_high_watermark":     "space_inodes_high_watermark",
+	"space_inodes_low_watermark":      "space_inodes_low_watermark",
+	"pending_max_age":                 "pending_max_age",
+	"pending_gc_interval":             "pending_gc_interval",
+	"quota_bytes":                     "quota_bytes",
+	"quota_chunks":                    "quota_chunks",
+	"quota_file":                      "quota_file",
+	"quota_save_interval":             "quota_save_interval",
+	"statfs_ttl":                      "statfs_ttl",
+	"orphan_interval":                 "orphan_interval",
+	"orphan_rate":                     "orphan_rate",
+	"orphan_grace":                    "orphan_grace",
+	"orphan_dry_run":                  "orphan_dry_run",
+	"io_engine":                       "io_engine",
+	"verify_get":                      "verify_get",
+	"scrub_bandwidth":                 "scrub_bandwidth",
+	"scrub_interval":                  "scrub_interval",
+	"scrub_tree_blocks":               "scrub_tree_blocks",
+	"hash_tree_block_size":            "hash_tree_block_size",
+	"max_chunk_size":                  "max_chunk_size",
+	"max_chunk_size_by_policy":        "max_chunk_size_by_policy",
+	"compression_level":               "compression_level",
+	"compression_min_size":            "compression_min_size",
+	"compression_min_saving":          "compression_min_saving",
+	"compression_detect":              "compression_detect",
+	"compression_dict":                "compression_dict",
+	"compression_dict_max_chunk_size": "compression_dict_max_chunk_size",
+	"compression_dict_size":           "compression_dict_size",
+	"compression_dict_samples":        "compression_dict_samples",
+	"compression_dict_interval":       "compression_dict_interval",
+	"content_encoding":                "content_encoding",
+	"content_encoding_workers":        "content_encoding_workers",
+	"content_encoding_min_size":       "content_encoding_min_size",
+	"content_encoding_level":          "content_encoding_level",
+	"checksum_algorithm":              "checksum_algorithm",
+	"encryption_key_file":             "encryption_key_file",
+	"encryption_key_id":               "encryption_key_id",
+	"encryption_kms":                  "encryption_kms",
+	"encryption_key_ttl":              "encryption_key_ttl",
 	// TODO(jfs): also implement a cachedir
 }
 
@@ -101,3 +101,7 @@ func oioGetConfigValue(namespace, value string) string {
 func OioGetEventAgent(namespace string) string {
 	return oioGetConfigValue(namespace, oioConfigEventAgent)
 }
+
+func OioGetProxy(namespace string) string {
+	return oioGetConfigValue(namespace, oioConfigProxy)
+}
@@ -39,6 +39,18 @@ const (
 	AttrNameChunkSize          = "user.grid.chunk.size"
 	AttrNameOioVersion         = "user.grid.oio.version"
 	AttrNameCompression        = "user.grid.compression"
+	AttrNameCompressionDict    = "user.rawx.compression.dict"
+	AttrNameHashTree           = "user.rawx.hash.tree"
+	AttrNameHashAlgo           = "user.rawx.hash.algo"
+	AttrNameIdempotencyKey     = "user.rawx.idempotency.key"
+	AttrNameEncryption         = "user.grid.encryption"
+	AttrNameEncryptionKey      = "user.grid.encryption.key"
+	AttrNameEncryptionSalt     = "user.grid.encryption.salt"
+	AttrNameQuarantineReason   = "user.rawx.quarantine.reason"
+	AttrNameQuarantineTime     = "user.rawx.quarantine.time"
+	AttrNameOrphanSince        = "user.rawx.orphan.since"
+	AttrNameOffloaded          = "user.rawx.offloaded"
+	AttrNameFormatInode        = "user.rawx.format.inode"
 )
 
 const (
@@ -46,6 +58,8 @@ const (
 	compressionLzw     = "lzw"
 	compressionZlib    = "zlib"
 	compressionDeflate = "deflate"
+	compressionZstd    = "zstd"
+	compressionLz4     = "lz4"
 )
 
 const (
@@ -59,18 +73,35 @@ const (
 	HeaderNameChunkPosition      = "X-oio-Chunk-Meta-Chunk-Pos"
 	HeaderNameChunkSize          = "X-oio-Chunk-Meta-Chunk-Size"
 	HeaderNameChunkChecksum      = "X-oio-Chunk-Meta-Chunk-Hash"
+	HeaderNameChunkHashAlgo      = "X-oio-Chunk-Meta-Chunk-Hash-Algo"
+	HeaderNameIdempotencyKey     = "X-oio-Idempotency-Key"
 	HeaderNameMetachunkSize      = "X-oio-Chunk-Meta-Metachunk-Size"
 	HeaderNameMetachunkChecksum  = "X-oio-Chunk-Meta-Metachunk-Hash"
 	HeaderNameChunkID            = "X-oio-Chunk-Meta-Chunk-Id"
 	HeaderNameXattrVersion       = "X-oio-Chunk-Meta-Oio-Version"
+	HeaderNameContentMD5         = "Content-MD5"
+	HeaderNameDigest             = "Digest"
 )
 
 const (
 	HeaderNameCheckHash = "X-oio-check-hash"
-	HeaderNameOioReqId  = "X-oio-req-id"
-	HeaderLenOioReqId   = 63
-	HeaderNameTransId   = "X-trans-id"
-	HeaderNameError     = "X-Error"
+	// The compression algorithm, chosen by the proxy for the storage policy
+	HeaderNameCompression = "X-oio-compression"
+	HeaderNameOioReqId    = "X-oio-req-id"
+	// When the client stops waiting for the reply
+	HeaderNameDeadline    = "X-oio-req-deadline"
+	HeaderNameTransaction = "X-oio-Transaction"
+	// The upload sessions, and the bytes they received
+	HeaderNameUploadSession = "X-oio-Upload-Session"
+	HeaderNameUploadOffset  = "X-oio-Upload-Offset"
+	HeaderLenOioReqId       = 63
+	HeaderNameTransId       = "X-trans-id"
+	HeaderNameError         = "X-Error"
+
+	// The data is known as already compressed, by the client
+	HeaderNameIncompressible = "X-oio-incompressible"
+	// Where the chunk deleted has been moved
+	HeaderNameMovedTo = "X-oio-Chunk-Moved-To"
 )
 
 const (
@@ -82,16 +113,32 @@ const (
 	configFadviseYes = iota
 
 	// Use this value to advise the kernel to avoid caching the file
-	// using FADV_DONTNEED
+	// using FADV_DONTNEED, once the transfer is over
 	configFadviseNocache = iota
 
 	// Use this value to advise the kernel to keep the fie in cache
 	// using FADV_WILLNEED + the general FADV_SEQUENTIAL
 	configFadviseCache = iota
+
+	// Read ahead during the transfer with FADV_SEQUENTIAL, then drop the
+	// pages with FADV_DONTNEED once it is over
+	configFadviseStream = iota
+)
+
+const (
+	// Use this value to never preallocate the chunk files
+	configFallocateNone = iota
+
+	// Preallocate the length announced by the client at once, then by
+	// extents when the length is unknown
+	configFallocateFull = iota
+
+	// Only preallocate by extents, as the upload progresses
+	configFallocateExtent = iota
 )
 
 const (
-	configDefaultFallocate = false
+	configDefaultFallocate = configFallocateNone
 	configDefaultSyncFile  = false
 	configDefaultSyncDir   = false
 
@@ -100,6 +147,9 @@ const (
 
 	// By default, no fadvise() will be called before download a chunk
 	configDefaultFadviseDownload = configFadviseNone
+
+	// By default, the chunks are written through the page cache
+	configDefaultDirectUpload = false
 )
 
 const (
@@ -116,10 +166,27 @@ const (
 	// Minimum size (in bytes) of the upload buffer
 	uploadBufferSizeMin int = 32768
 
-	// Specifies the extension size when Fallocate is called to prepare file placeholders
+	// Default extension size when Fallocate is called to prepare file placeholders
 	uploadExtensionSize int64 = 16 * 1024 * 1024
 )
 
+// Where the corrupted chunks are moved, under the root of the volume
+const quarantineDir = ".quarantine"
+
+// Where the deleted chunks are kept for a while, under the root of the volume
+const trashDir = ".trash"
+
+// Where the chunks moved away tell their new location
+const movedDir = ".moved"
+
+// Why a chunk has been quarantined
+const (
+	quarantineHashMismatch = "hash mismatch"
+	quarantineTruncated    = "truncated"
+	quarantineBadSegment   = "corrupted segment"
+	quarantineBadBlock     = "corrupted block"
+)
+
 const (
 	hashWidth    = 3
 	hashDepth    = 1
@@ -133,6 +200,12 @@ const (
 	checksumSmart  = iota
 )
 
+const (
+	verifyGetOff    = iota
+	verifyGetStream = iota
+	verifyGetStrict = iota
+)
+
 const (
 	oioEtcDir          = "/etc/oio"
 	oioConfigFilePath  = oioEtcDir + "/sds.conf"
@@ -142,6 +215,7 @@ const (
 
 const (
 	oioConfigEventAgent = "event-agent"
+	oioConfigProxy      = "proxy"
 )
 
 const (
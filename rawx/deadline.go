@@ -0,0 +1,157 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The deadline of the client, told by the X-oio-req-deadline header as a Unix
+timestamp in seconds (with an optional fraction), e.g. the deadline of the
+proxy. Beyond it, the work on the request is abandoned: the body of an
+upload stops being read (the chunk isn't committed), the reply stops being
+written, the wait for the delivery of a synchronous event is cut short. The
+request is then answered with a 504, if the reply didn't start yet, and its
+connection closed. A request already late is refused at once.
+
+A malformed deadline is ignored.
+*/
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var errDeadlineExceeded = errors.New("Request deadline exceeded")
+
+func parseDeadline(v string) (time.Time, bool) {
+	secs, err := strconv.ParseFloat(v, 64)
+	if err != nil || secs <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(secs*float64(time.Second))), true
+}
+
+type deadlineBody struct {
+	io.ReadCloser
+	ctx context.Context
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	if b.ctx.Err() != nil {
+		return 0, errDeadlineExceeded
+	}
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && b.ctx.Err() != nil {
+		err = errDeadlineExceeded
+	}
+	return n, err
+}
+
+type deadlineWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+}
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	if w.ctx.Err() != nil {
+		return 0, errDeadlineExceeded
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Keeps the sendfile() of the server, checked once before starting
+func (w *deadlineWriter) ReadFrom(src io.Reader) (int64, error) {
+	if w.ctx.Err() != nil {
+		return 0, errDeadlineExceeded
+	}
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(w.ResponseWriter, src)
+}
+
+func (w *deadlineWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Bounds the request by the deadline of the client, if any, then tells how
+// to release the deadline once the request is served.
+func (rr *rawxRequest) applyDeadline() func() {
+	v := rr.req.Header.Get(HeaderNameDeadline)
+	if v == "" {
+		return nil
+	}
+	when, ok := parseDeadline(v)
+	if !ok {
+		LogDebug("Malformed deadline ignored: %s", v)
+		return nil
+	}
+	ctx, cancel := context.WithDeadline(rr.req.Context(), when)
+	rr.req = rr.req.WithContext(ctx)
+	if rr.req.Body != nil {
+		rr.req.Body = &deadlineBody{ReadCloser: rr.req.Body, ctx: ctx}
+	}
+	// A read blocked on a silent client is interrupted as well
+	rc := http.NewResponseController(rr.rep)
+	stop := context.AfterFunc(ctx, func() {
+		if ctx.Err() == context.DeadlineExceeded {
+			rr.req.Close = true
+			_ = rc.SetReadDeadline(time.Now())
+		}
+	})
+	rr.rep = &deadlineWriter{ResponseWriter: rr.rep, ctx: ctx}
+	return func() {
+		stop()
+		cancel()
+	}
+}
+
+// Tells if the deadline of the client already passed
+func (rr *rawxRequest) pastDeadline() bool {
+	return rr.req.Context().Err() == context.DeadlineExceeded
+}
+
+// Gives up the request, too late for the client
+func (rr *rawxRequest) replyLate() {
+	atomic.AddUint64(&counters.DeadlineExceeded, 1)
+	rr.req.Close = true
+	setError(rr.rep, errDeadlineExceeded)
+	rr.replyCode(http.StatusGatewayTimeout)
+}
+
+// Emits the event and waits for its delivery, at most until the deadline
+// of the client. The event is delivered anyway.
+func (rr *rawxRequest) notifySync(eventType string) error {
+	ctx := rr.req.Context()
+	if _, ok := ctx.Deadline(); !ok {
+		return notifySync(rr.rawx, eventType, rr.reqid, &rr.chunk)
+	}
+	chunk := rr.chunk
+	done := make(chan error, 1)
+	go func() {
+		done <- notifySync(rr.rawx, eventType, rr.reqid, &chunk)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return errDeadlineExceeded
+	}
+}
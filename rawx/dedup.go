@@ -0,0 +1,247 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The deduplication of the chunks with the same payload. Once committed, a
+chunk is looked up in an index of the volume, by its hash and its size:
+
+	.dedup/<HASH>.<SIZE>
+
+When absent, the chunk is linked there. When present and identical, byte
+per byte and, with the xattr store, attribute per attribute apart from
+the full path, the chunk is replaced by a hard link to the indexed file.
+The number of links to the indexed file counts the chunks sharing its
+data, the file system maintaining it whatever happens to the chunks. The
+entries of the index left as the only link are released by a background
+task, every dedup_sweep_interval seconds.
+
+Neither the encrypted chunks nor the chunks in the format 2, whose header
+holds their attributes, are deduplicated.
+*/
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+const (
+	dedupDir                  = ".dedup"
+	dedupSuffix               = ".dedup"
+	dedupDefaultSweepInterval = 3600
+	dedupCompareBlock         = 1024 * 1024
+)
+
+// Replaces the chunk just committed by a link to an identical one
+func (fw *realFileWriter) dedup() {
+	fr := fw.repo
+	if !fr.dedup || fw.hash == "" || fw.base != 0 || encryptNewChunks {
+		return
+	}
+	key := dedupDir + "/" + strings.ToUpper(fw.hash) + "." + strconv.FormatInt(fw.written, 10)
+	err := syscall.Linkat(fr.rootFd, fw.pathFinal, fr.rootFd, key, 0)
+	if err == syscall.ENOENT {
+		err = syscall.Mkdirat(fr.rootFd, dedupDir, uint32(fr.putMkdirMode))
+		if err == nil || err == syscall.EEXIST {
+			err = syscall.Linkat(fr.rootFd, fw.pathFinal, fr.rootFd, key, 0)
+		}
+	}
+	if err == syscall.EEXIST {
+		err = fr.dedupLink(key, fw.pathFinal, fw.written)
+	}
+	if err != nil {
+		LogWarning("Chunk %s not deduplicated: %v", fw.pathFinal, err)
+	}
+}
+
+// Replaces the chunk by a link to the indexed file, when identical
+func (fr *fileRepository) dedupLink(key, relPath string, size int64) error {
+	var stKey, stChunk syscall.Stat_t
+	if err := syscall.Fstatat(fr.rootFd, key, &stKey, 0); err != nil {
+		return err
+	}
+	if err := syscall.Fstatat(fr.rootFd, relPath, &stChunk, 0); err != nil {
+		return err
+	}
+	if stKey.Ino == stChunk.Ino {
+		return nil
+	}
+	if same, err := fr.sameChunks(key, relPath); err != nil || !same {
+		return err
+	}
+
+	pathTemp := relPath + dedupSuffix
+	if err := syscall.Linkat(fr.rootFd, key, fr.rootFd, pathTemp, 0); err != nil {
+		return err
+	}
+	// The indexed file gets the full path of the chunk as well
+	xattrName := AttrNameFullPrefix + filepath.Base(relPath)
+	err := fr.copyXattr(relPath, pathTemp, xattrName)
+	if err == nil {
+		err = syscall.Renameat(fr.rootFd, pathTemp, fr.rootFd, relPath)
+	}
+	if err != nil {
+		if !fr.sidecar {
+			_ = syscall.Removexattr(fr.root+"/"+pathTemp, xattrName)
+		}
+		_ = syscall.Unlinkat(fr.rootFd, pathTemp, 0)
+		return err
+	}
+	atomic.AddUint64(&counters.DedupChunks, 1)
+	atomic.AddUint64(&counters.DedupBytes, uint64(size))
+	return nil
+}
+
+func (fr *fileRepository) copyXattr(src, dst, name string) error {
+	if fr.sidecar {
+		return nil
+	}
+	value, err := getXattr(fr.root+"/"+src, name)
+	if err == nil {
+		err = syscall.Setxattr(fr.root+"/"+dst, name, value, 0)
+	}
+	return err
+}
+
+func getXattr(path, name string) ([]byte, error) {
+	size, err := syscall.Getxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, size)
+	size, err = syscall.Getxattr(path, name, value)
+	return value[:size], err
+}
+
+// Tells if both chunks have the same data, and the same attributes apart
+// from their full path when the attributes are shared by their links.
+func (fr *fileRepository) sameChunks(path0, path1 string) (bool, error) {
+	f0, err := os.Open(fr.root + "/" + path0)
+	if err != nil {
+		return false, err
+	}
+	defer f0.Close()
+	f1, err := os.Open(fr.root + "/" + path1)
+	if err != nil {
+		return false, err
+	}
+	defer f1.Close()
+
+	if !fr.sidecar {
+		attrs0, err := contentXattrs(int(f0.Fd()))
+		if err != nil {
+			return false, err
+		}
+		attrs1, err := contentXattrs(int(f1.Fd()))
+		if err != nil {
+			return false, err
+		}
+		if len(attrs0) != len(attrs1) {
+			return false, nil
+		}
+		for k, v := range attrs0 {
+			if v1, ok := attrs1[k]; !ok || v1 != v {
+				return false, nil
+			}
+		}
+	}
+
+	buf0 := make([]byte, dedupCompareBlock)
+	buf1 := make([]byte, dedupCompareBlock)
+	for {
+		n0, err0 := io.ReadFull(f0, buf0)
+		n1, err1 := io.ReadFull(f1, buf1)
+		if n0 != n1 || !bytes.Equal(buf0[:n0], buf1[:n1]) {
+			return false, nil
+		}
+		if err0 == io.EOF || err0 == io.ErrUnexpectedEOF {
+			return err1 == err0, nil
+		}
+		if err0 != nil {
+			return false, err0
+		}
+		if err1 != nil {
+			return false, err1
+		}
+	}
+}
+
+// Loads the xattr of the chunk, apart from the full paths of its links
+func contentXattrs(fd int) (map[string]string, error) {
+	attrs := make(map[string]string)
+	size, err := syscall.Flistxattr(fd, nil)
+	if err != nil || size <= 0 {
+		return attrs, err
+	}
+	names := make([]byte, size)
+	if size, err = syscall.Flistxattr(fd, names); err != nil {
+		return nil, err
+	}
+	for _, name := range strings.Split(string(names[:size]), "\x00") {
+		if !strings.HasPrefix(name, "user.") || strings.HasPrefix(name, AttrNameFullPrefix) {
+			continue
+		}
+		n, err := syscall.Fgetxattr(fd, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, n)
+		if n, err = syscall.Fgetxattr(fd, name, value); err != nil {
+			return nil, err
+		}
+		attrs[name] = string(value[:n])
+	}
+	return attrs, nil
+}
+
+func (fr *fileRepository) startDedupSweeper(interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			fr.sweepDedup()
+		}
+	}()
+}
+
+// Releases the entries of the index no chunk links to anymore
+func (fr *fileRepository) sweepDedup() {
+	entries, err := ioutil.ReadDir(fr.root + "/" + dedupDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			LogWarning("Deduplication index of %s not swept: %v", fr.root, err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		var st syscall.Stat_t
+		key := dedupDir + "/" + entry.Name()
+		if err := syscall.Fstatat(fr.rootFd, key, &st, 0); err == nil && st.Nlink == 1 {
+			if err := syscall.Unlinkat(fr.rootFd, key, 0); err != nil {
+				LogWarning("Deduplicated chunk %s not released: %v", entry.Name(), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+func TestDedup(t *testing.T) {
+	repo := makeTestRepository(t, optionsMap{"dedup": "true"})
+	fr := &repo.sub
+
+	same := bytes.Repeat([]byte("dedup"), 100)
+	other := bytes.Repeat([]byte("other"), 100)
+	chunks := []chunkInfo{
+		makeTestChunk(1, same),
+		makeTestChunk(2, same),
+		makeTestChunk(3, other),
+	}
+	payloads := [][]byte{same, same, other}
+	linked := atomic.LoadUint64(&counters.DedupChunks)
+	for i := range chunks {
+		putTestChunk(t, fr, &chunks[i], payloads[i])
+	}
+	if n := atomic.LoadUint64(&counters.DedupChunks) - linked; n != 1 {
+		t.Errorf("%d chunks deduplicated, expected 1", n)
+	}
+
+	// The identical chunks share the indexed file, the other one has its own
+	inode := func(name string) syscall.Stat_t {
+		var st syscall.Stat_t
+		if err := syscall.Fstatat(fr.rootFd, fr.nameToRelPath(name), &st, 0); err != nil {
+			t.Fatalf("stat %s: %v", name, err)
+		}
+		return st
+	}
+	first, second, third := inode(chunks[0].ChunkID), inode(chunks[1].ChunkID), inode(chunks[2].ChunkID)
+	if first.Ino != second.Ino || first.Nlink != 3 {
+		t.Errorf("identical chunks not linked: inodes %d/%d, %d links", first.Ino, second.Ino, first.Nlink)
+	}
+	if third.Ino == first.Ino || third.Nlink != 2 {
+		t.Errorf("distinct chunk linked: inode %d, %d links", third.Ino, third.Nlink)
+	}
+
+	// Each chunk keeps its own attributes
+	for i, chunk := range chunks {
+		data, info := getTestChunk(t, repo, chunk.ChunkID)
+		if !bytes.Equal(data, payloads[i]) || info.ContentID != chunk.ContentID {
+			t.Errorf("chunk %d: read back %q, content %s", i, data, info.ContentID)
+		}
+	}
+
+	// The index entries are released once the chunks are deleted
+	key := dedupDir + "/" + chunks[0].ChunkHash + "." + strconv.Itoa(len(same))
+	if err := repo.del(chunks[0].ChunkID); err != nil {
+		t.Fatal(err)
+	}
+	fr.sweepDedup()
+	if syscall.Faccessat(fr.rootFd, key, syscall.F_OK, 0) != nil {
+		t.Errorf("index entry %s released while still linked", key)
+	}
+	if err := repo.del(chunks[1].ChunkID); err != nil {
+		t.Fatal(err)
+	}
+	fr.sweepDedup()
+	if syscall.Faccessat(fr.rootFd, key, syscall.F_OK, 0) == nil {
+		t.Errorf("index entry %s not released", key)
+	}
+}
@@ -0,0 +1,266 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The dictionaries of the zstd compression of the small chunks. The small
+chunks share little redundancy within each of them, but a lot between them
+(e.g. the same JSON or protobuf schemas), and a dictionary trained on a
+sample of the chunks already stored markedly improves their ratio.
+
+With compression_dict, a background job of the main volume samples up to
+compression_dict_samples chunks of at most compression_dict_max_chunk_size
+bytes every compression_dict_interval seconds, then trains a new dictionary
+from their clear data. The chunks uploaded afterwards with zstd, and
+announced below compression_dict_max_chunk_size, are compressed with the
+latest dictionary, its ID being saved in their attributes.
+
+The dictionaries are kept in the ".dicts" directory of the main volume and
+never removed, since the chunks compressed with any of them remain. They
+are shared by all the volumes of the service, so that a chunk moved to the
+cold tier still finds its dictionary.
+*/
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	dictDir = ".dicts"
+
+	dictDefaultMaxChunkSize = 64 * 1024
+	dictDefaultSize         = 112640
+	dictDefaultSamples      = 1000
+	dictDefaultInterval     = 86400
+	// Fewer samples make a dictionary worse than none
+	dictMinSamples = 16
+	// The IDs below are reserved by the zstd format
+	dictFirstID = 32768
+)
+
+var (
+	dictMaxChunkSize int64 = dictDefaultMaxChunkSize
+	dictSize               = dictDefaultSize
+	dictSamples            = dictDefaultSamples
+)
+
+var errDictNotFound = errors.New("Compression dictionary not found")
+
+type zstdDict struct {
+	id   uint32
+	data []byte
+}
+
+type dictRegistry struct {
+	lock    sync.RWMutex
+	dir     string
+	dicts   map[uint32]*zstdDict
+	current *zstdDict
+}
+
+// The dictionaries known by the service, nil when never enabled
+var zstdDicts *dictRegistry
+
+// Loads the dictionaries already trained on the volume
+func openDictRegistry(root string) (*dictRegistry, error) {
+	reg := &dictRegistry{
+		dir:   root + "/" + dictDir,
+		dicts: make(map[uint32]*zstdDict),
+	}
+	if err := os.MkdirAll(reg.dir, putMkdirMode); err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(reg.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range entries {
+		id, err := strconv.ParseUint(fi.Name(), 10, 32)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		data, err := ioutil.ReadFile(reg.dir + "/" + fi.Name())
+		if err != nil {
+			return nil, err
+		}
+		d := &zstdDict{id: uint32(id), data: data}
+		reg.dicts[d.id] = d
+		if reg.current == nil || d.id > reg.current.id {
+			reg.current = d
+		}
+	}
+	return reg, nil
+}
+
+func (reg *dictRegistry) latest() *zstdDict {
+	reg.lock.RLock()
+	defer reg.lock.RUnlock()
+	return reg.current
+}
+
+func (reg *dictRegistry) get(id string) (*zstdDict, error) {
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return nil, errDictNotFound
+	}
+	reg.lock.RLock()
+	defer reg.lock.RUnlock()
+	if d, ok := reg.dicts[uint32(n)]; ok {
+		return d, nil
+	}
+	return nil, errDictNotFound
+}
+
+// Saves the dictionary, then makes it the one of the next uploads
+func (reg *dictRegistry) add(data []byte, id uint32) error {
+	path := reg.dir + "/" + strconv.FormatUint(uint64(id), 10)
+	if err := ioutil.WriteFile(path+".pending", data, putOpenMode); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".pending", path); err != nil {
+		return err
+	}
+	d := &zstdDict{id: id, data: data}
+	reg.lock.Lock()
+	reg.dicts[id] = d
+	reg.current = d
+	reg.lock.Unlock()
+	return nil
+}
+
+func (reg *dictRegistry) nextID() uint32 {
+	reg.lock.RLock()
+	defer reg.lock.RUnlock()
+	if reg.current == nil {
+		return dictFirstID
+	}
+	return reg.current.id + 1
+}
+
+// Tells the dictionary to compress the chunk uploaded, if any
+func (rr *rawxRequest) compressionDict(algo string) *zstdDict {
+	if zstdDicts == nil || algo != compressionZstd {
+		return nil
+	}
+	if rr.req.ContentLength < 0 || rr.req.ContentLength > dictMaxChunkSize {
+		return nil
+	}
+	return zstdDicts.latest()
+}
+
+func (reg *dictRegistry) startTrainer(cr *chunkRepository, interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			if err := reg.train(cr); err != nil {
+				LogWarning("Compression dictionary not trained: %v", err)
+			}
+		}
+	}()
+}
+
+// Trains a new dictionary on a sample of the small chunks of the volume
+func (reg *dictRegistry) train(cr *chunkRepository) error {
+	// Reservoir sampling, the volume being walked once
+	var names []string
+	seen := 0
+	err := cr.sub.walk(func(name, relPath string, fi os.FileInfo) error {
+		if fi.Size() == 0 || fi.Size() > dictMaxChunkSize {
+			return nil
+		}
+		seen++
+		if len(names) < dictSamples {
+			names = append(names, name)
+		} else if i := rand.Intn(seen); i < dictSamples {
+			names[i] = name
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var samples [][]byte
+	for _, name := range names {
+		if data, err := reg.clearData(cr, name); err == nil && len(data) > 0 {
+			samples = append(samples, data)
+		}
+	}
+	if len(samples) < dictMinSamples {
+		LogDebug("Only %d samples on %s, no dictionary trained", len(samples), cr.sub.root)
+		return nil
+	}
+
+	id := reg.nextID()
+	data, err := dict.BuildZstdDict(samples, dict.Options{
+		MaxDictSize: dictSize,
+		HashBytes:   6,
+		ZstdDictID:  id,
+		ZstdLevel:   zstd.EncoderLevelFromZstd(compressionZstdLevel),
+	})
+	if err != nil {
+		return err
+	}
+	if err = reg.add(data, id); err != nil {
+		return err
+	}
+	atomic.AddUint64(&counters.DictTrained, 1)
+	LogInfo("Compression dictionary %d trained on %d chunks of %s", id, len(samples), cr.sub.root)
+	return nil
+}
+
+// Loads the data of the chunk as uploaded, the encrypted chunks skipped
+func (reg *dictRegistry) clearData(cr *chunkRepository, name string) ([]byte, error) {
+	r, err := cr.sub.get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var chunk chunkInfo
+	if err = chunk.loadAttr(r, name); err != nil {
+		return nil, err
+	}
+	if chunk.encryption != "" {
+		return nil, nil
+	}
+	var d *zstdDict
+	if chunk.compressionDict != "" {
+		if d, err = reg.get(chunk.compressionDict); err != nil {
+			return nil, err
+		}
+	}
+	var in io.Reader = r
+	filter, err := makeDecompressor(chunk.compression, d, r)
+	if err != nil {
+		return nil, err
+	} else if filter != nil {
+		defer filter.Close()
+		in = filter
+	}
+	return ioutil.ReadAll(io.LimitReader(in, dictMaxChunkSize))
+}
@@ -0,0 +1,107 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The O_DIRECT write path: the data is accumulated in an aligned buffer and
+written by aligned blocks. Only the unaligned tail of the chunk is written
+through the page cache, once O_DIRECT has been cleared.
+*/
+
+import (
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+const (
+	directIOAlign      = 4096
+	directIOBufferSize = 1024 * 1024
+)
+
+// Allocates a buffer whose address is aligned for O_DIRECT
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+directIOAlign)
+	offset := int(uintptr(unsafe.Pointer(&buf[0])) & (directIOAlign - 1))
+	if offset != 0 {
+		offset = directIOAlign - offset
+	}
+	return buf[offset : offset : offset+size]
+}
+
+// The aligned buffers are recycled apart from the others, to stay aligned
+var directBuffers sync.Pool
+
+func getAlignedBuffer() []byte {
+	if b, ok := directBuffers.Get().(*[]byte); ok {
+		return (*b)[:0]
+	}
+	atomic.AddUint64(&counters.BuffersAllocated, 1)
+	return alignedBuffer(directIOBufferSize)
+}
+
+func (fw *realFileWriter) releaseDirect() {
+	if fw.direct != nil {
+		b := fw.direct[:0]
+		directBuffers.Put(&b)
+		fw.direct = nil
+	}
+}
+
+func (fw *realFileWriter) writeDirect(buffer []byte) (int, error) {
+	total := 0
+	for len(buffer) > 0 {
+		n := copy(fw.direct[len(fw.direct):cap(fw.direct)], buffer)
+		fw.direct = fw.direct[:len(fw.direct)+n]
+		buffer = buffer[n:]
+		total += n
+		if len(fw.direct) == cap(fw.direct) {
+			if _, err := fw.f.Write(fw.direct); err != nil {
+				return total, err
+			}
+			fw.direct = fw.direct[:0]
+		}
+	}
+	return total, nil
+}
+
+// Writes what remains in the buffer: the aligned blocks with O_DIRECT, then
+// the tail through the page cache.
+func (fw *realFileWriter) flushDirectTail() error {
+	aligned := len(fw.direct) &^ (directIOAlign - 1)
+	if aligned > 0 {
+		if _, err := fw.f.Write(fw.direct[:aligned]); err != nil {
+			return err
+		}
+	}
+	if tail := fw.direct[aligned:]; len(tail) > 0 {
+		flags, err := syscall.FcntlInt(fw.f.Fd(), syscall.F_GETFL, 0)
+		if err == nil {
+			_, err = syscall.FcntlInt(fw.f.Fd(), syscall.F_SETFL, flags&^syscall.O_DIRECT)
+		}
+		if err == nil {
+			_, err = fw.f.Write(tail)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	fw.direct = fw.direct[:0]
+	return nil
+}
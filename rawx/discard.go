@@ -0,0 +1,132 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Discard of the space freed by the deleted chunks, so that the flash devices
+keep their write performance under a heavy churn, without mounting the
+volume with the "discard" option:
+
+  - "punch": the blocks of each deleted chunk are deallocated at once, with
+    fallocate(PUNCH_HOLE), when its last link goes away.
+  - "fitrim": the whole volume is trimmed with the FITRIM ioctl, at most once
+    per discard_interval and only after deletions. This requires the
+    CAP_SYS_ADMIN capability.
+*/
+
+import (
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+const (
+	discardOff = iota
+	discardPunch
+	discardTrim
+)
+
+const (
+	discardDefaultInterval = 3600
+
+	// _IOWR('X', 121, struct fstrim_range)
+	ioctlFitrim = 0xc0185879
+)
+
+type fstrimRange struct {
+	start  uint64
+	length uint64
+	minLen uint64
+}
+
+// Unlinks the chunk, then discards its blocks according to the policy
+func (fr *fileRepository) unlinkDiscard(relPath string) error {
+	if fr.s3 != nil {
+		fr.dropOffloaded(relPath)
+	}
+	switch fr.discard {
+	case discardPunch:
+		// The chunk is kept open, its blocks are deallocated once unlinked
+		fd, errOpen := syscall.Openat(fr.rootFd, relPath, openFlagsWOnly, 0)
+		err := syscall.Unlinkat(fr.rootFd, relPath, 0)
+		if errOpen == nil {
+			if err == nil {
+				fr.punch(fd)
+			}
+			syscall.Close(fd)
+		}
+		return err
+	case discardTrim:
+		err := syscall.Unlinkat(fr.rootFd, relPath, 0)
+		if err == nil {
+			atomic.StoreInt32(&fr.discardPending, 1)
+		}
+		return err
+	}
+	return syscall.Unlinkat(fr.rootFd, relPath, 0)
+}
+
+// Deallocates the blocks of a chunk already unlinked, still open
+func (fr *fileRepository) punch(fd int) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil || st.Nlink > 0 || st.Size == 0 {
+		return
+	}
+	err := syscall.Fallocate(fd, syscall.FALLOC_FL_PUNCH_HOLE|syscall.FALLOC_FL_KEEP_SIZE, 0, st.Size)
+	if err != nil {
+		LogDebug("Discard failed on %s: %v", fr.root, err)
+		return
+	}
+	atomic.AddUint64(&counters.DiscardBytes, uint64(st.Size))
+}
+
+// Trims the volume periodically, when chunks have been deleted since the
+// last pass.
+func (fr *fileRepository) startTrimmer(interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			if atomic.SwapInt32(&fr.discardPending, 0) == 0 {
+				continue
+			}
+			if err := fr.trim(); err != nil {
+				LogWarning("FITRIM failed on %s, discard disabled: %v", fr.root, err)
+				return
+			}
+		}
+	}()
+}
+
+func (fr *fileRepository) trim() error {
+	fd, err := syscall.Open(fr.root, syscall.O_DIRECTORY|syscall.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	r := fstrimRange{length: ^uint64(0)}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), ioctlFitrim,
+		uintptr(unsafe.Pointer(&r)))
+	if errno != 0 {
+		return errno
+	}
+	// The kernel tells how many bytes have been trimmed
+	atomic.AddUint64(&counters.DiscardBytes, r.length)
+	LogDebug("Trimmed %d bytes on %s", r.length, fr.root)
+	return nil
+}
@@ -0,0 +1,239 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The Content-Encoding of the GET replies, negotiated with the Accept-Encoding
+of the client, to save the bandwidth of the remote readers (e.g. the
+replication across sites). Only the whole chunks are encoded, the replies
+to a Range stay in identity.
+
+A chunk stored compressed with an algorithm the client accepts is sent as
+stored: zstd (without dictionary) as "zstd", zlib as "deflate". Otherwise,
+with content_encoding, the chunk is compressed on the fly with zstd or gzip,
+by at most content_encoding_workers requests at once: beyond that, or below
+content_encoding_min_size bytes, the chunk is sent in identity.
+
+Every reply of a chunk that could be encoded tells Vary: Accept-Encoding,
+the replies in identity included, so that a cache never serves a coding the
+client didn't ask for. A HEAD tells the coding and the length the GET would
+reply for a chunk sent as stored.
+*/
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	encodingGzip = "gzip"
+	encodingZstd = "zstd"
+	// The zlib format of HTTP, despite its name
+	encodingDeflate = "deflate"
+)
+
+var (
+	contentEncoding        bool
+	contentEncodingMinSize int64 = 1024
+	contentEncodingLevel         = 1
+)
+
+// The slots of the on-the-fly compressions
+var contentEncodingSlots = make(chan struct{}, 4)
+
+func setContentEncodingWorkers(n int) {
+	if n > 0 {
+		contentEncodingSlots = make(chan struct{}, n)
+	}
+}
+
+// Tells if the Accept-Encoding allows the given coding, after its q-value
+func acceptedEncoding(header, coding string) bool {
+	q := -1.0
+	wildcard := -1.0
+	for _, item := range strings.Split(header, ",") {
+		fields := strings.Split(item, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		value := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					value = v
+				}
+			}
+		}
+		if name == coding {
+			q = value
+		} else if name == "*" {
+			wildcard = value
+		}
+	}
+	if q < 0 {
+		q = wildcard
+	}
+	return q > 0
+}
+
+// The coding of the data as stored, when the client accepts it
+func (rr *rawxRequest) storedEncoding(accept string) string {
+	if rr.chunk.encryption != "" || rr.chunk.compressionDict != "" {
+		return ""
+	}
+	coding := ""
+	switch rr.chunk.compression {
+	case compressionZstd:
+		coding = encodingZstd
+	case compressionZlib:
+		coding = encodingDeflate
+	}
+	if coding == "" || !acceptedEncoding(accept, coding) {
+		return ""
+	}
+	return coding
+}
+
+// Tells if the reply depends on the Accept-Encoding of the client
+func (rr *rawxRequest) encodingNegotiable() bool {
+	if rr.storedEncoding("*") != "" {
+		return true
+	}
+	return contentEncoding && rr.chunk.size >= contentEncodingMinSize
+}
+
+// Sets the headers of the chunk sent as stored, tells the length to reply
+func (rr *rawxRequest) fillStoredHeaders(headers http.Header, inChunk fileReader) (int64, bool) {
+	coding := rr.storedEncoding(rr.req.Header.Get("Accept-Encoding"))
+	if coding == "" {
+		return 0, false
+	}
+	size := inChunk.size()
+	headers.Set("Content-Encoding", coding)
+	rr.weakenETag(headers)
+	headers.Set("Content-Length", strconv.FormatInt(size, 10))
+	return size, true
+}
+
+// The coding to apply on the fly, if any
+func (rr *rawxRequest) dynamicEncoding(accept string) string {
+	if !contentEncoding || rr.chunk.size < contentEncodingMinSize {
+		return ""
+	}
+	for _, coding := range []string{encodingZstd, encodingGzip} {
+		if acceptedEncoding(accept, coding) {
+			return coding
+		}
+	}
+	return ""
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func makeEncoder(coding string, out io.Writer) (io.WriteCloser, error) {
+	if coding == encodingZstd {
+		return zstd.NewWriter(out,
+			zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(contentEncodingLevel)),
+			zstd.WithEncoderConcurrency(1))
+	}
+	return gzip.NewWriterLevel(out, contentEncodingLevel)
+}
+
+// Replies the whole chunk as stored, when the client accepts its compression,
+// then tells if it did.
+func (rr *rawxRequest) downloadStored(inChunk fileReader) bool {
+	if rr.storedEncoding(rr.req.Header.Get("Accept-Encoding")) == "" {
+		return false
+	}
+	headers := rr.rep.Header()
+	rr.fillChunkHeaders(headers, inChunk)
+	size, _ := rr.fillStoredHeaders(headers, inChunk)
+	rr.replyCode(http.StatusOK)
+	nb, err := copyPooled(rr.rep, io.LimitReader(inChunk, size))
+	rr.bytesOut = rr.bytesOut + uint64(nb)
+	if err != nil {
+		LogError("Write() error: %s", err)
+	}
+	atomic.AddUint64(&counters.EncodedStored, 1)
+	return true
+}
+
+// Another representation of the chunk, that can't be matched as is
+func (rr *rawxRequest) weakenETag(headers http.Header) {
+	if etag := headers.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		headers.Set("ETag", "W/"+etag)
+	}
+}
+
+// Replies the whole chunk compressed on the fly, then tells if it did. The
+// headers of the chunk are already set, except its length.
+func (rr *rawxRequest) downloadEncoded(in *io.LimitedReader) bool {
+	coding := rr.dynamicEncoding(rr.req.Header.Get("Accept-Encoding"))
+	if coding == "" {
+		return false
+	}
+	select {
+	case contentEncodingSlots <- struct{}{}:
+		defer func() { <-contentEncodingSlots }()
+	default:
+		atomic.AddUint64(&counters.EncodedSkipped, 1)
+		return false
+	}
+
+	cw := &countingWriter{w: rr.rep}
+	enc, err := makeEncoder(coding, cw)
+	if err != nil {
+		LogWarning("Encoder not ready: %v", err)
+		return false
+	}
+	headers := rr.rep.Header()
+	headers.Set("Content-Encoding", coding)
+	rr.weakenETag(headers)
+	rr.replyCode(http.StatusOK)
+
+	if rr.verifiable() && rr.rawx.verifyGet == verifyGetStream {
+		_, err = rr.copyVerified(enc, in)
+		if err == errCorruptedChunk {
+			rr.status = http.StatusInternalServerError
+		}
+	} else {
+		_, err = copyPooled(enc, in)
+	}
+	if err == nil {
+		err = enc.Close()
+	}
+	rr.bytesOut = rr.bytesOut + uint64(cw.n)
+	if err != nil {
+		LogError("Write() error: %s", err)
+	}
+	atomic.AddUint64(&counters.EncodedOnTheFly, 1)
+	return true
+}
@@ -0,0 +1,266 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+At-rest encryption of the chunks, with AES-256-GCM. The data is encrypted
+by segments of 64KiB, each one sealed with its own tag, so that a range can
+be read without decrypting the whole chunk:
+
+	[segment 0 + tag][segment 1 + tag]...[last segment + tag]
+
+Each chunk is encrypted with its own key, derived from the master key and a
+random salt, so that the nonces (the index of the segment) never repeat
+under the same key. The last segment is authenticated as such, a truncated
+chunk is detected. The ID of the master key and the salt are saved in the
+attributes of the chunk.
+
+The encryption applies to the data as stored, i.e. after its compression.
+*/
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+)
+
+const (
+	encryptionAes256Gcm = "aes-256-gcm"
+
+	encryptionSegmentSize = 64 * 1024
+	encryptionTagSize     = 16
+	encryptionSaltSize    = 16
+)
+
+var (
+	errEncryptionNotManaged = errors.New("Encryption mode not managed")
+	errUnknownKey           = errors.New("Unknown encryption key")
+	errCorruptedSegment     = errors.New("Corrupted encrypted segment")
+)
+
+// Where the master keys come from, nil when the encryption is disabled.
+// The new chunks are only encrypted when encryptNewChunks is set, the
+// chunks already encrypted remain readable otherwise.
+var keyProvider KeyProvider
+var encryptNewChunks = false
+
+// Prepares the cipher of a chunk, from its salt
+func makeChunkAEAD(master, salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte("oio-rawx chunk key"))
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func segmentNonce(nonce []byte, index uint64) []byte {
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], index)
+	return nonce
+}
+
+// The additional data tells if the segment is the last one
+func segmentAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// Prepares the encryption of a new chunk, then saves in its attributes how
+// to decrypt it.
+func (chunk *chunkInfo) makeEncrypter(out io.Writer) (*chunkEncrypter, error) {
+	salt := make([]byte, encryptionSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	keyID, master, err := keyProvider.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := makeChunkAEAD(master, salt)
+	if err != nil {
+		return nil, err
+	}
+	chunk.encryption = encryptionAes256Gcm
+	chunk.encryptionKey = keyID
+	chunk.encryptionSalt = hex.EncodeToString(salt)
+	return &chunkEncrypter{
+		aead:  aead,
+		out:   out,
+		nonce: make([]byte, aead.NonceSize()),
+		plain: make([]byte, 0, encryptionSegmentSize),
+		seal:  make([]byte, 0, encryptionSegmentSize+encryptionTagSize),
+	}, nil
+}
+
+type chunkEncrypter struct {
+	aead  cipher.AEAD
+	out   io.Writer
+	nonce []byte
+	index uint64
+	plain []byte
+	seal  []byte
+}
+
+func (ce *chunkEncrypter) flush(last bool) error {
+	ce.seal = ce.aead.Seal(ce.seal[:0], segmentNonce(ce.nonce, ce.index),
+		ce.plain, segmentAD(last))
+	ce.index++
+	ce.plain = ce.plain[:0]
+	_, err := ce.out.Write(ce.seal)
+	return err
+}
+
+// A full segment is only sealed once more data comes, the last segment
+// is sealed upon Close()
+func (ce *chunkEncrypter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(ce.plain) == cap(ce.plain) {
+			if err := ce.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(ce.plain[len(ce.plain):cap(ce.plain)], p)
+		ce.plain = ce.plain[:len(ce.plain)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (ce *chunkEncrypter) Close() error {
+	return ce.flush(true)
+}
+
+// Prepares the decryption of a chunk, from its attributes. A nil reader is
+// returned for a chunk stored in clear.
+func (chunk *chunkInfo) makeDecrypter(in fileReader) (*chunkDecrypter, error) {
+	switch chunk.encryption {
+	case "":
+		return nil, nil
+	case encryptionAes256Gcm:
+	default:
+		return nil, errEncryptionNotManaged
+	}
+	salt, err := hex.DecodeString(chunk.encryptionSalt)
+	if err != nil {
+		return nil, errCorruptedSegment
+	}
+	if keyProvider == nil {
+		return nil, errUnknownKey
+	}
+	master, err := keyProvider.Key(chunk.encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := makeChunkAEAD(master, salt)
+	if err != nil {
+		return nil, err
+	}
+	sealed := int64(encryptionSegmentSize + encryptionTagSize)
+	// Even an empty chunk holds its last segment, a tag alone: a chunk
+	// truncated down to nothing is detected as any other truncation.
+	segments := uint64((in.size() + sealed - 1) / sealed)
+	if segments == 0 {
+		segments = 1
+	}
+	return &chunkDecrypter{
+		aead:     aead,
+		in:       in,
+		nonce:    make([]byte, aead.NonceSize()),
+		segments: segments,
+		seal:     make([]byte, sealed),
+		plain:    make([]byte, 0, encryptionSegmentSize),
+	}, nil
+}
+
+type chunkDecrypter struct {
+	aead     cipher.AEAD
+	in       fileReader
+	nonce    []byte
+	index    uint64
+	segments uint64
+	seal     []byte
+	// The decrypted segment, and what remains to be read from it
+	plain []byte
+	avail []byte
+}
+
+func (cd *chunkDecrypter) next() error {
+	if cd.index >= cd.segments {
+		return io.EOF
+	}
+	n, err := io.ReadFull(cd.in, cd.seal)
+	last := cd.index == cd.segments-1
+	if err == io.ErrUnexpectedEOF && last {
+		err = nil
+	}
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	cd.plain, err = cd.aead.Open(cd.plain[:0], segmentNonce(cd.nonce, cd.index),
+		cd.seal[:n], segmentAD(last))
+	if err != nil {
+		return errCorruptedSegment
+	}
+	cd.index++
+	cd.avail = cd.plain
+	return nil
+}
+
+func (cd *chunkDecrypter) Read(p []byte) (int, error) {
+	for len(cd.avail) == 0 {
+		if err := cd.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, cd.avail)
+	cd.avail = cd.avail[n:]
+	return n, nil
+}
+
+// Positions the reader on an offset of the clear data
+func (cd *chunkDecrypter) seek(offset int64) error {
+	cd.index = uint64(offset / encryptionSegmentSize)
+	cd.avail = nil
+	if err := cd.in.seek(int64(cd.index) * int64(len(cd.seal))); err != nil {
+		return err
+	}
+	if skip := offset % encryptionSegmentSize; skip > 0 {
+		if err := cd.next(); err != nil {
+			return err
+		}
+		if int64(len(cd.avail)) < skip {
+			return io.ErrUnexpectedEOF
+		}
+		cd.avail = cd.avail[skip:]
+	}
+	return nil
+}
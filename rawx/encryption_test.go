@@ -0,0 +1,149 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// A chunk held in memory
+type memReader struct {
+	*bytes.Reader
+}
+
+func (r memReader) Close() error                                  { return nil }
+func (r memReader) File() *os.File                                { return nil }
+func (r memReader) size() int64                                   { return r.Size() }
+func (r memReader) getAttr(key string, value []byte) (int, error) { return 0, os.ErrNotExist }
+func (r memReader) readAhead(offset int64) int64                  { return 0 }
+func (r memReader) mapping() []byte                               { return nil }
+func (r memReader) throttle(n int64) bool                         { return false }
+
+func (r memReader) seek(offset int64) error {
+	_, err := r.Seek(offset, io.SeekStart)
+	return err
+}
+
+func encryptTestChunk(t *testing.T, chunk *chunkInfo, plain []byte) []byte {
+	sealed := bytes.Buffer{}
+	enc, err := chunk.makeEncrypter(&sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = enc.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err = enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return sealed.Bytes()
+}
+
+func TestEncryptionSegments(t *testing.T) {
+	defer func(provider KeyProvider) { keyProvider = provider }(keyProvider)
+	keyProvider = &fileKeyProvider{
+		keys:    map[string][]byte{"k1": bytes.Repeat([]byte{0x42}, 32)},
+		current: "k1",
+	}
+
+	const seg = encryptionSegmentSize
+	sizes := []int{0, 1, seg - 1, seg, seg + 1, 2 * seg, 2*seg + 5}
+	for _, size := range sizes {
+		plain := make([]byte, size)
+		for i := range plain {
+			plain[i] = byte(i * 7)
+		}
+		chunk := chunkInfo{}
+		sealed := encryptTestChunk(t, &chunk, plain)
+		segments := (size + seg) / seg
+		if size > 0 && size%seg == 0 {
+			segments = size / seg
+		}
+		if expected := size + segments*encryptionTagSize; len(sealed) != expected {
+			t.Errorf("%d bytes: %d sealed, expected %d", size, len(sealed), expected)
+			continue
+		}
+
+		// From each offset around the boundaries of the segments
+		offsets := []int{0, 1, seg - 1, seg, seg + 1, 2*seg - 1, 2 * seg, size - 1, size}
+		for _, offset := range offsets {
+			if offset < 0 || offset > size {
+				continue
+			}
+			dec, err := chunk.makeDecrypter(memReader{bytes.NewReader(sealed)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = dec.seek(int64(offset)); err != nil {
+				t.Errorf("%d bytes, seek(%d): error %v", size, offset, err)
+				continue
+			}
+			got, err := ioutil.ReadAll(dec)
+			if err != nil {
+				t.Errorf("%d bytes from %d: error %v", size, offset, err)
+			} else if !bytes.Equal(got, plain[offset:]) {
+				t.Errorf("%d bytes from %d: %d bytes read, wrong data", size, offset, len(got))
+			}
+		}
+
+		// A chunk missing its last segment, or altered, is detected
+		truncated := sealed[:(segments-1)*(seg+encryptionTagSize)]
+		dec, _ := chunk.makeDecrypter(memReader{bytes.NewReader(truncated)})
+		if _, err := ioutil.ReadAll(dec); err == nil {
+			t.Errorf("%d bytes, truncated: no error", size)
+		}
+		altered := append([]byte{}, sealed...)
+		altered[len(altered)-1] ^= 1
+		dec, _ = chunk.makeDecrypter(memReader{bytes.NewReader(altered)})
+		if _, err := ioutil.ReadAll(dec); err != errCorruptedSegment {
+			t.Errorf("%d bytes, altered: error %v", size, err)
+		}
+	}
+}
+
+func TestMakeDecrypter(t *testing.T) {
+	defer func(provider KeyProvider) { keyProvider = provider }(keyProvider)
+	keyProvider = &fileKeyProvider{keys: map[string][]byte{"k1": make([]byte, 32)}}
+
+	cases := []struct {
+		name  string
+		chunk chunkInfo
+		clear bool
+		err   error
+	}{
+		{"clear", chunkInfo{}, true, nil},
+		{"unknown mode", chunkInfo{encryption: "rot13"}, false, errEncryptionNotManaged},
+		{"unknown key", chunkInfo{encryption: encryptionAes256Gcm, encryptionKey: "k2"},
+			false, errUnknownKey},
+		{"bad salt", chunkInfo{encryption: encryptionAes256Gcm, encryptionKey: "k1",
+			encryptionSalt: "salt"}, false, errCorruptedSegment},
+		{"known key", chunkInfo{encryption: encryptionAes256Gcm, encryptionKey: "k1",
+			encryptionSalt: "00112233445566778899aabbccddeeff"}, false, nil},
+	}
+	for _, tc := range cases {
+		dec, err := tc.chunk.makeDecrypter(memReader{bytes.NewReader(nil)})
+		if err != tc.err {
+			t.Errorf("%s: error %v, expected %v", tc.name, err, tc.err)
+		} else if err == nil && (dec == nil) != tc.clear {
+			t.Errorf("%s: decrypter %v", tc.name, dec)
+		}
+	}
+}
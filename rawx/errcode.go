@@ -0,0 +1,136 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The failures are replied with a JSON body telling a stable code, along with
+a message for the humans and the ID of the request, so that the SDK and the
+proxy branch on the precise cause of the failure rather than on its status:
+
+	{"status": 507, "code": "no_space", "message": "Insufficient storage",
+	 "request_id": "..."}
+
+The codes never change once released, the messages might. The unexpected
+errors are only told by their status, without any detail. The replies to a
+HEAD, and the failures already replied with a body of their own (e.g. the
+text of /info), have no such body.
+*/
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type errorReply struct {
+	Status    int    `json:"status"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// The stable codes of the known errors
+var errorCodes = map[error]string{
+	errInvalidChunkID:        "invalid_chunk_id",
+	errMissingHeader:         "missing_header",
+	errInvalidHeader:         "invalid_header",
+	errChecksumMismatch:      "bad_hash",
+	errContentLength:         "invalid_content_length",
+	errCompressionNotManaged: "compression_not_managed",
+	errInvalidRange:          "range_not_satisfiable",
+	errListMarker:            "invalid_marker",
+	errListPrefix:            "invalid_prefix",
+	errChunkTooLarge:         "chunk_too_large",
+	errTxnTooLarge:           "transaction_too_large",
+	errQuotaExceeded:         "quota_exceeded",
+	errInsufficientStorage:   "no_space",
+	errAuthMissing:           "auth_required",
+	errAuthForbidden:         "token_forbidden",
+	errAdminDisabled:         "admin_disabled",
+	errACLDenied:             "network_forbidden",
+	errSignatureMissing:      "signature_required",
+	errSignatureInvalid:      "bad_signature",
+	errSignatureExpired:      "signature_expired",
+	errDeadlineExceeded:      "deadline_exceeded",
+	errRateLimited:           "rate_limited",
+	errTooBusy:               "too_busy",
+	errUnderPressure:         "under_pressure",
+	errAppendUnsupported:     "append_unsupported",
+	errPreconditionFailed:    "precondition_failed",
+	errVolumeReadOnly:        "read_only",
+	errVolumeDown:            "volume_down",
+	errMaintenance:           "maintenance",
+	errCorruptedChunk:        "corrupted_chunk",
+}
+
+// The code and the message of the error, empty when it isn't known
+func describeError(err error) (string, string) {
+	if code, ok := errorCodes[err]; ok {
+		return code, err.Error()
+	}
+	switch {
+	case os.IsExist(err):
+		return "chunk_exists", "Chunk already exists"
+	case os.IsNotExist(err):
+		return "chunk_not_found", "Chunk not found"
+	case os.IsPermission(err):
+		return "permission_denied", "Permission denied"
+	case isNoSpace(err):
+		return "no_space", "Insufficient storage"
+	case isIOError(err):
+		return "io_error", "IO error on the volume"
+	}
+	return "", ""
+}
+
+// The code of a failure only known by its status, e.g. "method_not_allowed"
+func statusCode(status int) string {
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+// Replies the failure with its JSON body
+func (rr *rawxRequest) replyFailure(status int) {
+	headers := rr.rep.Header()
+	if rr.req.Method == "HEAD" || headers.Get("Content-Type") != "" {
+		rr.rep.WriteHeader(status)
+		return
+	}
+
+	code, message := describeError(rr.failure)
+	if code == "" {
+		code = statusCode(status)
+	}
+	if message == "" {
+		message = headers.Get(HeaderNameError)
+	}
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	body, _ := json.Marshal(errorReply{
+		Status:    status,
+		Code:      code,
+		Message:   message,
+		RequestID: rr.reqid,
+	})
+	headers.Set("Content-Type", "application/json")
+	headers.Set("Content-Length", strconv.Itoa(len(body)))
+	rr.rep.WriteHeader(status)
+	rr.rep.Write(body)
+	rr.bytesOut += uint64(len(body))
+}
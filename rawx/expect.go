@@ -0,0 +1,87 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The requests with an "Expect: 100-continue". The server only sends the
+"100 Continue" upon the first read of the body, so the upload is validated
+before: the chunk ID, the authentication and the signature, the headers, the
+size announced, the compression asked, the quota of the container and the room left on the
+volume. A request refused then gets its final status without its body being
+read: the connection is closed instead of drained, the client doesn't send
+a body bound to be discarded.
+*/
+
+import (
+	"io"
+	"strings"
+)
+
+// Tells when the body of the request starts being read
+type continueBody struct {
+	io.ReadCloser
+	read *bool
+}
+
+func (b *continueBody) Read(p []byte) (int, error) {
+	*b.read = true
+	return b.ReadCloser.Read(p)
+}
+
+func (rr *rawxRequest) expectContinue() bool {
+	return strings.EqualFold(rr.req.Header.Get("Expect"), "100-continue")
+}
+
+// Watches the body of the requests awaiting a "100 Continue"
+func (rr *rawxRequest) watchContinue() {
+	if rr.expectContinue() && rr.req.Body != nil {
+		rr.req.Body = &continueBody{ReadCloser: rr.req.Body, read: &rr.bodyRead}
+	}
+}
+
+// Tells if the body is still held by the client, then it isn't drained
+func (rr *rawxRequest) bodyHeld() bool {
+	if rr.bodyRead || !rr.expectContinue() {
+		return false
+	}
+	rr.req.Close = true
+	return true
+}
+
+// The checks of an upload that don't need its body
+func (rr *rawxRequest) validateUpload() error {
+	if err := rr.chunk.retrieveHeaders(&rr.req.Header, rr.chunkID); err != nil {
+		return err
+	}
+	if err := rr.capUpload(0); err != nil {
+		return err
+	}
+	if _, err := rr.compressionAlgorithm(); err != nil {
+		return err
+	}
+	if idx := rr.quotas(); idx != nil {
+		if err := idx.check(rr.chunk.ContainerID, rr.req.ContentLength); err != nil {
+			return err
+		}
+	}
+	if repo, ok := rr.rawx.repo.(*chunkRepository); ok && rr.req.ContentLength > 0 {
+		if u, err := repo.sub.usage(); err == nil && uint64(rr.req.ContentLength) > u.bytesFree {
+			return errInsufficientStorage
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Exports the manifest of the chunks held by the volume, as a gzip-compressed
+CSV document, either in a local file or uploaded to a HTTP endpoint. This
+allows the capacity planning tools to work without crawling the volumes.
+*/
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var exportHeader = []string{
+	"chunk_id", "chunk_size", "mtime", "storage_policy", "container_id",
+}
+
+// Opens the destination of the export: a local file that must not exist
+// yet, or a URL the document will be PUT to. The returned function ends the
+// export, given the error it met if any: on error, the partial file is
+// removed, or the upload is aborted so that no truncated document is stored.
+func openExport(dest string) (io.Writer, func(error) error, error) {
+	if !strings.HasPrefix(dest, "http://") && !strings.HasPrefix(dest, "https://") {
+		f, err := os.OpenFile(dest, os.O_CREATE|os.O_EXCL|os.O_WRONLY, putOpenMode)
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, func(err error) error {
+			if errClose := f.Close(); err == nil {
+				err = errClose
+			}
+			if err != nil {
+				_ = os.Remove(dest)
+			}
+			return err
+		}, nil
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := func() error {
+			req, err := http.NewRequest("PUT", dest, pr)
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Content-Type", "text/csv")
+			req.Header.Set("Content-Encoding", "gzip")
+			rep, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return err
+			}
+			_, _ = io.Copy(ioutil.Discard, rep.Body)
+			_ = rep.Body.Close()
+			if rep.StatusCode/100 != 2 {
+				return errors.New("Upload failed: " + rep.Status)
+			}
+			return nil
+		}()
+		// Unblock the writer if the upload stopped early
+		pr.CloseWithError(err)
+		done <- err
+	}()
+	return pw, func(err error) error {
+		// The body ends with an error, the request fails instead of
+		// storing a truncated document
+		if err != nil {
+			pw.CloseWithError(err)
+		} else {
+			err = pw.Close()
+		}
+		if errWait := <-done; err == nil {
+			err = errWait
+		}
+		return err
+	}, nil
+}
+
+func exportChunks(repo *chunkRepository, dest string) error {
+	out, finish, err := openExport(dest)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(out)
+	w := csv.NewWriter(gz)
+	_ = w.Write(exportHeader)
+
+	var count, failed uint64
+	err = repo.sub.walkAll(func(name, relPath string, fi os.FileInfo) error {
+		chunk := chunkInfo{}
+		if err := repo.loadInfo(name, &chunk); err != nil {
+			LogWarning("Export: failed to load chunk %s: %v", name, err)
+			failed++
+			return nil
+		}
+		count++
+		return w.Write([]string{
+			name,
+			strconv.FormatInt(chunk.size, 10),
+			strconv.FormatInt(fi.ModTime().Unix(), 10),
+			chunk.ContentStgPol,
+			chunk.ContainerID,
+		})
+	})
+
+	w.Flush()
+	if err == nil {
+		err = w.Error()
+	}
+	if errClose := gz.Close(); err == nil {
+		err = errClose
+	}
+	if err = finish(err); err != nil {
+		return err
+	}
+	LogInfo("Export: %d chunks exported, %d failures", count, failed)
+	return nil
+}
@@ -19,9 +19,15 @@ package main
 import (
 	"bytes"
 	"errors"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	syscall "golang.org/x/sys/unix"
 )
@@ -34,17 +40,88 @@ const (
 )
 
 type fileRepository struct {
-	root            string
-	rootFd          int
-	putOpenMode     uint32
-	putMkdirMode    os.FileMode
-	hashWidth       int
-	hashDepth       int
-	syncFile        bool
-	syncDir         bool
-	fallocateFile   bool
+	root         string
+	rootFd       int
+	putOpenMode  uint32
+	putMkdirMode os.FileMode
+	hashWidth    int
+	hashDepth    int
+	syncFile     bool
+	syncDir      bool
+	// Set when the syncs of the uploads are grouped
+	syncGroup       *syncGroup
+	fallocate       int
+	fallocateExtent int64
 	fadviseUpload   int
 	fadviseDownload int
+	directUpload    bool
+	// The chunks of at least readaheadMinSize bytes are read ahead by
+	// readaheadWindow bytes upon GET.
+	readaheadWindow  int64
+	readaheadMinSize int64
+	// The chunks from mmapMinSize to mmapMaxSize bytes are mapped upon GET
+	mmapMinSize int64
+	mmapMaxSize int64
+	// The bandwidth caps of the volume, nil when unlimited
+	readBandwidth  *tokenBucket
+	writeBandwidth *tokenBucket
+	// The state of the volume, as told by its health probes, and the IO
+	// errors met since the last probe.
+	health            int32
+	ioErrors          uint32
+	healthMaxIOErrors int
+	// Turned read-only by an operator, whatever its health, cf. admin.go
+	readOnly int32
+	// In maintenance by the configuration or an operator, and whether
+	// its marker file was there when last checked, cf. maintenance.go
+	maintenance   int32
+	markerPresent int32
+	markerChecked int64
+	// The object store where the cold chunks are offloaded, if any, and
+	// if the chunks fetched from there are restored on the volume.
+	s3        *s3Store
+	rehydrate bool
+	// The attributes are saved in sidecar files instead of xattr
+	sidecar bool
+	// The new chunks embed their attributes in a header (format 2)
+	header bool
+	// The former layout of the chunks, set while they are migrated
+	migrateFrom *hashLayout
+	// The percents of bytes and of inodes used, above which the new chunks
+	// are refused until the usage goes below the low watermark.
+	bytesWatermark  watermark
+	inodesWatermark watermark
+	full            int32
+	usageCache      usageCache
+	// How the space freed by the deletions is discarded
+	discard        int
+	discardPending int32
+	// How the chunks are copied, and if the reflinks failed
+	copyMode  int
+	noReflink int32
+	// How long the deleted chunks stay in the trash, 0 to unlink them
+	trashRetention time.Duration
+	movedRetention time.Duration
+	// The small chunks packed in slabs, nil when never enabled
+	slabs *slabStore
+	// The journal of the uploads in progress, nil when disabled
+	journal *uploadJournal
+	// The temporary files of the uploads in progress
+	pending pendingUploads
+	// The identical chunks are linked to a single file
+	dedup bool
+	// The blocks of zeros uploaded are left as holes
+	sparse bool
+	// Held exclusively while a snapshot of the volume is taken, the
+	// renames and the deletions hold it shared.
+	frozen sync.RWMutex
+	// Tells when the device of the volume is under pressure, nil when
+	// not monitored
+	pressure *ioPressure
+
+	// Optional watcher of the out-of-band modifications, to be told about
+	// the modifications performed by the service itself.
+	watcher *volumeWatcher
 }
 
 func (fr *fileRepository) init(root string) error {
@@ -60,9 +137,12 @@ func (fr *fileRepository) init(root string) error {
 	fr.putMkdirMode = putMkdirMode
 	fr.syncFile = configDefaultSyncFile
 	fr.syncDir = configDefaultSyncDir
-	fr.fallocateFile = configDefaultFallocate
+	fr.fallocate = configDefaultFallocate
+	fr.fallocateExtent = uploadExtensionSize
 	fr.fadviseUpload = configDefaultFadviseUpload
 	fr.fadviseDownload = configDefaultFadviseDownload
+	fr.directUpload = configDefaultDirectUpload
+	fr.readaheadMinSize = defaultReadaheadMinSize
 
 	if fr.rootFd, err = syscall.Open(fr.root, syscall.O_DIRECTORY|syscall.O_PATH|openFlagsROnly, 0); err != nil {
 		return err
@@ -71,39 +151,154 @@ func (fr *fileRepository) init(root string) error {
 }
 
 func (fr *fileRepository) getAttr(name, key string, value []byte) (int, error) {
-	absPath := fr.root + "/" + fr.nameToRelPath(name)
-	return syscall.Getxattr(absPath, key, value)
+	if e := fr.slabEntry(name); e != nil {
+		return e.attrs.get(key, value)
+	}
+	return fr.getRelAttr(fr.locate(name), key, value)
+}
+
+func (fr *fileRepository) getRelAttr(relPath, key string, value []byte) (int, error) {
+	if fr.header {
+		meta, err := fr.relHeader(relPath)
+		if err != nil {
+			return 0, err
+		} else if meta != nil {
+			return meta.get(key, value)
+		}
+	}
+	if fr.sidecar {
+		meta, err := fr.loadSidecar(relPath)
+		if err != nil {
+			return 0, err
+		}
+		return meta.get(key, value)
+	}
+	return syscall.Getxattr(fr.root+"/"+relPath, key, value)
+}
+
+// Sets an attribute of a chunk already committed
+func (fr *fileRepository) setAttr(name, key, value string) error {
+	if fr.slabEntry(name) != nil {
+		return fr.slabs.update(name, func(attrs sidecar) { attrs[key] = value })
+	}
+	relPath := fr.locate(name)
+	if fr.header {
+		ok, err := fr.updateHeader(relPath, func(meta sidecar) { meta[key] = value })
+		if ok || err != nil {
+			return err
+		}
+	}
+	if !fr.sidecar {
+		return syscall.Setxattr(fr.root+"/"+relPath, key, []byte(value), 0)
+	}
+	meta, err := fr.loadSidecar(relPath)
+	if err != nil {
+		return err
+	}
+	meta[key] = value
+	return fr.saveSidecar(relPath, meta)
+}
+
+func (fr *fileRepository) removeAttr(name, key string) error {
+	if e := fr.slabEntry(name); e != nil {
+		if _, ok := e.attrs[key]; !ok {
+			return syscall.ENODATA
+		}
+		return fr.slabs.update(name, func(attrs sidecar) { delete(attrs, key) })
+	}
+	relPath := fr.locate(name)
+	if fr.header {
+		var err error
+		ok, errHeader := fr.updateHeader(relPath, func(meta sidecar) {
+			if _, present := meta[key]; !present {
+				err = syscall.ENODATA
+			}
+			delete(meta, key)
+		})
+		if errHeader != nil {
+			return errHeader
+		} else if ok {
+			return err
+		}
+	}
+	if !fr.sidecar {
+		return syscall.Removexattr(fr.root+"/"+relPath, key)
+	}
+	meta, err := fr.loadSidecar(relPath)
+	if err != nil {
+		return err
+	}
+	delete(meta, key)
+	return fr.saveSidecar(relPath, meta)
 }
 
 func (fr *fileRepository) lock(ns, id string) error {
 	var err error
-	err = setOrHasXattr(fr.root, "user.server.id", id)
+	err = fr.setOrHasAttr("user.server.id", id)
 	if err != nil {
 		return err
 	}
-	err = setOrHasXattr(fr.root, "user.server.ns", ns)
+	err = fr.setOrHasAttr("user.server.ns", ns)
 	if err != nil {
 		return err
 	}
-	err = setOrHasXattr(fr.root, "user.server.type", "rawx")
+	err = fr.setOrHasAttr("user.server.type", "rawx")
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// Declares the chunk is about to be modified by the service itself
+func (fr *fileRepository) expect(name string) {
+	if fr.watcher != nil {
+		fr.watcher.expect(name)
+	}
+}
+
 func (fr *fileRepository) del(name string) error {
-	relPath := fr.nameToRelPath(name)
+	fr.expect(name)
+	if fr.slabEntry(name) != nil {
+		return fr.slabs.del(name)
+	}
+	relPath := fr.locate(name)
+
+	// The trashed chunk keeps its attributes, to be restored as is
+	if fr.trashRetention > 0 {
+		return fr.trash(name, relPath)
+	}
+	return fr.unlink(name, relPath)
+}
+
+// Deletes the chunk for good, whatever the trash retention, e.g. when
+// another copy of the chunk remains.
+func (fr *fileRepository) remove(name string) error {
+	fr.expect(name)
+	if fr.slabEntry(name) != nil {
+		return fr.slabs.del(name)
+	}
+	return fr.unlink(name, fr.locate(name))
+}
+
+func (fr *fileRepository) unlink(name, relPath string) error {
 	absPath := fr.root + "/" + relPath
 	xattrName := AttrNameFullPrefix + name
 
 	var err error
-	err = syscall.Removexattr(absPath, xattrName)
-	if err != nil {
-		LogWarning("Failed to remove xattr %s on %s: %s", xattrName, absPath, err.Error())
-		err = nil
+	// A chunk in the format 2 keeps its attributes in its header
+	if !fr.sidecar && !(fr.header && fr.unshareHeader(relPath, xattrName)) {
+		err = syscall.Removexattr(absPath, xattrName)
+		if err != nil {
+			LogWarning("Failed to remove xattr %s on %s: %s", xattrName, absPath, err.Error())
+			err = nil
+		}
+	}
+	err = fr.unlinkDiscard(relPath)
+	if err == nil && fr.sidecar {
+		if errMeta := fr.removeSidecar(relPath); errMeta != nil {
+			LogWarning("Failed to remove the sidecar of %s: %s", absPath, errMeta)
+		}
 	}
-	err = syscall.Unlinkat(fr.rootFd, relPath, 0)
 	if err != nil && fr.syncDir {
 		LogWarning("Failed to remove chunk (was %s) %s: %s", xattrName, absPath, err.Error())
 		dir := filepath.Dir(relPath)
@@ -112,6 +307,108 @@ func (fr *fileRepository) del(name string) error {
 	return err
 }
 
+// Moves the chunk into the quarantine directory of the volume. Its
+// attributes are saved in a sidecar, along with the reason of the
+// quarantine, whatever the store of the attributes. The directory starts
+// with a dot, so that it is neither walked nor watched.
+func (fr *fileRepository) quarantine(name, reason string) error {
+	fr.expect(name)
+	if err := syscall.Mkdirat(fr.rootFd, quarantineDir, uint32(fr.putMkdirMode)); err != nil && err != syscall.EEXIST {
+		return err
+	}
+	if fr.slabEntry(name) != nil {
+		return fr.slabs.quarantine(name, reason)
+	}
+	relPath := fr.locate(name)
+	fd, err := syscall.Openat(fr.rootFd, relPath, openFlagsROnly, 0)
+	if err != nil {
+		return err
+	}
+	r := &realFileReader{f: os.NewFile(uintptr(fd), relPath), repo: fr}
+	attrs, err := r.attrs()
+	r.Close()
+	if err != nil {
+		LogWarning("Attributes of the quarantined chunk %s lost: %v", name, err)
+	}
+
+	meta := make(sidecar)
+	for k, v := range attrs {
+		meta[k] = string(v)
+	}
+	meta[AttrNameQuarantineReason] = reason
+	meta[AttrNameQuarantineTime] = strconv.FormatInt(time.Now().Unix(), 10)
+	dest := quarantineDir + "/" + name
+	if err = fr.saveSidecar(dest, meta); err != nil {
+		return err
+	}
+	if err = syscall.Renameat(fr.rootFd, relPath, fr.rootFd, dest); err != nil {
+		_ = fr.removeSidecar(dest)
+		return err
+	}
+	if fr.sidecar {
+		_ = fr.removeSidecar(relPath)
+	}
+	return nil
+}
+
+type quarantinedChunk struct {
+	ChunkID string            `json:"chunk_id"`
+	Volume  string            `json:"volume"`
+	Size    int64             `json:"size"`
+	Reason  string            `json:"reason,omitempty"`
+	Time    int64             `json:"time,omitempty"`
+	Attrs   map[string]string `json:"attrs,omitempty"`
+}
+
+func (fr *fileRepository) quarantined() ([]quarantinedChunk, error) {
+	entries, err := ioutil.ReadDir(fr.root + "/" + quarantineDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var chunks []quarantinedChunk
+	for _, fi := range entries {
+		if !fi.Mode().IsRegular() || !isHexaString(fi.Name(), 64) {
+			continue
+		}
+		chunk := quarantinedChunk{
+			ChunkID: fi.Name(),
+			Volume:  fr.root,
+			Size:    fi.Size(),
+			Time:    fi.ModTime().Unix(),
+		}
+		if meta, err := fr.loadSidecar(quarantineDir + "/" + fi.Name()); err == nil {
+			chunk.Reason = meta[AttrNameQuarantineReason]
+			if t, err := strconv.ParseInt(meta[AttrNameQuarantineTime], 10, 64); err == nil {
+				chunk.Time = t
+			}
+			delete(meta, AttrNameQuarantineReason)
+			delete(meta, AttrNameQuarantineTime)
+			chunk.Attrs = meta
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, nil
+}
+
+func (fr *fileRepository) exists(name string) bool {
+	if fr.slabEntry(name) != nil {
+		return true
+	}
+	return syscall.Faccessat(fr.rootFd, fr.locate(name), syscall.F_OK, 0) == nil
+}
+
+// Marks the chunk as accessed. The chunks are opened with O_NOATIME, the
+// access time is only maintained for the tiering.
+func (fr *fileRepository) touch(name string) {
+	ts := []syscall.Timespec{
+		syscall.NsecToTimespec(time.Now().UnixNano()),
+		{Nsec: syscall.UTIME_OMIT},
+	}
+	_ = syscall.UtimesNanoAt(fr.rootFd, fr.locate(name), ts, 0)
+}
+
 func (fr *fileRepository) getRelPath(path string) (fileReader, error) {
 	fd, err := syscall.Openat(fr.rootFd, path, openFlagsROnly, 0)
 	if err != nil {
@@ -119,29 +416,54 @@ func (fr *fileRepository) getRelPath(path string) (fileReader, error) {
 	}
 
 	f := &realFileReader{f: os.NewFile(uintptr(fd), path), repo: fr}
+	if fr.header {
+		meta, err := fr.readHeader(fd, path)
+		if err == nil && meta != nil {
+			f.meta, f.base = meta, chunkHeaderSize
+			err = f.seek(0)
+		}
+		if err != nil {
+			f.f.Close()
+			return nil, err
+		}
+	}
 
+	// FADV_DONTNEED is issued upon Close(), once the pages have been served
 	switch fr.fadviseDownload {
-	case configFadviseNone:
-	case configFadviseYes:
+	case configFadviseNone, configFadviseNocache:
+	case configFadviseYes, configFadviseStream:
 		syscall.Fadvise(fd, 0, f.size(), syscall.FADV_SEQUENTIAL)
-	case configFadviseNocache:
-		syscall.Fadvise(fd, 0, f.size(), syscall.FADV_DONTNEED)
 	case configFadviseCache:
 		syscall.Fadvise(fd, 0, f.size(), syscall.FADV_SEQUENTIAL)
 		syscall.Fadvise(fd, 0, f.size(), syscall.FADV_WILLNEED)
 	}
+	if fr.readaheadWindow > 0 {
+		f.window = fr.readaheadFor(f.size())
+	}
 
 	return f, nil
 }
 
 func (fr *fileRepository) get(name string) (fileReader, error) {
-	path := fr.nameToRelPath(name)
+	if e := fr.slabEntry(name); e != nil {
+		return fr.slabs.open(e)
+	}
+	path := fr.locate(name)
 	return fr.getRelPath(path)
 }
 
 func (fr *fileRepository) putRelPath(path string) (fileWriter, error) {
-	pathTemp := path + ".pending"
-	fd, err := syscall.Openat(fr.rootFd, pathTemp, syscall.O_CREAT|syscall.O_EXCL|openFlagsWOnly, fr.putOpenMode)
+	pathTemp := path + pendingSuffix
+	flags := syscall.O_CREAT | syscall.O_EXCL | openFlagsWOnly
+	if fr.directUpload {
+		flags |= syscall.O_DIRECT
+	}
+	fd, err := syscall.Openat(fr.rootFd, pathTemp, flags, fr.putOpenMode)
+	if err == syscall.EINVAL && fr.directUpload {
+		// O_DIRECT not supported by the filesystem
+		flags &^= syscall.O_DIRECT
+		fd, err = syscall.Openat(fr.rootFd, pathTemp, flags, fr.putOpenMode)
+	}
 	if err != nil {
 		if os.IsNotExist(err) {
 			// Lazy dir creation
@@ -161,14 +483,40 @@ func (fr *fileRepository) putRelPath(path string) (fileWriter, error) {
 		return nil, os.ErrExist
 	}
 
-	return &realFileWriter{
+	fw := &realFileWriter{
 		f:         os.NewFile(uintptr(fd), pathTemp),
 		pathFinal: path, pathTemp: pathTemp, repo: fr,
-		allocated: 0, written: 0}, nil
+		allocated: 0, written: 0}
+	fr.pending.add(pathTemp)
+	// The space preallocated past the end of the file can't be punched
+	fw.noAllocate = fr.sparse
+	if err = fw.reserveHeader(); err != nil {
+		fw.abort()
+		return nil, err
+	}
+	if fr.journal != nil {
+		fw.journalID = fr.journal.begin(pathTemp, path)
+	}
+	if flags&syscall.O_DIRECT != 0 {
+		fw.direct = getAlignedBuffer()
+	}
+	return fw, nil
 }
 
 func (fr *fileRepository) put(name string) (fileWriter, error) {
-	path := fr.nameToRelPath(name)
+	if err := fr.checkSpace(); err != nil {
+		return nil, err
+	}
+	fr.expect(name)
+	if fr.slabEntry(name) != nil {
+		return nil, os.ErrExist
+	}
+	if fr.slabs != nil && fr.slabs.maxChunkSize > 0 {
+		return fr.slabs.writer(name)
+	}
+	// A chunk still at its former place must be seen by the check of the
+	// existence of the chunk.
+	path := fr.locate(name)
 	return fr.putRelPath(path)
 }
 
@@ -188,7 +536,7 @@ func (fr *fileRepository) linkRelPath_FastPath(fromPath, toPath string) (linkOpe
 		return nil, err
 	}
 
-	return &realLinkOp{relPath: toPath, repo: fr}, nil
+	return &realLinkOp{srcPath: fromPath, relPath: toPath, repo: fr}, nil
 }
 
 func (fr *fileRepository) linkRelPath(fromPath, toPath string) (linkOperation, error) {
@@ -214,9 +562,29 @@ func (fr *fileRepository) linkRelPath(fromPath, toPath string) (linkOperation, e
 }
 
 func (fr *fileRepository) link(src, dst string) (linkOperation, error) {
-	relSrc := fr.nameToRelPath(src)
-	relDst := fr.nameToRelPath(dst)
-	return fr.linkRelPath(relSrc, relDst)
+	fr.expect(dst)
+	if e := fr.slabEntry(src); e != nil {
+		return fr.slabs.link(src, dst, e)
+	}
+	if fr.slabEntry(dst) != nil {
+		return nil, os.ErrExist
+	}
+	if fr.copyMode == copyModeReflink || (fr.copyMode == copyModeAuto && atomic.LoadInt32(&fr.noReflink) == 0) {
+		op, err := fr.reflink(src, dst)
+		if err == nil || fr.copyMode == copyModeReflink || !reflinkUnsupported(err) {
+			return op, err
+		}
+		LogInfo("Reflinks not supported on %s, hard links used: %v", fr.root, err)
+		atomic.StoreInt32(&fr.noReflink, 1)
+	}
+	relSrc := fr.locate(src)
+	relDst := fr.locate(dst)
+	op, err := fr.linkRelPath(relSrc, relDst)
+	if err == syscall.EMLINK {
+		// Too many copies of the same chunk
+		return fr.copyData(src, dst)
+	}
+	return op, err
 }
 
 // Synchronize the directory, based on its path
@@ -242,12 +610,31 @@ func (fr *fileRepository) syncRelFile(relPath string) error {
 }
 
 type realLinkOp struct {
+	srcPath string
 	relPath string
 	repo    *fileRepository
 }
 
+// With a sidecar, the link gets a copy of the attributes of its source
 func (lo *realLinkOp) setAttr(key string, value []byte) error {
-	return syscall.Setxattr(lo.repo.root+"/"+lo.relPath, key, value, 0)
+	if lo.repo.header {
+		update := func(meta sidecar) { meta[key] = string(value) }
+		if ok, err := lo.repo.updateHeader(lo.relPath, update); ok || err != nil {
+			return err
+		}
+	}
+	if !lo.repo.sidecar {
+		return syscall.Setxattr(lo.repo.root+"/"+lo.relPath, key, value, 0)
+	}
+	meta, err := lo.repo.loadSidecar(lo.relPath)
+	if err == syscall.ENOENT {
+		meta, err = lo.repo.loadSidecar(lo.srcPath)
+	}
+	if err != nil {
+		return err
+	}
+	meta[key] = string(value)
+	return lo.repo.saveSidecar(lo.relPath, meta)
 }
 
 func (lo *realLinkOp) commit() error {
@@ -258,10 +645,16 @@ func (lo *realLinkOp) commit() error {
 	if lo.repo.syncFile {
 		err = lo.repo.syncRelFile(lo.relPath)
 	}
+	if err == nil {
+		err = lo.repo.syncCommitted()
+	}
 	return err
 }
 
 func (lo *realLinkOp) rollback() error {
+	if lo.repo.sidecar {
+		_ = lo.repo.removeSidecar(lo.relPath)
+	}
 	err := syscall.Unlinkat(lo.repo.rootFd, lo.relPath, 0)
 	if err == nil && lo.repo.syncDir {
 		err = lo.repo.syncRelDir(filepath.Dir(lo.relPath))
@@ -275,8 +668,28 @@ type realFileWriter struct {
 	pathTemp  string
 	repo      *fileRepository
 
-	allocated int64
-	written   int64
+	allocated  int64
+	written    int64
+	noAllocate bool
+
+	// With O_DIRECT, the data is written by aligned blocks
+	direct []byte
+
+	// The attributes to be saved in the sidecar or in the header upon
+	// commit, the data being written past the header.
+	meta       sidecar
+	base       int64
+	superseded bool
+
+	// The sidecar saved before the rename, to be removed upon abort
+	sidecarSaved bool
+
+	// The bytes of zeros left as holes
+	holes int64
+
+	// The upload in the journal, and the hash to be recorded there
+	journalID uint64
+	hash      string
 }
 
 func (fw *realFileWriter) fd() int {
@@ -284,17 +697,42 @@ func (fw *realFileWriter) fd() int {
 }
 
 func (fw *realFileWriter) setAttr(key string, value []byte) error {
+	if key == AttrNameChunkChecksum {
+		fw.hash = string(value)
+	}
+	if fw.repo.sidecar || fw.base > 0 {
+		if fw.meta == nil {
+			fw.meta = make(sidecar)
+		}
+		fw.meta[key] = string(value)
+		return nil
+	}
 	return syscall.Fsetxattr(fw.fd(), key, value, 0)
 }
 
 func (fw *realFileWriter) Write(buffer []byte) (int, error) {
 	buflen := int64(len(buffer))
 
-	if fw.written+buflen > fw.allocated {
-		fw.Extend(uploadExtensionSize)
+	if fw.written+buflen > fw.allocated && fw.repo.fallocate != configFallocateNone && !fw.noAllocate {
+		extent := fw.repo.fallocateExtent
+		if extent < buflen {
+			extent = buflen
+		}
+		fw.allocate(extent)
 	}
 
+	fw.throttle(len(buffer))
+	offset := fw.base + fw.written
 	fw.written += buflen
+	if fw.direct != nil {
+		return fw.writeDirect(buffer)
+	}
+	if fw.repo.sparse {
+		return fw.writeSparse(buffer, offset)
+	}
+	if fileEngine != nil {
+		return enginePwriteAll(fileEngine, fw.fd(), buffer, offset)
+	}
 	return fw.f.Write(buffer)
 }
 
@@ -304,22 +742,62 @@ func (fw *realFileWriter) close() {
 
 func (fw *realFileWriter) abort() error {
 	defer fw.close()
+	defer fw.journalEnd()
+	defer fw.repo.pending.remove(fw.pathTemp)
+	fw.releaseDirect()
+	if fw.sidecarSaved {
+		_ = fw.repo.removeSidecar(fw.pathFinal)
+	}
 	return syscall.Unlinkat(fw.repo.rootFd, fw.pathTemp, 0)
 }
 
 func (fw *realFileWriter) commit() error {
+	err := fw.prepare()
+	if err == nil && fw.journalID != 0 {
+		err = fw.repo.journal.commit(fw.journalID, fw.base+fw.written, fw.hash)
+	}
+	if err == nil {
+		err = fw.publish()
+	}
+	if err != nil {
+		fw.abort()
+	}
+	return err
+}
+
+// Makes the chunk ready to be renamed: its data and its attributes are
+// written and synced, and the file is closed.
+func (fw *realFileWriter) prepare() error {
 	var err error
 
-	if fw.allocated > fw.written {
-		err = fw.f.Truncate(fw.written)
+	if fw.direct != nil {
+		err = fw.flushDirectTail()
+		fw.releaseDirect()
+	}
+
+	// The size is also set when the chunk ends with a hole
+	if err == nil && (fw.allocated > fw.written || fw.holes > 0) {
+		err = fw.f.Truncate(fw.base + fw.written)
+	}
+
+	if err == nil {
+		err = fw.writeHeader()
+	}
+	if err == nil {
+		err = fw.supersedeSidecar()
 	}
 
+	if err == nil {
+		err = fw.syncFile()
+	}
+
+	// After the sync, so that FADV_DONTNEED finds clean pages to drop
 	if err == nil {
 		switch fw.repo.fadviseUpload {
 		case configFadviseNone:
 		case configFadviseYes:
 			syscall.Fadvise(fw.fd(), 0, fw.written, syscall.FADV_SEQUENTIAL)
-		case configFadviseNocache:
+		case configFadviseNocache, configFadviseStream:
 			syscall.Fadvise(fw.fd(), 0, fw.written, syscall.FADV_DONTNEED)
 		case configFadviseCache:
 			syscall.Fadvise(fw.fd(), 0, fw.written, syscall.FADV_SEQUENTIAL)
@@ -327,20 +805,58 @@ func (fw *realFileWriter) commit() error {
 		}
 	}
 
+	// Close before the rename, so that the final name of the chunk is never
+	// seen as being written by the watchers of the volume.
 	if err == nil {
-		err = fw.syncFile()
-		if err == nil {
-			err := syscall.Renameat(fw.repo.rootFd, fw.pathTemp, fw.repo.rootFd, fw.pathFinal)
-			if err == nil {
-				_ = fw.syncDir()
-			}
-		}
+		err = fw.f.Close()
 	}
 
-	if err != nil {
-		fw.abort()
+	if err == nil && fw.repo.sidecar && fw.base == 0 {
+		err = fw.repo.saveSidecar(fw.pathFinal, fw.meta)
+		fw.sidecarSaved = err == nil
+	}
+	return err
+}
+
+// Gives its final name to the chunk already prepared
+func (fw *realFileWriter) publish() error {
+	if err := fw.rename(0); err != nil {
+		return err
+	}
+	fw.dedup()
+	// Only acknowledged once durable
+	return fw.repo.syncCommitted()
+}
+
+// Gives the chunk its final name, it is visible at once. With
+// RENAME_NOREPLACE, a chunk already there under that name is left untouched.
+func (fw *realFileWriter) rename(flags uint) error {
+	fw.repo.frozen.RLock()
+	defer fw.repo.frozen.RUnlock()
+	var err error
+	if flags == 0 {
+		err = syscall.Renameat(fw.repo.rootFd, fw.pathTemp, fw.repo.rootFd, fw.pathFinal)
 	} else {
-		fw.close()
+		err = syscall.Renameat2(fw.repo.rootFd, fw.pathTemp, fw.repo.rootFd, fw.pathFinal, flags)
+	}
+	if err != nil {
+		return err
+	}
+	fw.sidecarSaved = false
+	fw.repo.pending.remove(fw.pathTemp)
+	if fw.superseded {
+		_ = fw.repo.removeSidecar(fw.pathFinal)
+	}
+	_ = fw.syncDir()
+	fw.journalEnd()
+	return nil
+}
+
+// Takes back the chunk just renamed, when its transaction fails
+func (fw *realFileWriter) unpublish() error {
+	err := syscall.Unlinkat(fw.repo.rootFd, fw.pathFinal, 0)
+	if err == nil && fw.repo.sidecar {
+		_ = fw.repo.removeSidecar(fw.pathFinal)
 	}
 	return err
 }
@@ -360,18 +876,37 @@ func (fw *realFileWriter) syncDir() error {
 	return fw.repo.syncRelDir(dir)
 }
 
+// Prepares the room for the length announced by the client
 func (fw *realFileWriter) Extend(size int64) {
-	if fw.repo.fallocateFile {
-		err := syscall.Fallocate(fw.fd(), syscall.FALLOC_FL_KEEP_SIZE, fw.written, size)
-		if err == nil {
-			fw.allocated = fw.written + size
-		}
+	if fw.repo.fallocate == configFallocateFull && !fw.noAllocate {
+		fw.allocate(size)
+	}
+}
+
+func (fw *realFileWriter) allocate(size int64) {
+	err := syscall.Fallocate(fw.fd(), syscall.FALLOC_FL_KEEP_SIZE, fw.base+fw.written, size)
+	if err == nil {
+		fw.allocated = fw.written + size
+	} else if err == syscall.EOPNOTSUPP {
+		// e.g. ZFS, don't insist for the rest of the upload
+		fw.noAllocate = true
 	}
 }
 
 type realFileReader struct {
 	f    *os.File
 	repo *fileRepository
+	// The attributes, loaded once from the sidecar or from the header
+	meta sidecar
+	// The offset of the data, past the header of the chunks in the format 2
+	base int64
+	// Current offset in the file, when the reads go through the IO engine
+	pos int64
+	// The readahead window, and the end of the pages already advised
+	window  int64
+	advised int64
+	// The whole chunk, when mapped in memory
+	mapped []byte
 }
 
 func (fr *realFileReader) fd() int {
@@ -383,23 +918,42 @@ func (fr *realFileReader) size() int64 {
 	if err != nil {
 		return -1
 	} else {
-		return fi.Size()
+		return fi.Size() - fr.base
 	}
 }
 
 func (fr *realFileReader) seek(offset int64) error {
-	_, err := fr.f.Seek(offset, os.SEEK_SET)
+	_, err := fr.f.Seek(fr.base+offset, os.SEEK_SET)
+	fr.pos = fr.base + offset
 	return err
 }
 
 func (fr *realFileReader) Close() error {
+	fr.unmap()
+	switch fr.repo.fadviseDownload {
+	case configFadviseNocache, configFadviseStream:
+		syscall.Fadvise(fr.fd(), 0, 0, syscall.FADV_DONTNEED)
+	}
 	err := fr.f.Close()
 	fr.f = nil
 	return err
 }
 
 func (fr *realFileReader) Read(buffer []byte) (int, error) {
-	return fr.f.Read(buffer)
+	fr.readAhead(fr.pos)
+	if fileEngine == nil {
+		n, err := fr.f.Read(buffer)
+		fr.pos += int64(n)
+		fr.throttle(int64(n))
+		return n, err
+	}
+	n, err := fileEngine.pread(fr.fd(), buffer, fr.pos)
+	fr.pos += int64(n)
+	fr.throttle(int64(n))
+	if err == nil && n == 0 && len(buffer) > 0 {
+		err = io.EOF
+	}
+	return n, err
 }
 
 func (fr *realFileReader) File() *os.File {
@@ -407,18 +961,115 @@ func (fr *realFileReader) File() *os.File {
 }
 
 func (fr *realFileReader) getAttr(key string, value []byte) (int, error) {
-	return syscall.Fgetxattr(fr.fd(), key, value)
+	if fr.base == 0 && !fr.repo.sidecar {
+		return syscall.Fgetxattr(fr.fd(), key, value)
+	}
+	if fr.meta == nil {
+		meta, err := fr.repo.loadSidecar(fr.f.Name())
+		if err != nil {
+			return 0, err
+		}
+		fr.meta = meta
+	}
+	return fr.meta.get(key, value)
+}
+
+// Loads all the attributes of the chunk
+func (fr *realFileReader) attrs() (map[string][]byte, error) {
+	all := make(map[string][]byte)
+	if fr.base > 0 || fr.repo.sidecar {
+		meta := fr.meta
+		if fr.base == 0 {
+			var err error
+			if meta, err = fr.repo.loadSidecar(fr.f.Name()); err != nil {
+				return nil, err
+			}
+		}
+		for k, v := range meta {
+			all[k] = []byte(v)
+		}
+		return all, nil
+	}
+
+	fd := fr.fd()
+	size, err := syscall.Flistxattr(fd, nil)
+	if err != nil || size <= 0 {
+		return all, err
+	}
+	names := make([]byte, size)
+	if size, err = syscall.Flistxattr(fd, names); err != nil {
+		return nil, err
+	}
+	start := 0
+	for i := 0; i < size; i++ {
+		if names[i] != 0 {
+			continue
+		}
+		key := string(names[start:i])
+		start = i + 1
+		n, err := syscall.Fgetxattr(fd, key, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, n)
+		if n, err = syscall.Fgetxattr(fd, key, value); err != nil {
+			return nil, err
+		}
+		all[key] = value[:n]
+	}
+	return all, nil
+}
+
+// Walk calls the hook for each chunk found in the repository, in lexical
+// order. The hook receives the name of the chunk and its path relative to
+// the root of the repository. Hidden directories (i.e. administrative
+// areas) and temporary files are skipped.
+func (fr *fileRepository) walk(hook func(name, relPath string, fi os.FileInfo) error) error {
+	return filepath.Walk(fr.root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Removed during the walk
+				return nil
+			}
+			return err
+		}
+		name := fi.Name()
+		if fi.IsDir() {
+			if path != fr.root && strings.HasPrefix(name, ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() || !isHexaString(name, 64) {
+			return nil
+		}
+		return hook(strings.ToUpper(name), path[len(fr.root)+1:], fi)
+	})
 }
 
 func (fr *fileRepository) nameToRelPath(name string) string {
-	var result strings.Builder
-	for i := 0; i < fr.hashDepth; i++ {
-		start := i * fr.hashDepth
-		result.WriteString(name[start : start+fr.hashWidth])
-		result.WriteRune('/')
-	}
-	result.WriteString(name)
-	return result.String()
+	return hashLayout{width: fr.hashWidth, depth: fr.hashDepth}.relPath(name)
+}
+
+func (fr *fileRepository) setOrHasAttr(key, value string) error {
+	if !fr.sidecar && !fr.header {
+		return setOrHasXattr(fr.root, key, value)
+	}
+	meta, err := fr.loadSidecar(".volume")
+	if err == syscall.ENOENT {
+		meta, err = make(sidecar), nil
+	}
+	if err != nil {
+		return err
+	}
+	if v, ok := meta[key]; ok {
+		if v != value {
+			return errors.New("XATTR mismatch")
+		}
+		return nil
+	}
+	meta[key] = value
+	return fr.saveSidecar(".volume", meta)
 }
 
 func setOrHasXattr(path, key, value string) error {
@@ -0,0 +1,332 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The format of the chunk files. The chunks in the format 1, the legacy one,
+only hold the data, their attributes live apart: in extended attributes or
+in sidecar files, depending on attr_store. The chunks in the format 2 embed
+their attributes in a header of fixed size, ahead of the data, so that the
+volumes need no extended attributes at all:
+
+	"OIOCHNK2" | attributes length (u32) | CRC32 of the attributes (u32)
+	| attributes (JSON) | zeros up to 4KiB | data
+
+With chunk_format 2, the new chunks are written in the format 2 and the
+chunks already there are still read in the format 1. Since the data of a
+legacy chunk might start with anything, a file is only taken as a chunk in
+the format 2 when it has no legacy attributes. With chunk_format_convert,
+a background sweep rewrites the legacy chunks in the format 2.
+
+An attribute set on a committed chunk is saved by rewriting the header in
+place, a single aligned block.
+*/
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+const (
+	chunkFormatLegacy = 1
+	chunkFormatHeader = 2
+
+	chunkHeaderSize   = 4096
+	chunkHeaderMagic  = "OIOCHNK2"
+	chunkHeaderPrefix = 16
+)
+
+var errHeaderTooLarge = errors.New("Attributes too large for the chunk header")
+
+// Encodes the header into a buffer of chunkHeaderSize bytes
+func encodeChunkHeader(meta sidecar, header []byte) error {
+	encoded, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if len(encoded) > chunkHeaderSize-chunkHeaderPrefix {
+		return errHeaderTooLarge
+	}
+	copy(header, chunkHeaderMagic)
+	binary.LittleEndian.PutUint32(header[8:], uint32(len(encoded)))
+	binary.LittleEndian.PutUint32(header[12:], crc32.ChecksumIEEE(encoded))
+	n := copy(header[chunkHeaderPrefix:], encoded)
+	for i := chunkHeaderPrefix + n; i < len(header); i++ {
+		header[i] = 0
+	}
+	return nil
+}
+
+// Decodes the header, nil when the buffer doesn't start with a valid one
+func decodeChunkHeader(header []byte) sidecar {
+	if len(header) < chunkHeaderSize || string(header[:8]) != chunkHeaderMagic {
+		return nil
+	}
+	length := binary.LittleEndian.Uint32(header[8:])
+	if length > chunkHeaderSize-chunkHeaderPrefix {
+		return nil
+	}
+	encoded := header[chunkHeaderPrefix : chunkHeaderPrefix+length]
+	if crc32.ChecksumIEEE(encoded) != binary.LittleEndian.Uint32(header[12:]) {
+		return nil
+	}
+	meta := make(sidecar)
+	if json.Unmarshal(encoded, &meta) != nil {
+		return nil
+	}
+	return meta
+}
+
+// Loads the header of the chunk, nil when the chunk is in the legacy format
+func (fr *fileRepository) readHeader(fd int, relPath string) (sidecar, error) {
+	header := getBuffer(chunkHeaderSize)[:chunkHeaderSize]
+	defer putBuffer(header)
+	n, err := syscall.Pread(fd, header, 0)
+	if err != nil {
+		return nil, err
+	}
+	meta := decodeChunkHeader(header[:n])
+	if meta == nil {
+		return nil, nil
+	}
+	legacy, err := fr.hasLegacyAttrs(fd, relPath)
+	if legacy || err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// Tells if the chunk has attributes out of the file. A sidecar only
+// remains beside a chunk in the format 2 when its removal failed, it then
+// tells the inode of that chunk.
+func (fr *fileRepository) hasLegacyAttrs(fd int, relPath string) (bool, error) {
+	if fr.sidecar {
+		meta, err := fr.loadSidecar(relPath)
+		if err == syscall.ENOENT {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		var st syscall.Stat_t
+		if err = syscall.Fstat(fd, &st); err != nil {
+			return false, err
+		}
+		return meta[AttrNameFormatInode] != strconv.FormatUint(st.Ino, 10), nil
+	}
+
+	size, err := syscall.Flistxattr(fd, nil)
+	if err != nil || size <= 0 {
+		return false, err
+	}
+	names := make([]byte, size)
+	if size, err = syscall.Flistxattr(fd, names); err != nil {
+		return false, err
+	}
+	for _, name := range strings.Split(string(names[:size]), "\x00") {
+		if strings.HasPrefix(name, "user.") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Loads the header of the chunk at the given path, nil when legacy
+func (fr *fileRepository) relHeader(relPath string) (sidecar, error) {
+	fd, err := syscall.Openat(fr.rootFd, relPath, openFlagsROnly, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	return fr.readHeader(fd, relPath)
+}
+
+// Rewrites the header of a committed chunk. Tells false when the chunk is
+// in the legacy format, then left untouched.
+func (fr *fileRepository) updateHeader(relPath string, modify func(meta sidecar)) (bool, error) {
+	fd, err := syscall.Openat(fr.rootFd, relPath, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return false, err
+	}
+	defer syscall.Close(fd)
+	meta, err := fr.readHeader(fd, relPath)
+	if meta == nil || err != nil {
+		return false, err
+	}
+	modify(meta)
+	return true, fr.writeHeader(fd, meta)
+}
+
+func (fr *fileRepository) writeHeader(fd int, meta sidecar) error {
+	// Aligned, for the descriptors opened with O_DIRECT
+	header := alignedBuffer(chunkHeaderSize)[:chunkHeaderSize]
+	if err := encodeChunkHeader(meta, header); err != nil {
+		return err
+	}
+	n, err := syscall.Pwrite(fd, header, 0)
+	if err == nil && n < len(header) {
+		err = syscall.EIO
+	}
+	if err == nil && fr.syncFile {
+		err = syscall.Fdatasync(fd)
+	}
+	return err
+}
+
+// Removes the attribute from the header of a chunk with other links, about
+// to be unlinked. Tells false when the chunk is in the legacy format.
+func (fr *fileRepository) unshareHeader(relPath, key string) bool {
+	var st syscall.Stat_t
+	if err := syscall.Fstatat(fr.rootFd, relPath, &st, 0); err != nil {
+		return false
+	}
+	if st.Nlink <= 1 {
+		meta, err := fr.relHeader(relPath)
+		return meta != nil && err == nil
+	}
+	ok, err := fr.updateHeader(relPath, func(meta sidecar) { delete(meta, key) })
+	if err != nil {
+		LogWarning("Failed to remove %s from the header of %s: %v", key, relPath, err)
+	}
+	return ok
+}
+
+// Starts the data of the file past the room of its header
+func (fw *realFileWriter) reserveHeader() error {
+	if !fw.repo.header {
+		return nil
+	}
+	if _, err := fw.f.Seek(chunkHeaderSize, os.SEEK_SET); err != nil {
+		return err
+	}
+	fw.base = chunkHeaderSize
+	return nil
+}
+
+// Writes the header of the chunk being written, if it has one
+func (fw *realFileWriter) writeHeader() error {
+	if fw.base == 0 {
+		return nil
+	}
+	if fw.meta == nil {
+		fw.meta = make(sidecar)
+	}
+	return fw.repo.writeHeader(fw.fd(), fw.meta)
+}
+
+// Marks the legacy sidecar of the chunk replaced (i.e. converted) as
+// superseded by the new file, to be removed once the file renamed.
+func (fw *realFileWriter) supersedeSidecar() error {
+	if fw.base == 0 || !fw.repo.sidecar {
+		return nil
+	}
+	meta, err := fw.repo.loadSidecar(fw.pathFinal)
+	if err == syscall.ENOENT {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var st syscall.Stat_t
+	if err = syscall.Fstat(fw.fd(), &st); err != nil {
+		return err
+	}
+	meta[AttrNameFormatInode] = strconv.FormatUint(st.Ino, 10)
+	fw.superseded = true
+	return fw.repo.saveSidecar(fw.pathFinal, meta)
+}
+
+// Rewrites the legacy chunks in the format 2. The RAWX keeps serving the
+// chunks meanwhile.
+func (fr *fileRepository) sweepFormat() {
+	go func() {
+		var converted, failed uint64
+		err := fr.walk(func(name, relPath string, fi os.FileInfo) error {
+			switch ok, err := fr.convert(name, relPath); {
+			case ok:
+				converted++
+			case err != nil && !os.IsNotExist(err):
+				LogWarning("Chunk %s not converted: %v", name, err)
+				failed++
+			}
+			return nil
+		})
+		if err != nil {
+			LogWarning("Format conversion of %s interrupted: %v", fr.root, err)
+		} else if failed > 0 {
+			LogWarning("Format conversion of %s: %d chunks converted, %d left in the format 1",
+				fr.root, converted, failed)
+		} else {
+			LogInfo("Format conversion of %s complete: %d chunks converted", fr.root, converted)
+		}
+	}()
+}
+
+// Copies the legacy chunk into a file in the format 2, committed in its
+// place. Tells false when the chunk was already in the format 2.
+func (fr *fileRepository) convert(name, relPath string) (bool, error) {
+	in, err := fr.getRelPath(relPath)
+	if err != nil {
+		return false, err
+	}
+	r := in.(*realFileReader)
+	defer r.Close()
+	if r.base > 0 {
+		if fr.sidecar {
+			// Left by a conversion interrupted after the rename
+			_ = fr.removeSidecar(relPath)
+		}
+		return false, nil
+	}
+	attrs, err := r.attrs()
+	if err != nil {
+		return false, err
+	}
+
+	w, err := fr.tempWriter(relPath)
+	if err != nil {
+		return false, err
+	}
+	_, err = copyPooled(w, r)
+	for key, value := range attrs {
+		if err != nil {
+			break
+		}
+		err = w.setAttr(key, value)
+	}
+	if err != nil {
+		w.abort()
+		return false, err
+	}
+	fr.expect(name)
+	// The chunk has been deleted meanwhile, the deletion wins
+	if syscall.Faccessat(fr.rootFd, relPath, syscall.F_OK, 0) != nil {
+		w.abort()
+		return false, nil
+	}
+	if err = w.commit(); err != nil {
+		return false, err
+	}
+	atomic.AddUint64(&counters.FormatConverted, 1)
+	return true, nil
+}
@@ -0,0 +1,87 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestChunkHeader(t *testing.T) {
+	cases := []struct {
+		name   string
+		meta   sidecar
+		mangle func(header []byte)
+		valid  bool
+	}{
+		{"empty", sidecar{}, nil, true},
+		{"attributes", sidecar{
+			AttrNameChunkSize: "1024",
+			AttrNameHashAlgo:  "xxh64",
+			"weird":           "\"quoted\"\n\x00",
+		}, nil, true},
+		{"largest", sidecar{"k": strings.Repeat("x", chunkHeaderSize-chunkHeaderPrefix-8)},
+			nil, true},
+		{"bad magic", sidecar{"k": "v"}, func(h []byte) { h[0] = 'X' }, false},
+		{"bad checksum", sidecar{"k": "v"}, func(h []byte) { h[12]++ }, false},
+		{"altered attributes", sidecar{"k": "v"},
+			func(h []byte) { h[chunkHeaderPrefix+2] = 'K' }, false},
+		{"length overflow", sidecar{"k": "v"},
+			func(h []byte) { binary.LittleEndian.PutUint32(h[8:], chunkHeaderSize) }, false},
+	}
+	for _, tc := range cases {
+		header := make([]byte, chunkHeaderSize)
+		// Whatever the buffer held before, the padding is zeroed
+		for i := range header {
+			header[i] = 0xff
+		}
+		if err := encodeChunkHeader(tc.meta, header); err != nil {
+			t.Errorf("%s: encoding error %v", tc.name, err)
+			continue
+		}
+		if tc.mangle != nil {
+			tc.mangle(header)
+		}
+		meta := decodeChunkHeader(header)
+		if !tc.valid {
+			if meta != nil {
+				t.Errorf("%s: decoded as %v", tc.name, meta)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(meta, tc.meta) {
+			t.Errorf("%s: decoded as %v, expected %v", tc.name, meta, tc.meta)
+		}
+		length := binary.LittleEndian.Uint32(header[8:])
+		for i := chunkHeaderPrefix + int(length); i < chunkHeaderSize; i++ {
+			if header[i] != 0 {
+				t.Errorf("%s: padding not zeroed at %d", tc.name, i)
+				break
+			}
+		}
+	}
+
+	if decodeChunkHeader(make([]byte, chunkHeaderSize-1)) != nil {
+		t.Errorf("short buffer decoded")
+	}
+	tooLarge := sidecar{"k": strings.Repeat("x", chunkHeaderSize)}
+	if err := encodeChunkHeader(tooLarge, make([]byte, chunkHeaderSize)); err != errHeaderTooLarge {
+		t.Errorf("too large: error %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The durability of the uploads, as told by fsync_policy:
+
+  - "strict": the chunk file and its directory are synced upon each PUT
+  - "grouped": the PUT waits for the next sync of the whole filesystem of
+    the volume, performed every fsync_group_interval milliseconds when
+    uploads are waiting for it, so that a single syncfs() stands for the
+    syncs of all those uploads
+  - "relaxed": the RAWX relies on the OS to flush the data
+
+Without fsync_policy, grid_fsync and grid_fsync_dir tell what is synced.
+*/
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+const (
+	fsyncPolicyStrict  = "strict"
+	fsyncPolicyGrouped = "grouped"
+	fsyncPolicyRelaxed = "relaxed"
+
+	fsyncDefaultGroupInterval = 10
+)
+
+// A sync of the filesystem, shared by the uploads waiting for it
+type syncRound struct {
+	done chan struct{}
+	err  error
+}
+
+type syncGroup struct {
+	lock     sync.Mutex
+	fd       int
+	interval time.Duration
+	next     *syncRound
+	waiting  bool
+	kick     chan struct{}
+}
+
+func configureFsync(fr *fileRepository, opts optionsMap) error {
+	switch v := opts["fsync_policy"]; strings.ToLower(v) {
+	case "":
+	case fsyncPolicyStrict:
+		fr.syncFile, fr.syncDir = true, true
+	case fsyncPolicyRelaxed:
+		fr.syncFile, fr.syncDir = false, false
+	case fsyncPolicyGrouped:
+		fr.syncFile, fr.syncDir = false, false
+		interval := opts.getInt("fsync_group_interval", fsyncDefaultGroupInterval)
+		fr.syncGroup = makeSyncGroup(fr.rootFd, time.Duration(interval)*time.Millisecond)
+	default:
+		return errors.New("Invalid fsync_policy: " + v)
+	}
+	return nil
+}
+
+func makeSyncGroup(fd int, interval time.Duration) *syncGroup {
+	g := &syncGroup{
+		fd:       fd,
+		interval: interval,
+		next:     &syncRound{done: make(chan struct{})},
+		kick:     make(chan struct{}, 1),
+	}
+	go g.run()
+	return g
+}
+
+func (g *syncGroup) run() {
+	for range g.kick {
+		// Let the uploads gather
+		time.Sleep(g.interval)
+		g.lock.Lock()
+		round := g.next
+		g.next = &syncRound{done: make(chan struct{})}
+		g.waiting = false
+		g.lock.Unlock()
+
+		round.err = syscall.Syncfs(g.fd)
+		atomic.AddUint64(&counters.FsyncGroups, 1)
+		close(round.done)
+	}
+}
+
+// Waits for a sync of the filesystem started after the call
+func (g *syncGroup) wait() error {
+	g.lock.Lock()
+	round := g.next
+	if !g.waiting {
+		g.waiting = true
+		g.kick <- struct{}{}
+	}
+	g.lock.Unlock()
+	<-round.done
+	return round.err
+}
+
+// Makes the upload just committed durable, when the syncs are grouped
+func (fr *fileRepository) syncCommitted() error {
+	if fr.syncGroup == nil {
+		return nil
+	}
+	return fr.syncGroup.wait()
+}
@@ -0,0 +1,196 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The check of a chunk on demand, with GET /check/<CHUNKID>: the chunk is
+hashed by the service, then the verdict is replied in JSON, without the
+data, so that the rebuilders triage the suspect chunks at the cost of a
+disk read only:
+
+	{"chunk_id": "...", "ok": false, "reason": "hash mismatch",
+	 "size": 1048576, "expected_size": "1048576",
+	 "hash_algo": "md5", "hash": "...", "expected_hash": "...",
+	 "attributes": ["missing chunk position"]}
+
+The attributes are checked for consistency too: the mandatory ones must be
+present, the size and the hash must be well formed. Unreadable attributes
+leave the data unchecked. The chunk isn't moved to the quarantine, whatever
+the verdict.
+*/
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const checkPathPrefix = "/check/"
+
+type checkReply struct {
+	ChunkID      string   `json:"chunk_id"`
+	OK           bool     `json:"ok"`
+	Reason       string   `json:"reason,omitempty"`
+	Size         int64    `json:"size"`
+	ExpectedSize string   `json:"expected_size,omitempty"`
+	HashAlgo     string   `json:"hash_algo"`
+	Hash         string   `json:"hash,omitempty"`
+	ExpectedHash string   `json:"expected_hash,omitempty"`
+	Attributes   []string `json:"attributes,omitempty"`
+}
+
+// Lists what is wrong with the attributes of the chunk
+func (chunk *chunkInfo) inconsistencies() []string {
+	var found []string
+	for _, attr := range []struct {
+		name  string
+		value string
+	}{
+		{"full path", chunk.ContentFullpath + chunk.ContentID},
+		{"storage policy", chunk.ContentStgPol},
+		{"chunk method", chunk.ContentChunkMethod},
+		{"chunk position", chunk.ChunkPosition},
+		{"chunk hash", chunk.ChunkHash},
+		{"chunk size", chunk.ChunkSize},
+	} {
+		if attr.value == "" {
+			found = append(found, "missing "+attr.name)
+		}
+	}
+	if chunk.ChunkSize != "" {
+		if _, err := strconv.ParseInt(chunk.ChunkSize, 10, 64); err != nil {
+			found = append(found, "invalid chunk size")
+		}
+	}
+	if chunk.ChunkHash != "" && !isHexaString(chunk.ChunkHash, hashHexSize(chunk.hashAlgo)) {
+		found = append(found, "invalid chunk hash")
+	}
+	if chunk.MetachunkSize != "" {
+		if _, err := strconv.ParseInt(chunk.MetachunkSize, 10, 64); err != nil {
+			found = append(found, "invalid metachunk size")
+		}
+	}
+	if strings.HasPrefix(chunk.ContentChunkMethod, "ec/") && (chunk.MetachunkHash == "" || chunk.MetachunkSize == "") {
+		found = append(found, "missing metachunk")
+	}
+	return found
+}
+
+func (rr *rawxRequest) checkIntegrityOnDemand() (*checkReply, error) {
+	inChunk, err := rr.rawx.repo.get(rr.chunkID)
+	if err != nil {
+		return nil, err
+	}
+	defer inChunk.Close()
+
+	reply := &checkReply{ChunkID: rr.chunkID}
+	if err = rr.chunk.loadAttr(inChunk, rr.chunkID); err != nil {
+		// Without its attributes, the data can't be judged
+		reply.Attributes = []string{err.Error()}
+		return reply, nil
+	}
+	reply.Attributes = append(reply.Attributes, rr.chunk.inconsistencies()...)
+	reply.ExpectedSize = rr.chunk.ChunkSize
+	reply.ExpectedHash = rr.chunk.ChunkHash
+	reply.HashAlgo = rr.chunk.hashAlgo
+	if reply.HashAlgo == "" {
+		reply.HashAlgo = hashAlgoMD5
+	}
+
+	in, filter, err := rr.getChunkReader(inChunk, rr.chunk.size, rangeInfo{})
+	if filter != nil {
+		defer filter.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	h, err := rr.chunk.newHash()
+	if err != nil {
+		return nil, err
+	}
+	var sink io.Writer = h
+	var th *treeHasher
+	tree, _ := loadHashTree(inChunk)
+	if tree != nil {
+		th = makeTreeHasher(tree.blockSize)
+		sink = io.MultiWriter(h, th)
+	}
+	n, err := copyPooled(sink, in)
+	if err != nil && err != errCorruptedSegment {
+		return nil, err
+	}
+	reply.Size = n
+	reply.Hash = strings.ToUpper(hex.EncodeToString(h.Sum(nil)))
+
+	reply.Reason = rr.checkIntegrity(n, h.Sum(nil), err)
+	if reply.Reason == "" && th != nil {
+		if i := tree.mismatch(th.sum()); i >= 0 {
+			reply.Reason = badBlockReason(int64(i))
+		}
+	}
+	reply.OK = reply.Reason == "" && len(reply.Attributes) == 0
+	return reply, nil
+}
+
+func (rr *rawxRequest) serveCheck(rep http.ResponseWriter, req *http.Request) {
+	if err := rr.drain(); err != nil {
+		rr.replyError(err)
+		return
+	}
+
+	var spent uint64
+	id := strings.TrimPrefix(req.URL.Path, checkPathPrefix)
+	if !isHexaString(id, 64) {
+		rr.replyError(errInvalidChunkID)
+		spent = IncrementStatReqOther(rr)
+	} else if req.Method != "GET" {
+		rr.replyCode(http.StatusMethodNotAllowed)
+		spent = IncrementStatReqOther(rr)
+	} else {
+		rr.chunkID = strings.ToUpper(id)
+		if reply, err := rr.checkIntegrityOnDemand(); err != nil {
+			rr.replyError(err)
+		} else if body, err := json.Marshal(reply); err != nil {
+			rr.replyError(err)
+		} else {
+			atomic.AddUint64(&counters.ChunksChecked, 1)
+			rep.Header().Set("Content-Type", "application/json")
+			rr.replyCode(http.StatusOK)
+			rep.Write(body)
+			rr.bytesOut = uint64(len(body))
+		}
+		spent = IncrementStatReqInfo(rr)
+	}
+
+	if isVerbose() {
+		LogHttp(AccessLogEvent{
+			status:    rr.status,
+			timeSpent: spent,
+			bytesIn:   rr.bytesIn,
+			bytesOut:  rr.bytesOut,
+			method:    rr.req.Method,
+			local:     rr.rawx.url,
+			peer:      rr.req.RemoteAddr,
+			path:      rr.req.URL.Path,
+			reqId:     rr.reqid,
+		})
+	}
+}
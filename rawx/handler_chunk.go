@@ -17,10 +17,6 @@
 package main
 
 import (
-	"compress/flate"
-	"compress/lzw"
-	"compress/zlib"
-	"crypto/md5"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -40,6 +36,7 @@ var (
 	errCompressionNotManaged = errors.New("Compression mode not managed")
 	errMissingHeader         = errors.New("Missing mandatory header")
 	errInvalidHeader         = errors.New("Invalid header")
+	errChecksumMismatch      = errors.New("Checksum mismatch")
 	errInvalidRange          = errors.New("Invalid range")
 	errRangeNotSatisfiable   = errors.New("Range not satisfiable")
 	errListMarker            = errors.New("Invalid listing marker")
@@ -124,21 +121,41 @@ func copyReadWriteBuffer(dst io.Writer, src io.Reader, buf []byte) (written int6
 }
 
 func (rr *rawxRequest) checksumRequired() bool {
-	return rr.rawx.checksumMode == checksumAlways || (rr.rawx.checksumMode == checksumSmart && !strings.HasPrefix(rr.chunk.ContentStgPol, "ec/"))
+	return rr.rawx.checksumMode == checksumAlways || (rr.rawx.checksumMode == checksumSmart && !strings.HasPrefix(rr.chunk.ContentStgPol, "ec/")) || rr.checksumAnnounced()
+}
+
+// Tells if the client announced a checksum in the trailers, then it is
+// verified whatever the checksum mode.
+func (rr *rawxRequest) checksumAnnounced() bool {
+	for _, k := range []string{HeaderNameChunkChecksum, HeaderNameContentMD5, HeaderNameDigest} {
+		if _, ok := rr.req.Trailer[http.CanonicalHeaderKey(k)]; ok {
+			return true
+		}
+	}
+	return false
 }
 
 func (rr *rawxRequest) putData(out io.Writer) (uploadInfo, error) {
 	var in io.Reader = rr.req.Body
 	var h hash.Hash
+	var th *treeHasher
 
 	// Trigger the checksum only if configured so
 	if rr.checksumRequired() {
-		h = md5.New()
+		var err error
+		if h, err = rr.chunk.newHash(); err != nil {
+			return uploadInfo{}, err
+		}
 		in = io.TeeReader(rr.req.Body, h)
 	}
+	if hashTreeBlockSize > 0 {
+		th = makeTreeHasher(hashTreeBlockSize)
+		in = io.TeeReader(in, th)
+	}
 
 	ul := uploadInfo{}
-	buffer := make([]byte, rr.rawx.bufferSize, rr.rawx.bufferSize)
+	buffer := getBuffer(rr.rawx.bufferSize)
+	defer putBuffer(buffer)
 	chunkLength, err := copyReadWriteBuffer(out, in, buffer)
 	if err != nil {
 		return ul, err
@@ -148,25 +165,36 @@ func (rr *rawxRequest) putData(out io.Writer) (uploadInfo, error) {
 		bin := make([]byte, 0, 32)
 		ul.hash = strings.ToUpper(hex.EncodeToString(h.Sum(bin)))
 	}
+	if th != nil {
+		if tree := th.sum().encode(); len(tree) <= hashTreeMaxAttrSize {
+			rr.chunk.hashTree = tree
+		} else {
+			LogWarning("Chunk %s too large to be sealed", rr.chunkID)
+		}
+	}
 	ul.length = chunkLength
 	rr.bytesIn = uint64(chunkLength)
 	return ul, nil
 }
 
 func (rr *rawxRequest) uploadChunk() {
-	if err := rr.chunk.retrieveHeaders(&rr.req.Header, rr.chunkID); err != nil {
+	if err := rr.validateUpload(); err != nil {
 		rr.replyError(err)
 		// Discard request body
-		io.Copy(ioutil.Discard, rr.req.Body)
+		rr.drain()
 		return
 	}
 
 	// Attempt a PUT in the repository
 	out, err := rr.rawx.repo.put(rr.chunkID)
+	if os.IsExist(err) && rr.replayUpload() {
+		rr.drain()
+		return
+	}
 	if err != nil {
 		rr.replyError(err)
 		// Discard request body
-		io.Copy(ioutil.Discard, rr.req.Body)
+		rr.drain()
 		return
 	}
 
@@ -177,19 +205,23 @@ func (rr *rawxRequest) uploadChunk() {
 
 	var ul uploadInfo
 
+	// Maybe encrypt the data stored
+	var sink io.Writer = out
+	var enc *chunkEncrypter
+	if encryptNewChunks {
+		if enc, err = rr.chunk.makeEncrypter(out); err == nil {
+			sink = enc
+		}
+	}
+
 	// Maybe intercept the upload with a compression filter
-	var z io.WriteCloser
-	switch rr.rawx.compression {
-	case compressionZlib:
-		z = zlib.NewWriter(out)
-	case compressionDeflate:
-		z, err = flate.NewWriter(out, 1)
-	case compressionLzw:
-		z = lzw.NewWriter(out, lzw.MSB, 8)
-	case "", compressionOff:
-		z = nil
-	default:
-		err = errCompressionNotManaged
+	var z *chunkCompressor
+	compression, errAlgo := rr.compressionAlgorithm()
+	if err == nil {
+		err = errAlgo
+	}
+	if err == nil && compression != "" && compression != compressionOff {
+		z, err = makeChunkCompressor(compression, rr.compressionDict(compression), sink)
 	}
 
 	// Upload, and maybe manage compression
@@ -199,16 +231,21 @@ func (rr *rawxRequest) uploadChunk() {
 		if err == nil {
 			err = errClose
 		}
+		compression = z.algorithm()
+		rr.chunk.compressionDict = z.dictionary()
 	} else if err == nil {
-		ul, err = rr.putData(out)
+		ul, err = rr.putData(sink)
 		if err != nil {
 			LogError("Chunk upload error: %s", err)
 		}
 	}
+	if enc != nil && err == nil {
+		err = enc.Close()
+	}
 
 	// If a hash has been sent, it must match the hash computed
 	if err == nil {
-		rr.chunk.compression = rr.rawx.compression
+		rr.chunk.compression = compression
 		if err = rr.chunk.retrieveTrailers(&rr.req.Trailer, &ul); err != nil {
 			LogError("Trailer error: %s", err)
 		}
@@ -226,12 +263,53 @@ func (rr *rawxRequest) uploadChunk() {
 		rr.replyError(err)
 		out.abort()
 		// Discard request body
-		io.Copy(ioutil.Discard, rr.req.Body)
+		rr.drain()
+	} else if txn := rr.req.Header.Get(HeaderNameTransaction); txn != "" {
+		// Only visible once the transaction is committed
+		if err = stageChunk(rr.rawx, txn, rr.chunk, out); err != nil {
+			out.abort()
+			rr.replyError(err)
+		} else {
+			rr.chunk.fillHeadersLight(rr.rep.Header())
+			rr.replyCode(http.StatusAccepted)
+		}
+	} else if err = out.commit(); err != nil {
+		// The chunk is not there, the client must not be told otherwise
+		LogError("Chunk commit error: %s", err)
+		rr.replyError(err)
 	} else {
-		out.commit()
+		rr.accountChunk(&rr.chunk, 1)
 		rr.chunk.fillHeadersLight(rr.rep.Header())
-		rr.replyCode(http.StatusCreated)
-		NotifyNew(rr.rawx.notifier, rr.reqid, &rr.chunk)
+		if !notifConf().syncPut {
+			// The event is queued, and maybe logged, before the reply
+			if err = NotifyNew(rr.rawx, rr.reqid, &rr.chunk); err != nil {
+				LogError("Event not queued, chunk %s taken back: %s", rr.chunkID, err)
+				rr.takeBack()
+				setError(rr.rep, err)
+				rr.replyCode(http.StatusServiceUnavailable)
+			} else {
+				rr.replyCode(http.StatusCreated)
+			}
+		} else if err = rr.notifySync(eventTypeNewChunk); err == errDeadlineExceeded {
+			rr.replyError(err)
+		} else if err != nil {
+			LogError("Event not acknowledged: %s", err)
+			setError(rr.rep, err)
+			rr.replyCode(http.StatusServiceUnavailable)
+		} else {
+			rr.replyCode(http.StatusCreated)
+		}
+	}
+}
+
+// Takes back the chunk just uploaded, bypassing the trash: its client is
+// told the upload failed.
+func (rr *rawxRequest) takeBack() {
+	rr.accountChunk(&rr.chunk, -1)
+	if repo, ok := rr.rawx.repo.(*chunkRepository); ok {
+		_ = repo.sub.remove(rr.chunkID)
+	} else {
+		_ = rr.rawx.repo.del(rr.chunkID)
 	}
 }
 
@@ -262,7 +340,16 @@ func (rr *rawxRequest) copyChunk() {
 		} else {
 			// The link already exists and has an xattr. Commit is a matter of sync.
 			_ = op.commit()
+			setHeader(rr.rep.Header(), HeaderNameChunkID, rr.chunk.ChunkID)
 			rr.replyCode(http.StatusCreated)
+			if rr.quotas() != nil {
+				buf := getBuffer(2048)
+				if n, err := rr.rawx.repo.getAttr(rr.chunkID, AttrNameChunkSize, buf); err == nil && n > 0 {
+					rr.chunk.ChunkSize = string(buf[:n])
+					rr.accountChunk(&rr.chunk, 1)
+				}
+				putBuffer(buf)
+			}
 		}
 	}
 }
@@ -270,6 +357,9 @@ func (rr *rawxRequest) copyChunk() {
 func (rr *rawxRequest) checkChunk() {
 	chunkIn, err := rr.rawx.repo.get(rr.chunkID)
 	if err != nil {
+		if os.IsNotExist(err) && rr.replyMoved() {
+			return
+		}
 		rr.replyError(err)
 		return
 	}
@@ -281,6 +371,9 @@ func (rr *rawxRequest) checkChunk() {
 		rr.replyError(err)
 		return
 	}
+	if rr.replyPreconditions() {
+		return
+	}
 
 	if GetBool(rr.req.Header.Get(HeaderNameCheckHash), false) {
 		expected_hash := rr.req.Header.Get(HeaderNameChunkChecksum)
@@ -300,8 +393,11 @@ func (rr *rawxRequest) checkChunk() {
 			defer filter.Close()
 		}
 
-		h := md5.New()
-		if _, err = io.Copy(h, in); err == nil {
+		var h hash.Hash
+		if h, err = rr.chunk.newHash(); err == nil {
+			_, err = copyPooled(h, in)
+		}
+		if err == nil {
 			actual_hash := strings.ToUpper(hex.EncodeToString(h.Sum(nil)))
 			if expected_hash != actual_hash {
 				rr.replyCode(http.StatusPreconditionFailed)
@@ -315,44 +411,34 @@ func (rr *rawxRequest) checkChunk() {
 	}
 
 	headers := rr.rep.Header()
-	rr.chunk.fillHeaders(headers)
-	headers.Set("Content-Length", strconv.FormatUint(uint64(rr.chunk.size), 10))
-	headers.Set("Accept-Ranges", "bytes")
+	rr.fillChunkHeaders(headers, chunkIn)
+	if _, ok := rr.fillStoredHeaders(headers, chunkIn); !ok {
+		headers.Set("Content-Length", strconv.FormatUint(uint64(rr.chunk.size), 10))
+	}
 
 	rr.replyCode(http.StatusOK)
 }
 
-func (rr *rawxRequest) getRange(chunkSize int64) (rangeInfo, error) {
-	ri := rangeInfo{}
-	headerRange := rr.req.Header.Get("Range")
-	if headerRange == "" || chunkSize == 0 {
-		return ri, nil
-	}
-
-	var offset int64
-	var last int64
-	if nb, err := fmt.Sscanf(headerRange, "bytes=%d-%d", &offset, &last); err != nil || nb != 2 {
-		return ri, nil
-	}
-	if offset < 0 || last < 0 || offset > last {
-		return ri, nil
-	}
-	LogWarning("Range chunksize=%v offset=%v last=%v", chunkSize, offset, last)
-	if offset >= chunkSize {
-		return ri, errInvalidRange
+// Fill the headers of the reply with the whole metadata of the chunk, the
+// same upon GET and HEAD.
+func (rr *rawxRequest) fillChunkHeaders(headers http.Header, in fileReader) {
+	rr.chunk.fillHeaders(headers)
+	setHeader(headers, HeaderNameCompression, rr.chunk.compression)
+	if mtime, ok := lastModified(in); ok {
+		headers.Set("Last-Modified", mtime.Format(http.TimeFormat))
 	}
-	if last >= chunkSize {
-		last = chunkSize - 1
+	headers.Set("Accept-Ranges", "bytes")
+	if rr.encodingNegotiable() {
+		headers.Add("Vary", "Accept-Encoding")
 	}
-	ri.offset = offset
-	ri.last = last
-	ri.size = last - offset + 1
-	return ri, nil
 }
 
 func (rr *rawxRequest) downloadChunk() {
 	inChunk, err := rr.rawx.repo.get(rr.chunkID)
 	if err != nil {
+		if os.IsNotExist(err) && rr.replyMoved() {
+			return
+		}
 		rr.replyError(err)
 		return
 	}
@@ -362,6 +448,12 @@ func (rr *rawxRequest) downloadChunk() {
 		rr.replyError(err)
 		return
 	}
+	if rr.replyPreconditions() {
+		return
+	}
+	if repo, ok := rr.rawx.repo.(*chunkRepository); ok {
+		repo.touch(rr.chunkID)
+	}
 
 	var rangeInf rangeInfo
 	// A potential decompression filter
@@ -369,10 +461,44 @@ func (rr *rawxRequest) downloadChunk() {
 	// Actual reader that will be used
 	var in *io.LimitedReader
 
-	// Load the range, with the specific case of the compression
-	rangeInf, err = rr.getRange(rr.chunk.size)
-	if err != nil {
-		rr.replyError(err)
+	// Load the range, unless the chunk changed since the client got a part
+	if headerRange := rr.req.Header.Get("Range"); headerRange != "" && rr.ifRangeHolds(inChunk) {
+		ranges, err := parseRanges(headerRange, rr.chunk.size)
+		if err == errInvalidRange {
+			rr.rep.Header().Set("Content-Range", fmt.Sprintf("bytes */%v", rr.chunk.size))
+		}
+		if err != nil {
+			rr.replyError(err)
+			return
+		}
+		if len(ranges) > 1 {
+			rr.downloadRanges(inChunk, ranges)
+			return
+		} else if len(ranges) == 1 {
+			rangeInf = ranges[0]
+		}
+	}
+
+	// Only the blocks covering the range, when the chunk is sealed
+	verified := false
+	if !rangeInf.isVoid() && rr.rawx.verifyGet != verifyGetOff {
+		if tree, _ := loadHashTree(inChunk); tree != nil {
+			if err = rr.verifyBlocks(inChunk, tree, rangeInf.offset, rangeInf.last); err != nil {
+				rr.replyError(err)
+				return
+			}
+			verified = true
+		}
+	}
+
+	if !verified && rr.verifiable() && rr.rawx.verifyGet == verifyGetStrict {
+		if err = rr.verifyChunk(inChunk); err != nil {
+			rr.replyError(err)
+			return
+		}
+	}
+
+	if rangeInf.isVoid() && rr.downloadStored(inChunk) {
 		return
 	}
 
@@ -387,7 +513,10 @@ func (rr *rawxRequest) downloadChunk() {
 
 	// Prepare the headers of the reply
 	headers := rr.rep.Header()
-	rr.chunk.fillHeaders(headers)
+	rr.fillChunkHeaders(headers, inChunk)
+	if rangeInf.isVoid() && rr.downloadEncoded(in) {
+		return
+	}
 	if !rangeInf.isVoid() {
 		headers.Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v",
 			rangeInf.offset, rangeInf.last, rr.chunk.size))
@@ -399,7 +528,17 @@ func (rr *rawxRequest) downloadChunk() {
 	}
 
 	// Now transmit the clear data to the client
-	nb, err := io.Copy(rr.rep, in)
+	var nb int64
+	if rangeInf.isVoid() && rr.verifiable() && rr.rawx.verifyGet == verifyGetStream {
+		nb, err = rr.copyVerified(rr.rep, in)
+		if err == errCorruptedChunk {
+			// Reported as such in the access log, the client sees a
+			// truncated reply.
+			rr.status = http.StatusInternalServerError
+		}
+	} else {
+		nb, err = copyMapped(rr.rep, in, inChunk)
+	}
 	if err == nil {
 		rr.bytesOut = rr.bytesOut + uint64(nb)
 	} else {
@@ -408,21 +547,27 @@ func (rr *rawxRequest) downloadChunk() {
 }
 
 func (rr *rawxRequest) getChunkReader(inChunk fileReader, cs int64, ri rangeInfo) (in *io.LimitedReader, filter io.ReadCloser, err error) {
-	// !!!(jfs): we do not manage requests on multiple ranges
-	// TODO(jfs): is a multiple range is encountered, we should follow the norm
-	// that allows us to answer a "200 OK" with the complete content.
-	switch rr.chunk.compression {
-	case compressionZlib:
-		filter, err = zlib.NewReader(inChunk.File())
-	case compressionLzw:
-		filter = lzw.NewReader(inChunk.File(), lzw.MSB, 8)
-	case compressionDeflate:
-		filter = flate.NewReader(inChunk.File())
-	case "", compressionOff:
-		filter = nil
-	default:
-		err = errCompressionNotManaged
+	// A single range, the multiple ranges are served part by part (see
+	// multirange.go). The clear data, when the chunk is encrypted.
+	var data io.Reader = inChunk
+	dec, err := rr.chunk.makeDecrypter(inChunk)
+	if err != nil {
+		return nil, nil, err
+	}
+	if dec != nil {
+		data = dec
+	}
+
+	var d *zstdDict
+	if rr.chunk.compressionDict != "" {
+		if zstdDicts == nil {
+			return nil, nil, errDictNotFound
+		}
+		if d, err = zstdDicts.get(rr.chunk.compressionDict); err != nil {
+			return nil, nil, err
+		}
 	}
+	filter, err = makeDecompressor(rr.chunk.compression, d, data)
 
 	if err == nil {
 		if filter != nil {
@@ -433,6 +578,13 @@ func (rr *rawxRequest) getChunkReader(inChunk fileReader, cs int64, ri rangeInfo
 			} else {
 				in = &io.LimitedReader{R: filter, N: cs}
 			}
+		} else if dec != nil {
+			// No compression, the encrypted segments allow the ranges
+			in = &io.LimitedReader{R: dec, N: cs}
+			if !ri.isVoid() {
+				err = dec.seek(ri.offset)
+				in.N = ri.size
+			}
 		} else {
 			// No compression, we can serve the raw file
 			in = &io.LimitedReader{R: inChunk.File(), N: cs}
@@ -447,7 +599,14 @@ func (rr *rawxRequest) getChunkReader(inChunk fileReader, cs int64, ri rangeInfo
 }
 
 func (rr *rawxRequest) removeChunk() {
-	tmp := make([]byte, 2048, 2048)
+	movedTo, err := rr.movedTo()
+	if err != nil {
+		rr.replyError(err)
+		return
+	}
+
+	tmp := getBuffer(2048)
+	defer putBuffer(tmp)
 	getter := func(name, key string) (string, error) {
 		nb, err := rr.rawx.repo.getAttr(name, key, tmp)
 		if nb <= 0 || err != nil {
@@ -458,21 +617,54 @@ func (rr *rawxRequest) removeChunk() {
 	}
 
 	// Load only the fullpath in an attempt to spare syscalls
-	err := rr.chunk.loadFullPath(getter, rr.chunkID)
+	err = rr.chunk.loadFullPath(getter, rr.chunkID)
 	if err != nil {
 		rr.replyError(err)
 		return
 	}
 
+	if rr.quotas() != nil {
+		rr.chunk.ChunkSize, _ = getter(rr.chunkID, AttrNameChunkSize)
+	}
+	if rr.conditional() {
+		lock := chunkLock(rr.chunkID)
+		lock.Lock()
+		defer lock.Unlock()
+		rr.chunk.ChunkHash, _ = getter(rr.chunkID, AttrNameChunkChecksum)
+		if rr.replyPreconditions() {
+			return
+		}
+		if ok, err := rr.unmodifiedSince(); err != nil {
+			rr.replyError(err)
+			return
+		} else if !ok {
+			setHeader(rr.rep.Header(), "ETag", rr.chunk.etag())
+			rr.replyCode(http.StatusPreconditionFailed)
+			return
+		}
+	}
+
 	err = rr.rawx.repo.del(rr.chunkID)
+	if err == nil {
+		rr.accountChunk(&rr.chunk, -1)
+		rr.leaveTombstone(movedTo)
+	}
 	if err != nil {
 		if !os.IsNotExist(err) {
 			LogWarning("Failed to remove chunk %s", err)
 		}
 		rr.replyError(err)
+	} else if !notifConf().syncDelete {
+		rr.replyCode(http.StatusNoContent)
+		NotifyDel(rr.rawx, rr.reqid, &rr.chunk)
+	} else if err = rr.notifySync(eventTypeDelChunk); err == errDeadlineExceeded {
+		rr.replyError(err)
+	} else if err != nil {
+		LogError("Event not acknowledged: %s", err)
+		setError(rr.rep, err)
+		rr.replyCode(http.StatusServiceUnavailable)
 	} else {
 		rr.replyCode(http.StatusNoContent)
-		NotifyDel(rr.rawx.notifier, rr.reqid, &rr.chunk)
 	}
 }
 
@@ -482,6 +674,21 @@ func (rr *rawxRequest) serveChunk() {
 		return
 	}
 	rr.chunkID = strings.ToUpper(rr.req.URL.Path[1:])
+	if err := rr.checkPresigned(); err != nil {
+		rr.drain()
+		rr.replyError(err)
+		return
+	}
+	if err := rr.checkPriority(); err != nil {
+		rr.replyError(err)
+		return
+	}
+	release, err := rr.admit()
+	if err != nil {
+		rr.replyError(err)
+		return
+	}
+	defer release()
 
 	var spent uint64
 	switch rr.req.Method {
@@ -495,6 +702,9 @@ func (rr *rawxRequest) serveChunk() {
 	case "PUT":
 		rr.uploadChunk()
 		spent = IncrementStatReqPut(rr)
+	case "PATCH":
+		rr.appendChunk()
+		spent = IncrementStatReqPut(rr)
 	case "DELETE":
 		if err := rr.drain(); err != nil {
 			rr.replyError(err)
@@ -516,6 +726,15 @@ func (rr *rawxRequest) serveChunk() {
 			rr.copyChunk()
 		}
 		spent = IncrementStatReqCopy(rr)
+	case "POST":
+		if err := rr.drain(); err != nil {
+			rr.replyError(err)
+		} else if rr.req.Header.Get("Destination") != "" {
+			rr.copyChunk()
+		} else {
+			rr.updateChunk()
+		}
+		spent = IncrementStatReqCopy(rr)
 	default:
 		if err := rr.drain(); err != nil {
 			rr.replyError(err)
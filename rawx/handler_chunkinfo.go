@@ -0,0 +1,142 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The metadata of a chunk in JSON, with GET /chunk/<CHUNKID>/info, for the
+tools that would otherwise parse the headers of a HEAD:
+
+	{"full_path": "...", "container_id": "...", "content_path": "...",
+	 "content_version": "...", "content_id": "...", "chunk_id": "...",
+	 "chunk_position": "0", "chunk_hash": "...", "chunk_size": "1048576",
+	 "size": 1048576, "hash_algo": "md5", "compression": "zstd",
+	 "etag": "\"...\"", "last_modified": "2019-06-01T12:00:00Z", ...}
+
+The attributes absent are omitted. The keys of the encryption are never
+replied, only the scheme. The data isn't read, the HEAD with
+X-oio-check-hash or GET /check/<CHUNKID> verify it. The conditional headers
+apply like upon a HEAD of the chunk.
+*/
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const (
+	chunkInfoPathPrefix = "/chunk/"
+	chunkInfoPathSuffix = "/info"
+)
+
+type chunkStat struct {
+	chunkInfo
+	Size            int64  `json:"size"`
+	HashAlgo        string `json:"hash_algo"`
+	Compression     string `json:"compression,omitempty"`
+	CompressionDict string `json:"compression_dict,omitempty"`
+	Encryption      string `json:"encryption,omitempty"`
+	Sealed          bool   `json:"sealed"`
+	ETag            string `json:"etag,omitempty"`
+	LastModified    string `json:"last_modified,omitempty"`
+}
+
+func (rr *rawxRequest) statChunk() (*chunkStat, bool) {
+	inChunk, err := rr.rawx.repo.get(rr.chunkID)
+	if err != nil {
+		rr.replyError(err)
+		return nil, false
+	}
+	defer inChunk.Close()
+
+	if err = rr.chunk.loadAttr(inChunk, rr.chunkID); err != nil {
+		LogError("Failed to load xattr: %s", err)
+		rr.replyError(err)
+		return nil, false
+	}
+	if rr.replyPreconditions() {
+		return nil, false
+	}
+
+	stat := &chunkStat{
+		chunkInfo:       rr.chunk,
+		Size:            rr.chunk.size,
+		HashAlgo:        rr.chunk.hashAlgo,
+		Compression:     rr.chunk.compression,
+		CompressionDict: rr.chunk.compressionDict,
+		Encryption:      rr.chunk.encryption,
+		ETag:            rr.chunk.etag(),
+	}
+	if stat.HashAlgo == "" {
+		stat.HashAlgo = hashAlgoMD5
+	}
+	if tree, _ := loadHashTree(inChunk); tree != nil {
+		stat.Sealed = true
+	}
+	if mtime, ok := lastModified(inChunk); ok {
+		stat.LastModified = mtime.Format("2006-01-02T15:04:05Z")
+	}
+	return stat, true
+}
+
+func (rr *rawxRequest) serveChunkInfo(rep http.ResponseWriter, req *http.Request) {
+	if err := rr.drain(); err != nil {
+		rr.replyError(err)
+		return
+	}
+
+	var spent uint64
+	id := strings.TrimPrefix(req.URL.Path, chunkInfoPathPrefix)
+	if !strings.HasSuffix(id, chunkInfoPathSuffix) ||
+		!isHexaString(strings.TrimSuffix(id, chunkInfoPathSuffix), 64) {
+		rr.replyError(errInvalidChunkID)
+		spent = IncrementStatReqOther(rr)
+	} else if req.Method != "GET" && req.Method != "HEAD" {
+		rr.replyCode(http.StatusMethodNotAllowed)
+		spent = IncrementStatReqOther(rr)
+	} else {
+		rr.chunkID = strings.ToUpper(strings.TrimSuffix(id, chunkInfoPathSuffix))
+		if stat, ok := rr.statChunk(); ok {
+			if body, err := json.Marshal(stat); err != nil {
+				rr.replyError(err)
+			} else {
+				rep.Header().Set("Content-Type", "application/json")
+				setHeader(rep.Header(), "ETag", stat.ETag)
+				rr.replyCode(http.StatusOK)
+				if req.Method == "GET" {
+					rep.Write(body)
+					rr.bytesOut = uint64(len(body))
+				}
+			}
+		}
+		spent = IncrementStatReqInfo(rr)
+	}
+
+	if isVerbose() {
+		LogHttp(AccessLogEvent{
+			status:    rr.status,
+			timeSpent: spent,
+			bytesIn:   rr.bytesIn,
+			bytesOut:  rr.bytesOut,
+			method:    rr.req.Method,
+			local:     rr.rawx.url,
+			peer:      rr.req.RemoteAddr,
+			path:      rr.req.URL.Path,
+			reqId:     rr.reqid,
+		})
+	}
+}
@@ -35,6 +35,26 @@ func doGetInfo(rr *rawxRequest) {
 		bb.WriteRune('\n')
 	}
 
+	// The conscience-agent takes the service down upon anything but a 200
+	if repo, ok := rr.rawx.repo.(*chunkRepository); ok {
+		if state := repo.sub.healthState(); state != healthOK {
+			bb.WriteString("health ")
+			bb.WriteString(healthNames[state])
+			bb.WriteRune('\n')
+			rr.rep.Header().Set("Content-Type", "text/plain")
+			rr.replyCode(http.StatusServiceUnavailable)
+			rr.rep.Write(bb.Bytes())
+			return
+		}
+		if repo.sub.inMaintenance() {
+			bb.WriteString("maintenance true\n")
+			rr.rep.Header().Set("Content-Type", "text/plain")
+			rr.replyCode(http.StatusServiceUnavailable)
+			rr.rep.Write(bb.Bytes())
+			return
+		}
+	}
+
 	rr.replyCode(http.StatusOK)
 	rr.rep.Write(bb.Bytes())
 }
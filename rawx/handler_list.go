@@ -0,0 +1,220 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The listing of the chunks of the volume, for the rebuilders and the
+auditors, in the order of their IDs and by pages:
+
+	GET /list?marker=<CHUNKID>&prefix=<HEX>&max=<N>&meta=1
+
+replies the at most max (1000 by default) chunks after the marker, whose ID
+starts with the prefix, with their attributes when meta is set:
+
+	{"chunks":[{"chunk_id":"...", ...}], "truncated":true, "next_marker":"..."}
+
+The chunks of the cold tier are listed with those of the volume. Each page
+walks the whole volume, only the first level of directories being pruned.
+*/
+
+import (
+	"container/heap"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	listDefaultMax = 1000
+	listMaxMax     = 10000
+)
+
+type listReply struct {
+	Chunks     []chunkInfo `json:"chunks"`
+	Truncated  bool        `json:"truncated"`
+	NextMarker string      `json:"next_marker,omitempty"`
+}
+
+// A max-heap of names, to keep the smallest ones
+type nameHeap []string
+
+func (h nameHeap) Len() int            { return len(h) }
+func (h nameHeap) Less(i, j int) bool  { return h[i] > h[j] }
+func (h nameHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *nameHeap) Push(x interface{}) { *h = append(*h, x.(string)) }
+func (h *nameHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Collects the max+1 first names after the marker, with the prefix
+func (fr *fileRepository) listNames(marker, prefix string, max int, names *nameHeap) error {
+	width := fr.hashWidth
+	return filepath.Walk(fr.root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		name := strings.ToUpper(fi.Name())
+		if fi.IsDir() {
+			if path == fr.root {
+				return nil
+			}
+			if strings.HasPrefix(name, ".") {
+				return filepath.SkipDir
+			}
+			// The first level holds the first characters of the names
+			if filepath.Dir(path) == fr.root && fr.migrateFrom == nil && len(name) == width {
+				if marker != "" && name < marker[:width] {
+					return filepath.SkipDir
+				}
+				n := len(prefix)
+				if n > width {
+					n = width
+				}
+				if name[:n] != prefix[:n] {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() || !isHexaString(name, 64) {
+			return nil
+		}
+		if name <= marker || !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		if names.Len() <= max {
+			heap.Push(names, name)
+		} else if name < (*names)[0] {
+			(*names)[0] = name
+			heap.Fix(names, 0)
+		}
+		return nil
+	})
+}
+
+func doGetList(rr *rawxRequest) {
+	repo, ok := rr.rawx.repo.(*chunkRepository)
+	if !ok {
+		rr.replyCode(http.StatusNotImplemented)
+		return
+	}
+	query := rr.req.URL.Query()
+	marker := strings.ToUpper(query.Get("marker"))
+	if marker != "" && !isHexaString(marker, 64) {
+		rr.replyError(errListMarker)
+		return
+	}
+	prefix := strings.ToUpper(query.Get("prefix"))
+	if len(prefix) > 64 || (prefix != "" && !isHexaString(prefix, 0)) {
+		rr.replyError(errListPrefix)
+		return
+	}
+	max := listDefaultMax
+	if v := query.Get("max"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			rr.replyError(os.ErrInvalid)
+			return
+		}
+		if n < listMaxMax {
+			max = n
+		} else {
+			max = listMaxMax
+		}
+	}
+	withMeta := GetBool(query.Get("meta"), false)
+
+	names := &nameHeap{}
+	err := repo.sub.listNames(marker, prefix, max, names)
+	if err == nil && repo.cold != nil {
+		err = repo.cold.listNames(marker, prefix, max, names)
+	}
+	if err != nil {
+		LogError("Failed to list the chunks: %v", err)
+		rr.replyError(err)
+		return
+	}
+
+	sorted := make([]string, names.Len())
+	for i := len(sorted) - 1; i >= 0; i-- {
+		sorted[i] = heap.Pop(names).(string)
+	}
+	reply := listReply{Chunks: []chunkInfo{}}
+	if len(sorted) > max {
+		sorted = sorted[:max]
+		reply.Truncated = true
+		reply.NextMarker = sorted[max-1]
+	}
+	for _, name := range sorted {
+		chunk := chunkInfo{ChunkID: name}
+		if withMeta {
+			if err := repo.loadInfo(name, &chunk); err != nil {
+				// Deleted since the walk
+				continue
+			}
+		}
+		reply.Chunks = append(reply.Chunks, chunk)
+	}
+
+	body, err := json.Marshal(&reply)
+	if err != nil {
+		rr.replyError(err)
+		return
+	}
+	rr.rep.Header().Set("Content-Type", "application/json")
+	rr.replyCode(http.StatusOK)
+	rr.rep.Write(body)
+}
+
+func (rr *rawxRequest) serveList(rep http.ResponseWriter, req *http.Request) {
+	if err := rr.drain(); err != nil {
+		rr.replyError(err)
+		return
+	}
+
+	var spent uint64
+	switch req.Method {
+	case "GET", "HEAD":
+		doGetList(rr)
+		spent = IncrementStatReqInfo(rr)
+	default:
+		rr.replyCode(http.StatusMethodNotAllowed)
+		spent = IncrementStatReqOther(rr)
+	}
+	if isVerbose() {
+		LogHttp(AccessLogEvent{
+			status:    rr.status,
+			timeSpent: spent,
+			bytesIn:   rr.bytesIn,
+			bytesOut:  rr.bytesOut,
+			method:    rr.req.Method,
+			local:     rr.rawx.url,
+			peer:      rr.req.RemoteAddr,
+			path:      rr.req.URL.Path,
+			reqId:     rr.reqid,
+		})
+	}
+}
@@ -0,0 +1,148 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The self-description of the service, replied in JSON to an OPTIONS on its
+root (or on "*"), so that the clients and the proxy detect the features of
+each RAWX instead of guessing them from its version:
+
+	{"service": "rawx", "version": "4.2",
+	 "routes": {"/<CHUNKID>": ["GET", "HEAD", "PUT", ...], ...},
+	 "extensions": ["ranges", "copy", "append", ...],
+	 "checksum_algorithms": ["md5", "sha256", "xxh64"],
+	 "compression": ["zlib", "lz4", ...],
+	 "limits": {"max_concurrent_get": 64, ...}}
+
+The optional features only appear when configured (or built) so.
+*/
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+type apiDescription struct {
+	Service            string              `json:"service"`
+	Version            string              `json:"version"`
+	Namespace          string              `json:"namespace"`
+	ServiceID          string              `json:"service_id,omitempty"`
+	Routes             map[string][]string `json:"routes"`
+	Extensions         []string            `json:"extensions"`
+	ChecksumAlgorithms []string            `json:"checksum_algorithms"`
+	Compression        []string            `json:"compression"`
+	ContentEncoding    []string            `json:"content_encoding,omitempty"`
+	Limits             map[string]int64    `json:"limits"`
+}
+
+var chunkMethods = []string{"GET", "HEAD", "PUT", "PATCH", "DELETE", "COPY", "POST"}
+
+func isRootPath(path string) bool {
+	return path == "/" || path == "*"
+}
+
+func (rr *rawxRequest) describe() apiDescription {
+	desc := apiDescription{
+		Service:   "rawx",
+		Version:   OioVersion,
+		Namespace: rr.rawx.ns,
+		ServiceID: rr.rawx.id,
+		Routes: map[string][]string{
+			"/<CHUNKID>":                    chunkMethods,
+			"/info":                         {"GET", "HEAD"},
+			"/stat":                         {"GET", "HEAD"},
+			"/list":                         {"GET", "HEAD"},
+			"/quarantine":                   {"GET", "HEAD"},
+			"/snapshot":                     {"POST"},
+			txnPathPrefix + "<ID>":          {"POST", "DELETE"},
+			sessionPathPrefix:               {"POST"},
+			sessionPathPrefix + "<ID>":      {"PUT", "HEAD", "POST", "DELETE"},
+			"/chunk/<CHUNKID>/info":         {"GET", "HEAD"},
+			checkPathPrefix + "<CHUNKID>":   {"GET"},
+			adminConfigPath:                 {"GET", "POST"},
+			adminResyncPrefix + "<CHUNKID>": {"POST"},
+			"/":                             {"OPTIONS"},
+		},
+		Extensions: []string{
+			"ranges", "multipart-ranges", "copy", "append", "metadata-update",
+			"conditional", "transactions", "sessions", "check",
+			"checksum-trailers", "expect-continue", "resync",
+			"chunk-info", "moved-redirect",
+		},
+		ChecksumAlgorithms: []string{hashAlgoMD5, hashAlgoSHA256, hashAlgoXXH64},
+		Compression: []string{compressionZlib, compressionDeflate,
+			compressionLzw, compressionZstd, compressionLz4},
+		ContentEncoding: []string{encodingZstd, encodingDeflate},
+		Limits: map[string]int64{
+			"max_concurrent_get": atomic.LoadInt64(&maxConcurrentGet),
+			"max_concurrent_put": atomic.LoadInt64(&maxConcurrentPut),
+			"max_connections":    maxConnections,
+			"client_bandwidth":   atomic.LoadInt64(&clientBandwidth),
+			"client_rate":        atomic.LoadInt64(&clientRate),
+			"max_chunk_size":     maxChunkSize,
+			"txn_timeout":        int64(txnTimeout.Seconds()),
+		},
+	}
+	if _, err := newBlake3(); err == nil {
+		desc.ChecksumAlgorithms = append(desc.ChecksumAlgorithms, hashAlgoBlake3)
+	}
+	if contentEncoding {
+		desc.ContentEncoding = append(desc.ContentEncoding, encodingGzip)
+	}
+	if len(presignKeys) > 0 {
+		desc.Extensions = append(desc.Extensions, "presigned-urls")
+	}
+	if hashTreeBlockSize > 0 {
+		desc.Extensions = append(desc.Extensions, "hash-tree")
+		desc.Limits["hash_tree_block_size"] = hashTreeBlockSize
+	}
+	return desc
+}
+
+func (rr *rawxRequest) serveOptions(rep http.ResponseWriter, req *http.Request) {
+	if err := rr.drain(); err != nil {
+		rr.replyError(err)
+		return
+	}
+
+	rep.Header().Set("Allow", strings.Join(append([]string{"OPTIONS"}, chunkMethods...), ", "))
+	if body, err := json.Marshal(rr.describe()); err != nil {
+		rr.replyError(err)
+	} else {
+		rep.Header().Set("Content-Type", "application/json")
+		rr.replyCode(http.StatusOK)
+		rep.Write(body)
+		rr.bytesOut = uint64(len(body))
+	}
+	spent := IncrementStatReqInfo(rr)
+
+	if isVerbose() {
+		LogHttp(AccessLogEvent{
+			status:    rr.status,
+			timeSpent: spent,
+			bytesIn:   rr.bytesIn,
+			bytesOut:  rr.bytesOut,
+			method:    rr.req.Method,
+			local:     rr.rawx.url,
+			peer:      rr.req.RemoteAddr,
+			path:      rr.req.URL.Path,
+			reqId:     rr.reqid,
+		})
+	}
+}
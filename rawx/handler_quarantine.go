@@ -0,0 +1,73 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Lists the chunks in the quarantine of the volume, with their attributes
+func doGetQuarantine(rr *rawxRequest) {
+	chunks, err := rr.rawx.repo.quarantined()
+	if err != nil {
+		LogError("Failed to list the quarantine: %v", err)
+		rr.replyError(err)
+		return
+	}
+	if chunks == nil {
+		chunks = []quarantinedChunk{}
+	}
+	body, err := json.Marshal(chunks)
+	if err != nil {
+		rr.replyError(err)
+		return
+	}
+	rr.rep.Header().Set("Content-Type", "application/json")
+	rr.replyCode(http.StatusOK)
+	rr.rep.Write(body)
+}
+
+func (rr *rawxRequest) serveQuarantine(rep http.ResponseWriter, req *http.Request) {
+	if err := rr.drain(); err != nil {
+		rr.replyError(err)
+		return
+	}
+
+	var spent uint64
+	switch req.Method {
+	case "GET", "HEAD":
+		doGetQuarantine(rr)
+		spent = IncrementStatReqInfo(rr)
+	default:
+		rr.replyCode(http.StatusMethodNotAllowed)
+		spent = IncrementStatReqOther(rr)
+	}
+	if isVerbose() {
+		LogHttp(AccessLogEvent{
+			status:    rr.status,
+			timeSpent: spent,
+			bytesIn:   rr.bytesIn,
+			bytesOut:  rr.bytesOut,
+			method:    rr.req.Method,
+			local:     rr.rawx.url,
+			peer:      rr.req.RemoteAddr,
+			path:      rr.req.URL.Path,
+			reqId:     rr.reqid,
+		})
+	}
+}
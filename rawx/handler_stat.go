@@ -56,6 +56,87 @@ type statInfo struct {
 
 	RepBread    uint64 `tag:"rep.bread"`
 	RepBwritten uint64 `tag:"rep.bwritten"`
+
+	EventsDroppedRate      uint64 `tag:"events.dropped.rate"`
+	EventsDroppedSampling  uint64 `tag:"events.dropped.sampling"`
+	EventsDroppedDuplicate uint64 `tag:"events.dropped.duplicate"`
+	EventsInvalid          uint64 `tag:"events.invalid"`
+
+	TierDemoted uint64 `tag:"tier.demoted"`
+
+	ChunksCorrupted uint64 `tag:"chunks.corrupted"`
+	ScrubChunks     uint64 `tag:"scrub.chunks"`
+	ScrubBytes      uint64 `tag:"scrub.bytes"`
+	ScrubBlocks     uint64 `tag:"scrub.blocks"`
+	ChunksChecked   uint64 `tag:"chunks.checked"`
+
+	LayoutMigrated uint64 `tag:"layout.migrated"`
+
+	OrphansFound   uint64 `tag:"orphans.found"`
+	OrphansDeleted uint64 `tag:"orphans.deleted"`
+
+	DiscardBytes   uint64 `tag:"discard.bytes"`
+	Reflinks       uint64 `tag:"reflinks"`
+	CopiedChunks   uint64 `tag:"copied.chunks"`
+	AppendedChunks uint64 `tag:"appended.chunks"`
+	UpdatedChunks  uint64 `tag:"updated.chunks"`
+
+	ReadaheadBytes   uint64 `tag:"readahead.bytes"`
+	BuffersAllocated uint64 `tag:"buffers.allocated"`
+	MmapChunks       uint64 `tag:"mmap.chunks"`
+
+	HealthChanges uint64 `tag:"health.changes"`
+	AdminChanges  uint64 `tag:"admin.changes"`
+
+	OffloadChunks      uint64 `tag:"offload.chunks"`
+	OffloadBytes       uint64 `tag:"offload.bytes"`
+	OffloadFetched     uint64 `tag:"offload.fetched"`
+	OffloadRehydrated  uint64 `tag:"offload.rehydrated"`
+	SlabPacked         uint64 `tag:"slab.packed"`
+	SlabCompactions    uint64 `tag:"slab.compactions"`
+	FormatConverted    uint64 `tag:"format.converted"`
+	JournalFinished    uint64 `tag:"journal.finished"`
+	JournalDiscarded   uint64 `tag:"journal.discarded"`
+	FsyncGroups        uint64 `tag:"fsync.groups"`
+	TxnCommitted       uint64 `tag:"txn.committed"`
+	TxnAborted         uint64 `tag:"txn.aborted"`
+	DedupChunks        uint64 `tag:"dedup.chunks"`
+	DedupBytes         uint64 `tag:"dedup.bytes"`
+	SparseBytes        uint64 `tag:"sparse.bytes"`
+	DictTrained        uint64 `tag:"dict.trained"`
+	SnapshotTaken      uint64 `tag:"snapshot.taken"`
+	SnapshotFailed     uint64 `tag:"snapshot.failed"`
+	StatfsCalls        uint64 `tag:"statfs.calls"`
+	PendingReaped      uint64 `tag:"pending.reaped"`
+	QuotaRefused       uint64 `tag:"quota.refused"`
+	RebalanceMoved     uint64 `tag:"rebalance.moved"`
+	TLSReloads         uint64 `tag:"tls.reloads"`
+	ChecksumMismatches uint64 `tag:"checksum.mismatches"`
+	EncodedStored      uint64 `tag:"encoded.stored"`
+	EncodedOnTheFly    uint64 `tag:"encoded.onthefly"`
+	EncodedSkipped     uint64 `tag:"encoded.skipped"`
+	RateLimited        uint64 `tag:"ratelimit.refused"`
+	ACLRefused         uint64 `tag:"acl.refused"`
+	ChunksTooLarge     uint64 `tag:"chunks.toolarge"`
+	IdempotentReplays  uint64 `tag:"idempotent.replays"`
+	CompressSkipped    uint64 `tag:"compression.skipped"`
+	ConnOpened         uint64 `tag:"connections.opened"`
+	ConnClosed         uint64 `tag:"connections.closed"`
+	ConnReaped         uint64 `tag:"connections.reaped"`
+	ConnRecycled       uint64 `tag:"connections.recycled"`
+	ChunksResynced     uint64 `tag:"chunks.resynced"`
+	ChunksRedirected   uint64 `tag:"chunks.redirected"`
+	MovedTombstones    uint64 `tag:"chunks.tombstones"`
+	MaintenanceRefused uint64 `tag:"maintenance.refused"`
+	DeadlineExceeded   uint64 `tag:"deadline.exceeded"`
+	ConcurrencyRefused uint64 `tag:"concurrency.refused"`
+	PressureChanges    uint64 `tag:"pressure.changes"`
+	PressureRefused    uint64 `tag:"pressure.refused"`
+	PresignRefused     uint64 `tag:"presign.refused"`
+	AuthRefused        uint64 `tag:"auth.refused"`
+
+	TrashChunks uint64 `tag:"trash.chunks"`
+	TrashPurged uint64 `tag:"trash.purged"`
 }
 
 var counters statInfo
@@ -166,6 +247,55 @@ func doGetStats(rr *rawxRequest) {
 	bb.WriteString(rr.rawx.path)
 	bb.WriteRune('\n')
 
+	if repo, ok := rr.rawx.repo.(*chunkRepository); ok {
+		if u, err := repo.sub.usage(); err == nil {
+			bb.WriteString("gauge space.bytes_used_percent ")
+			bb.WriteString(utoa(uint64(u.bytesPercent())))
+			bb.WriteString("\ngauge space.inodes_used_percent ")
+			bb.WriteString(utoa(uint64(u.inodesPercent())))
+			bb.WriteString("\ngauge space.inodes_idle ")
+			bb.WriteString(utoa(uint64(100 - u.inodesPercent())))
+			bb.WriteString("\ngauge space.bytes_used ")
+			bb.WriteString(utoa(u.bytesUsed))
+			bb.WriteString("\ngauge space.bytes_free ")
+			bb.WriteString(utoa(u.bytesFree))
+			bb.WriteString("\ngauge space.bytes_total ")
+			bb.WriteString(utoa(u.bytesTotal))
+			bb.WriteString("\ngauge space.inodes_used ")
+			bb.WriteString(utoa(u.inodesUsed))
+			bb.WriteString("\ngauge space.inodes_free ")
+			bb.WriteString(utoa(u.inodesFree))
+			bb.WriteString("\ngauge space.inodes_total ")
+			bb.WriteString(utoa(u.inodesTotal))
+			bb.WriteRune('\n')
+		}
+		bb.WriteString("gauge space.full ")
+		bb.WriteString(utoa(uint64(atomic.LoadInt32(&repo.sub.full))))
+		if repo.sub.pressure != nil {
+			bb.WriteString("\ngauge pressure.high ")
+			bb.WriteString(utoa(uint64(atomic.LoadInt32(&repo.sub.pressure.high))))
+		}
+		bb.WriteString("\ngauge health.state ")
+		bb.WriteString(utoa(uint64(repo.sub.healthState())))
+		bb.WriteString("\ngauge maintenance ")
+		if repo.sub.inMaintenance() {
+			bb.WriteString("1")
+		} else {
+			bb.WriteString("0")
+		}
+		bb.WriteString("\nconfig health ")
+		bb.WriteString(healthNames[repo.sub.healthState()])
+		bb.WriteRune('\n')
+	}
+
+	bb.WriteString("gauge concurrency.get ")
+	bb.WriteString(utoa(uint64(atomic.LoadInt64(&concurrency.get))))
+	bb.WriteString("\ngauge concurrency.put ")
+	bb.WriteString(utoa(uint64(atomic.LoadInt64(&concurrency.put))))
+	bb.WriteString("\ngauge concurrency.connections ")
+	bb.WriteString(utoa(uint64(atomic.LoadInt64(&concurrency.conns))))
+	bb.WriteRune('\n')
+
 	if rr.rawx.id != "" {
 		bb.WriteString("config service_id ")
 		bb.WriteString(rr.rawx.id)
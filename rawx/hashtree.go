@@ -0,0 +1,262 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The hash trees sealing the content of the chunks. With hash_tree_block_size,
+the clear data of each chunk uploaded is hashed by blocks of that size, and
+the MD5 of the blocks (the leaves) are saved with the root of the Merkle
+tree built on them, in the "user.rawx.hash.tree" attribute:
+
+	<BLOCK SIZE>:<ROOT>:<LEAF 0><LEAF 1>...
+
+So a range may be verified without reading the whole chunk: upon a GET of
+a range with verify_get, only the blocks covering the range are hashed. The
+scrubber verifies the chunks sealed block by block, and only the
+scrub_tree_blocks blocks drawn at random in each chunk (0 for all), so that
+each pass costs a fraction of a full rehash. A corrupted block is handled as
+a corrupted chunk.
+*/
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+// The largest value of an extended attribute
+const hashTreeMaxAttrSize = 65536
+
+var (
+	hashTreeBlockSize int64
+	scrubTreeBlocks   int
+)
+
+var errInvalidHashTree = errors.New("Invalid hash tree")
+
+type hashTree struct {
+	blockSize int64
+	leaves    [][]byte
+}
+
+// Builds the root of the tree, an odd node being promoted as is
+func (t *hashTree) root() []byte {
+	if len(t.leaves) == 0 {
+		sum := md5.Sum(nil)
+		return sum[:]
+	}
+	level := t.leaves
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			h := md5.New()
+			h.Write(level[i])
+			h.Write(level[i+1])
+			next = append(next, h.Sum(nil))
+		}
+		level = next
+	}
+	return level[0]
+}
+
+func (t *hashTree) encode() string {
+	sb := strings.Builder{}
+	sb.Grow(64 + 2*md5.Size*len(t.leaves))
+	sb.WriteString(strconv.FormatInt(t.blockSize, 10))
+	sb.WriteRune(':')
+	sb.WriteString(strings.ToUpper(hex.EncodeToString(t.root())))
+	sb.WriteRune(':')
+	for _, leaf := range t.leaves {
+		sb.WriteString(strings.ToUpper(hex.EncodeToString(leaf)))
+	}
+	return sb.String()
+}
+
+// Parses the tree saved, its root must match its leaves
+func parseHashTree(v string) (*hashTree, error) {
+	fields := strings.Split(v, ":")
+	if len(fields) != 3 || len(fields[2])%(2*md5.Size) != 0 {
+		return nil, errInvalidHashTree
+	}
+	t := &hashTree{}
+	var err error
+	if t.blockSize, err = strconv.ParseInt(fields[0], 10, 64); err != nil || t.blockSize <= 0 {
+		return nil, errInvalidHashTree
+	}
+	raw, err := hex.DecodeString(fields[2])
+	if err != nil {
+		return nil, errInvalidHashTree
+	}
+	for len(raw) > 0 {
+		t.leaves = append(t.leaves, raw[:md5.Size])
+		raw = raw[md5.Size:]
+	}
+	root, err := hex.DecodeString(fields[1])
+	if err != nil || !bytes.Equal(root, t.root()) {
+		return nil, errInvalidHashTree
+	}
+	return t, nil
+}
+
+// Hashes the data written by blocks
+type treeHasher struct {
+	tree    hashTree
+	h       hash.Hash
+	pending int64
+}
+
+func makeTreeHasher(blockSize int64) *treeHasher {
+	return &treeHasher{tree: hashTree{blockSize: blockSize}, h: md5.New()}
+}
+
+func (th *treeHasher) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		n := th.tree.blockSize - th.pending
+		if int64(len(p)) < n {
+			n = int64(len(p))
+		}
+		th.h.Write(p[:n])
+		th.pending += n
+		p = p[n:]
+		if th.pending == th.tree.blockSize {
+			th.tree.leaves = append(th.tree.leaves, th.h.Sum(nil))
+			th.h.Reset()
+			th.pending = 0
+		}
+	}
+	return written, nil
+}
+
+// Tells the tree of the data written, the last block being partial
+func (th *treeHasher) sum() *hashTree {
+	if th.pending > 0 {
+		th.tree.leaves = append(th.tree.leaves, th.h.Sum(nil))
+		th.h.Reset()
+		th.pending = 0
+	}
+	return &th.tree
+}
+
+// Loads the tree of the chunk, nil for a chunk never sealed
+func loadHashTree(inChunk fileReader) (*hashTree, error) {
+	buf := make([]byte, hashTreeMaxAttrSize)
+	l, err := inChunk.getAttr(AttrNameHashTree, buf)
+	if err == syscall.ENODATA || l == 0 {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return parseHashTree(string(buf[:l]))
+}
+
+// Hashes the blocks of the chunk covering [offset, last], then rewinds it
+func (rr *rawxRequest) verifyBlocks(inChunk fileReader, tree *hashTree, offset, last int64) error {
+	first := offset / tree.blockSize
+	end := last/tree.blockSize + 1
+	if end > int64(len(tree.leaves)) {
+		rr.reportCorruption(quarantineTruncated)
+		return errCorruptedChunk
+	}
+	for i := first; i < end; i++ {
+		if _, err := rr.verifyBlock(inChunk, tree, i, nil); err != nil {
+			return err
+		}
+	}
+	return inChunk.seek(0)
+}
+
+// Hashes a block of the chunk, its reads capped to the bandwidth if any
+func (rr *rawxRequest) verifyBlock(inChunk fileReader, tree *hashTree, i int64, bandwidth *tokenBucket) (int64, error) {
+	ri := rangeInfo{offset: i * tree.blockSize, last: (i+1)*tree.blockSize - 1}
+	if ri.last >= rr.chunk.size {
+		ri.last = rr.chunk.size - 1
+	}
+	ri.size = ri.last - ri.offset + 1
+	in, filter, err := rr.getChunkReader(inChunk, rr.chunk.size, ri)
+	if filter != nil {
+		defer filter.Close()
+	}
+	if err != nil {
+		return 0, err
+	}
+	var data io.Reader = in
+	if bandwidth != nil {
+		data = &throttledReader{r: in, bandwidth: bandwidth}
+	}
+	h := md5.New()
+	n, err := copyPooled(h, data)
+	switch {
+	case err == errCorruptedSegment:
+		rr.reportCorruption(quarantineBadSegment)
+		return n, errCorruptedChunk
+	case err != nil:
+		return n, err
+	case n < ri.size:
+		rr.reportCorruption(quarantineTruncated)
+		return n, errCorruptedChunk
+	case !bytes.Equal(h.Sum(nil), tree.leaves[i]):
+		rr.reportCorruption(badBlockReason(i))
+		return n, errCorruptedChunk
+	}
+	return n, nil
+}
+
+func badBlockReason(i int64) string {
+	return quarantineBadBlock + " " + strconv.FormatInt(i, 10)
+}
+
+// Draws the blocks verified by a pass of the scrubber, in order
+func (t *hashTree) scrubbedBlocks() []int {
+	blocks := rand.Perm(len(t.leaves))
+	if scrubTreeBlocks > 0 && scrubTreeBlocks < len(blocks) {
+		blocks = blocks[:scrubTreeBlocks]
+	}
+	sort.Ints(blocks)
+	return blocks
+}
+
+// Tells the first block of the tree not matching the other one, -1 if none
+func (t *hashTree) mismatch(other *hashTree) int {
+	for i, leaf := range t.leaves {
+		if i >= len(other.leaves) || !bytes.Equal(leaf, other.leaves[i]) {
+			return i
+		}
+	}
+	if len(other.leaves) > len(t.leaves) {
+		return len(t.leaves)
+	}
+	return -1
+}
+
+// Tells if a block of clear data may be read without the preceding ones
+func (chunk *chunkInfo) clearSeekable() bool {
+	return chunk.compression == "" || chunk.compression == compressionOff
+}
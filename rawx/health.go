@@ -0,0 +1,198 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Each volume is continuously probed: a canary file is written, synced, read
+back then removed, and the EIO met by the requests are counted. A volume
+that can't be written anymore (or that met too many EIO) is turned read-only,
+a volume that can't be read is turned out of service. Its state only changes
+after health_failures probes in a row agreed, in both directions, so that a
+volume recovers on its own once repaired.
+
+A read-only volume refuses the PUT, DELETE and COPY with a 503, a volume out
+of service refuses every chunk request. In both cases /info replies a 503,
+so that the conscience-agent zeroes the score of the service.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+const (
+	healthOK = iota
+	healthReadOnly
+	healthDown
+)
+
+const (
+	healthCanary          = ".health"
+	healthCanarySize      = 4096
+	healthDefaultInterval = 30
+	healthDefaultFailures = 3
+)
+
+var healthNames = []string{"ok", "readonly", "down"}
+
+var (
+	errVolumeReadOnly = errors.New("Volume read-only")
+	errVolumeDown     = errors.New("Volume out of service")
+)
+
+// Tells if the error is an IO error reported by the device
+func isIOError(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	return err == syscall.EIO
+}
+
+func (fr *fileRepository) countIOError() {
+	atomic.AddUint32(&fr.ioErrors, 1)
+}
+
+func (fr *fileRepository) healthState() int {
+	return int(atomic.LoadInt32(&fr.health))
+}
+
+func (fr *fileRepository) writable() error {
+	if fr.inMaintenance() {
+		atomic.AddUint64(&counters.MaintenanceRefused, 1)
+		return errMaintenance
+	}
+	if atomic.LoadInt32(&fr.readOnly) != 0 {
+		return errVolumeReadOnly
+	}
+	switch fr.healthState() {
+	case healthReadOnly:
+		return errVolumeReadOnly
+	case healthDown:
+		return errVolumeDown
+	}
+	return nil
+}
+
+func (fr *fileRepository) readable() error {
+	if fr.healthState() == healthDown {
+		return errVolumeDown
+	}
+	return nil
+}
+
+// Probes the volume once, then tells the state it deserves
+func (fr *fileRepository) probe() int {
+	canary := bytes.Repeat([]byte(strconv.FormatInt(time.Now().UnixNano(), 16)+"\n"),
+		healthCanarySize/17+1)[:healthCanarySize]
+	err := fr.writeCanary(canary)
+	if err == nil {
+		err = fr.readCanary(canary)
+		_ = syscall.Unlinkat(fr.rootFd, healthCanary, 0)
+		if err != nil {
+			LogWarning("Health probe of %s, read failed: %v", fr.root, err)
+			return healthDown
+		}
+	} else if !isNoSpace(err) {
+		// The reads are probed on the volume itself
+		LogWarning("Health probe of %s, write failed: %v", fr.root, err)
+		if err = fr.readRoot(); err != nil {
+			LogWarning("Health probe of %s, read failed: %v", fr.root, err)
+			return healthDown
+		}
+		return healthReadOnly
+	}
+
+	if eio := atomic.SwapUint32(&fr.ioErrors, 0); fr.healthMaxIOErrors > 0 && int(eio) >= fr.healthMaxIOErrors {
+		LogWarning("Health probe of %s, %d IO errors", fr.root, eio)
+		return healthReadOnly
+	}
+	return healthOK
+}
+
+func (fr *fileRepository) writeCanary(canary []byte) error {
+	fd, err := syscall.Openat(fr.rootFd, healthCanary,
+		syscall.O_CREAT|syscall.O_TRUNC|openFlagsWOnly, fr.putOpenMode)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	if _, err = syscall.Write(fd, canary); err == nil {
+		err = syscall.Fdatasync(fd)
+	}
+	return err
+}
+
+func (fr *fileRepository) readCanary(canary []byte) error {
+	fd, err := syscall.Openat(fr.rootFd, healthCanary, openFlagsROnly, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	// The pages just written would be served from the cache
+	_ = syscall.Fadvise(fd, 0, 0, syscall.FADV_DONTNEED)
+	buf := make([]byte, len(canary))
+	n, err := syscall.Read(fd, buf)
+	if err == nil && !bytes.Equal(buf[:n], canary) {
+		err = syscall.EIO
+	}
+	return err
+}
+
+func (fr *fileRepository) readRoot() error {
+	fd, err := syscall.Openat(fr.rootFd, ".", syscall.O_DIRECTORY|syscall.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	_, err = syscall.ReadDirent(fd, make([]byte, 4096))
+	return err
+}
+
+func (fr *fileRepository) startHealthProbe(interval time.Duration, failures int) {
+	go func() {
+		streak := 0
+		for {
+			time.Sleep(interval)
+			state := fr.probe()
+			current := fr.healthState()
+			if state == current {
+				streak = 0
+				continue
+			}
+			if streak++; streak < failures {
+				continue
+			}
+			streak = 0
+			atomic.StoreInt32(&fr.health, int32(state))
+			atomic.AddUint64(&counters.HealthChanges, 1)
+			if state == healthOK {
+				LogInfo("Volume %s back in service", fr.root)
+			} else {
+				LogError("Volume %s turned %s", fr.root, healthNames[state])
+			}
+		}
+	}()
+}
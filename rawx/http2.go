@@ -0,0 +1,50 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+HTTP/2 on the listener of the service, so that the proxy and the SDKs
+multiplex many operations on small chunks over a few connections. HTTP/2 is
+negotiated with ALPN when the listener serves TLS (tls_cert_file and
+tls_key_file), unless http2 is off. With http2_cleartext, HTTP/2 is also
+accepted without TLS ("h2c" with prior knowledge) next to HTTP/1.1.
+
+http2_max_concurrent_streams caps the requests in flight on a connection,
+http2_conn_window and http2_stream_window size the flow-control windows (in
+bytes) of a connection and of each of its streams. 0 keeps the defaults.
+*/
+
+import (
+	"errors"
+	"net/http"
+)
+
+var errQUICNotBuilt = errors.New("QUIC support not compiled in (build tag quic)")
+
+func configureHTTP2(srv *http.Server, opts optionsMap) {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(opts.getBool("http2", true))
+	protocols.SetUnencryptedHTTP2(opts.getBool("http2_cleartext", false))
+	srv.Protocols = protocols
+
+	srv.HTTP2 = &http.HTTP2Config{
+		MaxConcurrentStreams:          opts.getInt("http2_max_concurrent_streams", 0),
+		MaxReceiveBufferPerConnection: opts.getInt("http2_conn_window", 0),
+		MaxReceiveBufferPerStream:     opts.getInt("http2_stream_window", 0),
+	}
+}
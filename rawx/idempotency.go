@@ -0,0 +1,71 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The idempotent uploads: a PUT may carry an X-oio-Idempotency-Key header,
+saved along with the chunk. When a retry of the upload, e.g. after a
+connection lost before the reply, finds the chunk already there with the
+same key (and the same hash, when the retry tells it), the success of the
+first upload is replied again with its 201, instead of a 409. The body of
+the retry is then discarded, or not even sent with "Expect: 100-continue".
+No event is emitted again.
+*/
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+const idempotencyKeyMaxLength = 128
+
+// Parses the key of the upload, if any
+func (chunk *chunkInfo) retrieveIdempotencyKey(headers *http.Header) error {
+	chunk.idempotencyKey = headers.Get(HeaderNameIdempotencyKey)
+	if len(chunk.idempotencyKey) > idempotencyKeyMaxLength {
+		return returnError(errInvalidHeader, HeaderNameIdempotencyKey)
+	}
+	return nil
+}
+
+// Replies the success of the upload already done, if the chunk there is
+// the one the client retries to upload.
+func (rr *rawxRequest) replayUpload() bool {
+	if rr.chunk.idempotencyKey == "" {
+		return false
+	}
+	in, err := rr.rawx.repo.get(rr.chunkID)
+	if err != nil {
+		return false
+	}
+	defer in.Close()
+	var stored chunkInfo
+	if err = stored.loadAttr(in, rr.chunkID); err != nil {
+		return false
+	}
+	if stored.idempotencyKey != rr.chunk.idempotencyKey {
+		return false
+	}
+	if rr.chunk.ChunkHash != "" && !strings.EqualFold(rr.chunk.ChunkHash, stored.ChunkHash) {
+		return false
+	}
+	atomic.AddUint64(&counters.IdempotentReplays, 1)
+	stored.fillHeadersLight(rr.rep.Header())
+	rr.replyCode(http.StatusCreated)
+	return true
+}
@@ -0,0 +1,112 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The detection of the data not worth compressing: the media files, the
+archives, the encrypted data. With compression_detect, the first bytes of
+each chunk are looked at before any compression: a chunk starting like a
+well-known compressed format, or whose first bytes look random, is stored
+raw, without the cost of a trial compression.
+
+The client might know better, it sends X-oio-incompressible: true for the
+data it knows already compressed (e.g. according to the MIME type of the
+content), then the chunk is stored raw whatever the detection.
+*/
+
+import (
+	"bytes"
+	"math"
+)
+
+// How many bytes are looked at to detect the incompressible data
+const incompressibleSampleSize = 4096
+
+// The entropy (in bits per byte) above which the data is deemed random
+const incompressibleEntropy = 7.5
+
+var compressionDetect = false
+
+// The signatures of the compressed formats, at the start of the data
+var compressedMagics = [][]byte{
+	{0x1f, 0x8b},                       // gzip
+	{0x28, 0xb5, 0x2f, 0xfd},           // zstd
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},   // xz
+	{0x04, 0x22, 0x4d, 0x18},           // lz4
+	[]byte("BZh"),                      // bzip2
+	[]byte("PK\x03\x04"),               // zip, jar, docx...
+	{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, // 7z
+	[]byte("Rar!\x1a\x07"),             // rar
+	{0xff, 0xd8, 0xff},                 // jpeg
+	{0x89, 'P', 'N', 'G', '\r', '\n'},  // png
+	[]byte("GIF8"),                     // gif
+	{0x1a, 0x45, 0xdf, 0xa3},           // matroska, webm
+	[]byte("OggS"),                     // ogg
+	[]byte("fLaC"),                     // flac
+	[]byte("ID3"),                      // mp3
+}
+
+// Tells if the data starts like a compressed format
+func looksCompressed(head []byte) bool {
+	for _, magic := range compressedMagics {
+		if bytes.HasPrefix(head, magic) {
+			return true
+		}
+	}
+	// ISO media (mp4, mov, heic...) and RIFF (webp, avi)
+	if len(head) >= 12 {
+		if bytes.Equal(head[4:8], []byte("ftyp")) {
+			return true
+		}
+		if bytes.HasPrefix(head, []byte("RIFF")) && (bytes.Equal(head[8:12], []byte("WEBP")) || bytes.Equal(head[8:12], []byte("AVI "))) {
+			return true
+		}
+	}
+	return false
+}
+
+// Shannon entropy of the bytes, in bits per byte
+func entropy(data []byte) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+	var freq [256]int
+	for _, b := range data {
+		freq[b]++
+	}
+	var e float64
+	total := float64(len(data))
+	for _, n := range freq {
+		if n > 0 {
+			p := float64(n) / total
+			e -= p * math.Log2(p)
+		}
+	}
+	return e
+}
+
+// Tells if the beginning of the chunk proves the compression useless
+func incompressible(head []byte) bool {
+	if looksCompressed(head) {
+		return true
+	}
+	// Too few bytes for the entropy to mean anything
+	if len(head) < incompressibleSampleSize {
+		return false
+	}
+	return entropy(head) >= incompressibleEntropy
+}
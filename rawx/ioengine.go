@@ -0,0 +1,81 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The IO engine used for the chunk data. By default, the plain read() and
+write() syscalls are used. An io_uring engine can be compiled in with the
+"iouring" build tag, then selected with the "io_engine" option: it batches
+the IOs of the concurrent requests into a single io_uring_enter(). When the
+kernel is too old, the default engine is kept.
+
+The raw download of a chunk is left out of the engine, it is served with
+sendfile() which is already cheaper.
+*/
+
+import (
+	"errors"
+)
+
+type ioEngine interface {
+	pread(fd int, buf []byte, offset int64) (int, error)
+	pwrite(fd int, buf []byte, offset int64) (int, error)
+}
+
+const (
+	ioEngineSync  = "sync"
+	ioEngineUring = "uring"
+)
+
+var errUringNotBuilt = errors.New("io_uring support not compiled in (build tag iouring)")
+
+// The engine in use, nil for the plain syscalls
+var fileEngine ioEngine
+
+func setIOEngine(name string) error {
+	switch name {
+	case "", ioEngineSync:
+		fileEngine = nil
+	case ioEngineUring:
+		engine, err := makeUringEngine()
+		if err != nil {
+			LogWarning("io_uring unavailable, using the plain syscalls: %v", err)
+			fileEngine = nil
+		} else {
+			fileEngine = engine
+		}
+	default:
+		return errors.New("Unexpected IO engine: " + name)
+	}
+	return nil
+}
+
+// Writes the whole buffer, as a write() on a regular file would
+func enginePwriteAll(engine ioEngine, fd int, buf []byte, offset int64) (int, error) {
+	written := 0
+	for written < len(buf) {
+		n, err := engine.pwrite(fd, buf[written:], offset+int64(written))
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, errors.New("short write")
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,77 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The bandwidth of each volume might be capped, for the reads and for the
+writes, so that the device stays under its saturation point. The caps apply
+at the repository layer, thus to the client requests as well as to the
+background tasks (scrubber, tiering...). The raw chunks sent with sendfile()
+are throttled step by step.
+*/
+
+import (
+	"io"
+)
+
+// Size of the steps of the throttled transfers without a readahead window
+const throttleStep = 256 * 1024
+
+func makeBandwidth(rate int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return makeTokenBucket(float64(rate), float64(rate))
+}
+
+func (fr *realFileReader) throttle(n int64) bool {
+	if fr.repo.readBandwidth == nil {
+		return false
+	}
+	if n > 0 {
+		fr.repo.readBandwidth.wait(float64(n))
+	}
+	return true
+}
+
+func (fw *realFileWriter) throttle(n int) {
+	if fw.repo.writeBandwidth != nil && n > 0 {
+		fw.repo.writeBandwidth.wait(float64(n))
+	}
+}
+
+// Writes the data by steps, each admitted by the read bandwidth of the volume
+func writeThrottled(dst io.Writer, data []byte, chunk fileReader) (int, error) {
+	if !chunk.throttle(0) {
+		return dst.Write(data)
+	}
+	total := 0
+	for len(data) > 0 {
+		n := len(data)
+		if n > throttleStep {
+			n = throttleStep
+		}
+		chunk.throttle(int64(n))
+		nw, err := dst.Write(data[:n])
+		total += nw
+		if err != nil {
+			return total, err
+		}
+		data = data[n:]
+	}
+	return total, nil
+}
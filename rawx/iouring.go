@@ -0,0 +1,262 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build linux && iouring
+
+package main
+
+/*
+A minimal io_uring engine, without any dependency on liburing. A single
+goroutine owns the ring: it collects the pending requests, submits them in
+one batch, then dispatches the completions to the waiting callers.
+*/
+
+import (
+	"errors"
+	"sync/atomic"
+	"unsafe"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+const (
+	uringEntries = 256
+
+	uringOpRead  = 22
+	uringOpWrite = 23
+
+	// Introduced with IORING_OP_READ and IORING_OP_WRITE (Linux 5.6)
+	uringFeatRwCurPos = 1 << 3
+
+	uringEnterGetEvents = 1
+
+	uringOffSqRing = 0
+	uringOffCqRing = 0x8000000
+	uringOffSqes   = 0x10000000
+)
+
+type uringSqOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type uringCqOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type uringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  uringSqOffsets
+	cqOff                                                                  uringCqOffsets
+}
+
+type uringSqe struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	rwFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+type uringCqe struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+type uringRequest struct {
+	opcode uint8
+	fd     int
+	buf    []byte
+	offset int64
+	result chan uringResult
+}
+
+type uringResult struct {
+	n   int
+	err error
+}
+
+type uringEngine struct {
+	fd        int
+	sqEntries uint32
+	sqHead    *uint32
+	sqTail    *uint32
+	sqMask    uint32
+	sqArray   unsafe.Pointer
+	sqes      unsafe.Pointer
+	cqHead    *uint32
+	cqTail    *uint32
+	cqMask    uint32
+	cqes      unsafe.Pointer
+	requests  chan *uringRequest
+}
+
+func makeUringEngine() (ioEngine, error) {
+	var params uringParams
+	fd, _, errno := syscall.Syscall(syscall.SYS_IO_URING_SETUP,
+		uintptr(uringEntries), uintptr(unsafe.Pointer(&params)), 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	if params.features&uringFeatRwCurPos == 0 {
+		syscall.Close(int(fd))
+		return nil, errors.New("kernel too old")
+	}
+
+	e := &uringEngine{fd: int(fd), sqEntries: params.sqEntries}
+	sqRing, err := syscall.Mmap(e.fd, uringOffSqRing,
+		int(params.sqOff.array+params.sqEntries*4),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	if err != nil {
+		syscall.Close(e.fd)
+		return nil, err
+	}
+	cqRing, err := syscall.Mmap(e.fd, uringOffCqRing,
+		int(params.cqOff.cqes+params.cqEntries*uint32(unsafe.Sizeof(uringCqe{}))),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	if err != nil {
+		syscall.Close(e.fd)
+		return nil, err
+	}
+	sqes, err := syscall.Mmap(e.fd, uringOffSqes,
+		int(params.sqEntries*uint32(unsafe.Sizeof(uringSqe{}))),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	if err != nil {
+		syscall.Close(e.fd)
+		return nil, err
+	}
+
+	e.sqHead = (*uint32)(unsafe.Pointer(&sqRing[params.sqOff.head]))
+	e.sqTail = (*uint32)(unsafe.Pointer(&sqRing[params.sqOff.tail]))
+	e.sqMask = *(*uint32)(unsafe.Pointer(&sqRing[params.sqOff.ringMask]))
+	e.sqArray = unsafe.Pointer(&sqRing[params.sqOff.array])
+	e.sqes = unsafe.Pointer(&sqes[0])
+	e.cqHead = (*uint32)(unsafe.Pointer(&cqRing[params.cqOff.head]))
+	e.cqTail = (*uint32)(unsafe.Pointer(&cqRing[params.cqOff.tail]))
+	e.cqMask = *(*uint32)(unsafe.Pointer(&cqRing[params.cqOff.ringMask]))
+	e.cqes = unsafe.Pointer(&cqRing[params.cqOff.cqes])
+	e.requests = make(chan *uringRequest, uringEntries)
+	go e.run()
+	return e, nil
+}
+
+func (e *uringEngine) submit(opcode uint8, fd int, buf []byte, offset int64) (int, error) {
+	if len(buf) <= 0 {
+		return 0, nil
+	}
+	req := &uringRequest{opcode: opcode, fd: fd, buf: buf, offset: offset,
+		result: make(chan uringResult, 1)}
+	e.requests <- req
+	res := <-req.result
+	return res.n, res.err
+}
+
+func (e *uringEngine) pread(fd int, buf []byte, offset int64) (int, error) {
+	return e.submit(uringOpRead, fd, buf, offset)
+}
+
+func (e *uringEngine) pwrite(fd int, buf []byte, offset int64) (int, error) {
+	return e.submit(uringOpWrite, fd, buf, offset)
+}
+
+// Queues the request in the submission ring
+func (e *uringEngine) prepare(id uint64, req *uringRequest) {
+	tail := *e.sqTail
+	idx := tail & e.sqMask
+	sqe := (*uringSqe)(unsafe.Pointer(uintptr(e.sqes) + uintptr(idx)*unsafe.Sizeof(uringSqe{})))
+	*sqe = uringSqe{
+		opcode:   req.opcode,
+		fd:       int32(req.fd),
+		off:      uint64(req.offset),
+		addr:     uint64(uintptr(unsafe.Pointer(&req.buf[0]))),
+		len:      uint32(len(req.buf)),
+		userData: id,
+	}
+	*(*uint32)(unsafe.Pointer(uintptr(e.sqArray) + uintptr(idx)*4)) = idx
+	atomic.StoreUint32(e.sqTail, tail+1)
+}
+
+func (e *uringEngine) run() {
+	// The buffers of the requests in flight are kept referenced here
+	inflight := make(map[uint64]*uringRequest)
+	var nextID uint64
+	for {
+		if len(inflight) == 0 {
+			req := <-e.requests
+			nextID++
+			inflight[nextID] = req
+			e.prepare(nextID, req)
+		}
+	batch:
+		for uint32(len(inflight)) < e.sqEntries {
+			select {
+			case req := <-e.requests:
+				nextID++
+				inflight[nextID] = req
+				e.prepare(nextID, req)
+			default:
+				break batch
+			}
+		}
+
+		for {
+			toSubmit := atomic.LoadUint32(e.sqTail) - atomic.LoadUint32(e.sqHead)
+			_, _, errno := syscall.Syscall6(syscall.SYS_IO_URING_ENTER, uintptr(e.fd),
+				uintptr(toSubmit), 1, uringEnterGetEvents, 0, 0)
+			if errno == 0 {
+				break
+			}
+			if errno != syscall.EINTR && errno != syscall.EAGAIN && errno != syscall.EBUSY {
+				// The ring is unusable, fail everything in flight
+				for id, req := range inflight {
+					req.result <- uringResult{err: errno}
+					delete(inflight, id)
+				}
+				break
+			}
+		}
+
+		head := *e.cqHead
+		tail := atomic.LoadUint32(e.cqTail)
+		for ; head != tail; head++ {
+			cqe := (*uringCqe)(unsafe.Pointer(uintptr(e.cqes) +
+				uintptr(head&e.cqMask)*unsafe.Sizeof(uringCqe{})))
+			req, ok := inflight[cqe.userData]
+			if !ok {
+				continue
+			}
+			delete(inflight, cqe.userData)
+			if cqe.res < 0 {
+				req.result <- uringResult{err: syscall.Errno(-cqe.res)}
+			} else {
+				req.result <- uringResult{n: int(cqe.res)}
+			}
+		}
+		atomic.StoreUint32(e.cqHead, head)
+	}
+}
@@ -0,0 +1,297 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The journal of the uploads in progress on a volume, so that a crash never
+leaves stray temporary files. Each upload appends up to three records to
+the ".journal" file at the root of the volume:
+
+	B <id> <temporary path> <final path>
+	C <id> <size> <hash>
+	E <id>
+
+The "C" record is appended once the data and the attributes are synced,
+right before the rename, and it is synced itself. Upon the startup, an
+upload committed but not ended is finished, i.e. its file is renamed when
+it still has the recorded size and hash, and the other uploads not ended
+are discarded.
+
+The uploads of a transaction are committed together: their "C" records
+carry the ID of the transaction, and they are only taken into account when
+followed by the record telling the transaction is committed, all of them
+being appended at once:
+
+	C <id> <size> <hash> <transaction>
+	T <transaction>
+
+The journal is truncated whenever no upload is in progress and it has grown
+beyond a few MiB.
+*/
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+const (
+	journalFile    = ".journal"
+	journalMaxSize = 4 * 1024 * 1024
+)
+
+type uploadJournal struct {
+	lock sync.Mutex
+	f    *os.File
+	sync bool
+	size int64
+	seq  uint64
+	// The uploads in progress
+	open int
+}
+
+type journalEntry struct {
+	temp      string
+	final     string
+	size      int64
+	hash      string
+	txn       string
+	committed bool
+}
+
+// Recovers the uploads interrupted by a crash, then starts a new journal
+func (fr *fileRepository) openJournal() error {
+	if err := fr.recoverUploads(); err != nil {
+		return err
+	}
+	fd, err := syscall.Openat(fr.rootFd, journalFile,
+		syscall.O_CREAT|syscall.O_TRUNC|syscall.O_APPEND|openFlagsWOnly, fr.putOpenMode)
+	if err != nil {
+		return err
+	}
+	fr.journal = &uploadJournal{f: os.NewFile(uintptr(fd), journalFile), sync: fr.syncFile}
+	return nil
+}
+
+func (fr *fileRepository) recoverUploads() error {
+	fd, err := syscall.Openat(fr.rootFd, journalFile, openFlagsROnly, 0)
+	if err == syscall.ENOENT {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), journalFile)
+	defer f.Close()
+
+	entries := make(map[string]*journalEntry)
+	txns := make(map[string]bool)
+	var order []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// A record partially written is ignored
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 4 && fields[0] == "B":
+			entries[fields[1]] = &journalEntry{temp: fields[2], final: fields[3]}
+			order = append(order, fields[1])
+		case (len(fields) == 4 || len(fields) == 5) && fields[0] == "C":
+			if e, ok := entries[fields[1]]; ok {
+				e.size, err = strconv.ParseInt(fields[2], 10, 64)
+				e.hash = fields[3]
+				e.committed = err == nil
+				if len(fields) == 5 {
+					e.txn = fields[4]
+				}
+			}
+		case len(fields) == 2 && fields[0] == "T":
+			txns[fields[1]] = true
+		case len(fields) == 2 && fields[0] == "E":
+			delete(entries, fields[1])
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	var finished, discarded uint64
+	for _, id := range order {
+		e, ok := entries[id]
+		if !ok {
+			continue
+		}
+		if syscall.Faccessat(fr.rootFd, e.temp, syscall.F_OK, 0) != nil {
+			// Renamed, or already discarded
+			continue
+		}
+		if e.txn != "" && !txns[e.txn] {
+			e.committed = false
+		}
+		if e.committed && fr.finishUpload(e) {
+			finished++
+		} else {
+			fr.discardUpload(e)
+			discarded++
+		}
+	}
+	if finished+discarded > 0 {
+		atomic.AddUint64(&counters.JournalFinished, finished)
+		atomic.AddUint64(&counters.JournalDiscarded, discarded)
+		LogInfo("Interrupted uploads on %s: %d finished, %d discarded",
+			fr.root, finished, discarded)
+	}
+	return nil
+}
+
+// Renames the file of the upload, if complete and not replacing anything
+func (fr *fileRepository) finishUpload(e *journalEntry) bool {
+	var st syscall.Stat_t
+	if err := syscall.Fstatat(fr.rootFd, e.temp, &st, 0); err != nil || st.Size != e.size {
+		return false
+	}
+	if e.hash != "-" && fr.uploadHash(e) != e.hash {
+		return false
+	}
+	err := syscall.Renameat2(fr.rootFd, e.temp, fr.rootFd, e.final, syscall.RENAME_NOREPLACE)
+	if err != nil {
+		LogWarning("Upload of %s not finished: %v", e.final, err)
+		return false
+	}
+	return true
+}
+
+// Loads the hash saved with the file of the upload
+func (fr *fileRepository) uploadHash(e *journalEntry) string {
+	in, err := fr.getRelPath(e.temp)
+	if err != nil {
+		return ""
+	}
+	defer in.Close()
+	if r := in.(*realFileReader); r.base == 0 && fr.sidecar {
+		// Saved for the final path, before the rename
+		meta, err := fr.loadSidecar(e.final)
+		if err != nil {
+			return ""
+		}
+		return meta[AttrNameChunkChecksum]
+	}
+	buf := getBuffer(2048)
+	defer putBuffer(buf)
+	n, err := in.getAttr(AttrNameChunkChecksum, buf)
+	if err != nil || n <= 0 {
+		return ""
+	}
+	return string(buf[:n])
+}
+
+func (fr *fileRepository) discardUpload(e *journalEntry) {
+	if err := syscall.Unlinkat(fr.rootFd, e.temp, 0); err != nil && err != syscall.ENOENT {
+		LogWarning("Interrupted upload %s not removed: %v", e.temp, err)
+	}
+	// The sidecar might have been saved before the crash
+	if fr.sidecar && syscall.Faccessat(fr.rootFd, e.final, syscall.F_OK, 0) != nil {
+		_ = fr.removeSidecar(e.final)
+	}
+}
+
+func (j *uploadJournal) append(record string) error {
+	n, err := j.f.WriteString(record)
+	j.size += int64(n)
+	return err
+}
+
+// Records an upload starting, 0 when the journal couldn't record it
+func (j *uploadJournal) begin(temp, final string) uint64 {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.seq++
+	if err := j.append(fmt.Sprintf("B %d %s %s\n", j.seq, temp, final)); err != nil {
+		LogWarning("Upload journal error: %v", err)
+		return 0
+	}
+	j.open++
+	return j.seq
+}
+
+func journalHash(hash string) string {
+	if hash == "" {
+		return "-"
+	}
+	return hash
+}
+
+// Records an upload ready to be renamed, the record being synced
+func (j *uploadJournal) commit(id uint64, size int64, hash string) error {
+	return j.commitRecords(fmt.Sprintf("C %d %d %s\n", id, size, journalHash(hash)))
+}
+
+// Records the uploads of a transaction ready to be renamed, all or none
+func (j *uploadJournal) commitGroup(txn string, writers []*realFileWriter) error {
+	var records strings.Builder
+	for _, fw := range writers {
+		if fw.journalID != 0 {
+			fmt.Fprintf(&records, "C %d %d %s %s\n",
+				fw.journalID, fw.base+fw.written, journalHash(fw.hash), txn)
+		}
+	}
+	fmt.Fprintf(&records, "T %s\n", txn)
+	return j.commitRecords(records.String())
+}
+
+func (j *uploadJournal) commitRecords(records string) error {
+	j.lock.Lock()
+	err := j.append(records)
+	j.lock.Unlock()
+	if err == nil && j.sync {
+		err = syscall.Fdatasync(int(j.f.Fd()))
+	}
+	return err
+}
+
+// Syncs the records already appended, e.g. before a snapshot
+func (j *uploadJournal) flush() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return syscall.Fdatasync(int(j.f.Fd()))
+}
+
+// Records an upload over, either renamed or aborted
+func (j *uploadJournal) end(id uint64) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if err := j.append(fmt.Sprintf("E %d\n", id)); err != nil {
+		LogWarning("Upload journal error: %v", err)
+	}
+	j.open--
+	if j.open == 0 && j.size > journalMaxSize {
+		if err := j.f.Truncate(0); err == nil {
+			j.size = 0
+		}
+	}
+}
+
+func (fw *realFileWriter) journalEnd() {
+	if fw.journalID != 0 {
+		fw.repo.journal.end(fw.journalID)
+		fw.journalID = 0
+	}
+}
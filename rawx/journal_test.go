@@ -0,0 +1,115 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+func TestJournalRecovery(t *testing.T) {
+	repo := makeTestRepository(t, optionsMap{"upload_journal": "on"})
+	fr := &repo.sub
+	data := bytes.Repeat([]byte("journal"), 10)
+
+	// Uploads interrupted at various steps, by a crash
+	prepare := func(id int) *realFileWriter {
+		chunk := makeTestChunk(id, data)
+		w, err := fr.put(chunk.ChunkID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write(data); err == nil {
+			err = chunk.saveAttr(w)
+		}
+		fw := w.(*realFileWriter)
+		if err == nil {
+			err = fw.prepare()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fw
+	}
+	commit := func(fw *realFileWriter, txn string) error {
+		if txn == "" {
+			return fr.journal.commit(fw.journalID, fw.base+fw.written, fw.hash)
+		}
+		// Without the record telling the transaction is committed
+		return fr.journal.commitRecords(fmt.Sprintf("C %d %d %s %s\n",
+			fw.journalID, fw.base+fw.written, journalHash(fw.hash), txn))
+	}
+	cases := []struct {
+		name     string
+		finished bool
+		fw       *realFileWriter
+	}{
+		{"committed", true, prepare(1)},
+		{"not committed", false, prepare(2)},
+		{"transaction not committed", false, prepare(3)},
+		{"transaction committed", true, prepare(4)},
+		{"size changed", false, prepare(5)},
+	}
+	if err := commit(cases[0].fw, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(cases[2].fw, "T1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fr.journal.commitGroup("T2", []*realFileWriter{cases[3].fw}); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(cases[4].fw, ""); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := os.OpenFile(fr.root+"/"+cases[4].fw.pathTemp, os.O_WRONLY|os.O_APPEND, 0); err == nil {
+		f.Write([]byte("garbage"))
+		f.Close()
+	}
+	// An upload over is left untouched
+	done := makeTestChunk(6, data)
+	putTestChunk(t, fr, &done, data)
+
+	finished := atomic.LoadUint64(&counters.JournalFinished)
+	discarded := atomic.LoadUint64(&counters.JournalDiscarded)
+	if err := fr.recoverUploads(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range cases {
+		visible := syscall.Faccessat(fr.rootFd, tc.fw.pathFinal, syscall.F_OK, 0) == nil
+		if visible != tc.finished {
+			t.Errorf("%s: chunk visible %v, expected %v", tc.name, visible, tc.finished)
+		}
+		if syscall.Faccessat(fr.rootFd, tc.fw.pathTemp, syscall.F_OK, 0) == nil {
+			t.Errorf("%s: temporary file left", tc.name)
+		}
+	}
+	if got, _ := getTestChunk(t, repo, done.ChunkID); !bytes.Equal(got, data) {
+		t.Errorf("upload over altered: %q", got)
+	}
+	if n := atomic.LoadUint64(&counters.JournalFinished) - finished; n != 2 {
+		t.Errorf("%d uploads finished, expected 2", n)
+	}
+	if n := atomic.LoadUint64(&counters.JournalDiscarded) - discarded; n != 3 {
+		t.Errorf("%d uploads discarded, expected 3", n)
+	}
+}
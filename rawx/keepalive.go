@@ -0,0 +1,145 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The reuse of the connections. tcp_keepalive lets the clients send several
+requests on a connection, idle for at most timeout_idle seconds between
+two of them. For the long-lived clients (e.g. the proxies), a connection is
+closed after max_requests_per_connection requests, so that the load spreads
+again over the services behind a balancer. For the many short-lived ones,
+every conn_reap_interval seconds the connections idle beyond
+max_idle_connections are closed, the longest idle first (0 disables each).
+
+The connections opened, closed, reaped and recycled are counted in /stat.
+*/
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	maxRequestsPerConn int64
+	maxIdleConns       int
+	connReapInterval   time.Duration
+)
+
+type connKey struct{}
+
+// What is known of a connection, along its requests
+type connInfo struct {
+	requests int64
+}
+
+type idleConns struct {
+	lock  sync.Mutex
+	since map[net.Conn]time.Time
+}
+
+var idle = idleConns{since: make(map[net.Conn]time.Time)}
+
+func (ic *idleConns) set(cnx net.Conn, state http.ConnState) {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+	if state == http.StateIdle {
+		ic.since[cnx] = time.Now()
+	} else {
+		delete(ic.since, cnx)
+	}
+}
+
+// Closes the connections idle beyond the maximum, the longest idle first
+func (ic *idleConns) reap(max int) {
+	ic.lock.Lock()
+	conns := make([]net.Conn, 0, len(ic.since))
+	for cnx := range ic.since {
+		conns = append(conns, cnx)
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		return ic.since[conns[i]].Before(ic.since[conns[j]])
+	})
+	if len(conns) > max {
+		conns = conns[:len(conns)-max]
+	} else {
+		conns = nil
+	}
+	for _, cnx := range conns {
+		delete(ic.since, cnx)
+	}
+	ic.lock.Unlock()
+
+	for _, cnx := range conns {
+		cnx.Close()
+	}
+	atomic.AddUint64(&counters.ConnReaped, uint64(len(conns)))
+}
+
+func (ic *idleConns) Start() {
+	go func() {
+		for {
+			time.Sleep(connReapInterval)
+			ic.reap(maxIdleConns)
+		}
+	}()
+}
+
+// Tracks the connections of the server, along with the former hooks
+func configureKeepAlive(srv *http.Server) {
+	srv.ConnContext = func(ctx context.Context, cnx net.Conn) context.Context {
+		return context.WithValue(ctx, connKey{}, &connInfo{})
+	}
+	previous := srv.ConnState
+	srv.ConnState = func(cnx net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			atomic.AddUint64(&counters.ConnOpened, 1)
+		case http.StateClosed, http.StateHijacked:
+			atomic.AddUint64(&counters.ConnClosed, 1)
+		}
+		if maxIdleConns > 0 {
+			idle.set(cnx, state)
+		}
+		if previous != nil {
+			previous(cnx, state)
+		}
+	}
+	if maxIdleConns > 0 && connReapInterval > 0 {
+		idle.Start()
+	}
+}
+
+// Closes the connection after the reply, when it served enough requests
+func (rr *rawxRequest) recycleConnection() {
+	if maxRequestsPerConn <= 0 {
+		return
+	}
+	info, ok := rr.req.Context().Value(connKey{}).(*connInfo)
+	if !ok {
+		return
+	}
+	if atomic.AddInt64(&info.requests, 1) == maxRequestsPerConn {
+		atomic.AddUint64(&counters.ConnRecycled, 1)
+		rr.req.Close = true
+		rr.rep.Header().Set("Connection", "close")
+	}
+}
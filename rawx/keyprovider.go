@@ -0,0 +1,441 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The providers of the encryption keys. The keys come from a local key file,
+or are data keys generated and wrapped by an external KMS:
+
+	vault+https://HOST:PORT/[MOUNT/]KEYNAME  (Vault transit, VAULT_TOKEN)
+	awskms://REGION/KEYID                    (AWS KMS, AWS_ACCESS_KEY_ID...)
+
+The credentials come from the environment, as for the other clients of these
+services.
+
+With a KMS, the ID of the key saved in the attributes of each chunk is the
+wrapped data key, only the KMS is able to unwrap it. A data key is used for
+the new chunks for a while before a new one is generated, and the keys
+unwrapped are kept in cache, so that the KMS isn't involved in each request.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type KeyProvider interface {
+	// Returns the key to encrypt the new chunks, with its ID
+	CurrentKey() (string, []byte, error)
+	// Returns the key with the given ID, to decrypt a chunk
+	Key(id string) ([]byte, error)
+}
+
+const (
+	kmsTimeout        = 5 * time.Second
+	kmsKeyCacheSize   = 1024
+	kmsDefaultKeyTTL  = 3600
+	vaultDefaultMount = "transit"
+	awsSigningScheme  = "AWS4-HMAC-SHA256"
+)
+
+var errNoCurrentKey = errors.New("No encryption key for the new chunks")
+
+// How long a data key generated by a KMS is used for the new chunks
+var kmsKeyTTL = kmsDefaultKeyTTL * time.Second
+
+func makeKeyProvider(config string) (KeyProvider, error) {
+	var service dataKeyService
+	var err error
+	if v, ok := hasPrefix(config, "vault+"); ok {
+		service, err = makeVaultService(v)
+	} else if v, ok := hasPrefix(config, "awskms://"); ok {
+		service, err = makeAwsKmsService(v)
+	} else {
+		err = errors.New("Unexpected KMS, only vault+http(s):// and awskms:// are accepted")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &kmsKeyProvider{service: service, cache: make(map[string][]byte)}, nil
+}
+
+// The master keys loaded from a file, with one "ID HEXKEY" per line
+type fileKeyProvider struct {
+	keys    map[string][]byte
+	current string
+}
+
+func makeFileKeyProvider(path, current string) (*fileKeyProvider, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	provider := &fileKeyProvider{keys: make(map[string][]byte), current: current}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.New("Invalid key line, ID HEXKEY expected")
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil || len(key) != 32 {
+			return nil, errors.New("Invalid key " + fields[0] + ", 32 bytes expected")
+		}
+		provider.keys[fields[0]] = key
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if _, ok := provider.keys[current]; current != "" && !ok {
+		return nil, errors.New("Encryption key " + current + " not found in " + path)
+	}
+	return provider, nil
+}
+
+func (p *fileKeyProvider) CurrentKey() (string, []byte, error) {
+	if p.current == "" {
+		return "", nil, errNoCurrentKey
+	}
+	return p.current, p.keys[p.current], nil
+}
+
+func (p *fileKeyProvider) Key(id string) ([]byte, error) {
+	if key, ok := p.keys[id]; ok {
+		return key, nil
+	}
+	return nil, errUnknownKey
+}
+
+// A KMS generating data keys, along with their wrapped form
+type dataKeyService interface {
+	generate() (wrapped string, key []byte, err error)
+	unwrap(wrapped string) ([]byte, error)
+}
+
+type kmsKeyProvider struct {
+	service dataKeyService
+
+	lock      sync.Mutex
+	currentID string
+	current   []byte
+	expiry    time.Time
+	cache     map[string][]byte
+}
+
+func (p *kmsKeyProvider) CurrentKey() (string, []byte, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	if p.current == nil || now.After(p.expiry) {
+		id, key, err := p.service.generate()
+		if err != nil {
+			return "", nil, err
+		}
+		p.currentID, p.current, p.expiry = id, key, now.Add(kmsKeyTTL)
+		p.remember(id, key)
+	}
+	return p.currentID, p.current, nil
+}
+
+func (p *kmsKeyProvider) Key(id string) ([]byte, error) {
+	p.lock.Lock()
+	key, ok := p.cache[id]
+	p.lock.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	key, err := p.service.unwrap(id)
+	if err != nil {
+		return nil, err
+	}
+	p.lock.Lock()
+	p.remember(id, key)
+	p.lock.Unlock()
+	return key, nil
+}
+
+// Must be called with the lock held
+func (p *kmsKeyProvider) remember(id string, key []byte) {
+	if len(p.cache) >= kmsKeyCacheSize {
+		for k := range p.cache {
+			delete(p.cache, k)
+			break
+		}
+	}
+	p.cache[id] = key
+}
+
+// Posts a JSON request to a KMS, then decodes its JSON reply
+func kmsCall(req *http.Request, reply interface{}) error {
+	client := http.Client{Timeout: kmsTimeout}
+	rep, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rep.Body.Close()
+	body, err := ioutil.ReadAll(rep.Body)
+	if err != nil {
+		return err
+	}
+	if rep.StatusCode/100 != 2 {
+		return errors.New("KMS error: " + rep.Status)
+	}
+	return json.Unmarshal(body, reply)
+}
+
+func decodeKey(b64 string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(b64)
+	if err == nil && len(key) != 32 {
+		err = errors.New("Invalid data key from the KMS, 32 bytes expected")
+	}
+	return key, err
+}
+
+// The transit secrets engine of Vault
+type vaultService struct {
+	url   string
+	name  string
+	token string
+}
+
+func makeVaultService(config string) (*vaultService, error) {
+	idx := strings.Index(config, "://")
+	if idx < 0 {
+		return nil, errors.New("Invalid Vault URL: " + config)
+	}
+	parts := strings.Split(config[idx+3:], "/")
+	if len(parts) < 2 || parts[len(parts)-1] == "" {
+		return nil, errors.New("Invalid Vault URL, no key name: " + config)
+	}
+	mount := vaultDefaultMount
+	if len(parts) > 2 {
+		mount = strings.Join(parts[1:len(parts)-1], "/")
+	}
+	service := &vaultService{
+		url:   config[:idx+3] + parts[0] + "/v1/" + mount,
+		name:  parts[len(parts)-1],
+		token: os.Getenv("VAULT_TOKEN"),
+	}
+	if service.token == "" {
+		return nil, errors.New("VAULT_TOKEN not set")
+	}
+	return service, nil
+}
+
+func (s *vaultService) call(op string, args interface{}, reply interface{}) error {
+	body, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.url+"/"+op+"/"+s.name, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", s.token)
+	return kmsCall(req, reply)
+}
+
+func (s *vaultService) generate() (string, []byte, error) {
+	var reply struct {
+		Data struct {
+			Plaintext  string `json:"plaintext"`
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	args := map[string]interface{}{"bits": 256}
+	if err := s.call("datakey/plaintext", args, &reply); err != nil {
+		return "", nil, err
+	}
+	key, err := decodeKey(reply.Data.Plaintext)
+	return reply.Data.Ciphertext, key, err
+}
+
+func (s *vaultService) unwrap(wrapped string) ([]byte, error) {
+	var reply struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	args := map[string]string{"ciphertext": wrapped}
+	if err := s.call("decrypt", args, &reply); err != nil {
+		return nil, err
+	}
+	return decodeKey(reply.Data.Plaintext)
+}
+
+// The credentials of the AWS APIs, from the usual environment variables
+type awsCredentials struct {
+	accessKey string
+	secretKey string
+	token     string
+}
+
+func loadAwsCredentials() (awsCredentials, error) {
+	creds := awsCredentials{
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.accessKey == "" || creds.secretKey == "" {
+		return creds, errors.New("AWS_ACCESS_KEY_ID or AWS_SECRET_ACCESS_KEY not set")
+	}
+	return creds, nil
+}
+
+// AWS KMS, through its JSON API signed with SigV4
+type awsKmsService struct {
+	awsCredentials
+	region   string
+	keyID    string
+	endpoint string
+}
+
+func makeAwsKmsService(config string) (*awsKmsService, error) {
+	idx := strings.IndexByte(config, '/')
+	if idx <= 0 || idx == len(config)-1 {
+		return nil, errors.New("Invalid AWS KMS URL, awskms://REGION/KEYID expected")
+	}
+	creds, err := loadAwsCredentials()
+	if err != nil {
+		return nil, err
+	}
+	service := &awsKmsService{
+		awsCredentials: creds,
+		region:         config[:idx],
+		keyID:          config[idx+1:],
+		endpoint:       "https://kms." + config[:idx] + ".amazonaws.com/",
+	}
+	// e.g. a VPC endpoint
+	if v := os.Getenv("AWS_ENDPOINT_URL_KMS"); v != "" {
+		service.endpoint = strings.TrimSuffix(v, "/") + "/"
+	}
+	return service, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Signs the request with AWS Signature Version 4, the payload being
+// represented by its hash. The request mustn't have a query string.
+func (creds awsCredentials) sign(req *http.Request, region, service, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.token)
+	}
+
+	names := []string{"host"}
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		name := strings.ToLower(k)
+		names = append(names, name)
+		headers[name] = strings.TrimSpace(v[0])
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, name := range names {
+		canonical.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	request := strings.Join([]string{req.Method, path, "",
+		canonical.String(), signed, payloadHash}, "\n")
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	toSign := strings.Join([]string{awsSigningScheme, amzDate, scope,
+		hexSHA256([]byte(request))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	req.Header.Set("Authorization", awsSigningScheme+
+		" Credential="+creds.accessKey+"/"+scope+
+		", SignedHeaders="+signed+
+		", Signature="+hex.EncodeToString(hmacSHA256(key, toSign)))
+}
+
+func (s *awsKmsService) call(op string, args interface{}, reply interface{}) error {
+	body, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+op)
+	s.sign(req, s.region, "kms", hexSHA256(body), time.Now())
+	return kmsCall(req, reply)
+}
+
+func (s *awsKmsService) generate() (string, []byte, error) {
+	var reply struct {
+		CiphertextBlob string
+		Plaintext      string
+	}
+	args := map[string]string{"KeyId": s.keyID, "KeySpec": "AES_256"}
+	if err := s.call("GenerateDataKey", args, &reply); err != nil {
+		return "", nil, err
+	}
+	key, err := decodeKey(reply.Plaintext)
+	return reply.CiphertextBlob, key, err
+}
+
+func (s *awsKmsService) unwrap(wrapped string) ([]byte, error) {
+	var reply struct {
+		Plaintext string
+	}
+	args := map[string]string{"KeyId": s.keyID, "CiphertextBlob": wrapped}
+	if err := s.call("Decrypt", args, &reply); err != nil {
+		return nil, err
+	}
+	return decodeKey(reply.Plaintext)
+}
@@ -0,0 +1,194 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The layout of the chunks in a volume: each chunk lies under hash_depth
+levels of directories, each named after hash_width hexdigits of the name of
+the chunk. A volume whose directories have grown too large may switch to
+another layout, the former one being given for the time of the migration:
+
+	hash_width         2
+	hash_depth         2
+	hash_migrate_from  3x1
+
+A chunk still at its former place is moved upon its first access, and a
+background sweep moves all the others. Once the sweep reports the migration
+as complete, the former layout can be forgotten.
+*/
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+type hashLayout struct {
+	width int
+	depth int
+}
+
+// Parses a layout given as "WIDTHxDEPTH", e.g. "3x1"
+func parseHashLayout(v string) (*hashLayout, error) {
+	parts := strings.Split(strings.ToLower(v), "x")
+	if len(parts) != 2 {
+		return nil, errors.New("Invalid hash layout, WIDTHxDEPTH expected: " + v)
+	}
+	width, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, errors.New("Invalid hash width: " + v)
+	}
+	depth, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, errors.New("Invalid hash depth: " + v)
+	}
+	layout := &hashLayout{width: width, depth: depth}
+	return layout, layout.check()
+}
+
+// The directories must be named after the 64 hexdigits of the chunk names
+func (l hashLayout) check() error {
+	if l.width < 1 || l.depth < 0 || l.depth*(l.depth-1)+l.width > 64 {
+		return errors.New("Invalid hash layout: " + strconv.Itoa(l.width) +
+			"x" + strconv.Itoa(l.depth))
+	}
+	return nil
+}
+
+func (l hashLayout) relPath(name string) string {
+	var result strings.Builder
+	for i := 0; i < l.depth; i++ {
+		// The offsets follow the depth, as they always did, so that the
+		// existing volumes keep their layout.
+		start := i * l.depth
+		result.WriteString(name[start : start+l.width])
+		result.WriteRune('/')
+	}
+	result.WriteString(name)
+	return result.String()
+}
+
+// Returns the path of the chunk, after it has been moved there if it was
+// still at its place in the former layout.
+func (fr *fileRepository) locate(name string) string {
+	relPath := fr.nameToRelPath(name)
+	if fr.migrateFrom != nil {
+		err := syscall.Faccessat(fr.rootFd, relPath, syscall.F_OK, 0)
+		if err == syscall.ENOENT {
+			fr.migrate(name)
+		}
+	}
+	return relPath
+}
+
+// Moves the chunk from its place in the former layout to its place in the
+// current one. The chunk is linked before being unlinked, so that it is
+// always reachable and never replaces a chunk with the same name.
+func (fr *fileRepository) migrate(name string) bool {
+	from := fr.migrateFrom.relPath(name)
+	to := fr.nameToRelPath(name)
+	if from == to {
+		return false
+	}
+	fr.expect(name)
+
+	// The attributes first, a chunk is never seen without them
+	if fr.sidecar {
+		err := fr.linkParents(from+metaSuffix, to+metaSuffix)
+		if err == syscall.ENOENT && fr.header {
+			// The chunks in the format 2 have no sidecar
+			err = nil
+		}
+		if err != nil && err != syscall.EEXIST {
+			if err != syscall.ENOENT {
+				LogWarning("Sidecar of %s not migrated: %v", name, err)
+			}
+			return false
+		}
+	}
+	if err := fr.linkParents(from, to); err != nil {
+		if err == syscall.EEXIST {
+			LogWarning("Chunk %s present in both layouts, the former one kept in %s", name, from)
+		} else if err != syscall.ENOENT {
+			LogWarning("Chunk %s not migrated: %v", name, err)
+		}
+		return false
+	}
+	_ = syscall.Unlinkat(fr.rootFd, from, 0)
+	if fr.sidecar {
+		_ = syscall.Unlinkat(fr.rootFd, from+metaSuffix, 0)
+	}
+	if fr.syncDir {
+		_ = fr.syncRelDir(filepath.Dir(to))
+	}
+
+	// Prune the former directories as soon as they are empty
+	for dir := filepath.Dir(from); dir != "."; dir = filepath.Dir(dir) {
+		if syscall.Unlinkat(fr.rootFd, dir, syscall.AT_REMOVEDIR) != nil {
+			break
+		}
+	}
+	atomic.AddUint64(&counters.LayoutMigrated, 1)
+	return true
+}
+
+// Links the file, with the lazy creation of the directories of the target
+func (fr *fileRepository) linkParents(from, to string) error {
+	err := syscall.Linkat(fr.rootFd, from, fr.rootFd, to, 0)
+	if err != syscall.ENOENT {
+		return err
+	}
+	if e0 := syscall.Faccessat(fr.rootFd, from, syscall.F_OK, 0); e0 != nil {
+		return err
+	}
+	if e0 := os.MkdirAll(filepath.Dir(fr.root+"/"+to), fr.putMkdirMode); e0 != nil {
+		return e0
+	}
+	return syscall.Linkat(fr.rootFd, from, fr.rootFd, to, 0)
+}
+
+// Moves all the chunks still laid out the former way. The RAWX keeps
+// serving the chunks meanwhile, moving them upon access.
+func (fr *fileRepository) sweepLayout() {
+	go func() {
+		var moved, failed uint64
+		err := fr.walk(func(name, relPath string, fi os.FileInfo) error {
+			if relPath != fr.migrateFrom.relPath(name) || relPath == fr.nameToRelPath(name) {
+				return nil
+			}
+			if fr.migrate(name) {
+				moved++
+			} else if syscall.Faccessat(fr.rootFd, relPath, syscall.F_OK, 0) == nil {
+				failed++
+			}
+			return nil
+		})
+		if err != nil {
+			LogWarning("Layout migration of %s interrupted: %v", fr.root, err)
+		} else if failed > 0 {
+			LogWarning("Layout migration of %s: %d chunks moved, %d left in place",
+				fr.root, moved, failed)
+		} else {
+			LogInfo("Layout migration of %s complete: %d chunks moved", fr.root, moved)
+		}
+	}()
+}
@@ -22,7 +22,7 @@ http handler.
 */
 
 import (
-	"context"
+	"errors"
 	"flag"
 	"log"
 	"log/syslog"
@@ -51,11 +51,12 @@ func checkNS(ns string) {
 	}
 }
 
-func installSigHandlers(rawx *rawxService, srv *http.Server) {
+func installSigHandlers(rawx *rawxService, d *drainer) {
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan,
 		syscall.SIGUSR1,
 		syscall.SIGUSR2,
+		syscall.SIGHUP,
 		syscall.SIGINT,
 		syscall.SIGTERM)
 
@@ -70,25 +71,276 @@ func installSigHandlers(rawx *rawxService, srv *http.Server) {
 				}()
 			case syscall.SIGUSR2:
 				resetVerbosity()
-			case syscall.SIGINT, syscall.SIGTERM:
-				ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-				if err := srv.Shutdown(ctx); err != nil {
-					LogWarning("graceful shutdown error: %v", err)
+			case syscall.SIGHUP:
+				if notifier, ok := rawx.notifier.(reloader); ok {
+					if err := notifier.reload(); err != nil {
+						LogWarning("Notifier reload error: %v", err)
+					} else {
+						LogNotice("Notifier reloaded")
+					}
 				}
+			case syscall.SIGINT, syscall.SIGTERM:
+				d.shutdown()
 			}
 		}
 	}()
 }
 
+// Parses a fadvise() policy, the boolean values stand for "sequential"
+func parseFadvise(v string, def int) int {
+	switch strings.ToLower(v) {
+	case "cache":
+		return configFadviseCache
+	case "nocache", "dontneed":
+		return configFadviseNocache
+	case "stream":
+		return configFadviseStream
+	case "sequential":
+		return configFadviseYes
+	}
+	if GetBool(v, false) {
+		return configFadviseYes
+	}
+	return def
+}
+
+// Opens the volume rooted at basedir and applies the storage settings
+func configureRepository(chunkrepo *chunkRepository, opts optionsMap, basedir string) error {
+	if err := chunkrepo.sub.init(basedir); err != nil {
+		return err
+	}
+	chunkrepo.sub.hashWidth = opts.getInt("hash_width", chunkrepo.sub.hashWidth)
+	chunkrepo.sub.hashDepth = opts.getInt("hash_depth", chunkrepo.sub.hashDepth)
+	layout := hashLayout{width: chunkrepo.sub.hashWidth, depth: chunkrepo.sub.hashDepth}
+	if err := layout.check(); err != nil {
+		return err
+	}
+	if v, ok := opts["hash_migrate_from"]; ok && v != "" {
+		layout, err := parseHashLayout(v)
+		if err != nil {
+			return err
+		}
+		chunkrepo.sub.migrateFrom = layout
+	}
+	chunkrepo.sub.syncFile = opts.getBool("fsync_file", chunkrepo.sub.syncFile)
+	chunkrepo.sub.syncDir = opts.getBool("fsync_dir", chunkrepo.sub.syncDir)
+	if err := configureFsync(&chunkrepo.sub, opts); err != nil {
+		return err
+	}
+	if extent := opts.getInt("fallocate_extent", 0); extent > 0 {
+		chunkrepo.sub.fallocateExtent = int64(extent)
+	}
+	chunkrepo.sub.directUpload = opts.getBool("direct_upload", chunkrepo.sub.directUpload)
+	chunkrepo.sub.readaheadWindow = int64(opts.getInt("readahead_window", 0))
+	if size := opts.getInt("readahead_min_size", 0); size > 0 {
+		chunkrepo.sub.readaheadMinSize = int64(size)
+	}
+	chunkrepo.sub.mmapMinSize = int64(opts.getInt("mmap_min_size", 0))
+	chunkrepo.sub.mmapMaxSize = int64(opts.getInt("mmap_max_size", 0))
+	chunkrepo.sub.readBandwidth = makeBandwidth(opts.getInt("read_bandwidth", 0))
+	chunkrepo.sub.writeBandwidth = makeBandwidth(opts.getInt("write_bandwidth", 0))
+	chunkrepo.sub.healthMaxIOErrors = opts.getInt("health_max_io_errors", 0)
+	if v := opts["s3_offload"]; v != "" {
+		store, err := makeS3Store(v, opts["s3_region"])
+		if err != nil {
+			return err
+		}
+		chunkrepo.sub.s3 = store
+		chunkrepo.sub.rehydrate = opts.getBool("s3_rehydrate", false)
+	}
+	switch v := opts["discard"]; strings.ToLower(v) {
+	case "", "off", "none":
+		chunkrepo.sub.discard = discardOff
+	case "punch":
+		chunkrepo.sub.discard = discardPunch
+	case "fitrim", "trim":
+		chunkrepo.sub.discard = discardTrim
+	default:
+		return errors.New("Invalid discard: " + v)
+	}
+
+	switch v := opts["copy_mode"]; strings.ToLower(v) {
+	case "", "link":
+		chunkrepo.sub.copyMode = copyModeLink
+	case "reflink":
+		chunkrepo.sub.copyMode = copyModeReflink
+	case "auto":
+		chunkrepo.sub.copyMode = copyModeAuto
+	default:
+		return errors.New("Invalid copy_mode: " + v)
+	}
+
+	retention := opts.getInt("trash_retention", 0)
+	chunkrepo.sub.trashRetention = time.Duration(retention) * time.Second
+	if opts.getBool("maintenance", false) {
+		chunkrepo.sub.maintenance = 1
+	}
+	retention = opts.getInt("moved_retention", 0)
+	chunkrepo.sub.movedRetention = time.Duration(retention) * time.Second
+
+	high := opts.getInt("space_high_watermark", 0)
+	low := opts.getInt("space_low_watermark", high-5)
+	chunkrepo.sub.bytesWatermark = watermark{high: high, low: low}
+	high = opts.getInt("space_inodes_high_watermark", high)
+	low = opts.getInt("space_inodes_low_watermark", high-5)
+	chunkrepo.sub.inodesWatermark = watermark{high: high, low: low}
+	chunkrepo.sub.usageCache.ttl = time.Duration(opts.getInt("statfs_ttl",
+		statfsDefaultTTL)) * time.Millisecond
+
+	switch v := opts["attr_store"]; strings.ToLower(v) {
+	case "", attrStoreXattr:
+		chunkrepo.sub.sidecar = false
+	case attrStoreSidecar:
+		chunkrepo.sub.sidecar = true
+	default:
+		return errors.New("Invalid attr_store: " + v)
+	}
+	switch v := opts.getInt("chunk_format", chunkFormatLegacy); v {
+	case chunkFormatLegacy:
+		chunkrepo.sub.header = false
+	case chunkFormatHeader:
+		chunkrepo.sub.header = true
+	default:
+		return errors.New("Invalid chunk_format: " + opts["chunk_format"])
+	}
+
+	// Patch the preallocation policy, the former boolean values are still
+	// accepted: "enabled" stands for "full".
+	if v, ok := opts["fallocate"]; ok {
+		switch strings.ToLower(v) {
+		case "full":
+			chunkrepo.sub.fallocate = configFallocateFull
+		case "extent", "incremental":
+			chunkrepo.sub.fallocate = configFallocateExtent
+		case "none":
+			chunkrepo.sub.fallocate = configFallocateNone
+		default:
+			if GetBool(v, false) {
+				chunkrepo.sub.fallocate = configFallocateFull
+			} else {
+				chunkrepo.sub.fallocate = configFallocateNone
+			}
+		}
+	}
+
+	// Patch the fadvise() upon upload and upon download
+	if v, ok := opts["fadvise_upload"]; ok {
+		chunkrepo.sub.fadviseUpload = parseFadvise(v, chunkrepo.sub.fadviseUpload)
+	}
+	if v, ok := opts["fadvise_download"]; ok {
+		chunkrepo.sub.fadviseDownload = parseFadvise(v, chunkrepo.sub.fadviseDownload)
+	}
+
+	chunkrepo.sub.adaptToCapabilities()
+
+	// The slabs already there are loaded even when the packing is disabled,
+	// their chunks remain readable.
+	maxChunkSize := opts.getInt("slab_max_chunk_size", 0)
+	if maxChunkSize > 0 || syscall.Faccessat(chunkrepo.sub.rootFd, slabDir, syscall.F_OK, 0) == nil {
+		slabs, err := openSlabStore(&chunkrepo.sub, int64(maxChunkSize),
+			int64(opts.getInt("slab_size", slabDefaultSize)),
+			int64(opts.getInt("slab_compact_ratio", slabDefaultCompactRatio)))
+		if err != nil {
+			return err
+		}
+		chunkrepo.sub.slabs = slabs
+	}
+
+	chunkrepo.sub.sparse = opts.getBool("sparse", false)
+	chunkrepo.sub.dedup = opts.getBool("dedup", false)
+	if chunkrepo.sub.dedup && chunkrepo.sub.header {
+		LogWarning("No deduplication of the chunks in the format 2 on %s", basedir)
+	}
+
+	if opts.getBool("upload_journal", false) {
+		if err := chunkrepo.sub.openJournal(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads the parameters of the emission of the events. Nothing is applied
+// here: the caller publishes them along with the notifier they go with.
+func makeNotifConfigFromOpts(opts optionsMap) (*notifConfig, error) {
+	conf := makeNotifConfig()
+	conf.fanout = opts.getBool("events_fanout", conf.fanout)
+	conf.maxAttempts = opts.getInt("events_max_attempts", conf.maxAttempts)
+	if conf.maxAttempts < 1 {
+		conf.maxAttempts = 1
+	}
+	conf.retryDelay = time.Duration(opts.getInt("events_retry_delay",
+		int(conf.retryDelay/time.Millisecond))) * time.Millisecond
+	conf.rateLimit = opts.getInt("events_rate_limit", conf.rateLimit)
+	conf.rateBurst = opts.getInt("events_rate_burst", conf.rateBurst)
+	conf.sampling = opts.getInt("events_sampling", conf.sampling)
+	conf.compressionThreshold = opts.getInt("events_compression_threshold",
+		conf.compressionThreshold)
+	if err := setEventCompression(conf, opts["events_compression"]); err != nil {
+		return nil, err
+	}
+	conf.hmacSecret = []byte(opts["events_hmac_secret"])
+	facility, err := parseSyslogFacility(opts["events_syslog_facility"], conf.syslogFacility)
+	if err != nil {
+		return nil, err
+	}
+	conf.syslogFacility = facility
+	sdID, err := parseSyslogSDID(opts["events_syslog_sd_id"], conf.syslogSDID)
+	if err != nil {
+		return nil, err
+	}
+	conf.syslogSDID = sdID
+	conf.tubeShards = opts.getInt("events_tube_shards", conf.tubeShards)
+	conf.syncDelete = opts.getBool("events_sync_delete", conf.syncDelete)
+	conf.syncPut = opts.getBool("events_sync_put", conf.syncPut)
+	conf.fileMaxSize = opts.getInt("events_file_max_size", conf.fileMaxSize)
+	conf.fileKeep = opts.getInt("events_file_keep", conf.fileKeep)
+	conf.fileCompress = opts.getBool("events_file_compress", conf.fileCompress)
+	if window := opts.getInt("events_dedup_window", 0); window > 0 {
+		size := opts.getInt("events_dedup_size", eventDedupDefaultSize)
+		conf.dedup = makeEventDedup(size, time.Duration(window)*time.Second)
+	}
+	return conf, nil
+}
+
+// Builds the notifier and the parameters of the emission of its events.
+// Neither is applied: on error, the current ones remain untouched.
+func makeNotifierFromOpts(opts optionsMap, rawx *rawxService) (Notifier, *notifConfig, error) {
+	// The local configuration takes precedence over the namespace-wide one
+	eventAgent := opts["event_agent"]
+	if override := eventAgentOverride(); override != "" {
+		eventAgent = override
+	}
+	if eventAgent == "" {
+		eventAgent = OioGetEventAgent(rawx.ns)
+	}
+	if eventAgent == "" {
+		return nil, nil, errors.New("no address")
+	}
+
+	conf, err := makeNotifConfigFromOpts(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	notifier, err := MakeNotifier(eventAgent, rawx)
+	if err != nil {
+		return nil, nil, err
+	}
+	setEventAgent(eventAgent)
+	return notifier, conf, nil
+}
+
 func main() {
 	_ = flag.String("D", "UNUSED", "Unused compatibility flag")
 	verbosePtr := flag.Bool("v", false, "Verbose mode, this activates stderr traces")
 	syslogIDPtr := flag.String("s", "", "Activates syslog traces with the given identifier")
 	confPtr := flag.String("f", "", "Path to configuration file")
 	servicingPtr := flag.Bool("servicing", false, "Don't lock volume")
+	exportPtr := flag.String("export", "", "Export the manifest of the chunks (gzipped CSV) to the given file or http(s) URL, then exit")
 	flag.Parse()
 
-	if flag.NArg() != 0 {
+	// Positional arguments are only expected for the subcommands
+	if flag.NArg() != 0 && flag.Arg(0) != "events" {
 		log.Fatal("Unexpected positional argument detected")
 	}
 
@@ -100,9 +352,12 @@ func main() {
 
 	var opts optionsMap
 
+	var cfg string
+	var err error
+
 	if len(*confPtr) <= 0 {
 		log.Fatal("Missing configuration file")
-	} else if cfg, err := filepath.Abs(*confPtr); err != nil {
+	} else if cfg, err = filepath.Abs(*confPtr); err != nil {
 		log.Fatalf("Invalid configuration file path: %v", err.Error())
 	} else if opts, err = readConfig(cfg); err != nil {
 		log.Fatalf("Exiting with error: %v", err.Error())
@@ -118,6 +373,10 @@ func main() {
 		InitNoopLogger()
 	}
 
+	if err := setIOEngine(opts["io_engine"]); err != nil {
+		LogFatal("%v", err)
+	}
+
 	chunkrepo := chunkRepository{}
 	namespace := opts["ns"]
 	rawxURL := opts["addr"]
@@ -134,15 +393,32 @@ func main() {
 		LogInfo("No service ID, using ADDR %s", rawxURL)
 	}
 
+	if flag.NArg() != 0 {
+		rawx := rawxService{ns: namespace, url: rawxURL, id: rawxID}
+		if err := runEventsCommand(opts, &rawx, flag.Args()[1:]); err != nil {
+			LogFatal("Command error: %v", err)
+		}
+		return
+	}
+
 	// Init the actual chunk storage
-	if err := chunkrepo.sub.init(opts["basedir"]); err != nil {
+	if err := configureRepository(&chunkrepo, opts, opts["basedir"]); err != nil {
 		LogFatal("Invalid directories: %v", err)
 	}
-	chunkrepo.sub.hashWidth = opts.getInt("hash_width", chunkrepo.sub.hashWidth)
-	chunkrepo.sub.hashDepth = opts.getInt("hash_depth", chunkrepo.sub.hashDepth)
-	chunkrepo.sub.syncFile = opts.getBool("fsync_file", chunkrepo.sub.syncFile)
-	chunkrepo.sub.syncDir = opts.getBool("fsync_dir", chunkrepo.sub.syncDir)
-	chunkrepo.sub.fallocateFile = opts.getBool("fallocate", chunkrepo.sub.fallocateFile)
+	if v, ok := opts["tier_cold_dir"]; ok {
+		cold := chunkRepository{}
+		if err := configureRepository(&cold, opts, v); err != nil {
+			LogFatal("Invalid cold tier: %v", err)
+		}
+		chunkrepo.cold = &cold.sub
+	}
+
+	if *exportPtr != "" {
+		if err := exportChunks(&chunkrepo, *exportPtr); err != nil {
+			LogFatal("Export error: %v", err)
+		}
+		return
+	}
 
 	rawx := rawxService{
 		ns:           namespace,
@@ -177,49 +453,167 @@ func main() {
 			rawx.checksumMode = checksumNever
 		}
 	}
+	if v := opts["checksum_algorithm"]; v != "" {
+		algo, err := parseHashAlgo(v)
+		if err != nil {
+			LogFatal("Unexpected checksum_algorithm [%s]: %v", v, err)
+		}
+		defaultHashAlgo = algo
+	}
 
-	// Patch the fadvise() upon upload
-	if v, ok := opts["fadvise_upload"]; ok {
-		if strings.ToLower(v) == "cache" {
-			chunkrepo.sub.fadviseUpload = configFadviseCache
-		} else if strings.ToLower(v) == "nocache" {
-			chunkrepo.sub.fadviseUpload = configFadviseNocache
-		} else if GetBool(v, false) {
-			chunkrepo.sub.fadviseUpload = configFadviseYes
+	txnTimeout = time.Duration(opts.getInt("txn_timeout",
+		int(txnTimeout/time.Second))) * time.Second
+	txnMaxOpen = opts.getInt("txn_max_open", txnMaxOpen)
+	txnMaxMembers = opts.getInt("txn_max_members", txnMaxMembers)
+
+	sessionTimeout = time.Duration(opts.getInt("session_timeout",
+		int(sessionTimeout/time.Second))) * time.Second
+	sessionMax = opts.getInt("session_max", sessionMax)
+
+	snapshotCommand = opts["snapshot_command"]
+	snapshotPostCommand = opts["snapshot_post_command"]
+	snapshotTimeout = time.Duration(opts.getInt("snapshot_timeout",
+		snapshotDefaultTimeout)) * time.Second
+
+	compressionZstdLevel = opts.getInt("compression_level", compressionZstdLevel)
+	compressionMinSize = int64(opts.getInt("compression_min_size", int(compressionMinSize)))
+	compressionMinSaving = opts.getInt("compression_min_saving", compressionMinSaving)
+	compressionDetect = opts.getBool("compression_detect", compressionDetect)
+	contentEncoding = opts.getBool("content_encoding", contentEncoding)
+	contentEncodingMinSize = int64(opts.getInt("content_encoding_min_size", int(contentEncodingMinSize)))
+	contentEncodingLevel = opts.getInt("content_encoding_level", contentEncodingLevel)
+	setContentEncodingWorkers(opts.getInt("content_encoding_workers", 4))
+	if !compressionManaged(rawx.compression) {
+		LogWarning("Unexpected compression, the uploads will fail: %s", rawx.compression)
+	}
+	if opts.getBool("compression_dict", false) {
+		dictMaxChunkSize = int64(opts.getInt("compression_dict_max_chunk_size", int(dictMaxChunkSize)))
+		dictSize = opts.getInt("compression_dict_size", dictSize)
+		dictSamples = opts.getInt("compression_dict_samples", dictSamples)
+		if zstdDicts, err = openDictRegistry(chunkrepo.sub.root); err != nil {
+			LogFatal("Compression dictionaries error: %v", err)
+		}
+		if !*servicingPtr {
+			interval := opts.getInt("compression_dict_interval", dictDefaultInterval)
+			zstdDicts.startTrainer(&chunkrepo, time.Duration(interval)*time.Second)
 		}
 	}
 
-	// Patch the fadvise() upon download
-	if v, ok := opts["fadvise_download"]; ok {
-		if strings.ToLower(v) == "cache" {
-			chunkrepo.sub.fadviseDownload = configFadviseCache
-		} else if strings.ToLower(v) == "nocache" {
-			chunkrepo.sub.fadviseDownload = configFadviseNocache
-		} else if GetBool(v, false) {
-			chunkrepo.sub.fadviseDownload = configFadviseYes
+	// Patch the source of the encryption keys
+	if v, ok := opts["encryption_kms"]; ok {
+		kmsKeyTTL = time.Duration(opts.getInt("encryption_key_ttl",
+			kmsDefaultKeyTTL)) * time.Second
+		provider, err := makeKeyProvider(v)
+		if err != nil {
+			LogFatal("Encryption KMS error: %v", err)
 		}
+		keyProvider, encryptNewChunks = provider, true
+	} else if v, ok := opts["encryption_key_file"]; ok {
+		provider, err := makeFileKeyProvider(v, opts["encryption_key_id"])
+		if err != nil {
+			LogFatal("Encryption keys error: %v", err)
+		}
+		keyProvider, encryptNewChunks = provider, provider.current != ""
 	}
 
-	eventAgent := OioGetEventAgent(namespace)
-	if eventAgent == "" {
-		LogFatal("Notifier error: no address")
+	// Patch the verification of the chunks upon GET
+	if v, ok := opts["verify_get"]; ok {
+		if v == "stream" {
+			rawx.verifyGet = verifyGetStream
+		} else if v == "strict" || GetBool(v, false) {
+			rawx.verifyGet = verifyGetStrict
+		} else {
+			rawx.verifyGet = verifyGetOff
+		}
+	}
+
+	if v, ok := opts["auth_tokens_file"]; ok {
+		if authTokens, err = loadAuthTokens(v); err != nil {
+			LogFatal("Authentication tokens error: %v", err)
+		}
+	}
+
+	for name, acl := range map[string]*aclList{
+		"acl_read":  &aclRead,
+		"acl_write": &aclWrite,
+		"acl_admin": &aclAdmin,
+	} {
+		if *acl, err = parseACL(opts[name]); err != nil {
+			LogFatal("Invalid %s: %v", name, err)
+		}
+	}
+
+	if v, ok := opts["presign_key_file"]; ok {
+		if presignKeys, err = loadPresignKeys(v); err != nil {
+			LogFatal("Presign keys error: %v", err)
+		}
+	}
+	presignRequired = opts.getBool("presign_required", false)
+	presignMaxTTL = int64(opts.getInt("presign_max_ttl", presignDefaultMaxTTL))
+	if presignRequired && len(presignKeys) == 0 {
+		LogFatal("presign_required requires presign_key_file")
 	}
 
-	notifier, err := MakeNotifier(eventAgent, &rawx)
+	maxChunkSize = int64(opts.getInt("max_chunk_size", 0))
+	if maxChunkSizeByPolicy, err = parseMaxChunkSizes(opts["max_chunk_size_by_policy"]); err != nil {
+		LogFatal("Invalid max_chunk_size_by_policy: %v", err)
+	}
+
+	hashTreeBlockSize = int64(opts.getInt("hash_tree_block_size", 0))
+	scrubTreeBlocks = opts.getInt("scrub_tree_blocks", 0)
+
+	if v, ok := opts["events_dead_letter"]; ok {
+		deadLetter, err := makeDeadLetter(v)
+		if err != nil {
+			LogFatal("Dead letter error: %v", err)
+		}
+		notifDeadLetter = deadLetter
+	}
+	// Upon a reload, the configuration is read again
+	notifier, err := makeReloadableNotifier(func() (Notifier, *notifConfig, error) {
+		if current, err := readConfig(cfg); err != nil {
+			return nil, nil, err
+		} else {
+			return makeNotifierFromOpts(current, &rawx)
+		}
+	})
 	if err != nil {
 		LogFatal("Notifier error: %v", err)
 	}
 	rawx.notifier = notifier
+	if v, ok := opts["events_wal"]; ok {
+		notifWalSegmentSize = opts.getInt("events_wal_segment_size", notifWalSegmentSize)
+		notifWalFsync = opts.getBool("events_wal_fsync", notifWalFsync)
+		wal, err := makeWalNotifier(v, notifier)
+		if err != nil {
+			LogFatal("Events log error: %v", err)
+		}
+		rawx.notifier = wal
+	}
+
+	// The additional volumes share the listener and the notifier
+	volumes := []*rawxService{&rawx}
+	if v, ok := opts["volumes"]; ok {
+		extra, err := makeVolumes(v, opts, &rawx)
+		if err != nil {
+			LogFatal("Volumes error: %v", err)
+		}
+		volumes = append(volumes, extra...)
+	}
+	var handler http.Handler = &rawx
+	if len(volumes) > 1 {
+		handler = makeVolumeRouter(volumes)
+	}
 
 	toReadHeader := opts.getInt("timeout_read_header", timeoutReadHeader)
 	toReadRequest := opts.getInt("timeout_read_request", timeoutReadRequest)
 	toWrite := opts.getInt("timeout_write_reply", timeoutWrite)
 	toIdle := opts.getInt("timeout_idle", timeoutIdle)
+	loadVerbTimeouts(opts)
 
 	srv := http.Server{
 		Addr:              rawx.url,
-		Handler:           &rawx,
-		TLSConfig:         nil,
+		Handler:           handler,
 		ReadHeaderTimeout: time.Duration(toReadHeader) * time.Second,
 		ReadTimeout:       time.Duration(toReadRequest) * time.Second,
 		WriteTimeout:      time.Duration(toWrite) * time.Second,
@@ -228,17 +622,167 @@ func main() {
 		MaxHeaderBytes: opts.getInt("headers_buffer_size", 65536),
 	}
 
-	installSigHandlers(&rawx, &srv)
+	shutdownTimeout = time.Duration(opts.getInt("shutdown_timeout",
+		shutdownDefaultTimeout)) * time.Second
+	drain := makeDrainer(&srv)
+	installSigHandlers(&rawx, drain)
 
 	rawx.notifier.Start()
 
-	if !*servicingPtr {
-		if err := chunkrepo.lock(namespace, rawxID); err != nil {
-			LogFatal("Volume lock error: %v", err.Error())
+	pressureQueueDepth = uint64(opts.getInt("priority_queue_depth", 0))
+	pressureLatency = uint64(opts.getInt("priority_latency", 0))
+	switch v := opts["priority_policy"]; v {
+	case "":
+	case priorityReads, priorityWrites:
+		pressurePolicy = v
+	default:
+		LogFatal("Unexpected priority_policy [%s]", v)
+	}
+
+	for _, vol := range volumes {
+		repo := vol.repo.(*chunkRepository)
+		if pressureQueueDepth > 0 || pressureLatency > 0 {
+			pressure, err := makeIOPressure(repo.sub.root)
+			if err != nil {
+				LogFatal("IO pressure error: %v", err)
+			}
+			repo.sub.pressure = pressure
+			interval := opts.getInt("priority_interval", pressureDefaultInterval)
+			pressure.Start(time.Duration(interval) * time.Millisecond)
+		}
+		if opts.getBool("watch_volume", false) {
+			watcher, err := makeVolumeWatcher(vol, repo)
+			if err != nil {
+				LogFatal("Volume watcher error: %v", err)
+			}
+			repo.sub.watcher = watcher
+			watcher.Start()
+		}
+
+		if !*servicingPtr {
+			if err := repo.lock(namespace, vol.id); err != nil {
+				LogFatal("Volume lock error: %v", err.Error())
+			}
+			if bandwidth := opts.getInt("scrub_bandwidth", 0); bandwidth > 0 {
+				interval := opts.getInt("scrub_interval", scrubDefaultInterval)
+				makeScrubber(vol, bandwidth, time.Duration(interval)*time.Second).Start()
+			}
+			if maxAge := opts.getInt("pending_max_age", pendingDefaultMaxAge); maxAge > 0 {
+				interval := opts.getInt("pending_gc_interval", pendingDefaultInterval)
+				repo.sub.reapPending(time.Duration(maxAge) * time.Second)
+				repo.sub.startPendingReaper(time.Duration(maxAge)*time.Second,
+					time.Duration(interval)*time.Second)
+			}
+			if repo.sub.migrateFrom != nil {
+				repo.sub.sweepLayout()
+			}
+			if repo.sub.header && opts.getBool("chunk_format_convert", false) {
+				repo.sub.sweepFormat()
+			}
+			if repo.sub.trashRetention > 0 {
+				interval := opts.getInt("trash_purge_interval", trashDefaultPurgeInterval)
+				repo.sub.startPurger(time.Duration(interval) * time.Second)
+				if repo.cold != nil {
+					repo.cold.startPurger(time.Duration(interval) * time.Second)
+				}
+			}
+			if repo.sub.movedRetention > 0 {
+				interval := opts.getInt("moved_purge_interval", movedDefaultPurgeInterval)
+				repo.sub.startTombstonePurger(time.Duration(interval) * time.Second)
+			}
+			if interval := opts.getInt("health_interval", healthDefaultInterval); interval > 0 {
+				failures := opts.getInt("health_failures", healthDefaultFailures)
+				repo.sub.startHealthProbe(time.Duration(interval)*time.Second, failures)
+			}
+			if repo.sub.s3 != nil {
+				days := opts.getInt("s3_offload_after", offloadDefaultAfter)
+				interval := opts.getInt("s3_offload_interval", offloadDefaultInterval)
+				repo.sub.startOffloader(time.Duration(days)*24*time.Hour,
+					time.Duration(interval)*time.Second)
+			}
+			if repo.sub.slabs != nil {
+				interval := opts.getInt("slab_compact_interval", slabDefaultCompactInterval)
+				repo.sub.slabs.startCompactor(time.Duration(interval) * time.Second)
+			}
+			if repo.sub.dedup {
+				interval := opts.getInt("dedup_sweep_interval", dedupDefaultSweepInterval)
+				repo.sub.startDedupSweeper(time.Duration(interval) * time.Second)
+			}
+			if repo.sub.discard == discardTrim {
+				interval := opts.getInt("discard_interval", discardDefaultInterval)
+				repo.sub.startTrimmer(time.Duration(interval) * time.Second)
+			}
+			if interval := opts.getInt("orphan_interval", 0); interval > 0 {
+				proxy := opts["proxy"]
+				if proxy == "" {
+					proxy = OioGetProxy(namespace)
+				}
+				if proxy == "" {
+					LogFatal("Orphan collection requires a proxy")
+				}
+				rate := opts.getInt("orphan_rate", orphanDefaultRate)
+				grace := opts.getInt("orphan_grace", orphanDefaultGrace)
+				makeOrphanCollector(vol, proxy, rate,
+					time.Duration(grace)*time.Second,
+					time.Duration(interval)*time.Second,
+					opts.getBool("orphan_dry_run", false)).Start()
+			}
+		}
+	}
+
+	quotaDefault.Bytes = int64(opts.getInt("quota_bytes", 0))
+	quotaDefault.Chunks = int64(opts.getInt("quota_chunks", 0))
+	if v, ok := opts["quota_file"]; ok {
+		if quotaOverrides, err = loadQuotaFile(v); err != nil {
+			LogFatal("Quota file error: %v", err)
 		}
 	}
+	if quotaDefault.Bytes > 0 || quotaDefault.Chunks > 0 || len(quotaOverrides) > 0 {
+		interval := opts.getInt("quota_save_interval", quotaDefaultSaveInterval)
+		for _, vol := range volumes {
+			repo := vol.repo.(*chunkRepository)
+			if repo.quotas, err = openQuotaIndex(repo); err != nil {
+				LogFatal("Quota index error: %v", err)
+			}
+			repo.quotas.startSaver(time.Duration(interval) * time.Second)
+		}
+	}
+
+	if chunkrepo.cold != nil && !*servicingPtr {
+		days := opts.getInt("tier_demote_after", tierDefaultDemoteAfter)
+		interval := opts.getInt("tier_scan_interval", tierDefaultScanInterval)
+		makeTierMover(&rawx, time.Duration(days)*24*time.Hour,
+			time.Duration(interval)*time.Second).Start()
+	}
+
+	if threshold := opts.getInt("rebalance_threshold", 0); threshold > 0 && len(volumes) > 1 && !*servicingPtr {
+		rate := opts.getInt("rebalance_rate", rebalanceDefaultRate)
+		interval := opts.getInt("rebalance_interval", rebalanceDefaultInterval)
+		makeRebalancer(volumes, threshold, rate, time.Duration(interval)*time.Second).Start()
+	}
 
 	srv.SetKeepAlivesEnabled(tcp_keepalive)
+	configureHTTP2(&srv, opts)
+	if err := configureTLS(&srv, opts); err != nil {
+		LogFatal("TLS error: %v", err)
+	}
+	if opts.getInt("quic_port", 0) > 0 {
+		host, _, err := net.SplitHostPort(rawx.url)
+		if err != nil {
+			LogFatal("Invalid service URL: %v", err)
+		}
+		cert, key := opts["quic_cert_file"], opts["quic_key_file"]
+		if cert == "" && key == "" {
+			cert, key = opts["tls_cert_file"], opts["tls_key_file"]
+		}
+		if cert == "" || key == "" {
+			LogFatal("The QUIC listener requires a certificate")
+		}
+		addr := net.JoinHostPort(host, opts["quic_port"])
+		if err = startQUIC(&srv, addr, cert, key); err != nil {
+			LogFatal("QUIC listener error: %v", err)
+		}
+	}
 
 	if logExtremeVerbosity {
 		srv.ConnState = func(cnx net.Conn, state http.ConnState) {
@@ -246,9 +790,41 @@ func main() {
 		}
 	}
 
-	if err := srv.ListenAndServe(); err != nil {
+	clientBandwidth = int64(opts.getInt("client_bandwidth", 0))
+	if v := opts["client_bandwidth_key"]; v != "" {
+		if v != "ip" && v != "token" {
+			LogFatal("Unexpected client_bandwidth_key [%s]", v)
+		}
+		clientBandwidthKey = v
+	}
+	if clientBandwidth > 0 {
+		clientBuckets.Start()
+	}
+	clientRate = int64(opts.getInt("client_rate", 0))
+	clientRateBurst = int64(opts.getInt("client_rate_burst", int(clientRate)))
+	if v := opts["client_rate_key"]; v != "" {
+		if v != "ip" && v != "token" {
+			LogFatal("Unexpected client_rate_key [%s]", v)
+		}
+		clientRateKey = v
+	}
+	if clientRate > 0 {
+		clientRates.Start()
+	}
+	maxConcurrentGet = int64(opts.getInt("max_concurrent_get", 0))
+	maxConcurrentPut = int64(opts.getInt("max_concurrent_put", 0))
+	maxConnections = int64(opts.getInt("max_connections", 0))
+	concurrencyRetryAfter = opts.getInt("concurrency_retry_after", concurrencyRetryAfter)
+	trackConnections(&srv)
+	maxRequestsPerConn = int64(opts.getInt("max_requests_per_connection", 0))
+	maxIdleConns = opts.getInt("max_idle_connections", 0)
+	connReapInterval = time.Duration(opts.getInt("conn_reap_interval", 10)) * time.Second
+	configureKeepAlive(&srv)
+
+	if err := listenAndServe(&srv); err != nil {
 		LogWarning("HTTP Server exiting: %v", err)
 	}
+	drain.wait()
 
-	rawx.notifier.Stop()
+	rawx.notifier.Close()
 }
@@ -17,21 +17,102 @@
 package main
 
 import (
+	"crypto/md5"
+	"encoding/hex"
 	"flag"
+	"fmt"
+	"io"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
+
+	syscall "golang.org/x/sys/unix"
 )
 
 var syslogID string
 var conf string
 
 func init() {
+	// The flags of the testing package must be known before the parsing
+	testing.Init()
 	flag.StringVar(&syslogID, "test.syslog", "", "Activates syslog traces with the given identifier")
 	flag.StringVar(&conf, "test.conf", "", "Path to configuration file")
 	flag.Parse()
 }
 
 func TestSystem(t *testing.T) {
+	// Only the unit tests run without a service to start
+	if conf == "" {
+		t.Skip("no -test.conf")
+	}
 	os.Args = []string{os.Args[0], "-D", "FOREGROUND", "-s", syslogID, "-f", conf}
 	main()
 }
+
+// Opens a volume in a temporary directory, configured as the service does
+func makeTestRepository(t *testing.T, opts optionsMap) *chunkRepository {
+	InitNoopLogger()
+	repo := new(chunkRepository)
+	if err := configureRepository(repo, opts, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Close(repo.sub.rootFd) })
+	return repo
+}
+
+// Describes the chunk as its upload does
+func makeTestChunk(id int, data []byte) chunkInfo {
+	sum := md5.Sum(data)
+	contentID := fmt.Sprintf("%032X", id)
+	return chunkInfo{
+		ContentFullpath:    "ACCT/JFS/object/1/" + contentID,
+		ContainerID:        cidFromName("ACCT", "JFS"),
+		ContentPath:        "object",
+		ContentVersion:     "1",
+		ContentID:          contentID,
+		ContentChunkMethod: "plain/nb_copy=3",
+		ContentStgPol:      "THREECOPIES",
+		ChunkID:            fmt.Sprintf("%064X", id),
+		ChunkPosition:      "0",
+		ChunkHash:          strings.ToUpper(hex.EncodeToString(sum[:])),
+		ChunkSize:          strconv.Itoa(len(data)),
+	}
+}
+
+// Uploads the chunk into the volume, with its attributes
+func putTestChunk(t *testing.T, fr *fileRepository, chunk *chunkInfo, data []byte) {
+	w, err := fr.put(chunk.ChunkID)
+	if err != nil {
+		t.Fatalf("put %s: %v", chunk.ChunkID, err)
+	}
+	w.Extend(int64(len(data)))
+	if _, err = w.Write(data); err == nil {
+		err = chunk.saveAttr(w)
+	}
+	if err != nil {
+		w.abort()
+		t.Fatalf("upload %s: %v", chunk.ChunkID, err)
+	}
+	if err = w.commit(); err != nil {
+		t.Fatalf("commit %s: %v", chunk.ChunkID, err)
+	}
+}
+
+// Reads the chunk back, with its attributes
+func getTestChunk(t *testing.T, repo repository, name string) ([]byte, chunkInfo) {
+	r, err := repo.get(name)
+	if err != nil {
+		t.Fatalf("get %s: %v", name, err)
+	}
+	defer r.Close()
+	var chunk chunkInfo
+	if err = chunk.loadAttr(r, name); err != nil {
+		t.Fatalf("attributes of %s: %v", name, err)
+	}
+	data := make([]byte, r.size())
+	if _, err = io.ReadFull(r, data); err != nil {
+		t.Fatalf("data of %s: %v", name, err)
+	}
+	return data, chunk
+}
@@ -0,0 +1,69 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The maintenance of a volume, e.g. before a disk is replaced or the service
+decommissioned: the volume still serves the GET and the HEAD, but refuses
+every change (PUT, DELETE, COPY, update of the metadata) with a 503 and the
+"maintenance" error code, and its /info replies a 503 so that the
+conscience allocates no new chunk there.
+
+A volume enters the maintenance with the maintenance option, with the
+"maintenance" setting of the admin API, or as long as a ".maintenance" file
+exists at its root, whatever the service (e.g. touched by a provisioning
+tool). The file is looked for at most once a second.
+*/
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+const (
+	maintenanceMarker      = ".maintenance"
+	maintenanceMarkerDelay = time.Second
+)
+
+var errMaintenance = errors.New("Volume in maintenance")
+
+func (fr *fileRepository) inMaintenance() bool {
+	if atomic.LoadInt32(&fr.maintenance) != 0 {
+		return true
+	}
+	return fr.maintenanceMarked()
+}
+
+// Tells if the marker file is at the root of the volume, as last seen
+func (fr *fileRepository) maintenanceMarked() bool {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&fr.markerChecked)
+	if now-last >= int64(maintenanceMarkerDelay) && atomic.CompareAndSwapInt64(&fr.markerChecked, last, now) {
+		var st syscall.Stat_t
+		var present int32
+		if syscall.Fstatat(fr.rootFd, maintenanceMarker, &st, 0) == nil {
+			present = 1
+		}
+		if atomic.SwapInt32(&fr.markerPresent, present) != present {
+			LogNotice("Volume %s maintenance marker present=%v", fr.root, present != 0)
+		}
+	}
+	return atomic.LoadInt32(&fr.markerPresent) != 0
+}
@@ -0,0 +1,104 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The largest chunk accepted, max_chunk_size bytes (0 for no limit), or the
+size given for the storage policy of the chunk by max_chunk_size_by_policy:
+
+	max_chunk_size_by_policy  EC=1073741824,THREECOPIES=104857600
+
+An upload announcing a larger Content-Length is refused with a 413 before
+its body is read, a chunked upload is aborted with a 413 as soon as it goes
+beyond the limit. The appends (PATCH) are bounded the same way, the data
+already in the chunk included.
+*/
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	maxChunkSize         int64
+	maxChunkSizeByPolicy map[string]int64
+)
+
+var errChunkTooLarge = errors.New("Chunk too large")
+
+// Parses "POLICY=SIZE" items separated by commas
+func parseMaxChunkSizes(v string) (map[string]int64, error) {
+	sizes := make(map[string]int64)
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		eq := strings.IndexByte(item, '=')
+		if eq <= 0 {
+			return nil, errors.New("Invalid item, expected POLICY=SIZE: " + item)
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(item[eq+1:]), 10, 64)
+		if err != nil || size < 0 {
+			return nil, errors.New("Invalid size: " + item)
+		}
+		sizes[strings.TrimSpace(item[:eq])] = size
+	}
+	return sizes, nil
+}
+
+// The largest size of the chunk, 0 when unbounded
+func (chunk *chunkInfo) maxSize() int64 {
+	if size, ok := maxChunkSizeByPolicy[chunk.ContentStgPol]; ok {
+		return size
+	}
+	return maxChunkSize
+}
+
+// Fails the reads beyond the size allowed
+type cappedBody struct {
+	io.ReadCloser
+	left int64
+}
+
+func (b *cappedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.left -= int64(n); b.left < 0 {
+		return n, errChunkTooLarge
+	}
+	return n, err
+}
+
+// Refuses the upload already too large, then caps its body at what is left
+// for the chunk, given the size it already has.
+func (rr *rawxRequest) capUpload(current int64) error {
+	max := rr.chunk.maxSize()
+	if max <= 0 {
+		return nil
+	}
+	if current+rr.req.ContentLength > max {
+		atomic.AddUint64(&counters.ChunksTooLarge, 1)
+		return errChunkTooLarge
+	}
+	if rr.req.Body != nil {
+		rr.req.Body = &cappedBody{ReadCloser: rr.req.Body, left: max - current}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The update of the metadata of a chunk, with a POST /<CHUNKID> without any
+Destination header (with one, the POST is a COPY), so that the renames and
+the repairs of the metadata don't upload the chunk again. The headers of
+the upload tell the new values: the full path (thus the container, the
+path, the version and the content ID), the metachunk hash and size, the
+position, the storage policy and the chunk method. The hash and the size of
+the chunk can't change, they are only checked when present.
+
+The chunk moved to another container or content is announced by a
+"storage.chunk.deleted" event for the former one, then a
+"storage.chunk.new" for the new one. Otherwise a "storage.chunk.new" tells
+the new metadata.
+*/
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Sets the attributes of a chunk already committed
+type committedAttrs struct {
+	repo *fileRepository
+	name string
+}
+
+func (ca *committedAttrs) setAttr(key string, value []byte) error {
+	return ca.repo.setAttr(ca.name, key, string(value))
+}
+
+// Applies the headers of the request onto the metadata of the chunk
+func (chunk *chunkInfo) retrieveUpdateHeaders(headers *http.Header) error {
+	changed := false
+	if headers.Get(HeaderNameFullpath) != "" {
+		if err := chunk.retrieveContentFullpathHeader(headers); err != nil {
+			return err
+		}
+		changed = true
+	}
+	if v := headers.Get(HeaderNameMetachunkChecksum); v != "" {
+		if !isHexaString(v, 0) {
+			return returnError(errInvalidHeader, HeaderNameMetachunkChecksum)
+		}
+		chunk.MetachunkHash = strings.ToUpper(v)
+		changed = true
+	}
+	if v := headers.Get(HeaderNameMetachunkSize); v != "" {
+		if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+			return returnError(errInvalidHeader, HeaderNameMetachunkSize)
+		}
+		chunk.MetachunkSize = v
+		changed = true
+	}
+	for _, field := range []struct {
+		header string
+		ptr    *string
+	}{
+		{HeaderNameChunkPosition, &chunk.ChunkPosition},
+		{HeaderNameContentStgPol, &chunk.ContentStgPol},
+		{HeaderNameContentChunkMethod, &chunk.ContentChunkMethod},
+	} {
+		if v := headers.Get(field.header); v != "" {
+			*field.ptr = v
+			changed = true
+		}
+	}
+
+	// The data isn't rewritten
+	if v := headers.Get(HeaderNameChunkChecksum); v != "" && !strings.EqualFold(v, chunk.ChunkHash) {
+		return returnError(errInvalidHeader, HeaderNameChunkChecksum)
+	}
+	if v := headers.Get(HeaderNameChunkSize); v != "" && v != chunk.ChunkSize {
+		return returnError(errInvalidHeader, HeaderNameChunkSize)
+	}
+	if !changed {
+		return returnError(errMissingHeader, HeaderNameFullpath)
+	}
+	return nil
+}
+
+func (rr *rawxRequest) updateChunk() {
+	repo, ok := rr.rawx.repo.(*chunkRepository)
+	if !ok {
+		rr.replyCode(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := repo.sub.writable(); err != nil {
+		rr.replyError(err)
+		return
+	}
+	repo.sub.waitThawed()
+
+	lock := chunkLock(rr.chunkID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	former, err := rr.updateMetadata(&repo.sub)
+	if err != nil {
+		rr.replyError(err)
+		return
+	}
+	atomic.AddUint64(&counters.UpdatedChunks, 1)
+	rr.chunk.fillHeaders(rr.rep.Header())
+	rr.replyCode(http.StatusOK)
+	if former.ContainerID != rr.chunk.ContainerID || former.ContentID != rr.chunk.ContentID {
+		NotifyDel(rr.rawx, rr.reqid, &former)
+	}
+	NotifyNew(rr.rawx, rr.reqid, &rr.chunk)
+}
+
+// Saves the new metadata, then tells the former one
+func (rr *rawxRequest) updateMetadata(fr *fileRepository) (chunkInfo, error) {
+	var former chunkInfo
+	r, err := fr.get(rr.chunkID)
+	if err != nil {
+		return former, err
+	}
+	err = rr.chunk.loadAttr(r, rr.chunkID)
+	r.Close()
+	if err != nil {
+		return former, err
+	}
+	if rr.checkPreconditions() != 0 {
+		return former, errPreconditionFailed
+	}
+	former = rr.chunk
+	if err = rr.chunk.retrieveUpdateHeaders(&rr.req.Header); err != nil {
+		return former, err
+	}
+
+	attrs := &committedAttrs{repo: fr, name: rr.chunkID}
+	if rr.chunk.ContentFullpath != former.ContentFullpath {
+		if err = rr.chunk.saveContentFullpathAttr(attrs); err != nil {
+			return former, err
+		}
+	}
+	for _, attr := range []struct {
+		key      string
+		old, new string
+	}{
+		{AttrNameMetachunkChecksum, former.MetachunkHash, rr.chunk.MetachunkHash},
+		{AttrNameMetachunkSize, former.MetachunkSize, rr.chunk.MetachunkSize},
+		{AttrNameChunkPosition, former.ChunkPosition, rr.chunk.ChunkPosition},
+		{AttrNameContentStgPol, former.ContentStgPol, rr.chunk.ContentStgPol},
+		{AttrNameContentChunkMethod, former.ContentChunkMethod, rr.chunk.ContentChunkMethod},
+	} {
+		if attr.new == attr.old {
+			continue
+		}
+		if err = attrs.setAttr(attr.key, []byte(attr.new)); err != nil {
+			return former, err
+		}
+	}
+
+	if former.ContainerID != rr.chunk.ContainerID {
+		rr.accountChunk(&former, -1)
+		rr.accountChunk(&rr.chunk, 1)
+	}
+	return former, nil
+}
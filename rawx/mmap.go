@@ -0,0 +1,85 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The medium sized chunks, hot enough to stay in the page cache, might be sent
+from a memory mapping instead of the file: the reply is then written in one
+go, without any read() nor copy. The chunks between mmap_min_size and
+mmap_max_size bytes are mapped, as long as they are served raw (neither
+compressed nor encrypted). The committed chunks are never truncated, so the
+mapping can't fault beyond the end of the file.
+*/
+
+import (
+	"io"
+	"sync/atomic"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+// Tells if the chunk of the given size is mapped upon GET
+func (fr *fileRepository) mmapFor(size int64) bool {
+	return fr.mmapMaxSize > 0 && size >= fr.mmapMinSize && size <= fr.mmapMaxSize
+}
+
+func (fr *realFileReader) mapping() []byte {
+	if fr.mapped != nil {
+		return fr.mapped
+	}
+	size := fr.size()
+	if size <= 0 || !fr.repo.mmapFor(size) {
+		return nil
+	}
+	// The whole file, the offsets in the mapping are those in the file
+	data, err := syscall.Mmap(fr.fd(), 0, int(fr.base+size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		LogDebug("mmap(%s) error: %v", fr.f.Name(), err)
+		return nil
+	}
+	_ = syscall.Madvise(data, syscall.MADV_SEQUENTIAL)
+	_ = syscall.Madvise(data, syscall.MADV_WILLNEED)
+	atomic.AddUint64(&counters.MmapChunks, 1)
+	fr.mapped = data
+	return data
+}
+
+func (fr *realFileReader) unmap() {
+	if fr.mapped != nil {
+		_ = syscall.Munmap(fr.mapped)
+		fr.mapped = nil
+	}
+}
+
+// Sends the raw chunk from its mapping, or from the file when not mapped
+func copyMapped(dst io.Writer, in *io.LimitedReader, chunk fileReader) (int64, error) {
+	offset, raw := rawOffset(in, chunk)
+	if !raw {
+		return copyAhead(dst, in, chunk)
+	}
+	data := chunk.mapping()
+	if data == nil || offset > int64(len(data)) {
+		return copyAhead(dst, in, chunk)
+	}
+	end := offset + in.N
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	n, err := writeThrottled(dst, data[offset:end], chunk)
+	in.N -= int64(n)
+	return int64(n), err
+}
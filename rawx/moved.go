@@ -0,0 +1,173 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The tombstones of the chunks moved elsewhere, so that the clients with a
+stale location keep on reading the chunk during a migration. A chunk moved
+away leaves a small file holding its new location:
+
+	.moved/<CHUNKID>
+
+then a GET or a HEAD of the chunk, once absent, is answered with a 307 to
+the same chunk on the destination rawx. The tombstone is left by the
+rebalancing between the volumes, and by a DELETE telling the destination
+with the X-oio-Chunk-Moved-To header (e.g. by a decommission tool, once it
+copied the chunk), as a rawx address or its URL.
+
+The tombstones are kept moved_retention seconds (0 leaves none), then
+purged in the background. A chunk uploaded again on the volume is served as
+usual, whatever its tombstone.
+*/
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+const movedDefaultPurgeInterval = 3600
+
+// Normalizes the location told, to the base URL of the destination rawx
+func movedLocation(v string) (string, error) {
+	v = strings.TrimSpace(v)
+	if !strings.Contains(v, "://") {
+		v = "http://" + v
+	}
+	u, err := url.Parse(v)
+	if err != nil || u.Host == "" || strings.Trim(u.Path, "/") != "" ||
+		(u.Scheme != "http" && u.Scheme != "https") {
+		return "", errInvalidHeader
+	}
+	return u.Scheme + "://" + u.Host, nil
+}
+
+// Leaves the new location of a chunk moved away from the volume
+func (fr *fileRepository) leaveTombstone(name, location string) error {
+	if err := syscall.Mkdirat(fr.rootFd, movedDir, uint32(fr.putMkdirMode)); err != nil && err != syscall.EEXIST {
+		return err
+	}
+	path := fr.root + "/" + movedDir + "/" + name
+	if err := ioutil.WriteFile(path+".pending", []byte(location), putOpenMode); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".pending", path); err != nil {
+		return err
+	}
+	atomic.AddUint64(&counters.MovedTombstones, 1)
+	return nil
+}
+
+// Tells where the chunk has been moved, if it has been for long
+func (fr *fileRepository) tombstone(name string) (string, bool) {
+	path := fr.root + "/" + movedDir + "/" + name
+	fi, err := os.Stat(path)
+	if err != nil || time.Since(fi.ModTime()) > fr.movedRetention {
+		return "", false
+	}
+	location, err := ioutil.ReadFile(path)
+	if err != nil || len(location) == 0 {
+		return "", false
+	}
+	return string(location), true
+}
+
+func (fr *fileRepository) startTombstonePurger(interval time.Duration) {
+	go func() {
+		for {
+			fr.purgeTombstones()
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// Removes the tombstones older than the retention
+func (fr *fileRepository) purgeTombstones() {
+	dir := fr.root + "/" + movedDir
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			LogWarning("Tombstones of %s not purged: %v", fr.root, err)
+		}
+		return
+	}
+	limit := time.Now().Add(-fr.movedRetention)
+	var purged int
+	for _, fi := range entries {
+		if !fi.ModTime().Before(limit) {
+			continue
+		}
+		if err = os.Remove(dir + "/" + fi.Name()); err != nil && !os.IsNotExist(err) {
+			LogWarning("Tombstone %s not purged: %v", fi.Name(), err)
+			continue
+		}
+		purged++
+	}
+	if purged > 0 {
+		LogInfo("%d tombstones purged from %s", purged, fr.root)
+	}
+}
+
+// The destination told by the DELETE of a chunk moved, empty without any
+func (rr *rawxRequest) movedTo() (string, error) {
+	v := rr.req.Header.Get(HeaderNameMovedTo)
+	if v == "" {
+		return "", nil
+	}
+	location, err := movedLocation(v)
+	if err != nil {
+		return "", returnError(err, HeaderNameMovedTo)
+	}
+	return location, nil
+}
+
+// Tells where the chunk deleted went, when the DELETE told it
+func (rr *rawxRequest) leaveTombstone(location string) {
+	fr := rr.volume()
+	if location == "" || fr == nil || fr.movedRetention <= 0 {
+		return
+	}
+	if err := fr.leaveTombstone(rr.chunkID, location); err != nil {
+		LogWarning("Tombstone of %s not left: %v", rr.chunkID, err)
+	}
+}
+
+// Redirects the request of a chunk absent, when it has been moved
+func (rr *rawxRequest) replyMoved() bool {
+	fr := rr.volume()
+	if fr == nil || fr.movedRetention <= 0 {
+		return false
+	}
+	location, ok := fr.tombstone(rr.chunkID)
+	if !ok {
+		return false
+	}
+	target := location + "/" + rr.chunkID
+	if rr.req.URL.RawQuery != "" {
+		target += "?" + rr.req.URL.RawQuery
+	}
+	atomic.AddUint64(&counters.ChunksRedirected, 1)
+	rr.rep.Header().Set("Location", target)
+	rr.replyCode(http.StatusTemporaryRedirect)
+	return true
+}
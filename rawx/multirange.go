@@ -0,0 +1,151 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The GET of several ranges of a chunk in one request, so that the EC decoders
+and the repair tools fetch scattered fragments in a single round-trip:
+
+	Range: bytes=0-1023,65536-66559,-512
+
+The ranges are sent in a "multipart/byteranges" reply, in the order asked,
+each part with its own Content-Range. The ranges beyond the end of the chunk
+are ignored, a request without any satisfiable range is answered with a 416.
+A single range is served as usual, without the multipart envelope.
+*/
+
+import (
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// Beyond, the request is more likely an abuse than a repair
+const multiRangeMax = 64
+
+// Parses all the ranges of the header, nil when the header is to be
+// ignored.
+func parseRanges(header string, chunkSize int64) ([]rangeInfo, error) {
+	specs, ok := hasPrefix(header, "bytes=")
+	if !ok || chunkSize == 0 {
+		return nil, nil
+	}
+	var ranges []rangeInfo
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		dash := strings.IndexByte(spec, '-')
+		if dash < 0 {
+			return nil, nil
+		}
+		var ri rangeInfo
+		first, last := spec[:dash], spec[dash+1:]
+		if first == "" {
+			// The suffix of the chunk
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n <= 0 {
+				return nil, nil
+			}
+			if n > chunkSize {
+				n = chunkSize
+			}
+			ri.offset, ri.last = chunkSize-n, chunkSize-1
+		} else {
+			offset, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || offset < 0 {
+				return nil, nil
+			}
+			ri.offset, ri.last = offset, chunkSize-1
+			if last != "" {
+				if ri.last, err = strconv.ParseInt(last, 10, 64); err != nil || ri.last < offset {
+					return nil, nil
+				}
+			}
+			if offset >= chunkSize {
+				continue
+			}
+			if ri.last >= chunkSize {
+				ri.last = chunkSize - 1
+			}
+		}
+		ri.size = ri.last - ri.offset + 1
+		ranges = append(ranges, ri)
+	}
+	if len(ranges) == 0 || len(ranges) > multiRangeMax {
+		return nil, errInvalidRange
+	}
+	return ranges, nil
+}
+
+// Sends each range in its own part
+func (rr *rawxRequest) downloadRanges(inChunk fileReader, ranges []rangeInfo) {
+	if rr.rawx.verifyGet != verifyGetOff {
+		if tree, _ := loadHashTree(inChunk); tree != nil {
+			for _, ri := range ranges {
+				if err := rr.verifyBlocks(inChunk, tree, ri.offset, ri.last); err != nil {
+					rr.replyError(err)
+					return
+				}
+			}
+		} else if rr.verifiable() && rr.rawx.verifyGet == verifyGetStrict {
+			if err := rr.verifyChunk(inChunk); err != nil {
+				rr.replyError(err)
+				return
+			}
+		}
+	}
+
+	mw := multipart.NewWriter(rr.rep)
+	headers := rr.rep.Header()
+	rr.fillChunkHeaders(headers, inChunk)
+	headers.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	rr.replyCode(http.StatusPartialContent)
+
+	for _, ri := range ranges {
+		// Each range starts from the beginning of the data stored
+		if err := inChunk.seek(0); err != nil {
+			LogError("Seek error: %s", err)
+			return
+		}
+		in, filter, err := rr.getChunkReader(inChunk, rr.chunk.size, ri)
+		if err == nil {
+			var part io.Writer
+			part, err = mw.CreatePart(textproto.MIMEHeader{
+				"Content-Type":  {"application/octet-stream"},
+				"Content-Range": {fmt.Sprintf("bytes %v-%v/%v", ri.offset, ri.last, rr.chunk.size)},
+			})
+			if err == nil {
+				var nb int64
+				nb, err = copyPooled(part, in)
+				rr.bytesOut += uint64(nb)
+			}
+		}
+		if filter != nil {
+			filter.Close()
+		}
+		if err != nil {
+			LogError("Write() error: %s", err)
+			return
+		}
+	}
+	if err := mw.Close(); err != nil {
+		LogError("Write() error: %s", err)
+	}
+}
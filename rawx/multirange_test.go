@@ -0,0 +1,85 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseRanges(t *testing.T) {
+	cases := []struct {
+		name   string
+		header string
+		size   int64
+		ranges []rangeInfo
+		err    error
+	}{
+		{"not bytes", "items=0-1", 100, nil, nil},
+		{"empty chunk", "bytes=0-1", 0, nil, nil},
+		{"no dash", "bytes=12", 100, nil, nil},
+		{"garbage", "bytes=a-b", 100, nil, nil},
+		{"reversed", "bytes=10-5", 100, nil, nil},
+		{"single", "bytes=0-9", 100, []rangeInfo{{0, 9, 10}}, nil},
+		{"open", "bytes=90-", 100, []rangeInfo{{90, 99, 10}}, nil},
+		{"suffix", "bytes=-10", 100, []rangeInfo{{90, 99, 10}}, nil},
+		{"suffix larger than the chunk", "bytes=-500", 100, []rangeInfo{{0, 99, 100}}, nil},
+		{"empty suffix", "bytes=-0", 100, nil, nil},
+		{"several", "bytes=0-9, 20-29,-5", 100,
+			[]rangeInfo{{0, 9, 10}, {20, 29, 10}, {95, 99, 5}}, nil},
+		{"overlapping, kept as asked", "bytes=0-49,25-74", 100,
+			[]rangeInfo{{0, 49, 50}, {25, 74, 50}}, nil},
+		{"last beyond the end", "bytes=50-1000", 100, []rangeInfo{{50, 99, 50}}, nil},
+		{"beyond the end, ignored", "bytes=0-9,100-199", 100, []rangeInfo{{0, 9, 10}}, nil},
+		{"all beyond the end", "bytes=100-199,200-", 100, nil, errInvalidRange},
+	}
+	for _, tc := range cases {
+		ranges, err := parseRanges(tc.header, tc.size)
+		if err != tc.err {
+			t.Errorf("%s: error %v, expected %v", tc.name, err, tc.err)
+			continue
+		}
+		if !reflect.DeepEqual(ranges, tc.ranges) {
+			t.Errorf("%s: %v, expected %v", tc.name, ranges, tc.ranges)
+		}
+	}
+}
+
+func TestParseRangesMax(t *testing.T) {
+	specs := make([]string, multiRangeMax+1)
+	for i := range specs {
+		specs[i] = strconv.Itoa(2*i) + "-" + strconv.Itoa(2*i)
+	}
+	cases := []struct {
+		count int
+		err   error
+	}{
+		{1, nil},
+		{multiRangeMax, nil},
+		{multiRangeMax + 1, errInvalidRange},
+	}
+	for _, tc := range cases {
+		ranges, err := parseRanges("bytes="+strings.Join(specs[:tc.count], ","), 1000)
+		if err != tc.err {
+			t.Errorf("%d ranges: error %v, expected %v", tc.count, err, tc.err)
+		} else if err == nil && len(ranges) != tc.count {
+			t.Errorf("%d ranges: %d parsed", tc.count, len(ranges))
+		}
+	}
+}
@@ -16,189 +16,266 @@
 
 package main
 
+/*
+The notifiers deliver the events to their endpoints. Each kind of endpoint
+is implemented by a backend registered for a URL scheme, from the init()
+function of its own file, so that a new backend doesn't require any change
+in the dispatching code:
+
+	func init() {
+		registerNotifier("zmq", makeZmqNotifier)
+	}
+
+Most of the backends only have to implement an eventSink, then let a
+queuedNotifier deliver the events in order, from a dedicated worker.
+*/
+
 import (
-	"bytes"
-	"encoding/json"
 	"errors"
-	"strconv"
+	"log/syslog"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/klauspost/compress/zstd"
 )
 
+// An event, already formatted
+type Event struct {
+	Type string
+	Data []byte
+	// Push() only returns once the event has been delivered
+	Sync bool
+}
+
 type Notifier interface {
 	Start()
-	Stop()
-	asyncNotify(eventType, requestID string, chunk *chunkInfo)
+	// Queues the event, or delivers it when the event is synchronous
+	Push(evt Event) error
+	// Stops the notifier, once the events already queued are delivered
+	Close()
+}
+
+// Builds a notifier from its configuration, e.g. "beanstalk://IP:PORT/TUBE"
+type notifierFactory func(config string, rawx *rawxService) (Notifier, error)
+
+var notifierFactories = make(map[string]notifierFactory)
+
+// Registers the backend in charge of the endpoints with the given scheme
+func registerNotifier(scheme string, factory notifierFactory) {
+	if _, ok := notifierFactories[scheme]; ok {
+		panic("Notifier already registered: " + scheme)
+	}
+	notifierFactories[scheme] = factory
+}
+
+// An event waiting in a queue, with an optional channel where the outcome
+// of its delivery is reported.
+type queuedEvent struct {
+	data []byte
+	done chan error
 }
 
+var errNotifierClosed = errors.New("Notifier closed")
+
 const (
 	eventTypeNewChunk = "storage.chunk.new"
 	eventTypeDelChunk = "storage.chunk.deleted"
+	// A chunk vanished without the RAWX to be involved, only its ID is known
+	eventTypeLostChunk = "storage.chunk.lost"
+	// The data of the chunk doesn't match its hash anymore
+	eventTypeCorruptChunk = "storage.chunk.corrupted"
+	// The chunk moved to another volume of the service
+	eventTypeRelocatedChunk = "storage.chunk.relocated"
 )
 
-const (
-	beanstalkNotifierDefaultTube = "oio"
-	beanstalkNotifierPipeSize    = 4096
-)
+const notifierPipeSize = 4096
 
 // Tells if the current RAWX service may emit notifications
 var notifAllowed = true
 
-type beanstalkNotifier struct {
-	rawx       *rawxService
-	run        bool
-	wg         sync.WaitGroup
-	queue      chan []byte
-	endpoint   string
-	tube       string
-	beanstalkd *Beanstalkd
+// The parameters of the emission of the events. A reload builds a complete
+// new set, validated before it is published along with the new notifier:
+// the readers never see a mix of the previous and the new values.
+type notifConfig struct {
+	// Tells if each event is sent to all the configured endpoints, instead
+	// of being dispatched to one of them in a round-robin fashion.
+	fanout bool
+
+	// How many times the delivery of an event is attempted, and how long
+	// to wait between two attempts.
+	maxAttempts int
+	retryDelay  time.Duration
+
+	// Tells if the DELETE and the PUT wait for the delivery of their event
+	// before replying to the client.
+	syncDelete bool
+	syncPut    bool
+
+	// How many events per second of each type may be emitted (0 for no
+	// limit), how many in a burst, and the percentage actually emitted.
+	rateLimit int
+	rateBurst int
+	sampling  int
+	buckets   *eventBuckets
+
+	// The recently emitted events, nil when the deduplication is disabled
+	dedup *eventDedup
+
+	// The algorithm used to compress the events, and the size (in bytes)
+	// below which an event is not compressed.
+	compression          string
+	compressionThreshold int
+	zstdEncoder          *zstd.Encoder
+
+	// The secret shared with the consumers of the events, no signature if
+	// empty.
+	hmacSecret []byte
+
+	// The facility of the events, kept apart from the facilities of the logs,
+	// and the ID of their structured data.
+	syslogFacility syslog.Priority
+	syslogSDID     string
+
+	// How many tubes the events are spread on, keyed by container
+	tubeShards int
+
+	// The rotation of the files of events
+	fileMaxSize  int
+	fileKeep     int
+	fileCompress bool
 }
 
-func makeBeanstalkNotifier(endpoint string,
-	rawx *rawxService) (*beanstalkNotifier, error) {
-	// TODO(adu) Use connection pool
-	notifier := new(beanstalkNotifier)
-	notifier.rawx = rawx
+func makeNotifConfig() *notifConfig {
+	return &notifConfig{
+		maxAttempts:          3,
+		retryDelay:           500 * time.Millisecond,
+		sampling:             100,
+		buckets:              makeEventBuckets(),
+		compression:          eventCompressionOff,
+		compressionThreshold: 4096,
+		syslogFacility:       syslog.LOG_LOCAL2,
+		syslogSDID:           syslogDefaultSDID,
+		fileMaxSize:          64 * 1024 * 1024,
+		fileKeep:             10,
+	}
+}
+
+var notifConfigs atomic.Value
+
+func init() {
+	setNotifConf(makeNotifConfig())
+}
+
+// Returns the parameters of the emission currently in use
+func notifConf() *notifConfig {
+	return notifConfigs.Load().(*notifConfig)
+}
+
+func setNotifConf(conf *notifConfig) {
+	notifConfigs.Store(conf)
+}
+
+// Where the events go when their delivery failed too many times.
+// Events are dropped when not set.
+var notifDeadLetter eventSink
+
+// Something able to deliver an event already formatted. A sink that holds
+// resources might also implement `close()`.
+type eventSink interface {
+	send(eventJSON []byte) error
+}
+
+// Delivers the events to a sink, in order, from a dedicated worker
+type queuedNotifier struct {
+	run      bool
+	wg       sync.WaitGroup
+	queue    chan *queuedEvent
+	endpoint string
+	sink     eventSink
+}
+
+func makeQueuedNotifier(endpoint string, sink eventSink) *queuedNotifier {
+	notifier := new(queuedNotifier)
 	notifier.run = false
-	notifier.queue = make(chan []byte, beanstalkNotifierPipeSize)
+	notifier.queue = make(chan *queuedEvent, notifierPipeSize)
 	notifier.endpoint = endpoint
-	notifier.tube = beanstalkNotifierDefaultTube
-	// TODO(adu) Check endpoint
-	notifier.beanstalkd = nil
-	return notifier, nil
+	notifier.sink = sink
+	return notifier
 }
 
-func (notifier *beanstalkNotifier) Start() {
+func (notifier *queuedNotifier) Start() {
 	notifier.wg.Add(1)
 	go func() {
 		defer notifier.wg.Done()
-		for eventJSON := range notifier.queue {
-			notifier.syncNotify(eventJSON)
+		for evt := range notifier.queue {
+			err := deliverEvent(notifier.sink, notifier.endpoint, evt.data)
+			if evt.done != nil {
+				evt.done <- err
+			}
 		}
 	}()
 	notifier.run = true
 }
 
-func (notifier *beanstalkNotifier) Stop() {
+func (notifier *queuedNotifier) Close() {
 	notifier.run = false
 	close(notifier.queue)
 	notifier.wg.Wait()
-	notifier.closeBeanstalkd()
-}
-
-func (notifier *beanstalkNotifier) connectBeanstalkd() error {
-	if notifier.beanstalkd != nil {
-		return nil
+	if sink, ok := notifier.sink.(interface{ close() }); ok {
+		sink.close()
 	}
-	LogDebug("Connecting to %s using tube %s", notifier.endpoint, notifier.tube)
-	beanstalkd, err := DialBeanstalkd(notifier.endpoint)
-	if err != nil {
-		return err
-	}
-	err = beanstalkd.Use(notifier.tube)
-	if err != nil {
-		return err
-	}
-	notifier.beanstalkd = beanstalkd
-	return nil
 }
 
-func (notifier *beanstalkNotifier) closeBeanstalkd() {
-	if notifier.beanstalkd != nil {
-		notifier.beanstalkd.Close()
-		notifier.beanstalkd = nil
-	}
-}
-
-func (notifier *beanstalkNotifier) syncNotify(eventJSON []byte) {
-	err := notifier.connectBeanstalkd()
-	if err != nil {
-		LogWarning("ERROR to connect to %s using tube %s: %s",
-			notifier.endpoint, notifier.tube, err)
-		return
+func (notifier *queuedNotifier) Push(evt Event) error {
+	if !notifier.run {
+		return errNotifierClosed
 	}
-	_, err = notifier.beanstalkd.Put(eventJSON)
-	if err != nil {
-		LogWarning("ERROR to notify to %s using tube %s: %s",
-			notifier.endpoint, notifier.tube, err)
-		notifier.closeBeanstalkd()
-		return
+	if !evt.Sync {
+		notifier.queue <- &queuedEvent{data: evt.Data}
+		return nil
 	}
+	done := make(chan error, 1)
+	notifier.queue <- &queuedEvent{data: evt.Data, done: done}
+	return <-done
 }
 
-func (notifier *beanstalkNotifier) asyncNotify(eventType, requestID string,
-	chunk *chunkInfo) {
-	if !notifier.run {
-		LogWarning("Can't send a event to %s using tube %s: closed",
-			notifier.endpoint, notifier.tube)
-		return
-	}
-
-	sb := bytes.Buffer{}
-	sb.Grow(4096)
-	addQuoted := func(n string) {
-		sb.WriteRune('"')
-		sb.WriteString(n)
-		sb.WriteRune('"')
-	}
-	addFieldRaw := func(k, v string) {
-		sb.WriteRune(',')
-		addQuoted(k)
-		sb.WriteRune(':')
-		sb.WriteString(v)
-	}
-	addFieldStr := func(k, v string) {
-		addQuoted(k)
-		sb.WriteRune(':')
-		addQuoted(v)
-	}
-	add := func(k, v string) {
-		if len(v) > 0 {
-			sb.WriteRune(',')
-			addFieldStr(k, v)
+// Delivers the event with a bounded number of attempts. Once the budget is
+// exhausted, the event is forwarded to the dead letter destination, along
+// with the reason of the failure. An error is returned when the event
+// couldn't be delivered to its endpoint.
+func deliverEvent(sink eventSink, endpoint string, eventJSON []byte) error {
+	conf := notifConf()
+	var err error
+	attempt := 0
+	for attempt < conf.maxAttempts {
+		if attempt > 0 {
+			time.Sleep(conf.retryDelay)
 		}
-	}
-	addEscaped := func(k, v string) {
-		if len(v) > 0 {
-			sb.WriteRune(',')
-			addQuoted(k)
-			sb.WriteRune(':')
-			sb.WriteRune('"')
-			json.HTMLEscape(&sb, []byte(v))
-			sb.WriteRune('"')
+		attempt++
+		if err = sink.send(eventJSON); err == nil {
+			return nil
 		}
+		LogWarning("ERROR to notify to %s (attempt %d/%d): %s",
+			endpoint, attempt, conf.maxAttempts, err)
 	}
 
-	sb.WriteRune('{')
-	addFieldStr("event", eventType)
-	addFieldRaw("when", strconv.FormatInt(time.Now().UnixNano()/1000, 10))
-	add("request_id", requestID)
-	addFieldRaw("data", "{")
-	addFieldStr("volume_id", notifier.rawx.url)
-	add("volume_service_id", notifier.rawx.id)
-	addEscaped("full_path", chunk.ContentFullpath)
-	addEscaped("content_path", chunk.ContentPath)
-	add("container_id", chunk.ContainerID)
-	add("content_version", chunk.ContentVersion)
-	add("content_id", chunk.ContentID)
-	add("content_chunk_method", chunk.ContentChunkMethod)
-	add("content_storage_policy", chunk.ContentStgPol)
-	add("metachunk_hash", chunk.MetachunkHash)
-	add("metachunk_size", chunk.MetachunkSize)
-	add("chunk_id", chunk.ChunkID)
-	add("chunk_position", chunk.ChunkPosition)
-	add("chunk_hash", chunk.ChunkHash)
-	add("chunk_size", chunk.ChunkSize)
-	add("oio_version", chunk.OioVersion)
-	sb.WriteString("}}")
-
-	notifier.queue <- sb.Bytes()
+	if notifDeadLetter == nil {
+		LogError("Event dropped after %d attempts to %s", attempt, endpoint)
+		return err
+	}
+	letter := formatDeadLetter(eventJSON, endpoint, err, attempt)
+	if errDL := notifDeadLetter.send(letter); errDL != nil {
+		LogError("Event lost, dead letter failed: %s", errDL)
+	}
+	return err
 }
 
 type multiNotifier struct {
 	notifiers []Notifier
-	index     int
+	index     uint32
 }
 
 func makeMultiNotifier(config string, rawx *rawxService) (*multiNotifier, error) {
@@ -220,18 +297,36 @@ func (notifier *multiNotifier) Start() {
 	}
 }
 
-func (notifier *multiNotifier) Stop() {
+func (notifier *multiNotifier) Close() {
 	for _, notif := range notifier.notifiers {
-		notif.Stop()
+		notif.Close()
 	}
 }
 
-func (notifier *multiNotifier) asyncNotify(eventType, requestID string,
-	chunk *chunkInfo) {
-	notif := notifier.notifiers[notifier.index]
-	// Round-robin
-	notifier.index = (notifier.index + 1) % len(notifier.notifiers)
-	notif.asyncNotify(eventType, requestID, chunk)
+func (notifier *multiNotifier) Push(evt Event) error {
+	if notifConf().fanout {
+		// Each endpoint has its own queue and its own worker, so that
+		// a failing endpoint doesn't prevent the others from working.
+		// When the event is synchronous, each endpoint must acknowledge it.
+		var err error
+		for _, notif := range notifier.notifiers {
+			if errNotif := notif.Push(evt); errNotif != nil {
+				err = errNotif
+			}
+		}
+		return err
+	}
+	count := len(notifier.notifiers)
+	var index uint32
+	if notifConf().tubeShards > 1 {
+		// All the events of a container go to the same endpoint, so that
+		// they remain ordered, as in the tubes they are sharded on.
+		index = containerShard(evt.Data, count)
+	} else {
+		// Round-robin
+		index = (atomic.AddUint32(&notifier.index, 1) - 1) % uint32(count)
+	}
+	return notifier.notifiers[index].Push(evt)
 }
 
 func hasPrefix(s, prefix string) (string, bool) {
@@ -245,21 +340,100 @@ func MakeNotifier(config string, rawx *rawxService) (Notifier, error) {
 	if strings.Contains(config, ";") {
 		return makeMultiNotifier(config, rawx)
 	}
-	if endpoint, ok := hasPrefix(config, "beanstalk://"); ok {
-		return makeBeanstalkNotifier(endpoint, rawx)
+	scheme := config
+	if idx := strings.Index(config, "://"); idx >= 0 {
+		scheme = config[:idx]
+	}
+	if factory, ok := notifierFactories[scheme]; ok {
+		return factory(config, rawx)
+	}
+	schemes := make([]string, 0, len(notifierFactories))
+	for s := range notifierFactories {
+		schemes = append(schemes, s+"://")
+	}
+	sort.Strings(schemes)
+	return nil, errors.New("Unexpected notification endpoint, only " +
+		strings.Join(schemes, ", ") + " are accepted")
+}
+
+// Queues the event. An error tells the event couldn't be queued, e.g. not
+// persisted in the events log.
+func notify(rawx *rawxService, eventType, requestID string, chunk *chunkInfo) error {
+	if notifAllowed && !duplicateEvent(eventType, chunk, false) && admitEvent(eventType) {
+		eventJSON, err := formatEvent(rawx, eventType, requestID, chunk)
+		if err != nil {
+			atomic.AddUint64(&counters.EventsInvalid, 1)
+			LogError("Event %s not emitted: %v", eventType, err)
+			return nil
+		}
+		if err := rawx.notifier.Push(Event{Type: eventType, Data: eventJSON}); err != nil {
+			LogWarning("Can't emit a %s event: %v", eventType, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Emits the event and waits for its delivery. Such critical events bypass
+// the sampling, the rate limiting and the deduplication.
+func notifySync(rawx *rawxService, eventType, requestID string, chunk *chunkInfo) error {
+	if !notifAllowed {
+		return nil
 	}
-	// TODO(adu) makeZMQNotifier
-	return nil, errors.New("Unexpected notification endpoint, only `beanstalk://...` is accepted")
+	duplicateEvent(eventType, chunk, true)
+	eventJSON, err := formatEvent(rawx, eventType, requestID, chunk)
+	if err != nil {
+		atomic.AddUint64(&counters.EventsInvalid, 1)
+		LogError("Event %s not emitted: %v", eventType, err)
+		return err
+	}
+	return rawx.notifier.Push(Event{Type: eventType, Data: eventJSON, Sync: true})
 }
 
-func NotifyNew(notifier Notifier, requestID string, chunk *chunkInfo) {
-	if notifAllowed {
-		notifier.asyncNotify(eventTypeNewChunk, requestID, chunk)
+// Tells the chunk moved from a volume to another one, and waits for the
+// delivery: the chunk would be lost for meta2 without it.
+func NotifyRelocated(from, rawx *rawxService, requestID string, chunk *chunkInfo) error {
+	if !notifAllowed {
+		return nil
+	}
+	eventJSON, err := formatEventFrom(from, rawx, eventTypeRelocatedChunk, requestID, chunk)
+	if err != nil {
+		atomic.AddUint64(&counters.EventsInvalid, 1)
+		LogError("Event %s not emitted: %v", eventTypeRelocatedChunk, err)
+		return err
 	}
+	return rawx.notifier.Push(Event{Type: eventTypeRelocatedChunk, Data: eventJSON, Sync: true})
 }
 
-func NotifyDel(notifier Notifier, requestID string, chunk *chunkInfo) {
-	if notifAllowed {
-		notifier.asyncNotify(eventTypeDelChunk, requestID, chunk)
+// Tells the chunk moved to another tier of the volume, and waits for the
+// delivery: the consumers tracking the location of the chunks rely on it.
+func NotifyTiered(rawx *rawxService, fromTier, tier string, chunk *chunkInfo) error {
+	if !notifAllowed {
+		return nil
 	}
+	eventJSON, err := formatTierEvent(rawx, fromTier, tier, chunk)
+	if err != nil {
+		atomic.AddUint64(&counters.EventsInvalid, 1)
+		LogError("Event %s not emitted: %v", eventTypeRelocatedChunk, err)
+		return err
+	}
+	return rawx.notifier.Push(Event{Type: eventTypeRelocatedChunk, Data: eventJSON, Sync: true})
+}
+
+// The error tells the chunk is unknown to the consumers of the events, its
+// upload must not succeed.
+func NotifyNew(rawx *rawxService, requestID string, chunk *chunkInfo) error {
+	return notify(rawx, eventTypeNewChunk, requestID, chunk)
+}
+
+func NotifyDel(rawx *rawxService, requestID string, chunk *chunkInfo) {
+	notify(rawx, eventTypeDelChunk, requestID, chunk)
+}
+
+func NotifyLost(rawx *rawxService, requestID string, chunk *chunkInfo) {
+	notify(rawx, eventTypeLostChunk, requestID, chunk)
+}
+
+func NotifyCorrupt(rawx *rawxService, requestID string, chunk *chunkInfo) {
+	notify(rawx, eventTypeCorruptChunk, requestID, chunk)
 }
@@ -0,0 +1,135 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+const beanstalkNotifierDefaultTube = "oio"
+
+func init() {
+	registerNotifier("beanstalk", func(config string, rawx *rawxService) (Notifier, error) {
+		sink, err := makeBeanstalkSink(strings.TrimPrefix(config, "beanstalk://"))
+		if err != nil {
+			return nil, err
+		}
+		return makeQueuedNotifier(sink.endpoint+"/"+sink.tube, sink), nil
+	})
+}
+
+type beanstalkSink struct {
+	endpoint   string
+	tube       string
+	beanstalkd *Beanstalkd
+	// The payloads are sent as is, to the tube configured (the dead letters)
+	raw bool
+}
+
+func makeBeanstalkSink(endpoint string) (*beanstalkSink, error) {
+	// TODO(adu) Use connection pool
+	sink := new(beanstalkSink)
+	sink.endpoint = endpoint
+	sink.tube = beanstalkNotifierDefaultTube
+	// An explicit tube might follow the endpoint: "IP:PORT/TUBE"
+	if idx := strings.IndexByte(endpoint, '/'); idx >= 0 {
+		sink.endpoint = endpoint[:idx]
+		sink.tube = endpoint[idx+1:]
+		if sink.tube == "" {
+			return nil, errors.New("Invalid beanstalkd tube")
+		}
+	}
+	// TODO(adu) Check endpoint
+	sink.beanstalkd = nil
+	return sink, nil
+}
+
+func (sink *beanstalkSink) connectBeanstalkd(tube string) error {
+	if sink.beanstalkd == nil {
+		LogDebug("Connecting to %s using tube %s", sink.endpoint, tube)
+		beanstalkd, err := DialBeanstalkd(sink.endpoint)
+		if err != nil {
+			return err
+		}
+		sink.beanstalkd = beanstalkd
+	} else if !sink.beanstalkd.Synced() {
+		LogDebug("Reconnecting to %s using tube %s", sink.endpoint, tube)
+		if err := sink.beanstalkd.Reconnect(); err != nil {
+			return err
+		}
+	}
+	// Cheap when the tube is already in use
+	return sink.beanstalkd.Use(tube)
+}
+
+func (sink *beanstalkSink) close() {
+	if sink.beanstalkd != nil {
+		sink.beanstalkd.Close()
+		sink.beanstalkd = nil
+	}
+}
+
+// Tells which tube the event goes to. All the events of a container go to
+// the same tube and are sent by the same worker, so they remain ordered.
+// With N > 1 shards, the events go to the tubes "<tube>-0" to "<tube>-<N-1>".
+func (sink *beanstalkSink) tubeFor(eventJSON []byte) string {
+	shards := notifConf().tubeShards
+	if shards <= 1 || sink.raw {
+		return sink.tube
+	}
+	shard := containerShard(eventJSON, shards)
+	return sink.tube + "-" + strconv.FormatUint(uint64(shard), 10)
+}
+
+// Tells which of the n shards the events of the container of the event go to
+func containerShard(eventJSON []byte, n int) uint32 {
+	h := fnv.New32a()
+	h.Write(eventContainerID(eventJSON))
+	return h.Sum32() % uint32(n)
+}
+
+// Extracts the container ID from the event, without a complete parsing
+func eventContainerID(eventJSON []byte) []byte {
+	key := []byte(`"container_id":"`)
+	idx := bytes.Index(eventJSON, key)
+	if idx < 0 {
+		return nil
+	}
+	value := eventJSON[idx+len(key):]
+	if end := bytes.IndexByte(value, '"'); end >= 0 {
+		return value[:end]
+	}
+	return nil
+}
+
+func (sink *beanstalkSink) send(eventJSON []byte) error {
+	err := sink.connectBeanstalkd(sink.tubeFor(eventJSON))
+	if err != nil {
+		return err
+	}
+	// An I/O error leaves the connection out of sync, it will be
+	// reestablished upon the next attempt.
+	if !sink.raw {
+		eventJSON = signEvent(compressEvent(eventJSON))
+	}
+	_, err = sink.beanstalkd.Put(eventJSON)
+	return err
+}
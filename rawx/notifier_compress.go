@@ -0,0 +1,93 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Optional compression of the large events. A compressed event starts with a
+header line telling the algorithm used, e.g. "#oio-compressed:gzip\n", then
+the compressed JSON follows. Consumers detect it because a plain event
+always starts with '{'.
+*/
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	eventCompressionOff  = "off"
+	eventCompressionGzip = "gzip"
+	eventCompressionZstd = "zstd"
+
+	eventCompressedMagic = "#oio-compressed:"
+)
+
+// Checks the algorithm and prepares what it requires
+func setEventCompression(conf *notifConfig, algo string) error {
+	switch algo {
+	case "", eventCompressionOff:
+		conf.compression = eventCompressionOff
+	case eventCompressionGzip:
+		conf.compression = algo
+	case eventCompressionZstd:
+		// Stateless, safe for concurrent use through EncodeAll()
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			return err
+		}
+		conf.compression = algo
+		conf.zstdEncoder = enc
+	default:
+		return errors.New("Unexpected events compression: " + algo)
+	}
+	return nil
+}
+
+// Returns the event compressed, or as is when compressing is not worth it
+func compressEvent(eventJSON []byte) []byte {
+	conf := notifConf()
+	if conf.compression == eventCompressionOff || len(eventJSON) < conf.compressionThreshold {
+		return eventJSON
+	}
+
+	bb := bytes.Buffer{}
+	bb.Grow(len(eventJSON) / 2)
+	bb.WriteString(eventCompressedMagic)
+	bb.WriteString(conf.compression)
+	bb.WriteByte('\n')
+
+	switch conf.compression {
+	case eventCompressionGzip:
+		w := gzip.NewWriter(&bb)
+		if _, err := w.Write(eventJSON); err != nil {
+			return eventJSON
+		}
+		if err := w.Close(); err != nil {
+			return eventJSON
+		}
+	case eventCompressionZstd:
+		bb.Write(conf.zstdEncoder.EncodeAll(eventJSON, nil))
+	}
+
+	if bb.Len() >= len(eventJSON) {
+		return eventJSON
+	}
+	return bb.Bytes()
+}
@@ -0,0 +1,135 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Dead letters are the events whose delivery failed too many times. Instead
+of being dropped, they are kept (with the reason of the failure) in a
+destination where they can be inspected then replayed.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type deadLetter struct {
+	Event   json.RawMessage `json:"event"`
+	Failure deadLetterInfo  `json:"failure"`
+}
+
+type deadLetterInfo struct {
+	Endpoint string `json:"endpoint"`
+	Error    string `json:"error"`
+	Attempts int    `json:"attempts"`
+	When     int64  `json:"when"`
+}
+
+func formatDeadLetter(eventJSON []byte, endpoint string, err error, attempts int) []byte {
+	letter := deadLetter{
+		Event: json.RawMessage(eventJSON),
+		Failure: deadLetterInfo{
+			Endpoint: endpoint,
+			Attempts: attempts,
+			When:     time.Now().UnixNano() / 1000,
+		},
+	}
+	if err != nil {
+		letter.Failure.Error = err.Error()
+	}
+	encoded, errJSON := json.Marshal(&letter)
+	if errJSON != nil {
+		// Not a valid JSON event, keep it as a string
+		letter.Event, _ = json.Marshal(string(eventJSON))
+		encoded, _ = json.Marshal(&letter)
+	}
+	return encoded
+}
+
+// Appends each dead letter as a line of a local file
+type fileDeadLetter struct {
+	path string
+	f    *os.File
+}
+
+func (dl *fileDeadLetter) send(eventJSON []byte) error {
+	if dl.f == nil {
+		f, err := os.OpenFile(dl.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, putOpenMode)
+		if err != nil {
+			return err
+		}
+		dl.f = f
+	}
+	line := make([]byte, 0, len(eventJSON)+1)
+	line = append(line, eventJSON...)
+	line = append(line, '\n')
+	if _, err := dl.f.Write(line); err != nil {
+		_ = dl.f.Close()
+		dl.f = nil
+		return err
+	}
+	return nil
+}
+
+// The dead letter destination is shared by all the notifiers
+type lockedEventSink struct {
+	lock sync.Mutex
+	sink eventSink
+}
+
+func (ls *lockedEventSink) send(eventJSON []byte) error {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	return ls.sink.send(eventJSON)
+}
+
+// Builds the dead letter destination from its configuration: a tube of a
+// beanstalkd (`beanstalk://IP:PORT/TUBE`), a HTTP endpoint or a local file
+// (`file:///path` or simply an absolute path). The dead letters are sent as
+// they are formatted, to the tube configured: neither sharded, compressed
+// nor signed like the events.
+func makeDeadLetter(config string) (eventSink, error) {
+	var sink eventSink
+	var err error
+	if endpoint, ok := hasPrefix(config, "beanstalk://"); ok {
+		var bs *beanstalkSink
+		if bs, err = makeBeanstalkSink(endpoint); err == nil {
+			bs.raw = true
+			sink = bs
+		}
+	} else if strings.HasPrefix(config, "http://") || strings.HasPrefix(config, "https://") {
+		var hs *httpSink
+		if hs, err = makeHttpSink(config); err == nil {
+			hs.raw = true
+			sink = hs
+		}
+	} else if path, ok := hasPrefix(config, "file://"); ok {
+		sink = &fileDeadLetter{path: path}
+	} else if strings.HasPrefix(config, "/") {
+		sink = &fileDeadLetter{path: config}
+	} else {
+		err = errors.New("Unexpected dead letter destination")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &lockedEventSink{sink: sink}, nil
+}
@@ -0,0 +1,194 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Appends each event as a line of a local file (`file:///path`), for the sites
+without a broker or for offline reconciliation jobs. The file is rotated once
+it reaches a size, the rotated segments are named after the time of the
+rotation, e.g. "events.jsonl.20191231T235959.123456", and are optionally
+compressed with gzip. Only the most recent segments are kept.
+*/
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerNotifier("file", func(config string, rawx *rawxService) (Notifier, error) {
+		sink, err := makeFileSink(strings.TrimPrefix(config, "file://"))
+		if err != nil {
+			return nil, err
+		}
+		return makeQueuedNotifier(sink.path, sink), nil
+	})
+}
+
+type fileSink struct {
+	path string
+	f    *os.File
+	size int64
+	// Serializes the compression and the cleanup of the rotated segments
+	rotation sync.Mutex
+	wg       sync.WaitGroup
+}
+
+func makeFileSink(path string) (*fileSink, error) {
+	if !filepath.IsAbs(path) {
+		return nil, os.ErrInvalid
+	}
+	return &fileSink{path: path}, nil
+}
+
+// Waits for the rotated segments to be compressed
+func (sink *fileSink) close() {
+	sink.wg.Wait()
+	if sink.f != nil {
+		_ = sink.f.Close()
+		sink.f = nil
+	}
+}
+
+func (sink *fileSink) open() error {
+	f, err := os.OpenFile(sink.path,
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, putOpenMode)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	sink.f = f
+	sink.size = fi.Size()
+	return nil
+}
+
+func (sink *fileSink) send(eventJSON []byte) error {
+	if sink.f == nil {
+		if err := sink.open(); err != nil {
+			return err
+		}
+	}
+	line := make([]byte, 0, len(eventJSON)+1)
+	line = append(line, eventJSON...)
+	line = append(line, '\n')
+	if _, err := sink.f.Write(line); err != nil {
+		// A partial line would corrupt the next event, it is removed so
+		// that the retry appends a whole line. The file is reopened (and
+		// its size read again) upon the next attempt.
+		if errTrunc := sink.f.Truncate(sink.size); errTrunc != nil {
+			LogWarning("Events file truncation error [%s]: %v", sink.path, errTrunc)
+		}
+		_ = sink.f.Close()
+		sink.f = nil
+		return err
+	}
+	sink.size += int64(len(line))
+	if sink.size >= int64(notifConf().fileMaxSize) {
+		sink.rotate()
+	}
+	return nil
+}
+
+// Renames the current file, then compresses and cleans the segments in the
+// background. The next event will open a new file.
+func (sink *fileSink) rotate() {
+	_ = sink.f.Close()
+	sink.f = nil
+	conf := notifConf()
+	segment := sink.path + "." + time.Now().UTC().Format("20060102T150405.000000")
+	if err := os.Rename(sink.path, segment); err != nil {
+		LogWarning("Events file rotation error [%s]: %v", sink.path, err)
+		return
+	}
+
+	sink.wg.Add(1)
+	go func() {
+		defer sink.wg.Done()
+		sink.rotation.Lock()
+		defer sink.rotation.Unlock()
+		if conf.fileCompress {
+			if err := compressSegment(segment); err != nil {
+				LogWarning("Events file compression error [%s]: %v", segment, err)
+			}
+		}
+		sink.prune(conf.fileKeep)
+	}()
+}
+
+func compressSegment(segment string) error {
+	in, err := os.Open(segment)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(segment+".gz.tmp",
+		os.O_CREATE|os.O_TRUNC|os.O_WRONLY, putOpenMode)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if err == nil {
+		err = gz.Close()
+	}
+	if errClose := out.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Rename(segment+".gz.tmp", segment+".gz")
+	}
+	if err != nil {
+		_ = os.Remove(segment + ".gz.tmp")
+		return err
+	}
+	return os.Remove(segment)
+}
+
+// Removes the oldest segments beyond the number to be kept
+func (sink *fileSink) prune(keep int) {
+	if keep <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(sink.path + ".*")
+	if err != nil {
+		return
+	}
+	segments := make([]string, 0, len(matches))
+	for _, m := range matches {
+		if !strings.HasSuffix(m, ".tmp") {
+			segments = append(segments, m)
+		}
+	}
+	// The timestamps sort lexicographically
+	sort.Strings(segments)
+	for len(segments) > keep {
+		if err := os.Remove(segments[0]); err != nil {
+			LogWarning("Events file cleanup error [%s]: %v", segments[0], err)
+		}
+		segments = segments[1:]
+	}
+}
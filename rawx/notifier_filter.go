@@ -0,0 +1,167 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Admission of the events: a runaway client must not be able to flood the
+event queues. Each type of event has its own token bucket, and the events
+might also be sampled. The events recently emitted for the same chunk are
+also suppressed, to prevent retry storms from generating duplicate work.
+*/
+
+import (
+	"container/list"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The token buckets of the types of events, dropped along with the
+// configuration they were built from.
+type eventBuckets struct {
+	sync.Mutex
+	byType map[string]*tokenBucket
+}
+
+func makeEventBuckets() *eventBuckets {
+	return &eventBuckets{byType: make(map[string]*tokenBucket)}
+}
+
+func eventBucket(conf *notifConfig, eventType string) *tokenBucket {
+	conf.buckets.Lock()
+	defer conf.buckets.Unlock()
+	tb, ok := conf.buckets.byType[eventType]
+	if !ok {
+		tb = makeTokenBucket(float64(conf.rateLimit), float64(conf.rateBurst))
+		conf.buckets.byType[eventType] = tb
+	}
+	return tb
+}
+
+// How many recent events are remembered, by default
+const eventDedupDefaultSize = 4096
+
+// A LRU of the (chunk ID, event type) recently emitted, with the content
+// they were emitted for
+type eventDedup struct {
+	lock    sync.Mutex
+	size    int
+	window  time.Duration
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type dedupEntry struct {
+	key         string
+	fingerprint string
+	when        time.Time
+}
+
+func makeEventDedup(size int, window time.Duration) *eventDedup {
+	return &eventDedup{
+		size:    size,
+		window:  window,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Tells apart two events of the same type for the same chunk: a chunk
+// written again with another content is not a duplicate.
+func eventFingerprint(chunk *chunkInfo) string {
+	return chunk.ContentID + "|" + chunk.ContentVersion + "|" +
+		chunk.ChunkHash + "|" + chunk.ChunkSize
+}
+
+// Tells if the event has already been emitted within the window, and
+// remembers it otherwise.
+func (d *eventDedup) seen(eventType string, chunk *chunkInfo) bool {
+	key := eventType + "|" + chunk.ChunkID
+	fingerprint := eventFingerprint(chunk)
+	now := time.Now()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if elt, ok := d.entries[key]; ok {
+		entry := elt.Value.(*dedupEntry)
+		if entry.fingerprint == fingerprint && now.Sub(entry.when) < d.window {
+			return true
+		}
+		entry.fingerprint = fingerprint
+		entry.when = now
+		d.order.MoveToFront(elt)
+		return false
+	}
+
+	d.entries[key] = d.order.PushFront(&dedupEntry{
+		key: key, fingerprint: fingerprint, when: now})
+	for d.order.Len() > d.size {
+		oldest := d.order.Back()
+		d.order.Remove(oldest)
+		delete(d.entries, oldest.Value.(*dedupEntry).key)
+	}
+	return false
+}
+
+// Forgets the event emitted for the chunk, the next one won't be suppressed
+func (d *eventDedup) forget(eventType, chunkID string) {
+	key := eventType + "|" + chunkID
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if elt, ok := d.entries[key]; ok {
+		d.order.Remove(elt)
+		delete(d.entries, key)
+	}
+}
+
+// Tells if the event is a duplicate of an event recently emitted. A
+// synchronous event is remembered but never suppressed: its caller waits
+// for an acknowledgement the previous event might never have got.
+// A chunk deleted then written again (or the opposite) emits its event again.
+func duplicateEvent(eventType string, chunk *chunkInfo, sync bool) bool {
+	dedup := notifConf().dedup
+	if dedup == nil {
+		return false
+	}
+	if dedup.seen(eventType, chunk) && !sync {
+		atomic.AddUint64(&counters.EventsDroppedDuplicate, 1)
+		return true
+	}
+	switch eventType {
+	case eventTypeNewChunk:
+		dedup.forget(eventTypeDelChunk, chunk.ChunkID)
+	case eventTypeDelChunk:
+		dedup.forget(eventTypeNewChunk, chunk.ChunkID)
+	}
+	return false
+}
+
+// Tells if the event may be emitted, and accounts the events dropped
+func admitEvent(eventType string) bool {
+	conf := notifConf()
+	if conf.sampling < 100 && rand.Intn(100) >= conf.sampling {
+		atomic.AddUint64(&counters.EventsDroppedSampling, 1)
+		return false
+	}
+	if conf.rateLimit > 0 && !eventBucket(conf, eventType).allow(1) {
+		atomic.AddUint64(&counters.EventsDroppedRate, 1)
+		return false
+	}
+	return true
+}
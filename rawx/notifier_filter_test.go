@@ -0,0 +1,151 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDuplicateEvent(t *testing.T) {
+	defer setNotifConf(notifConf())
+
+	chunk := func(id, hash string) *chunkInfo {
+		return &chunkInfo{ChunkID: id, ChunkHash: hash, ChunkSize: "1024",
+			ContentID: "C0FFEE", ContentVersion: "1"}
+	}
+	type step struct {
+		eventType string
+		chunk     *chunkInfo
+		sync      bool
+		duplicate bool
+	}
+	cases := []struct {
+		name  string
+		steps []step
+	}{
+		{"same event", []step{
+			{eventTypeNewChunk, chunk("A", "H1"), false, false},
+			{eventTypeNewChunk, chunk("A", "H1"), false, true},
+		}},
+		{"other chunk", []step{
+			{eventTypeNewChunk, chunk("A", "H1"), false, false},
+			{eventTypeNewChunk, chunk("B", "H1"), false, false},
+		}},
+		{"other type", []step{
+			{eventTypeNewChunk, chunk("A", "H1"), false, false},
+			{eventTypeCorruptChunk, chunk("A", "H1"), false, false},
+		}},
+		{"other content", []step{
+			{eventTypeNewChunk, chunk("A", "H1"), false, false},
+			{eventTypeNewChunk, chunk("A", "H2"), false, false},
+			{eventTypeNewChunk, chunk("A", "H2"), false, true},
+		}},
+		{"deleted then written again", []step{
+			{eventTypeNewChunk, chunk("A", "H1"), false, false},
+			{eventTypeDelChunk, chunk("A", "H1"), false, false},
+			{eventTypeNewChunk, chunk("A", "H1"), false, false},
+			{eventTypeDelChunk, chunk("A", "H1"), false, false},
+		}},
+		{"sync never suppressed", []step{
+			{eventTypeNewChunk, chunk("A", "H1"), false, false},
+			{eventTypeNewChunk, chunk("A", "H1"), true, false},
+			{eventTypeNewChunk, chunk("A", "H1"), false, true},
+		}},
+	}
+	for _, tc := range cases {
+		conf := makeNotifConfig()
+		conf.dedup = makeEventDedup(16, time.Minute)
+		setNotifConf(conf)
+		for i, s := range tc.steps {
+			if duplicate := duplicateEvent(s.eventType, s.chunk, s.sync); duplicate != s.duplicate {
+				t.Errorf("%s: step %d: duplicate %v, expected %v", tc.name, i, duplicate, s.duplicate)
+			}
+		}
+	}
+
+	// Without deduplication, nothing is a duplicate
+	setNotifConf(makeNotifConfig())
+	for i := 0; i < 2; i++ {
+		if duplicateEvent(eventTypeNewChunk, chunk("A", "H1"), false) {
+			t.Errorf("duplicate without deduplication")
+		}
+	}
+}
+
+func TestEventDedupBounds(t *testing.T) {
+	cases := []struct {
+		name      string
+		size      int
+		window    time.Duration
+		events    int
+		duplicate []bool
+	}{
+		// The events are replayed in the order they were emitted
+		{"within the size", 4, time.Minute, 4, []bool{true, true, true, true}},
+		{"oldest forgotten", 2, time.Minute, 3, []bool{false, false, false}},
+		{"window elapsed", 4, time.Nanosecond, 2, []bool{false, false}},
+	}
+	for _, tc := range cases {
+		dedup := makeEventDedup(tc.size, tc.window)
+		for i := 0; i < tc.events; i++ {
+			dedup.seen(eventTypeNewChunk, &chunkInfo{ChunkID: strconv.Itoa(i)})
+		}
+		time.Sleep(time.Millisecond)
+		for i := 0; i < tc.events; i++ {
+			seen := dedup.seen(eventTypeNewChunk, &chunkInfo{ChunkID: strconv.Itoa(i)})
+			if seen != tc.duplicate[i] {
+				t.Errorf("%s: event %d: duplicate %v, expected %v", tc.name, i, seen, tc.duplicate[i])
+			}
+		}
+	}
+}
+
+func TestAdmitEvent(t *testing.T) {
+	defer setNotifConf(notifConf())
+
+	cases := []struct {
+		name     string
+		rate     int
+		burst    int
+		sampling int
+		admitted int
+	}{
+		{"no limit", 0, 0, 100, 10},
+		{"burst then limited", 1, 3, 100, 3},
+		{"none sampled", 0, 0, 0, 0},
+	}
+	for _, tc := range cases {
+		conf := makeNotifConfig()
+		conf.rateLimit, conf.rateBurst, conf.sampling = tc.rate, tc.burst, tc.sampling
+		setNotifConf(conf)
+		admitted := 0
+		for i := 0; i < 10; i++ {
+			if admitEvent(eventTypeNewChunk) {
+				admitted++
+			}
+		}
+		if admitted != tc.admitted {
+			t.Errorf("%s: %d events admitted, expected %d", tc.name, admitted, tc.admitted)
+		}
+		// Each type of event has its own bucket
+		if tc.sampling == 100 && !admitEvent(eventTypeDelChunk) {
+			t.Errorf("%s: event of another type refused", tc.name)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const httpNotifierTimeout = 5 * time.Second
+
+func init() {
+	factory := func(config string, rawx *rawxService) (Notifier, error) {
+		sink, err := makeHttpSink(config)
+		if err != nil {
+			return nil, err
+		}
+		return makeQueuedNotifier(config, sink), nil
+	}
+	registerNotifier("http", factory)
+	registerNotifier("https", factory)
+}
+
+// Posts each event, as a JSON object, to a HTTP endpoint (e.g. a webhook
+// in charge of auditing the activity of the RAWX).
+type httpSink struct {
+	endpoint string
+	client   *http.Client
+	// The payloads are sent as is, without signature (the dead letters)
+	raw bool
+}
+
+func makeHttpSink(endpoint string) (*httpSink, error) {
+	sink := new(httpSink)
+	sink.endpoint = endpoint
+	sink.client = &http.Client{Timeout: httpNotifierTimeout}
+	return sink, nil
+}
+
+func (sink *httpSink) send(eventJSON []byte) error {
+	req, err := http.NewRequest("POST", sink.endpoint, bytes.NewReader(eventJSON))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret := notifConf().hmacSecret; len(secret) > 0 && !sink.raw {
+		req.Header.Set(eventSignatureHeader, eventSignatureAlgo+eventSignature(secret, eventJSON))
+	}
+	rep, err := sink.client.Do(req)
+	if err != nil {
+		return err
+	}
+	// Drain the body to let the connection be reused
+	_, _ = io.Copy(ioutil.Discard, rep.Body)
+	_ = rep.Body.Close()
+	if rep.StatusCode/100 != 2 {
+		return errors.New(rep.Status)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Allows the notification endpoints (and the parameters of the emission) to
+be changed at runtime, without losing any event: the new notifier starts
+receiving the events, then the previous one is stopped once it has
+delivered all the events it had already queued. The lock only protects the
+swap: a push in progress (e.g. a sync event waiting for its ack) holds no
+lock, the previous notifier waits for it before being stopped.
+*/
+
+import (
+	"sync"
+)
+
+// A notifier whose configuration can be reloaded
+type reloader interface {
+	reload() error
+}
+
+// A notifier along with the pushes it is serving
+type inflightNotifier struct {
+	Notifier
+	pushes sync.WaitGroup
+}
+
+type reloadableNotifier struct {
+	lock    sync.RWMutex
+	current *inflightNotifier
+	factory func() (Notifier, *notifConfig, error)
+}
+
+func makeReloadableNotifier(factory func() (Notifier, *notifConfig, error)) (*reloadableNotifier, error) {
+	notifier, conf, err := factory()
+	if err != nil {
+		return nil, err
+	}
+	setNotifConf(conf)
+	return &reloadableNotifier{
+		current: &inflightNotifier{Notifier: notifier},
+		factory: factory,
+	}, nil
+}
+
+func (notifier *reloadableNotifier) Start() {
+	notifier.lock.RLock()
+	defer notifier.lock.RUnlock()
+	notifier.current.Start()
+}
+
+func (notifier *reloadableNotifier) Close() {
+	notifier.lock.RLock()
+	defer notifier.lock.RUnlock()
+	notifier.current.Close()
+}
+
+func (notifier *reloadableNotifier) Push(evt Event) error {
+	notifier.lock.RLock()
+	current := notifier.current
+	current.pushes.Add(1)
+	notifier.lock.RUnlock()
+	defer current.pushes.Done()
+	return current.Push(evt)
+}
+
+// Replaces the current notifier by a freshly configured one, along with the
+// parameters of the emission. On error, both are kept.
+func (notifier *reloadableNotifier) reload() error {
+	next, conf, err := notifier.factory()
+	if err != nil {
+		return err
+	}
+	next.Start()
+
+	notifier.lock.Lock()
+	previous := notifier.current
+	notifier.current = &inflightNotifier{Notifier: next}
+	setNotifConf(conf)
+	notifier.lock.Unlock()
+
+	// Flushes the events still queued to the previous endpoints
+	previous.pushes.Wait()
+	previous.Close()
+	return nil
+}
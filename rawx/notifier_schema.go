@@ -0,0 +1,253 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The schema of the events. Each event carries the version of its schema, so
+that the consumers can evolve independently of the producers. The events
+are validated before being emitted: a malformed event is caught here rather
+than by the consumers.
+
+Version 1:
+
+	{"version":1, "event":"storage.chunk.new", "when":<microseconds>,
+	 "request_id":"...", "data":{"volume_id":"...", ...}}
+
+The events emitted before the versioning have no "version" field, they are
+considered as version 0 and share the layout of the version 1.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const eventSchemaVersion = 1
+
+var errInvalidEvent = errors.New("Invalid event")
+
+type eventEnvelope struct {
+	Version   int       `json:"version"`
+	Event     string    `json:"event"`
+	When      int64     `json:"when"`
+	RequestID string    `json:"request_id,omitempty"`
+	Data      eventData `json:"data"`
+}
+
+type eventData interface {
+	validate() error
+}
+
+// The payload of the "storage.chunk.new", "storage.chunk.deleted" and
+// "storage.chunk.corrupted" events
+type chunkEventData struct {
+	VolumeID        string `json:"volume_id"`
+	VolumeServiceID string `json:"volume_service_id,omitempty"`
+	chunkInfo
+}
+
+// The payload of the "storage.chunk.lost" events, only the ID of the chunk
+// is known.
+type lostChunkEventData struct {
+	VolumeID        string `json:"volume_id"`
+	VolumeServiceID string `json:"volume_service_id,omitempty"`
+	ChunkID         string `json:"chunk_id"`
+}
+
+// The payload of the "storage.chunk.relocated" events, the chunk moved to
+// another volume of the same service, or to another tier of its volume.
+type relocatedChunkEventData struct {
+	chunkEventData
+	FromVolumeID        string `json:"from_volume_id"`
+	FromVolumeServiceID string `json:"from_volume_service_id,omitempty"`
+	FromTier            string `json:"from_tier,omitempty"`
+	Tier                string `json:"tier,omitempty"`
+}
+
+func invalidField(name, value string) error {
+	return fmt.Errorf("%v: bad %s [%s]", errInvalidEvent, name, value)
+}
+
+func (data *chunkEventData) validate() error {
+	switch {
+	case data.VolumeID == "":
+		return invalidField("volume_id", data.VolumeID)
+	case !isHexaString(data.ChunkID, 64):
+		return invalidField("chunk_id", data.ChunkID)
+	case !isHexaString(data.ContainerID, 64):
+		return invalidField("container_id", data.ContainerID)
+	case data.ContentID == "" || !isHexaString(data.ContentID, 0):
+		return invalidField("content_id", data.ContentID)
+	case data.ContentFullpath == "":
+		return invalidField("full_path", data.ContentFullpath)
+	case data.ChunkPosition == "":
+		return invalidField("chunk_position", data.ChunkPosition)
+	}
+	return nil
+}
+
+func (data *relocatedChunkEventData) validate() error {
+	if data.FromTier != "" || data.Tier != "" {
+		if data.FromTier == data.Tier {
+			return invalidField("tier", data.Tier)
+		}
+	} else if data.FromVolumeID == data.VolumeID {
+		return invalidField("from_volume_id", data.FromVolumeID)
+	}
+	if data.FromVolumeID == "" {
+		return invalidField("from_volume_id", data.FromVolumeID)
+	}
+	return data.chunkEventData.validate()
+}
+
+func (data *lostChunkEventData) validate() error {
+	switch {
+	case data.VolumeID == "":
+		return invalidField("volume_id", data.VolumeID)
+	case !isHexaString(data.ChunkID, 64):
+		return invalidField("chunk_id", data.ChunkID)
+	}
+	return nil
+}
+
+// Allocates the payload expected for the type of event
+func makeEventData(eventType string) (eventData, error) {
+	switch eventType {
+	case eventTypeNewChunk, eventTypeDelChunk, eventTypeCorruptChunk:
+		return new(chunkEventData), nil
+	case eventTypeLostChunk:
+		return new(lostChunkEventData), nil
+	case eventTypeRelocatedChunk:
+		return new(relocatedChunkEventData), nil
+	default:
+		return nil, fmt.Errorf("%v: unexpected type [%s]", errInvalidEvent, eventType)
+	}
+}
+
+func (evt *eventEnvelope) validate(minVersion int) error {
+	if evt.Version < minVersion || evt.Version > eventSchemaVersion {
+		return fmt.Errorf("%v: unexpected version [%d]", errInvalidEvent, evt.Version)
+	}
+	if evt.When <= 0 {
+		return fmt.Errorf("%v: bad when [%d]", errInvalidEvent, evt.When)
+	}
+	if evt.Data == nil {
+		return fmt.Errorf("%v: no data", errInvalidEvent)
+	}
+	return evt.Data.validate()
+}
+
+// Generates the JSON representation of an event related to the chunk
+func formatEvent(rawx *rawxService, eventType, requestID string,
+	chunk *chunkInfo) ([]byte, error) {
+	return formatEventFrom(nil, rawx, eventType, requestID, chunk)
+}
+
+// Same as formatEvent, from telling the volume the chunk comes from
+func formatEventFrom(from, rawx *rawxService, eventType, requestID string,
+	chunk *chunkInfo) ([]byte, error) {
+	evt := eventEnvelope{
+		Version:   eventSchemaVersion,
+		Event:     eventType,
+		When:      time.Now().UnixNano() / 1000,
+		RequestID: requestID,
+	}
+	data, err := makeEventData(eventType)
+	if err != nil {
+		return nil, err
+	}
+	switch d := data.(type) {
+	case *chunkEventData:
+		d.VolumeID, d.VolumeServiceID = rawx.url, rawx.id
+		d.chunkInfo = *chunk
+	case *relocatedChunkEventData:
+		d.VolumeID, d.VolumeServiceID = rawx.url, rawx.id
+		d.chunkInfo = *chunk
+		if from != nil {
+			d.FromVolumeID, d.FromVolumeServiceID = from.url, from.id
+		}
+	case *lostChunkEventData:
+		d.VolumeID, d.VolumeServiceID = rawx.url, rawx.id
+		d.ChunkID = chunk.ChunkID
+	}
+	evt.Data = data
+	if err := evt.validate(eventSchemaVersion); err != nil {
+		return nil, err
+	}
+	return json.Marshal(&evt)
+}
+
+// Generates the JSON representation of the move of the chunk between the
+// tiers of the volume.
+func formatTierEvent(rawx *rawxService, fromTier, tier string, chunk *chunkInfo) ([]byte, error) {
+	data := &relocatedChunkEventData{FromTier: fromTier, Tier: tier}
+	data.VolumeID, data.VolumeServiceID = rawx.url, rawx.id
+	data.FromVolumeID, data.FromVolumeServiceID = rawx.url, rawx.id
+	data.chunkInfo = *chunk
+	evt := eventEnvelope{
+		Version: eventSchemaVersion,
+		Event:   eventTypeRelocatedChunk,
+		When:    time.Now().UnixNano() / 1000,
+		Data:    data,
+	}
+	if err := evt.validate(eventSchemaVersion); err != nil {
+		return nil, err
+	}
+	return json.Marshal(&evt)
+}
+
+// Strictly parses an event, whatever the version of its schema, and
+// validates it: unknown fields are rejected.
+func parseEvent(eventJSON []byte) (*eventEnvelope, error) {
+	var raw struct {
+		Version   int             `json:"version"`
+		Event     string          `json:"event"`
+		When      int64           `json:"when"`
+		RequestID string          `json:"request_id"`
+		Data      json.RawMessage `json:"data"`
+	}
+	if err := decodeStrict(eventJSON, &raw); err != nil {
+		return nil, err
+	}
+	data, err := makeEventData(raw.Event)
+	if err != nil {
+		return nil, err
+	}
+	if err := decodeStrict(raw.Data, data); err != nil {
+		return nil, err
+	}
+	evt := &eventEnvelope{
+		Version:   raw.Version,
+		Event:     raw.Event,
+		When:      raw.When,
+		RequestID: raw.RequestID,
+		Data:      data,
+	}
+	return evt, evt.validate(0)
+}
+
+func decodeStrict(raw []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("%v: %v", errInvalidEvent, err)
+	}
+	return nil
+}
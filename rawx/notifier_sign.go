@@ -0,0 +1,57 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Optional signature of the events, with a HMAC-SHA256 keyed by a secret
+shared with the consumers. On beanstalkd, the signed payload is prefixed
+with a header line "#oio-signature:sha256=<hex>\n", computed on what
+follows (i.e. the event, possibly compressed). The HTTP endpoints get the
+same signature in the X-oio-Signature header.
+*/
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+const (
+	eventSignatureAlgo   = "sha256="
+	eventSignatureMagic  = "#oio-signature:" + eventSignatureAlgo
+	eventSignatureHeader = "X-oio-Signature"
+)
+
+func eventSignature(secret, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns the payload prefixed with its signature, if configured so
+func signEvent(payload []byte) []byte {
+	secret := notifConf().hmacSecret
+	if len(secret) <= 0 {
+		return payload
+	}
+	signature := eventSignature(secret, payload)
+	signed := make([]byte, 0, len(eventSignatureMagic)+len(signature)+1+len(payload))
+	signed = append(signed, eventSignatureMagic...)
+	signed = append(signed, signature...)
+	signed = append(signed, '\n')
+	return append(signed, payload...)
+}
@@ -0,0 +1,226 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Emits each event as a structured syslog message (RFC 5424). The main
+attributes of the chunk are exposed as structured data, the complete event
+is the message itself.
+
+    syslog:///dev/log            local datagram socket
+    syslog://HOST:PORT           UDP
+    syslog+tcp://HOST:PORT       TCP, with octet-counting framing (RFC 6587)
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"log/syslog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	syslogNotifierTimeout = 5 * time.Second
+	syslogAppName         = "oio-rawx"
+	// The private enterprise number reserved for documentation (RFC 5612),
+	// to be replaced by the PEN of the operator with events_syslog_sd_id.
+	syslogDefaultSDID = "oio@32473"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":   syslog.LOG_KERN,
+	"user":   syslog.LOG_USER,
+	"daemon": syslog.LOG_DAEMON,
+	"local0": syslog.LOG_LOCAL0,
+	"local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6,
+	"local7": syslog.LOG_LOCAL7,
+}
+
+// Checks the SD-ID of the structured data is a private one (RFC 5424, 6.3.2),
+// i.e. NAME@PEN where PEN is a private enterprise number.
+func parseSyslogSDID(id, def string) (string, error) {
+	if id == "" {
+		return def, nil
+	}
+	at := strings.IndexByte(id, '@')
+	ok := len(id) <= 32 && at > 0 && at < len(id)-1
+	for i := 0; ok && i < len(id); i++ {
+		c := id[i]
+		switch {
+		case c <= ' ' || c > '~' || c == '=' || c == ']' || c == '"':
+			ok = false
+		case i > at && (c < '0' || c > '9') && c != '.':
+			ok = false
+		}
+	}
+	if !ok {
+		return def, errors.New("Unexpected syslog SD-ID, NAME@PEN expected: " + id)
+	}
+	return id, nil
+}
+
+func parseSyslogFacility(name string, facility syslog.Priority) (syslog.Priority, error) {
+	if name == "" {
+		return facility, nil
+	}
+	facility, ok := syslogFacilities[strings.ToLower(name)]
+	if !ok {
+		return facility, errors.New("Unexpected syslog facility: " + name)
+	}
+	return facility, nil
+}
+
+func init() {
+	factory := func(config string, rawx *rawxService) (Notifier, error) {
+		sink, err := makeSyslogSink(config)
+		if err != nil {
+			return nil, err
+		}
+		return makeQueuedNotifier(sink.address, sink), nil
+	}
+	registerNotifier("syslog", factory)
+	registerNotifier("syslog+tcp", factory)
+}
+
+type syslogSink struct {
+	network  string
+	address  string
+	hostname string
+	conn     net.Conn
+}
+
+func makeSyslogSink(config string) (*syslogSink, error) {
+	sink := new(syslogSink)
+	if address, ok := hasPrefix(config, "syslog+tcp://"); ok {
+		sink.network, sink.address = "tcp", address
+	} else if address, ok := hasPrefix(config, "syslog://"); ok {
+		if strings.HasPrefix(address, "/") {
+			sink.network, sink.address = "unixgram", address
+		} else {
+			sink.network, sink.address = "udp", address
+		}
+	}
+	if sink.address == "" {
+		return nil, errors.New("Invalid syslog endpoint")
+	}
+	sink.hostname, _ = os.Hostname()
+	if sink.hostname == "" {
+		sink.hostname = "-"
+	}
+	return sink, nil
+}
+
+func (sink *syslogSink) close() {
+	if sink.conn != nil {
+		sink.conn.Close()
+		sink.conn = nil
+	}
+}
+
+func (sink *syslogSink) send(eventJSON []byte) error {
+	if sink.conn == nil {
+		conn, err := net.DialTimeout(sink.network, sink.address,
+			syslogNotifierTimeout)
+		if err != nil {
+			return err
+		}
+		sink.conn = conn
+	}
+	msg := formatSyslogEvent(sink.hostname, eventJSON)
+	if sink.network == "tcp" {
+		msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+	sink.conn.SetWriteDeadline(time.Now().Add(syslogNotifierTimeout))
+	if _, err := sink.conn.Write(msg); err != nil {
+		// Reconnect upon the next attempt
+		sink.conn.Close()
+		sink.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Escapes a PARAM-VALUE of the structured data
+var syslogParamEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// Generates the RFC 5424 representation of the event:
+// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD] MSG
+func formatSyslogEvent(hostname string, eventJSON []byte) []byte {
+	var evt struct {
+		Event string `json:"event"`
+		Data  struct {
+			VolumeID    string `json:"volume_id"`
+			ContainerID string `json:"container_id"`
+			ContentID   string `json:"content_id"`
+			ChunkID     string `json:"chunk_id"`
+			ChunkSize   string `json:"chunk_size"`
+		} `json:"data"`
+	}
+	_ = json.Unmarshal(eventJSON, &evt)
+
+	severity := syslog.LOG_NOTICE
+	switch evt.Event {
+	case eventTypeLostChunk:
+		severity = syslog.LOG_WARNING
+	case eventTypeCorruptChunk:
+		severity = syslog.LOG_ERR
+	}
+	msgID := evt.Event
+	if msgID == "" || len(msgID) > 32 {
+		msgID = "-"
+	}
+
+	sb := strings.Builder{}
+	sb.Grow(512 + len(eventJSON))
+	sb.WriteRune('<')
+	sb.WriteString(strconv.Itoa(int(notifConf().syslogFacility | severity)))
+	sb.WriteString(">1 ")
+	sb.WriteString(time.Now().UTC().Format("2006-01-02T15:04:05.000000Z"))
+	sb.WriteRune(' ')
+	sb.WriteString(hostname)
+	sb.WriteRune(' ')
+	sb.WriteString(syslogAppName)
+	sb.WriteRune(' ')
+	sb.WriteString(strconv.Itoa(os.Getpid()))
+	sb.WriteRune(' ')
+	sb.WriteString(msgID)
+	sb.WriteString(" [" + notifConf().syslogSDID)
+	param := func(k, v string) {
+		if len(v) > 0 {
+			sb.WriteString(" " + k + "=\"")
+			sb.WriteString(syslogParamEscaper.Replace(v))
+			sb.WriteRune('"')
+		}
+	}
+	param("volume_id", evt.Data.VolumeID)
+	param("container_id", evt.Data.ContainerID)
+	param("content_id", evt.Data.ContentID)
+	param("chunk_id", evt.Data.ChunkID)
+	param("chunk_size", evt.Data.ChunkSize)
+	sb.WriteString("] ")
+	sb.Write(eventJSON)
+	return []byte(sb.String())
+}
@@ -0,0 +1,428 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+At-least-once delivery of the events. Each event is persisted in a
+write-ahead log before the reply is sent to the client, and it is only
+removed from the log once the endpoint has acknowledged it (or once it has
+been kept in the dead letter destination). Upon a restart, the events still
+present in the log are delivered again, so a crash of the RAWX might cause
+duplicates but never a loss.
+
+The log is a directory of segments, each segment holds one event per line
+and is named after the sequence number of its first event. The events are
+acknowledged in order: a sealed segment is removed as soon as its last
+event is acknowledged, and the active segment is truncated when all its
+events are. A segment name is never reused. A write failing is taken back,
+so that no partial line is left behind, and the lines that still aren't
+valid JSON (e.g. after a crash in the middle of a write) are skipped upon
+the recovery.
+
+The events are handed to the worker delivering them through a bounded
+queue, that never blocks: when it is full, the event is only in the log and
+the worker reads it back from there. So an unreachable endpoint delays the
+events, never the requests.
+*/
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	walPipeSize      = 4096
+	walSegmentPrefix = "events-"
+)
+
+var (
+	notifWalSegmentSize = 16 * 1024 * 1024
+	notifWalFsync       = true
+)
+
+type walSegment struct {
+	path string
+	// The sequence numbers of the first and the last events of the segment
+	first uint64
+	last  uint64
+}
+
+type walEvent struct {
+	seq uint64
+	evt Event
+}
+
+type walNotifier struct {
+	inner Notifier
+	dir   string
+	run   int32
+	wg    sync.WaitGroup
+	queue chan *walEvent
+	// Wakes the worker up, some events didn't fit in the queue
+	overflow chan struct{}
+
+	// Serializes the appends, so that the queue is ordered by sequence
+	// number. Held while the queue is fed.
+	appendLock sync.Mutex
+	// Protects the segments, the active file, the sequence numbers and the
+	// emitters waiting for the delivery of their event.
+	lock     sync.Mutex
+	segments []*walSegment
+	waiters  map[uint64]chan error
+	f        *os.File
+	size     int64
+	seq      uint64
+	// The number in the name of the next segment, at least
+	nextName uint64
+}
+
+func makeWalNotifier(dir string, inner Notifier) (*walNotifier, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	notifier := new(walNotifier)
+	notifier.inner = inner
+	notifier.dir = dir
+	notifier.queue = make(chan *walEvent, walPipeSize)
+	notifier.overflow = make(chan struct{}, 1)
+	notifier.waiters = make(map[uint64]chan error)
+
+	names, err := filepath.Glob(filepath.Join(dir, walSegmentPrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+	// The sequence numbers are zero-padded, the names sort in order
+	sort.Strings(names)
+	for _, name := range names {
+		id := strings.TrimPrefix(filepath.Base(name), walSegmentPrefix)
+		if n, err := strconv.ParseUint(id, 10, 64); err == nil && n >= notifier.nextName {
+			notifier.nextName = n + 1
+		}
+		count, err := countLines(name)
+		if err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			_ = os.Remove(name)
+			continue
+		}
+		first := notifier.seq + 1
+		notifier.seq += count
+		notifier.segments = append(notifier.segments,
+			&walSegment{path: name, first: first, last: notifier.seq})
+	}
+	if notifier.seq > 0 {
+		LogNotice("%d events to be recovered from %s", notifier.seq, dir)
+	}
+	return notifier, nil
+}
+
+func countLines(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var count uint64
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if json.Valid(scanner.Bytes()) {
+			count++
+		}
+	}
+	return count, scanner.Err()
+}
+
+func (notifier *walNotifier) Start() {
+	notifier.inner.Start()
+	atomic.StoreInt32(&notifier.run, 1)
+	notifier.wg.Add(1)
+	go func() {
+		defer notifier.wg.Done()
+		// The events recovered precede the new ones
+		next := uint64(1)
+		notifier.readBack(&next, notifier.lastSeq())
+		for {
+			select {
+			case evt, ok := <-notifier.queue:
+				if !ok {
+					return
+				}
+				// Already read back from the log
+				if evt.seq < next {
+					continue
+				}
+				notifier.readBack(&next, evt.seq-1)
+				notifier.deliver(evt.seq, evt.evt)
+				next = evt.seq + 1
+			case <-notifier.overflow:
+				notifier.readBack(&next, notifier.lastSeq())
+			}
+		}
+	}()
+}
+
+func (notifier *walNotifier) Close() {
+	notifier.appendLock.Lock()
+	atomic.StoreInt32(&notifier.run, 0)
+	close(notifier.queue)
+	notifier.appendLock.Unlock()
+	notifier.wg.Wait()
+	notifier.inner.Close()
+	notifier.lock.Lock()
+	defer notifier.lock.Unlock()
+	// The events left in the log are delivered upon the next startup
+	for seq, done := range notifier.waiters {
+		done <- errNotifierClosed
+		delete(notifier.waiters, seq)
+	}
+	if notifier.f != nil {
+		_ = notifier.f.Close()
+		notifier.f = nil
+	}
+}
+
+func (notifier *walNotifier) running() bool {
+	return atomic.LoadInt32(&notifier.run) != 0
+}
+
+func (notifier *walNotifier) lastSeq() uint64 {
+	notifier.lock.Lock()
+	defer notifier.lock.Unlock()
+	return notifier.seq
+}
+
+// Delivers the events of the log from the next one expected up to the
+// given one: those recovered upon the startup and those that didn't fit in
+// the queue. Only the worker acknowledges the events, so the segments
+// holding them stay in place meanwhile.
+func (notifier *walNotifier) readBack(next *uint64, upTo uint64) {
+	if *next > upTo {
+		return
+	}
+	notifier.lock.Lock()
+	var segments []walSegment
+	for _, seg := range notifier.segments {
+		if seg.last >= *next && seg.first <= upTo {
+			segments = append(segments, *seg)
+		}
+	}
+	notifier.lock.Unlock()
+	for _, seg := range segments {
+		if !notifier.running() {
+			return
+		}
+		notifier.readSegment(seg, next, upTo)
+	}
+}
+
+func (notifier *walNotifier) readSegment(seg walSegment, next *uint64, upTo uint64) {
+	f, err := os.Open(seg.path)
+	if err != nil {
+		LogError("Events log error [%s]: %v", seg.path, err)
+		*next = seg.last + 1
+		return
+	}
+	defer f.Close()
+	seq := seg.first
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for seq <= upTo && seq <= seg.last && notifier.running() && scanner.Scan() {
+		line := scanner.Bytes()
+		if !json.Valid(line) {
+			LogWarning("Events log [%s]: invalid event skipped", seg.path)
+			continue
+		}
+		if seq >= *next {
+			event := make([]byte, len(line))
+			copy(event, line)
+			notifier.deliver(seq, Event{Data: event})
+			*next = seq + 1
+		}
+		seq++
+	}
+}
+
+// Delivers the event then acknowledges it. An event neither delivered nor
+// kept as a dead letter stays in the log: its emitter is told at once, and
+// the delivery is retried until the notifier is stopped, then upon the next
+// startup.
+func (notifier *walNotifier) deliver(seq uint64, evt Event) {
+	evt.Sync = true
+	for {
+		err := notifier.inner.Push(evt)
+		delivered := err == nil || notifDeadLetter != nil
+		if delivered {
+			notifier.ack(seq)
+		}
+		notifier.tell(seq, err)
+		if delivered || !notifier.running() {
+			return
+		}
+		time.Sleep(notifConf().retryDelay)
+	}
+}
+
+// Tells the emitter waiting for the event, if any, how its delivery went
+func (notifier *walNotifier) tell(seq uint64, err error) {
+	notifier.lock.Lock()
+	defer notifier.lock.Unlock()
+	if done, ok := notifier.waiters[seq]; ok {
+		done <- err
+		delete(notifier.waiters, seq)
+	}
+}
+
+// Persists the event in the active segment, the emitter waits for its
+// delivery when done is set.
+func (notifier *walNotifier) append(eventJSON []byte, done chan error) (uint64, error) {
+	notifier.lock.Lock()
+	defer notifier.lock.Unlock()
+	if notifier.f != nil && notifier.size >= int64(notifWalSegmentSize) {
+		notifier.seal()
+	}
+	if notifier.f == nil {
+		id := notifier.seq + 1
+		if id < notifier.nextName {
+			id = notifier.nextName
+		}
+		notifier.nextName = id + 1
+		name := filepath.Join(notifier.dir,
+			fmt.Sprintf("%s%020d", walSegmentPrefix, id))
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, putOpenMode)
+		if err != nil {
+			return 0, err
+		}
+		notifier.f = f
+		notifier.size = 0
+		notifier.segments = append(notifier.segments,
+			&walSegment{path: name, first: notifier.seq + 1})
+	}
+
+	line := make([]byte, 0, len(eventJSON)+1)
+	line = append(line, eventJSON...)
+	line = append(line, '\n')
+	before := notifier.size
+	n, err := notifier.f.Write(line)
+	notifier.size += int64(n)
+	if err == nil && notifWalFsync {
+		err = notifier.f.Sync()
+	}
+	if err != nil {
+		// A partial line would corrupt the segment, it is taken back or
+		// the segment is left as is, for another one.
+		if errTrunc := notifier.f.Truncate(before); errTrunc == nil {
+			notifier.size = before
+		} else {
+			LogWarning("Events log truncation error: %v", errTrunc)
+			notifier.seal()
+		}
+		return 0, err
+	}
+	notifier.seq++
+	notifier.segments[len(notifier.segments)-1].last = notifier.seq
+	if done != nil {
+		notifier.waiters[notifier.seq] = done
+	}
+	return notifier.seq, nil
+}
+
+// Closes the active segment, removed when it holds no event
+func (notifier *walNotifier) seal() {
+	_ = notifier.f.Close()
+	notifier.f = nil
+	last := len(notifier.segments) - 1
+	if seg := notifier.segments[last]; seg.last == 0 {
+		_ = os.Remove(seg.path)
+		notifier.segments = notifier.segments[:last]
+	}
+}
+
+// Releases the segments whose events have all been acknowledged
+func (notifier *walNotifier) ack(seq uint64) {
+	notifier.lock.Lock()
+	defer notifier.lock.Unlock()
+	for len(notifier.segments) > 0 {
+		seg := notifier.segments[0]
+		if seg.last > seq || seg.last == 0 {
+			break
+		}
+		if len(notifier.segments) == 1 && notifier.f != nil {
+			// The active segment is reused
+			if err := notifier.f.Truncate(0); err != nil {
+				LogWarning("Events log truncation error [%s]: %v", seg.path, err)
+			} else {
+				notifier.size = 0
+				seg.first = seg.last + 1
+			}
+			break
+		}
+		if err := os.Remove(seg.path); err != nil {
+			LogWarning("Events log cleanup error [%s]: %v", seg.path, err)
+		}
+		notifier.segments = notifier.segments[1:]
+	}
+}
+
+func (notifier *walNotifier) enqueue(evt Event, done chan error) error {
+	notifier.appendLock.Lock()
+	defer notifier.appendLock.Unlock()
+	if !notifier.running() {
+		return errNotifierClosed
+	}
+	seq, err := notifier.append(evt.Data, done)
+	if err != nil {
+		return err
+	}
+	select {
+	case notifier.queue <- &walEvent{seq: seq, evt: evt}:
+	default:
+		select {
+		case notifier.overflow <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (notifier *walNotifier) Push(evt Event) error {
+	if !evt.Sync {
+		return notifier.enqueue(evt, nil)
+	}
+	done := make(chan error, 1)
+	if err := notifier.enqueue(evt, done); err != nil {
+		return err
+	}
+	return <-done
+}
+
+func (notifier *walNotifier) reload() error {
+	if inner, ok := notifier.inner.(reloader); ok {
+		return inner.reload()
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Keeps the events pushed, in order
+type recordNotifier struct {
+	lock   sync.Mutex
+	events []string
+}
+
+func (n *recordNotifier) Start() {}
+func (n *recordNotifier) Close() {}
+
+func (n *recordNotifier) Push(evt Event) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.events = append(n.events, string(evt.Data))
+	return nil
+}
+
+func (n *recordNotifier) count() int {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return len(n.events)
+}
+
+// Holds the events until released, then records them
+type gatedNotifier struct {
+	recordNotifier
+	gate chan struct{}
+}
+
+func (n *gatedNotifier) Push(evt Event) error {
+	<-n.gate
+	return n.recordNotifier.Push(evt)
+}
+
+// Never reaches its endpoint
+type failingNotifier struct{}
+
+func (n failingNotifier) Start()           {}
+func (n failingNotifier) Close()           {}
+func (n failingNotifier) Push(Event) error { return errors.New("unreachable") }
+
+func walSegmentName(id uint64) string {
+	return fmt.Sprintf("%s%020d", walSegmentPrefix, id)
+}
+
+func TestWalRecovery(t *testing.T) {
+	InitNoopLogger()
+	defer func(fsync bool) { notifWalFsync = fsync }(notifWalFsync)
+	notifWalFsync = false
+
+	cases := []struct {
+		name      string
+		segments  map[string]string
+		delivered []string
+		// The segment holding the event pushed after the recovery
+		active string
+	}{
+		{"empty log", nil, nil, walSegmentName(1)},
+		{"events in order", map[string]string{
+			walSegmentName(1): "{\"e\":1}\n{\"e\":2}\n",
+			walSegmentName(3): "{\"e\":3}\n",
+		}, []string{`{"e":1}`, `{"e":2}`, `{"e":3}`}, walSegmentName(4)},
+		{"partial line skipped", map[string]string{
+			walSegmentName(1): "{\"e\":1}\n{\"e\":\n{\"e\":2}\n{\"e\":3",
+		}, []string{`{"e":1}`, `{"e":2}`}, walSegmentName(3)},
+		{"empty segment removed, its name not reused", map[string]string{
+			walSegmentName(5): "",
+		}, nil, walSegmentName(6)},
+		{"name never reused", map[string]string{
+			walSegmentName(7): "{\"e\":1}\n",
+		}, []string{`{"e":1}`}, walSegmentName(8)},
+	}
+	for _, tc := range cases {
+		dir := t.TempDir()
+		for name, content := range tc.segments {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		inner := &recordNotifier{}
+		wal, err := makeWalNotifier(dir, inner)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		wal.Start()
+		// The recovered events are delivered before the new ones
+		if err = wal.Push(Event{Data: []byte(`{"e":"new"}`), Sync: true}); err != nil {
+			t.Errorf("%s: push error %v", tc.name, err)
+		}
+		wal.Close()
+
+		expected := append(append([]string{}, tc.delivered...), `{"e":"new"}`)
+		if !reflect.DeepEqual(inner.events, expected) {
+			t.Errorf("%s: delivered %v, expected %v", tc.name, inner.events, expected)
+		}
+		// Everything was acknowledged, only the active segment remains
+		files, _ := ioutil.ReadDir(dir)
+		var names []string
+		for _, fi := range files {
+			names = append(names, fi.Name())
+		}
+		if !reflect.DeepEqual(names, []string{tc.active}) {
+			t.Errorf("%s: segments %v, expected %s", tc.name, names, tc.active)
+		}
+		if fi, err := os.Stat(filepath.Join(dir, tc.active)); err == nil && fi.Size() != 0 {
+			t.Errorf("%s: active segment not truncated (%d bytes)", tc.name, fi.Size())
+		}
+	}
+}
+
+func TestWalOverflow(t *testing.T) {
+	InitNoopLogger()
+	defer func(fsync bool) { notifWalFsync = fsync }(notifWalFsync)
+	notifWalFsync = false
+
+	inner := &gatedNotifier{gate: make(chan struct{})}
+	wal, err := makeWalNotifier(t.TempDir(), inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.queue = make(chan *walEvent, 2)
+	wal.Start()
+	defer wal.Close()
+
+	// The pushes never wait for the endpoint, whatever the queue
+	var expected []string
+	for i := 0; i < 20; i++ {
+		event := fmt.Sprintf(`{"e":%d}`, i)
+		expected = append(expected, event)
+		if err = wal.Push(Event{Data: []byte(event)}); err != nil {
+			t.Fatalf("push %d: %v", i, err)
+		}
+	}
+	close(inner.gate)
+
+	// The events that didn't fit in the queue are read back from the log
+	deadline := time.Now().Add(5 * time.Second)
+	for inner.count() < len(expected) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	inner.lock.Lock()
+	defer inner.lock.Unlock()
+	if !reflect.DeepEqual(inner.events, expected) {
+		t.Errorf("delivered %v, expected %v", inner.events, expected)
+	}
+}
+
+func TestWalUnreachable(t *testing.T) {
+	InitNoopLogger()
+	defer func(fsync bool) { notifWalFsync = fsync }(notifWalFsync)
+	notifWalFsync = false
+	defer setNotifConf(notifConf())
+	conf := makeNotifConfig()
+	conf.retryDelay = time.Millisecond
+	setNotifConf(conf)
+
+	dir := t.TempDir()
+	wal, err := makeWalNotifier(dir, failingNotifier{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.Start()
+	// The emitter is told, the event is kept for later
+	if err = wal.Push(Event{Data: []byte(`{"e":1}`), Sync: true}); err == nil {
+		t.Error("undelivered event reported as delivered")
+	}
+	if err = wal.Push(Event{Data: []byte(`{"e":2}`)}); err != nil {
+		t.Errorf("push error %v", err)
+	}
+	wal.Close()
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, walSegmentName(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "{\"e\":1}\n{\"e\":2}\n" {
+		t.Errorf("log %q, the undelivered events expected", content)
+	}
+}
@@ -0,0 +1,326 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Offload of the cold chunks to an S3-compatible object store. The chunks not
+accessed for s3_offload_after days are uploaded as is (compressed or
+encrypted, with the hash of their content), then replaced on the volume by
+an empty stub. The stub keeps all the attributes of the chunk, plus the key
+of the object, so that the HEAD, the listings and the events don't notice
+anything.
+
+A GET of an offloaded chunk transparently fetches it, upon the first read of
+its data. With s3_rehydrate, the fetched chunk replaces its stub and the
+object is removed, otherwise the data only lives in an unlinked file for the
+time of the request. The object is removed along with its stub, once the
+chunk is actually unlinked (i.e. when purged from the trash, if any).
+*/
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+const (
+	offloadDefaultAfter    = 90
+	offloadDefaultInterval = 3600
+)
+
+// Tells the key of the object holding the chunk, empty when not offloaded
+func offloadedKey(r fileReader) string {
+	// Only the stubs are empty, the attribute isn't looked for otherwise
+	if r.size() != 0 {
+		return ""
+	}
+	buf := getBuffer(2048)
+	defer putBuffer(buf)
+	n, err := r.getAttr(AttrNameOffloaded, buf)
+	if err != nil || n <= 0 {
+		return ""
+	}
+	return string(buf[:n])
+}
+
+// Opens a temporary file next to the chunk, to be committed in its place
+func (fr *fileRepository) tempWriter(relPath string) (*realFileWriter, error) {
+	pathTemp := relPath + ".s3." + strconv.FormatInt(time.Now().UnixNano(), 36)
+	fd, err := syscall.Openat(fr.rootFd, pathTemp,
+		syscall.O_CREAT|syscall.O_EXCL|openFlagsWOnly, fr.putOpenMode)
+	if err != nil {
+		return nil, err
+	}
+	fw := &realFileWriter{
+		f:         os.NewFile(uintptr(fd), pathTemp),
+		pathFinal: relPath, pathTemp: pathTemp, repo: fr}
+	if err = fw.reserveHeader(); err != nil {
+		fw.abort()
+		return nil, err
+	}
+	return fw, nil
+}
+
+func (fr *fileRepository) startOffloader(after, interval time.Duration) {
+	go func() {
+		for {
+			fr.scanOffload(after)
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func (fr *fileRepository) scanOffload(after time.Duration) {
+	limit := time.Now().Add(-after).Unix()
+	var count uint64
+	err := fr.walk(func(name, relPath string, fi os.FileInfo) error {
+		// Nothing to gain from the empty chunks, the stubs included
+		if fi.Size() == 0 {
+			return nil
+		}
+		var st syscall.Stat_t
+		if err := syscall.Fstatat(fr.rootFd, relPath, &st, 0); err != nil || st.Atim.Sec > limit {
+			return nil
+		}
+		if err := fr.offloadChunk(name, relPath); err != nil {
+			LogWarning("Chunk %s not offloaded: %v", name, err)
+		} else {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		LogWarning("Offload scan error on %s: %v", fr.root, err)
+	}
+	if count > 0 {
+		LogInfo("%d chunks of %s offloaded", count, fr.root)
+	}
+}
+
+// Uploads the chunk, then replaces it by its stub
+func (fr *fileRepository) offloadChunk(name, relPath string) error {
+	r, err := fr.getRelPath(relPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	attrs, err := r.(*realFileReader).attrs()
+	if err != nil {
+		return err
+	}
+	size := r.size()
+	if err = fr.s3.put(name, r.File(), size); err != nil {
+		return err
+	}
+
+	w, err := fr.tempWriter(relPath)
+	if err != nil {
+		return err
+	}
+	for key, value := range attrs {
+		if err = w.setAttr(key, value); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.setAttr(AttrNameOffloaded, []byte(name))
+	}
+	if err != nil {
+		w.abort()
+		return err
+	}
+	// The chunk has been deleted during the upload, the deletion wins
+	if syscall.Faccessat(fr.rootFd, relPath, syscall.F_OK, 0) != nil {
+		w.abort()
+		return fr.s3.del(name)
+	}
+	if err = w.commit(); err != nil {
+		return err
+	}
+	atomic.AddUint64(&counters.OffloadChunks, 1)
+	atomic.AddUint64(&counters.OffloadBytes, uint64(size))
+	return nil
+}
+
+// Fetches the data of an offloaded chunk, either restored in place of its
+// stub or kept in an unlinked file.
+func (fr *fileRepository) fetchOffloaded(stub *realFileReader, key string) (fileReader, error) {
+	relPath := stub.f.Name()
+	body, err := fr.s3.get(key)
+	if err == errS3NotFound {
+		// Concurrently restored
+		if r, errLocal := fr.getRelPath(relPath); errLocal == nil {
+			if offloadedKey(r) == "" {
+				return r, nil
+			}
+			r.Close()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	w, err := fr.tempWriter(relPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(w, body); err != nil {
+		w.abort()
+		return nil, err
+	}
+	atomic.AddUint64(&counters.OffloadFetched, 1)
+
+	if !fr.rehydrate {
+		// Still readable from the descriptor, once unlinked
+		if err = w.writeHeader(); err != nil {
+			w.abort()
+			return nil, err
+		}
+		r, err := fr.getRelPath(w.pathTemp)
+		w.abort()
+		return r, err
+	}
+
+	attrs, err := stub.attrs()
+	if err != nil {
+		w.abort()
+		return nil, err
+	}
+	for k, value := range attrs {
+		if k == AttrNameOffloaded {
+			continue
+		}
+		if err = w.setAttr(k, value); err != nil {
+			w.abort()
+			return nil, err
+		}
+	}
+	if err = w.commit(); err != nil {
+		return nil, err
+	}
+	atomic.AddUint64(&counters.OffloadRehydrated, 1)
+	if err = fr.s3.del(key); err != nil {
+		LogWarning("Object %s of the rehydrated chunk not removed: %v", key, err)
+	}
+	return fr.getRelPath(relPath)
+}
+
+// Removes the object of the stub about to be unlinked, if it is one
+func (fr *fileRepository) dropOffloaded(relPath string) {
+	buf := getBuffer(2048)
+	defer putBuffer(buf)
+	n, err := fr.getRelAttr(relPath, AttrNameOffloaded, buf)
+	if err != nil || n <= 0 {
+		return
+	}
+	if err = fr.s3.del(string(buf[:n])); err != nil {
+		LogWarning("Object %s of the deleted chunk not removed: %v", string(buf[:n]), err)
+	}
+}
+
+// The stub of an offloaded chunk, whose data is fetched upon its first read
+type offloadedReader struct {
+	stub *realFileReader
+	key  string
+	data fileReader
+	err  error
+}
+
+// Wraps the reader of the chunk, when it is a stub
+func wrapOffloaded(r fileReader) fileReader {
+	stub, ok := r.(*realFileReader)
+	if !ok || stub.repo.s3 == nil {
+		return r
+	}
+	if key := offloadedKey(stub); key != "" {
+		return &offloadedReader{stub: stub, key: key}
+	}
+	return r
+}
+
+func (r *offloadedReader) fetch() fileReader {
+	if r.data == nil && r.err == nil {
+		r.data, r.err = r.stub.repo.fetchOffloaded(r.stub, r.key)
+		if r.err != nil {
+			LogError("Offloaded chunk %s not fetched: %v", r.key, r.err)
+		}
+	}
+	return r.data
+}
+
+func (r *offloadedReader) Read(buffer []byte) (int, error) {
+	if data := r.fetch(); data != nil {
+		return data.Read(buffer)
+	}
+	return 0, r.err
+}
+
+func (r *offloadedReader) Close() error {
+	if r.data != nil {
+		r.data.Close()
+	}
+	return r.stub.Close()
+}
+
+// nil when the data couldn't be fetched, whose methods then fail
+func (r *offloadedReader) File() *os.File {
+	if data := r.fetch(); data != nil {
+		return data.File()
+	}
+	return nil
+}
+
+func (r *offloadedReader) size() int64 {
+	if data := r.fetch(); data != nil {
+		return data.size()
+	}
+	return -1
+}
+
+func (r *offloadedReader) seek(offset int64) error {
+	if data := r.fetch(); data != nil {
+		return data.seek(offset)
+	}
+	return r.err
+}
+
+func (r *offloadedReader) getAttr(key string, value []byte) (int, error) {
+	return r.stub.getAttr(key, value)
+}
+
+func (r *offloadedReader) readAhead(offset int64) int64 {
+	if data := r.fetch(); data != nil {
+		return data.readAhead(offset)
+	}
+	return 0
+}
+
+func (r *offloadedReader) mapping() []byte {
+	if data := r.fetch(); data != nil {
+		return data.mapping()
+	}
+	return nil
+}
+
+func (r *offloadedReader) throttle(n int64) bool {
+	return r.stub.throttle(n)
+}
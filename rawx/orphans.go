@@ -0,0 +1,234 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The orphan collector walks the volume and asks meta2, through the proxy,
+whether the content of each chunk still references it. An orphan chunk is
+first marked with the time it was found orphan, then deleted once it stayed
+orphan for the grace period, as if it was deleted by a client. A chunk
+referenced again loses its mark.
+
+The chunks younger than the grace period are skipped, their content may
+not be committed yet. In dry-run mode, the orphans are only reported.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	orphanDefaultRate  = 10
+	orphanDefaultGrace = 7 * 86400
+
+	orphanProxyTimeout = 10 * time.Second
+)
+
+var errOrphanUnknown = errors.New("Orphan status unknown")
+
+type orphanCollector struct {
+	rawx     *rawxService
+	repo     *chunkRepository
+	proxy    string
+	rate     *tokenBucket
+	grace    time.Duration
+	interval time.Duration
+	dryRun   bool
+	client   *http.Client
+}
+
+// Builds a collector checking at most `rate` chunks per second against the
+// proxy, then waiting for `interval` between two passes on the volume.
+func makeOrphanCollector(rawx *rawxService, proxy string, rate int,
+	grace, interval time.Duration, dryRun bool) *orphanCollector {
+	return &orphanCollector{
+		rawx:     rawx,
+		repo:     rawx.repo.(*chunkRepository),
+		proxy:    proxy,
+		rate:     makeTokenBucket(float64(rate), 1),
+		grace:    grace,
+		interval: interval,
+		dryRun:   dryRun,
+		client:   &http.Client{Timeout: orphanProxyTimeout},
+	}
+}
+
+func (oc *orphanCollector) Start() {
+	go func() {
+		for {
+			oc.pass(&oc.repo.sub)
+			if oc.repo.cold != nil {
+				oc.pass(oc.repo.cold)
+			}
+			time.Sleep(oc.interval)
+		}
+	}()
+}
+
+func (oc *orphanCollector) pass(repo *fileRepository) {
+	var count, orphans, deleted uint64
+	limit := time.Now().Add(-oc.grace)
+	err := repo.walkAll(func(name, relPath string, fi os.FileInfo) error {
+		if fi.ModTime().After(limit) {
+			return nil
+		}
+		oc.rate.wait(1)
+		count++
+		switch err := oc.collect(repo, name); err {
+		case nil:
+		case errOrphanChunk:
+			orphans++
+		case errOrphanDeleted:
+			orphans++
+			deleted++
+		default:
+			if !os.IsNotExist(err) {
+				LogWarning("Chunk %s not checked for orphan: %v", name, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		LogWarning("Orphan collection error on %s: %v", repo.root, err)
+	}
+	LogInfo("Orphans on %s: %d chunks checked, %d orphans, %d deleted",
+		repo.root, count, orphans, deleted)
+}
+
+var (
+	errOrphanChunk   = errors.New("Orphan chunk")
+	errOrphanDeleted = errors.New("Orphan chunk deleted")
+)
+
+// Checks a single chunk, and marks or deletes it when orphan
+func (oc *orphanCollector) collect(repo *fileRepository, name string) error {
+	var chunk chunkInfo
+	r, err := repo.get(name)
+	if err != nil {
+		return err
+	}
+	err = chunk.loadAttr(r, name)
+	since, errSince := readAttr(r, AttrNameOrphanSince)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	if errSince != nil && errSince != syscall.ENODATA {
+		return errSince
+	}
+
+	orphan, err := oc.isOrphan(&chunk)
+	if err != nil {
+		return err
+	}
+	if !orphan {
+		if since != "" && !oc.dryRun {
+			LogInfo("Chunk %s referenced again", name)
+			return repo.removeAttr(name, AttrNameOrphanSince)
+		}
+		return nil
+	}
+
+	atomic.AddUint64(&counters.OrphansFound, 1)
+	if oc.dryRun {
+		LogInfo("Chunk %s orphan (dry run)", name)
+		return errOrphanChunk
+	}
+	if since == "" {
+		LogInfo("Chunk %s orphan, deleted in %v", name, oc.grace)
+		now := strconv.FormatInt(time.Now().Unix(), 10)
+		if err = repo.setAttr(name, AttrNameOrphanSince, now); err != nil {
+			return err
+		}
+		return errOrphanChunk
+	}
+	ts, err := strconv.ParseInt(since, 10, 64)
+	if err != nil || time.Since(time.Unix(ts, 0)) < oc.grace {
+		return errOrphanChunk
+	}
+	if err = repo.del(name); err != nil {
+		return err
+	}
+	LogInfo("Chunk %s deleted, orphan since %s", name, time.Unix(ts, 0))
+	atomic.AddUint64(&counters.OrphansDeleted, 1)
+	NotifyDel(oc.rawx, "", &chunk)
+	return errOrphanDeleted
+}
+
+// Tells if the content of the chunk doesn't reference it anymore. Any doubt
+// is reported as an error, the chunk is then kept.
+func (oc *orphanCollector) isOrphan(chunk *chunkInfo) (bool, error) {
+	if !isHexaString(chunk.ContainerID, 64) || chunk.ContentID == "" {
+		return false, errOrphanUnknown
+	}
+	params := url.Values{}
+	params.Set("cid", chunk.ContainerID)
+	params.Set("content", chunk.ContentID)
+	params.Set("properties", "False")
+	uri := "http://" + oc.proxy + "/v3.0/" + url.PathEscape(oc.rawx.ns) +
+		"/content/locate?" + params.Encode()
+
+	rep, err := oc.client.Get(uri)
+	if err != nil {
+		return false, err
+	}
+	defer rep.Body.Close()
+	switch rep.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		// Neither the container nor the content
+		_, _ = io.Copy(ioutil.Discard, rep.Body)
+		return true, nil
+	default:
+		_, _ = io.Copy(ioutil.Discard, rep.Body)
+		return false, errors.New("Proxy error: " + rep.Status)
+	}
+
+	var chunks []struct {
+		URL string `json:"url"`
+	}
+	if err = json.NewDecoder(rep.Body).Decode(&chunks); err != nil {
+		return false, err
+	}
+	suffix := "/" + strings.ToUpper(chunk.ChunkID)
+	for _, c := range chunks {
+		if strings.HasSuffix(strings.ToUpper(c.URL), suffix) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func readAttr(r fileReader, key string) (string, error) {
+	buf := make([]byte, 64)
+	n, err := r.getAttr(key, buf)
+	if err != nil {
+		return "", err
+	}
+	return string(buf[:n]), nil
+}
@@ -0,0 +1,123 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The temporary files left behind by the uploads interrupted, e.g. by a crash
+without the journal of the uploads, or by a client gone while its chunk was
+staged. The files named "*.pending" not modified for pending_max_age
+seconds are removed upon the startup, then every pending_gc_interval
+seconds. The temporary files of the uploads in progress are registered,
+they are never removed whatever their age: a staged chunk might be idle
+until its transaction ends.
+*/
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+const (
+	pendingSuffix          = ".pending"
+	pendingDefaultMaxAge   = 86400
+	pendingDefaultInterval = 3600
+)
+
+// The temporary files of the uploads in progress on a volume
+type pendingUploads struct {
+	lock  sync.Mutex
+	paths map[string]struct{}
+}
+
+func (p *pendingUploads) add(relPath string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.paths == nil {
+		p.paths = make(map[string]struct{})
+	}
+	p.paths[relPath] = struct{}{}
+}
+
+func (p *pendingUploads) remove(relPath string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.paths, relPath)
+}
+
+func (p *pendingUploads) has(relPath string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	_, ok := p.paths[relPath]
+	return ok
+}
+
+func (fr *fileRepository) startPendingReaper(maxAge, interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			fr.reapPending(maxAge)
+		}
+	}()
+}
+
+// Removes the temporary files older than maxAge, and not in use
+func (fr *fileRepository) reapPending(maxAge time.Duration) {
+	limit := time.Now().Add(-maxAge)
+	var count uint64
+	err := filepath.Walk(fr.root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() {
+			if path != fr.root && strings.HasPrefix(fi.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(fi.Name(), pendingSuffix) || fi.ModTime().After(limit) {
+			return nil
+		}
+		relPath := path[len(fr.root)+1:]
+		if fr.pending.has(relPath) {
+			return nil
+		}
+		if err := syscall.Unlinkat(fr.rootFd, relPath, 0); err != nil {
+			if err != syscall.ENOENT {
+				LogWarning("Stale upload %s not removed: %v", path, err)
+			}
+			return nil
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		LogWarning("Stale uploads scan error on %s: %v", fr.root, err)
+	}
+	if count > 0 {
+		atomic.AddUint64(&counters.PendingReaped, count)
+		LogInfo("%d stale uploads removed from %s", count, fr.root)
+	}
+}
@@ -0,0 +1,135 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The presigned URLs of the chunks, so that the proxy hands the clients a
+direct URL to a chunk, valid for a while, and the data doesn't transit
+through it. The URL carries when it expires (in seconds since the epoch)
+and the HMAC-SHA256 of the method, the chunk ID and the expiry, with a key
+shared by the proxy and the rawx services:
+
+	/<CHUNKID>?expires=<EXPIRES>&signature=<HEX(HMAC(KEY, "<METHOD>\n<CHUNKID>\n<EXPIRES>"))>
+
+The keys are read from presign_key_file, one per line: the first one signs,
+all of them are accepted, so that a key is rotated without any URL being
+refused. An URL expiring more than presign_max_ttl seconds in the future is
+refused. A signature is verified whenever present, and with presign_required
+the GET and HEAD of the chunks without a signature are refused.
+*/
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const presignDefaultMaxTTL = 7 * 86400
+
+var (
+	presignKeys     [][]byte
+	presignRequired bool
+	presignMaxTTL   int64 = presignDefaultMaxTTL
+)
+
+var (
+	errSignatureMissing = errors.New("Signature required")
+	errSignatureInvalid = errors.New("Invalid signature")
+	errSignatureExpired = errors.New("Signature expired")
+)
+
+func loadPresignKeys(path string) ([][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var keys [][]byte
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		keys = append(keys, []byte(line))
+	}
+	if err = scanner.Err(); err == nil && len(keys) == 0 {
+		err = errors.New("No key in " + path)
+	}
+	return keys, err
+}
+
+func presignature(key []byte, method, chunkID, expires string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(method + "\n" + chunkID + "\n" + expires))
+	return mac.Sum(nil)
+}
+
+// Tells if the request may access the chunk, as far as its signature is
+// concerned.
+func (rr *rawxRequest) checkPresigned() error {
+	err := rr.verifyPresigned()
+	if err != nil {
+		atomic.AddUint64(&counters.PresignRefused, 1)
+	}
+	return err
+}
+
+func (rr *rawxRequest) verifyPresigned() error {
+	query := rr.req.URL.Query()
+	signature := query.Get("signature")
+	if signature == "" {
+		if presignRequired && (rr.req.Method == "GET" || rr.req.Method == "HEAD") {
+			return errSignatureMissing
+		}
+		return nil
+	}
+	if len(presignKeys) == 0 {
+		return errSignatureInvalid
+	}
+
+	expires := query.Get("expires")
+	when, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return errSignatureInvalid
+	}
+	now := time.Now().Unix()
+	if when < now {
+		return errSignatureExpired
+	}
+	if when > now+presignMaxTTL {
+		return errSignatureInvalid
+	}
+
+	sum, err := hex.DecodeString(signature)
+	if err != nil {
+		return errSignatureInvalid
+	}
+	for _, key := range presignKeys {
+		if hmac.Equal(sum, presignature(key, rr.req.Method, rr.chunkID, expires)) {
+			return nil
+		}
+	}
+	return errSignatureInvalid
+}
@@ -0,0 +1,88 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/hex"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerifyPresigned(t *testing.T) {
+	defer func(keys [][]byte, required bool, ttl int64) {
+		presignKeys, presignRequired, presignMaxTTL = keys, required, ttl
+	}(presignKeys, presignRequired, presignMaxTTL)
+
+	chunkID := "0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF"
+	oldKey, newKey := []byte("previous"), []byte("current")
+	now := time.Now().Unix()
+	valid := strconv.FormatInt(now+60, 10)
+	sign := func(key []byte, method, id, expires string) string {
+		return hex.EncodeToString(presignature(key, method, id, expires))
+	}
+
+	cases := []struct {
+		name      string
+		keys      [][]byte
+		required  bool
+		method    string
+		expires   string
+		signature string
+		err       error
+	}{
+		{"unsigned", [][]byte{newKey}, false, "GET", "", "", nil},
+		{"unsigned, required", [][]byte{newKey}, true, "GET", "", "", errSignatureMissing},
+		{"unsigned HEAD, required", [][]byte{newKey}, true, "HEAD", "", "", errSignatureMissing},
+		{"unsigned PUT, required", [][]byte{newKey}, true, "PUT", "", "", nil},
+		{"signed", [][]byte{newKey}, false, "GET", valid,
+			sign(newKey, "GET", chunkID, valid), nil},
+		{"signed by a previous key", [][]byte{newKey, oldKey}, true, "GET", valid,
+			sign(oldKey, "GET", chunkID, valid), nil},
+		{"signed by an unknown key", [][]byte{newKey}, false, "GET", valid,
+			sign(oldKey, "GET", chunkID, valid), errSignatureInvalid},
+		{"no key", nil, false, "GET", valid,
+			sign(newKey, "GET", chunkID, valid), errSignatureInvalid},
+		{"other method", [][]byte{newKey}, false, "DELETE", valid,
+			sign(newKey, "GET", chunkID, valid), errSignatureInvalid},
+		{"other chunk", [][]byte{newKey}, false, "GET", valid,
+			sign(newKey, "GET", "F"+chunkID[1:], valid), errSignatureInvalid},
+		{"expired", [][]byte{newKey}, false, "GET", strconv.FormatInt(now-1, 10),
+			sign(newKey, "GET", chunkID, strconv.FormatInt(now-1, 10)), errSignatureExpired},
+		{"too far", [][]byte{newKey}, false, "GET", strconv.FormatInt(now+7200, 10),
+			sign(newKey, "GET", chunkID, strconv.FormatInt(now+7200, 10)), errSignatureInvalid},
+		{"invalid expiry", [][]byte{newKey}, false, "GET", "soon",
+			sign(newKey, "GET", chunkID, "soon"), errSignatureInvalid},
+		{"not hexadecimal", [][]byte{newKey}, false, "GET", valid, "signature", errSignatureInvalid},
+	}
+	presignMaxTTL = 3600
+	for _, tc := range cases {
+		presignKeys, presignRequired = tc.keys, tc.required
+		url := "/" + chunkID
+		if tc.signature != "" {
+			url += "?expires=" + tc.expires + "&signature=" + tc.signature
+		}
+		rr := rawxRequest{
+			req:     httptest.NewRequest(tc.method, url, nil),
+			chunkID: chunkID,
+		}
+		if err := rr.verifyPresigned(); err != tc.err {
+			t.Errorf("%s: error %v, expected %v", tc.name, err, tc.err)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The priority of the reads over the writes, when the device of the volume is
+under pressure. Every priority_interval milliseconds, the statistics of the
+block device are sampled: the device is under pressure once it has at least
+priority_queue_depth IO in flight, or once its IO took priority_latency
+milliseconds on average since the previous sample (0 disables each
+criterion).
+
+Meanwhile, with priority_policy set to "reads" (the default), the PUT, PATCH
+and COPY of chunks are refused with a 503 and a Retry-After, so that the
+GET served to the users stay fast while the ingestion is pushed back. With
+"writes", the GET and HEAD are the ones refused.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+const (
+	priorityReads  = "reads"
+	priorityWrites = "writes"
+
+	pressureDefaultInterval = 1000
+)
+
+var errUnderPressure = errors.New("Volume under pressure")
+
+var (
+	pressureQueueDepth uint64
+	pressureLatency    uint64
+	pressurePolicy     = priorityReads
+)
+
+type ioPressure struct {
+	statPath string
+	high     int32
+	ios      uint64
+	ticks    uint64
+}
+
+// Locates the statistics of the block device holding the volume
+func makeIOPressure(root string) (*ioPressure, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(root, &st); err != nil {
+		return nil, err
+	}
+	p := &ioPressure{
+		statPath: fmt.Sprintf("/sys/dev/block/%d:%d/stat",
+			syscall.Major(st.Dev), syscall.Minor(st.Dev)),
+	}
+	_, _, _, err := p.sample()
+	return p, err
+}
+
+// Reads how many IO are in flight, and how many IO took how long so far
+func (p *ioPressure) sample() (inFlight, ios, ticks uint64, err error) {
+	data, err := ioutil.ReadFile(p.statPath)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 9 {
+		return 0, 0, 0, errors.New("Unexpected block device statistics")
+	}
+	var values [9]uint64
+	for i := range values {
+		if values[i], err = strconv.ParseUint(fields[i], 10, 64); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	// reads, _, _, read ticks, writes, _, _, write ticks, in flight
+	return values[8], values[0] + values[4], values[3] + values[7], nil
+}
+
+func (p *ioPressure) update() {
+	inFlight, ios, ticks, err := p.sample()
+	if err != nil {
+		LogWarning("IO pressure not sampled: %v", err)
+		return
+	}
+	high := pressureQueueDepth > 0 && inFlight >= pressureQueueDepth
+	if pressureLatency > 0 && ios > p.ios && (ticks-p.ticks)/(ios-p.ios) >= pressureLatency {
+		high = true
+	}
+	p.ios, p.ticks = ios, ticks
+
+	var state int32
+	if high {
+		state = 1
+	}
+	if atomic.SwapInt32(&p.high, state) != state {
+		atomic.AddUint64(&counters.PressureChanges, 1)
+		if high {
+			LogWarning("Volume under IO pressure, the %s have the priority", pressurePolicy)
+		} else {
+			LogInfo("Volume no longer under IO pressure")
+		}
+	}
+}
+
+func (p *ioPressure) Start(interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			p.update()
+		}
+	}()
+}
+
+func (fr *fileRepository) underPressure() bool {
+	return fr.pressure != nil && atomic.LoadInt32(&fr.pressure.high) != 0
+}
+
+// Tells if the request may be served while the volume is under pressure
+func (rr *rawxRequest) checkPriority() error {
+	repo, ok := rr.rawx.repo.(*chunkRepository)
+	if !ok || !repo.sub.underPressure() {
+		return nil
+	}
+	shed := false
+	switch rr.req.Method {
+	case "PUT", "PATCH", "COPY", "POST":
+		shed = pressurePolicy == priorityReads
+	case "GET", "HEAD":
+		shed = pressurePolicy == priorityWrites
+	}
+	if shed {
+		atomic.AddUint64(&counters.PressureRefused, 1)
+		return errUnderPressure
+	}
+	return nil
+}
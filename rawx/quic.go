@@ -0,0 +1,60 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build quic
+
+package main
+
+/*
+An experimental HTTP/3 listener, on QUIC, next to the TCP listener. It saves
+the handshakes of TCP and TLS, and the loss of a packet only stalls its own
+stream, which matters on the lossy links between distant sites. The same
+handler serves both listeners, and the replies over TCP advertise the QUIC
+port in their Alt-Svc header.
+
+It requires a binary built with the "quic" tag, that pulls quic-go.
+*/
+
+import (
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+func startQUIC(srv *http.Server, addr, cert, key string) error {
+	h3 := &http3.Server{
+		Addr:    addr,
+		Handler: srv.Handler,
+	}
+
+	tcpHandler := srv.Handler
+	srv.Handler = http.HandlerFunc(func(rep http.ResponseWriter, req *http.Request) {
+		_ = h3.SetQUICHeaders(rep.Header())
+		tcpHandler.ServeHTTP(rep, req)
+	})
+	srv.RegisterOnShutdown(func() {
+		if err := h3.Close(); err != nil {
+			LogWarning("QUIC listener close error: %v", err)
+		}
+	})
+
+	go func() {
+		if err := h3.ListenAndServeTLS(cert, key); err != nil && err != http.ErrServerClosed {
+			LogError("QUIC listener exiting: %v", err)
+		}
+	}()
+	return nil
+}
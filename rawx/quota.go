@@ -0,0 +1,234 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The quotas of the containers on a volume, for the edge deployments shared
+by several tenants without any accounting service. Each volume accounts the
+bytes and the chunks of each container in a local index, updated upon each
+PUT, COPY and DELETE. A PUT is refused with a 507 and the X-Error header
+telling the quota is exceeded, once the container holds quota_bytes bytes
+or quota_chunks chunks (0 for no limit). The limits proper to some
+containers are read from quota_file, one container per line:
+
+	<CONTAINER_ID> <BYTES> <CHUNKS>
+
+The index is saved in the ".quota" file at the root of the volume every
+quota_save_interval seconds. A missing index is rebuilt upon the startup,
+from the attributes of all the chunks of the volume, so removing it is the
+way to fix an index drifted after a crash.
+*/
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	quotaIndexFile           = ".quota"
+	quotaDefaultSaveInterval = 60
+)
+
+var errQuotaExceeded = errors.New("Container quota exceeded")
+
+type containerUsage struct {
+	Bytes  int64 `json:"bytes"`
+	Chunks int64 `json:"chunks"`
+}
+
+// The limits of the containers, the default ones and the overrides
+var (
+	quotaDefault   containerUsage
+	quotaOverrides map[string]containerUsage
+)
+
+type quotaIndex struct {
+	lock  sync.Mutex
+	path  string
+	usage map[string]*containerUsage
+	dirty bool
+}
+
+// Parses the limits proper to some containers
+func loadQuotaFile(path string) (map[string]containerUsage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	limits := make(map[string]containerUsage)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 || !isHexaString(fields[0], 64) {
+			return nil, errors.New("Invalid quota: " + line)
+		}
+		var limit containerUsage
+		if limit.Bytes, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+			return nil, errors.New("Invalid quota: " + line)
+		}
+		if limit.Chunks, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+			return nil, errors.New("Invalid quota: " + line)
+		}
+		limits[strings.ToUpper(fields[0])] = limit
+	}
+	return limits, scanner.Err()
+}
+
+func quotaOf(container string) containerUsage {
+	if limit, ok := quotaOverrides[container]; ok {
+		return limit
+	}
+	return quotaDefault
+}
+
+// Loads the index of the volume, or rebuilds it when missing
+func openQuotaIndex(cr *chunkRepository) (*quotaIndex, error) {
+	idx := &quotaIndex{
+		path:  cr.sub.root + "/" + quotaIndexFile,
+		usage: make(map[string]*containerUsage),
+	}
+	encoded, err := ioutil.ReadFile(idx.path)
+	if err == nil {
+		return idx, json.Unmarshal(encoded, &idx.usage)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	LogInfo("Quota index of %s missing, rebuilt", cr.sub.root)
+	account := func(name, relPath string, fi os.FileInfo) error {
+		var chunk chunkInfo
+		if err := cr.loadInfo(name, &chunk); err == nil {
+			idx.add(chunk.ContainerID, chunk.size, 1)
+		}
+		return nil
+	}
+	if err = cr.sub.walk(account); err == nil && cr.cold != nil {
+		err = cr.cold.walk(account)
+	}
+	if err == nil {
+		err = idx.save()
+	}
+	return idx, err
+}
+
+func (idx *quotaIndex) add(container string, bytes, chunks int64) {
+	if container == "" {
+		return
+	}
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	u, ok := idx.usage[container]
+	if !ok {
+		u = &containerUsage{}
+		idx.usage[container] = u
+	}
+	u.Bytes += bytes
+	u.Chunks += chunks
+	if u.Bytes <= 0 && u.Chunks <= 0 {
+		delete(idx.usage, container)
+	}
+	idx.dirty = true
+}
+
+// Tells if the container may receive a chunk of the given size, -1 when
+// the size is unknown.
+func (idx *quotaIndex) check(container string, size int64) error {
+	limit := quotaOf(container)
+	if limit.Bytes <= 0 && limit.Chunks <= 0 {
+		return nil
+	}
+	idx.lock.Lock()
+	var u containerUsage
+	if current, ok := idx.usage[container]; ok {
+		u = *current
+	}
+	idx.lock.Unlock()
+	if size < 0 {
+		size = 0
+	}
+	if (limit.Bytes > 0 && u.Bytes+size > limit.Bytes) ||
+		(limit.Chunks > 0 && u.Chunks+1 > limit.Chunks) {
+		atomic.AddUint64(&counters.QuotaRefused, 1)
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// Replaces the index saved, if it changed
+func (idx *quotaIndex) save() error {
+	idx.lock.Lock()
+	encoded, err := json.Marshal(idx.usage)
+	idx.dirty = false
+	idx.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(idx.path+pendingSuffix, encoded, putOpenMode); err != nil {
+		return err
+	}
+	return os.Rename(idx.path+pendingSuffix, idx.path)
+}
+
+func (idx *quotaIndex) startSaver(interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			idx.lock.Lock()
+			dirty := idx.dirty
+			idx.lock.Unlock()
+			if !dirty {
+				continue
+			}
+			if err := idx.save(); err != nil {
+				LogWarning("Quota index %s not saved: %v", idx.path, err)
+			}
+		}
+	}()
+}
+
+func (rr *rawxRequest) quotas() *quotaIndex {
+	if repo, ok := rr.rawx.repo.(*chunkRepository); ok {
+		return repo.quotas
+	}
+	return nil
+}
+
+// Accounts the chunk in its container, sign being -1 for a removal
+func (rr *rawxRequest) accountChunk(chunk *chunkInfo, sign int64) {
+	idx := rr.quotas()
+	if idx == nil {
+		return
+	}
+	size, err := strconv.ParseInt(chunk.ChunkSize, 10, 64)
+	if err != nil {
+		size = 0
+	}
+	idx.add(chunk.ContainerID, sign*size, sign)
+}
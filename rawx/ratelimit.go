@@ -0,0 +1,73 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// A classic token bucket: tokens are earned at a constant rate, up to the
+// size of the burst, and consumed by the operations to be admitted.
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// Builds a bucket earning `rate` tokens per second, initially full
+func makeTokenBucket(rate, burst float64) *tokenBucket {
+	if burst < rate {
+		burst = rate
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+}
+
+// Consumes n tokens if they are available, without waiting
+func (tb *tokenBucket) allow(n float64) bool {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+	tb.refill(time.Now())
+	if tb.tokens < n {
+		return false
+	}
+	tb.tokens -= n
+	return true
+}
+
+// Consumes n tokens, waiting for them to be earned when they are not
+// available yet.
+func (tb *tokenBucket) wait(n float64) {
+	tb.lock.Lock()
+	tb.refill(time.Now())
+	tb.tokens -= n
+	deficit := -tb.tokens
+	tb.lock.Unlock()
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / tb.rate * float64(time.Second)))
+	}
+}
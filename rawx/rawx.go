@@ -21,6 +21,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -41,6 +42,7 @@ type rawxService struct {
 	notifier     Notifier
 	bufferSize   int
 	checksumMode int
+	verifyGet    int
 	compression  string
 }
 
@@ -58,9 +60,18 @@ type rawxRequest struct {
 	status   int
 	bytesIn  uint64
 	bytesOut uint64
+
+	// The body started being read, cf. expect.go
+	bodyRead bool
+
+	// The error replied, cf. errcode.go
+	failure error
 }
 
 func (rr *rawxRequest) drain() error {
+	if rr.bodyHeld() {
+		return nil
+	}
 	if _, err := io.Copy(ioutil.Discard, rr.req.Body); err != nil {
 		rr.req.Close = true
 		return err
@@ -71,17 +82,56 @@ func (rr *rawxRequest) drain() error {
 
 func (rr *rawxRequest) replyCode(code int) {
 	rr.status = code
-	rr.rep.WriteHeader(rr.status)
+	if code >= http.StatusBadRequest {
+		rr.replyFailure(code)
+	} else {
+		rr.rep.WriteHeader(rr.status)
+	}
 }
 
 func (rr *rawxRequest) replyError(err error) {
+	rr.failure = err
 	if os.IsExist(err) {
 		rr.replyCode(http.StatusConflict)
 	} else if os.IsPermission(err) {
 		rr.replyCode(http.StatusForbidden)
 	} else if os.IsNotExist(err) {
 		rr.replyCode(http.StatusNotFound)
+	} else if err == errChunkTooLarge || err == errTxnTooLarge {
+		rr.req.Close = true
+		setError(rr.rep, err)
+		rr.replyCode(http.StatusRequestEntityTooLarge)
+	} else if err == errQuotaExceeded {
+		setError(rr.rep, err)
+		rr.replyCode(http.StatusInsufficientStorage)
+	} else if isNoSpace(err) {
+		rr.replyCode(http.StatusInsufficientStorage)
+	} else if err == errAuthMissing {
+		setError(rr.rep, err)
+		rr.rep.Header().Set("WWW-Authenticate", "Bearer")
+		rr.replyCode(http.StatusUnauthorized)
+	} else if err == errAuthForbidden || err == errAdminDisabled || err == errACLDenied || err == errSignatureMissing || err == errSignatureInvalid || err == errSignatureExpired {
+		setError(rr.rep, err)
+		rr.replyCode(http.StatusForbidden)
+	} else if err == errDeadlineExceeded {
+		rr.replyLate()
+	} else if err == errTooBusy || err == errUnderPressure {
+		rr.replyBusy(err)
+	} else if err == errAppendUnsupported {
+		setError(rr.rep, err)
+		rr.replyCode(http.StatusConflict)
+	} else if err == errPreconditionFailed {
+		setHeader(rr.rep.Header(), "ETag", rr.chunk.etag())
+		rr.replyCode(http.StatusPreconditionFailed)
+	} else if err == errVolumeReadOnly || err == errVolumeDown || err == errMaintenance {
+		rr.replyCode(http.StatusServiceUnavailable)
 	} else {
+		if isIOError(err) {
+			if repo, ok := rr.rawx.repo.(*chunkRepository); ok {
+				repo.sub.countIOError()
+			}
+		}
+
 		// A strong error occured, we tend to close the connection
 		// whatever the client has sent in the request, in terms of
 		// connection management.
@@ -98,7 +148,7 @@ func (rr *rawxRequest) replyError(err error) {
 			rr.replyCode(http.StatusBadRequest)
 		} else {
 			switch err {
-			case errInvalidChunkID, errMissingHeader, errInvalidHeader:
+			case errInvalidChunkID, errMissingHeader, errInvalidHeader, errChecksumMismatch, errListMarker, errListPrefix:
 				rr.replyCode(http.StatusBadRequest)
 			case errInvalidRange:
 				rr.replyCode(http.StatusRequestedRangeNotSatisfiable)
@@ -122,6 +172,14 @@ func (rawx *rawxService) ServeHTTP(rep http.ResponseWriter, req *http.Request) {
 		startTime: time.Now(),
 	}
 
+	rawxreq.recycleConnection()
+	rawxreq.watchContinue()
+	rawxreq.applyTimeouts()
+	rawxreq.throttleClient()
+	if release := rawxreq.applyDeadline(); release != nil {
+		defer release()
+	}
+
 	// Extract some common headers
 	rawxreq.reqid = req.Header.Get(HeaderNameOioReqId)
 	if len(rawxreq.reqid) <= 0 {
@@ -139,6 +197,18 @@ func (rawx *rawxService) ServeHTTP(rep http.ResponseWriter, req *http.Request) {
 
 	if len(req.Host) > 0 && (req.Host != rawx.id && req.Host != rawx.url) {
 		rawxreq.replyCode(http.StatusTeapot)
+	} else if rawxreq.overConnected() {
+		rawxreq.replyBusy(errTooBusy)
+	} else if rawxreq.overRated() {
+		rawxreq.replyRateLimited()
+	} else if rawxreq.pastDeadline() {
+		rawxreq.replyError(errDeadlineExceeded)
+	} else if err := rawxreq.checkACL(); err != nil {
+		rawxreq.drain()
+		rawxreq.replyError(err)
+	} else if err := rawxreq.authenticate(); err != nil {
+		rawxreq.drain()
+		rawxreq.replyError(err)
 	} else {
 		for _dslash(req.URL.Path) {
 			req.URL.Path = req.URL.Path[1:]
@@ -148,8 +218,30 @@ func (rawx *rawxService) ServeHTTP(rep http.ResponseWriter, req *http.Request) {
 			rawxreq.serveInfo(rep, req)
 		case "/stat":
 			rawxreq.serveStat(rep, req)
+		case "/quarantine":
+			rawxreq.serveQuarantine(rep, req)
+		case "/list":
+			rawxreq.serveList(rep, req)
+		case "/snapshot":
+			rawxreq.serveSnapshot(rep, req)
+		case adminConfigPath:
+			rawxreq.serveAdmin(rep, req)
 		default:
-			rawxreq.serveChunk()
+			if strings.HasPrefix(req.URL.Path, txnPathPrefix) {
+				rawxreq.serveTransaction(rep, req)
+			} else if strings.HasPrefix(req.URL.Path, sessionPathPrefix) {
+				rawxreq.serveSession(rep, req)
+			} else if req.Method == "OPTIONS" && isRootPath(req.URL.Path) {
+				rawxreq.serveOptions(rep, req)
+			} else if strings.HasPrefix(req.URL.Path, checkPathPrefix) {
+				rawxreq.serveCheck(rep, req)
+			} else if strings.HasPrefix(req.URL.Path, chunkInfoPathPrefix) {
+				rawxreq.serveChunkInfo(rep, req)
+			} else if strings.HasPrefix(req.URL.Path, adminResyncPrefix) {
+				rawxreq.serveResync(rep, req)
+			} else {
+				rawxreq.serveChunk()
+			}
 		}
 	}
 }
@@ -0,0 +1,116 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The large chunks read sequentially, e.g. the EC fragments served over high
+latency links, benefit from a read-ahead larger than the one of the block
+device. While such a chunk is served, the next pages are advised to the
+kernel (FADV_WILLNEED) one window ahead of the current offset, so that the
+disk keeps reading while the network sends.
+
+The raw chunks are sent step by step, each step staying a LimitedReader on
+the file so that sendfile() is still used. The other chunks are read ahead
+from their Read().
+*/
+
+import (
+	"io"
+	"os"
+	"sync/atomic"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+const defaultReadaheadMinSize = 8 * 1024 * 1024
+
+// Tells how far the chunk of the given size is read ahead, 0 when it isn't
+func (fr *fileRepository) readaheadFor(size int64) int64 {
+	if fr.readaheadWindow <= 0 || size < fr.readaheadMinSize {
+		return 0
+	}
+	return fr.readaheadWindow
+}
+
+func (fr *realFileReader) readAhead(offset int64) int64 {
+	window := fr.window
+	if window <= 0 || offset+window/2 < fr.advised {
+		return window
+	}
+	start := fr.advised
+	if start < offset {
+		start = offset
+	}
+	end := offset + window
+	if err := syscall.Fadvise(fr.fd(), start, end-start, syscall.FADV_WILLNEED); err == nil {
+		atomic.AddUint64(&counters.ReadaheadBytes, uint64(end-start))
+	}
+	fr.advised = end
+	return window
+}
+
+// Tells the offset in the file when the chunk is served raw, i.e. when the
+// reader is the file itself.
+func rawOffset(in *io.LimitedReader, chunk fileReader) (int64, bool) {
+	f := chunk.File()
+	if in.R != io.Reader(f) {
+		return 0, false
+	}
+	offset, err := f.Seek(0, os.SEEK_CUR)
+	return offset, err == nil
+}
+
+// Copies the chunk to the client, a window ahead of the kernel readahead
+func copyAhead(dst io.Writer, in *io.LimitedReader, chunk fileReader) (int64, error) {
+	offset, raw := rawOffset(in, chunk)
+	if !raw {
+		// Read ahead from Read(), if at all
+		return io.Copy(dst, in)
+	}
+	if n, sparse, err := copySparse(dst, in, chunk); sparse {
+		return n, err
+	}
+	f := chunk.File()
+	size := chunk.readAhead(offset) / 2
+	if size <= 0 && chunk.throttle(0) {
+		size = throttleStep
+	}
+	if size <= 0 {
+		return io.Copy(dst, in)
+	}
+
+	var total int64
+	for in.N > 0 {
+		step := &io.LimitedReader{R: f, N: size}
+		if step.N > in.N {
+			step.N = in.N
+		}
+		chunk.throttle(step.N)
+		n, err := io.Copy(dst, step)
+		total += n
+		in.N -= n
+		if err != nil {
+			return total, err
+		}
+		if n == 0 {
+			break
+		}
+		offset += n
+		chunk.readAhead(offset)
+	}
+	return total, nil
+}
@@ -0,0 +1,191 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The rebalancing of the chunks between the volumes served by the process.
+Every rebalance_interval seconds, each volume whose bytes used exceed
+rebalance_threshold percents sheds chunks to the emptiest volume, at most
+rebalance_rate chunks per second, until it goes under the threshold. A
+volume only receives chunks while it is under the threshold itself.
+
+A chunk moved changes of service ID: a "storage.chunk.relocated" event,
+telling both its former and its new volume, is delivered before the chunk
+leaves its former volume, so that meta2 updates its location, and the
+former volume redirects to the new one meanwhile, cf. moved.go. The chunks
+of the cold tier stay where they are.
+*/
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	rebalanceDefaultRate     = 10
+	rebalanceDefaultInterval = 600
+)
+
+var errRebalanceDone = errors.New("Volume rebalanced")
+
+type rebalancer struct {
+	volumes   []*rawxService
+	threshold float64
+	rate      *tokenBucket
+	interval  time.Duration
+}
+
+func makeRebalancer(volumes []*rawxService, threshold, rate int, interval time.Duration) *rebalancer {
+	return &rebalancer{
+		volumes:   volumes,
+		threshold: float64(threshold),
+		rate:      makeTokenBucket(float64(rate), 1),
+		interval:  interval,
+	}
+}
+
+func (rb *rebalancer) Start() {
+	go func() {
+		for {
+			time.Sleep(rb.interval)
+			rb.pass()
+		}
+	}()
+}
+
+func volumeFill(vol *rawxService) float64 {
+	u, err := vol.repo.(*chunkRepository).sub.usage()
+	if err != nil {
+		return -1
+	}
+	return u.bytesPercent()
+}
+
+// The emptiest volume still under the threshold, nil if none
+func (rb *rebalancer) target(exclude *rawxService) *rawxService {
+	var best *rawxService
+	bestFill := rb.threshold
+	for _, vol := range rb.volumes {
+		if vol == exclude {
+			continue
+		}
+		if fill := volumeFill(vol); fill >= 0 && fill < bestFill {
+			best, bestFill = vol, fill
+		}
+	}
+	return best
+}
+
+func (rb *rebalancer) pass() {
+	for _, src := range rb.volumes {
+		if volumeFill(src) < rb.threshold {
+			continue
+		}
+		repo := src.repo.(*chunkRepository)
+		var count uint64
+		err := repo.sub.walk(func(name, relPath string, fi os.FileInfo) error {
+			// The stubs of the offloaded chunks stay where they are
+			if fi.Size() == 0 {
+				return nil
+			}
+			if volumeFill(src) < rb.threshold {
+				return errRebalanceDone
+			}
+			dst := rb.target(src)
+			if dst == nil {
+				return errRebalanceDone
+			}
+			rb.rate.wait(1)
+			if err := relocateChunk(src, dst, name); err != nil {
+				if !os.IsNotExist(err) {
+					LogWarning("Chunk %s not relocated to %s: %v", name, dst.path, err)
+				}
+			} else {
+				count++
+			}
+			return nil
+		})
+		if err != nil && err != errRebalanceDone {
+			LogWarning("Rebalancing error on %s: %v", src.path, err)
+		}
+		if count > 0 {
+			LogInfo("%d chunks relocated from %s", count, src.path)
+		}
+	}
+}
+
+// Moves the chunk, with its attributes, from a volume to another one
+func relocateChunk(src, dst *rawxService, name string) error {
+	from := src.repo.(*chunkRepository)
+	to := dst.repo.(*chunkRepository)
+	r, err := from.sub.get(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	var chunk chunkInfo
+	if err = chunk.loadAttr(r, name); err != nil {
+		return err
+	}
+
+	w, err := to.put(name)
+	if err != nil {
+		return err
+	}
+	if err = copyAttrs(r, w); err == nil {
+		_, err = io.Copy(w, r)
+	}
+	if err != nil {
+		w.abort()
+		return err
+	}
+	if err = w.commit(); err != nil {
+		return err
+	}
+	// The location known by meta2 changes before the chunk leaves
+	if err = NotifyRelocated(src, dst, "", &chunk); err != nil {
+		_ = to.sub.del(name)
+		return err
+	}
+
+	// The chunk has been deleted during the move, the deletion wins
+	if err = from.sub.del(name); err != nil {
+		_ = to.sub.del(name)
+		if os.IsNotExist(err) {
+			NotifyDel(dst, "", &chunk)
+		}
+		return err
+	}
+	if from.quotas != nil {
+		from.quotas.add(chunk.ContainerID, -chunk.size, -1)
+	}
+	if to.quotas != nil {
+		to.quotas.add(chunk.ContainerID, chunk.size, 1)
+	}
+	if from.sub.movedRetention > 0 {
+		if location, err := movedLocation(dst.url); err == nil {
+			if err = from.sub.leaveTombstone(name, location); err != nil {
+				LogWarning("Tombstone of %s not left: %v", name, err)
+			}
+		}
+	}
+	atomic.AddUint64(&counters.RebalanceMoved, 1)
+	return nil
+}
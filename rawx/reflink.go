@@ -0,0 +1,160 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Copies of the chunks sharing their blocks with the original (reflinks), on
+the filesystems supporting FICLONE, e.g. XFS or btrfs. Unlike a hard link,
+the copy is a distinct chunk with its own attributes, and it is still made
+in O(1) in time and space. The COPY operations depend on "copy_mode":
+
+  - "link": hard links, the default
+  - "reflink": reflinks only, turned into "link" on the volumes found
+    without them upon the startup
+  - "auto": reflinks, falling back to hard links where not supported
+
+A chunk already having as many hard links as the filesystem allows is
+copied byte per byte instead. The COPY is also accepted as a POST with the
+same Destination header, for the clients unable to send a COPY.
+*/
+
+import (
+	"strings"
+	"sync/atomic"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+const (
+	copyModeLink = iota
+	copyModeReflink
+	copyModeAuto
+)
+
+// A reflink is a new chunk being written, only its data is already there
+type reflinkOp struct {
+	fw *realFileWriter
+}
+
+func (op *reflinkOp) setAttr(key string, value []byte) error {
+	return op.fw.setAttr(key, value)
+}
+
+func (op *reflinkOp) commit() error {
+	return op.fw.commit()
+}
+
+func (op *reflinkOp) rollback() error {
+	return op.fw.abort()
+}
+
+func (fr *fileRepository) reflink(src, dst string) (linkOperation, error) {
+	in, err := fr.getRelPath(fr.locate(src))
+	if err != nil {
+		return nil, err
+	}
+	r := in.(*realFileReader)
+	defer r.Close()
+
+	out, err := fr.putRelPath(fr.locate(dst))
+	if err != nil {
+		return nil, err
+	}
+	fw := out.(*realFileWriter)
+	if err = fw.cloneFrom(r); err != nil {
+		fw.abort()
+		return nil, err
+	}
+	fw.written = r.size()
+
+	// The copy gets its own fullpath, not the one of the original
+	attrs, err := r.attrs()
+	for key, value := range attrs {
+		if err != nil {
+			break
+		}
+		if !strings.HasPrefix(key, AttrNameFullPrefix) {
+			err = fw.setAttr(key, value)
+		}
+	}
+	if err != nil {
+		fw.abort()
+		return nil, err
+	}
+	atomic.AddUint64(&counters.Reflinks, 1)
+	return &reflinkOp{fw: fw}, nil
+}
+
+// Copies the data of the chunk as stored, with its attributes but its
+// fullpath.
+func (fr *fileRepository) copyData(src, dst string) (linkOperation, error) {
+	in, err := fr.getRelPath(fr.locate(src))
+	if err != nil {
+		return nil, err
+	}
+	r := in.(*realFileReader)
+	defer r.Close()
+
+	out, err := fr.putRelPath(fr.locate(dst))
+	if err != nil {
+		return nil, err
+	}
+	fw := out.(*realFileWriter)
+	fw.Extend(r.size())
+	attrs, err := r.attrs()
+	for key, value := range attrs {
+		if err != nil {
+			break
+		}
+		if !strings.HasPrefix(key, AttrNameFullPrefix) {
+			err = fw.setAttr(key, value)
+		}
+	}
+	if err == nil {
+		_, err = copyPooled(fw, r)
+	}
+	if err != nil {
+		fw.abort()
+		return nil, err
+	}
+	atomic.AddUint64(&counters.CopiedChunks, 1)
+	return &reflinkOp{fw: fw}, nil
+}
+
+// Shares the data of the chunk, only the data when either has a header
+func (fw *realFileWriter) cloneFrom(r *realFileReader) error {
+	if fw.base == 0 && r.base == 0 {
+		return syscall.IoctlFileClone(fw.fd(), r.fd())
+	}
+	if err := fw.f.Truncate(fw.base); err != nil {
+		return err
+	}
+	return syscall.IoctlFileCloneRange(fw.fd(), &syscall.FileCloneRange{
+		Src_fd:      int64(r.fd()),
+		Src_offset:  uint64(r.base),
+		Dest_offset: uint64(fw.base),
+	})
+}
+
+// Tells if the error is due to the filesystem not supporting the reflinks
+func reflinkUnsupported(err error) bool {
+	switch err {
+	case syscall.EOPNOTSUPP, syscall.EXDEV, syscall.EINVAL, syscall.ENOTTY:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Implements the `events` subcommands of the service, e.g.:
+
+	oio-rawx -f rawx.conf events replay [-rate N] [-dry-run] FILE
+
+The FILE is expected to hold one entry per line, either a plain event (as
+found in an event spool) or a dead letter wrapping the event.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	replayDefaultRate = 100
+	replayMaxLine     = 16 * 1024 * 1024
+)
+
+func runEventsCommand(opts optionsMap, rawx *rawxService, args []string) error {
+	if len(args) <= 0 {
+		return errors.New("Missing events subcommand")
+	}
+	switch args[0] {
+	case "replay":
+		return replayEvents(opts, rawx, args[1:])
+	default:
+		return fmt.Errorf("Unexpected events subcommand: %s", args[0])
+	}
+}
+
+// Extracts the event from a line of a spool or a dead letter file
+func extractEvent(line []byte) ([]byte, error) {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(line, &fields); err != nil {
+		return nil, err
+	}
+	if _, ok := fields["failure"]; !ok {
+		return line, nil
+	}
+
+	event := fields["event"]
+	if len(event) > 0 && event[0] == '"' {
+		// The event was kept as a string in the dead letter
+		var s string
+		if err := json.Unmarshal(event, &s); err != nil {
+			return nil, err
+		}
+		event = json.RawMessage(s)
+	}
+	if !json.Valid(event) {
+		return nil, errors.New("Invalid event in the dead letter")
+	}
+	return event, nil
+}
+
+func replayEvents(opts optionsMap, rawx *rawxService, args []string) error {
+	fs := flag.NewFlagSet("events replay", flag.ContinueOnError)
+	rate := fs.Int("rate", replayDefaultRate, "Maximum number of events per second (0 for no limit)")
+	dryRun := fs.Bool("dry-run", false, "Print the events instead of sending them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("Expected exactly one file to replay")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The replayed events are not sent to the dead letter destination again,
+	// the original file is left untouched and might be replayed later.
+	var notifier Notifier
+	if !*dryRun {
+		var conf *notifConfig
+		notifier, conf, err = makeNotifierFromOpts(opts, rawx)
+		if err != nil {
+			return err
+		}
+		setNotifConf(conf)
+		notifier.Start()
+		defer notifier.Close()
+	}
+
+	var tick <-chan time.Time
+	if *rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(*rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	var count, invalid uint64
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 65536), replayMaxLine)
+	for lineno := 1; sc.Scan(); lineno++ {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) <= 0 {
+			continue
+		}
+		event, err := extractEvent(line)
+		if err == nil {
+			// Malformed events would only crash the consumers
+			_, err = parseEvent(event)
+		}
+		if err != nil {
+			LogWarning("Line %d ignored: %v", lineno, err)
+			invalid++
+			continue
+		}
+		if tick != nil {
+			<-tick
+		}
+		if *dryRun {
+			fmt.Println(string(event))
+		} else {
+			evt := Event{Data: append([]byte{}, event...)}
+			if err := notifier.Push(evt); err != nil {
+				return err
+			}
+		}
+		count++
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	LogInfo("%d events replayed, %d invalid lines", count, invalid)
+	return nil
+}
@@ -32,6 +32,10 @@ type repository interface {
 	link(fromName, toName string) (linkOperation, error)
 	del(name string) error
 	getAttr(name, key string, value []byte) (int, error)
+	// Moves the chunk out of the way, it won't be served anymore
+	quarantine(name, reason string) error
+	// Lists the chunks in quarantine
+	quarantined() ([]quarantinedChunk, error)
 }
 
 type decorable interface {
@@ -47,6 +51,17 @@ type fileReader interface {
 	size() int64
 	seek(int64) error
 	getAttr(key string, value []byte) (int, error)
+
+	// Advises the pages ahead of the given offset, returns the size of the
+	// window or 0 when the chunk isn't read ahead.
+	readAhead(offset int64) int64
+
+	// Maps the whole chunk in memory, if eligible, until Close()
+	mapping() []byte
+
+	// Waits for the read bandwidth of the volume to admit n bytes, returns
+	// false when the reads aren't limited.
+	throttle(n int64) bool
 }
 
 type fileWriter interface {
@@ -0,0 +1,255 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The repair of the metadata of a chunk from its data, with a POST
+/admin/resync/<CHUNKID>: the chunk is read again, then its hash and its size
+are rewritten as computed, e.g. once a filesystem incident lost or damaged
+its attributes. The data is trusted, the attributes aren't:
+
+	{"chunk_id": "...", "size": 1048576, "hash_algo": "md5", "hash": "...",
+	 "former_size": "", "former_hash": "", "restored": ["chunk hash", ...]}
+
+The attributes lost beyond the hash and the size can't be guessed, the
+request might tell them with the headers of an upload: the full path, the
+position, the storage policy, the chunk method, the metachunk, and the
+algorithm of the hash (md5 when unknown). The compressed or encrypted
+chunks need their attributes of compression or encryption to be read.
+
+A chunk whose content is known is announced by a "storage.chunk.new"
+event, so that the meta2 learns the new hash. As the other admin verbs,
+it requires a token with the ADMIN scope.
+*/
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const adminResyncPrefix = "/admin/resync/"
+
+type resyncReply struct {
+	ChunkID    string   `json:"chunk_id"`
+	Size       int64    `json:"size"`
+	HashAlgo   string   `json:"hash_algo"`
+	Hash       string   `json:"hash"`
+	FormerSize string   `json:"former_size"`
+	FormerHash string   `json:"former_hash"`
+	Restored   []string `json:"restored"`
+}
+
+// Applies the attributes told by the request, when the chunk lost them
+func (chunk *chunkInfo) retrieveResyncHeaders(headers *http.Header) error {
+	if headers.Get(HeaderNameFullpath) != "" {
+		if err := chunk.retrieveContentFullpathHeader(headers); err != nil {
+			return err
+		}
+	}
+	if v := headers.Get(HeaderNameChunkHashAlgo); v != "" {
+		algo, err := parseHashAlgo(v)
+		if err != nil {
+			return returnError(err, HeaderNameChunkHashAlgo)
+		}
+		chunk.hashAlgo = algo
+	}
+	if v := headers.Get(HeaderNameMetachunkChecksum); v != "" {
+		if !isHexaString(v, 0) {
+			return returnError(errInvalidHeader, HeaderNameMetachunkChecksum)
+		}
+		chunk.MetachunkHash = strings.ToUpper(v)
+	}
+	if v := headers.Get(HeaderNameMetachunkSize); v != "" {
+		if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+			return returnError(errInvalidHeader, HeaderNameMetachunkSize)
+		}
+		chunk.MetachunkSize = v
+	}
+	for _, field := range []struct {
+		header string
+		ptr    *string
+	}{
+		{HeaderNameChunkPosition, &chunk.ChunkPosition},
+		{HeaderNameContentStgPol, &chunk.ContentStgPol},
+		{HeaderNameContentChunkMethod, &chunk.ContentChunkMethod},
+	} {
+		if v := headers.Get(field.header); v != "" {
+			*field.ptr = v
+		}
+	}
+	return nil
+}
+
+// Hashes the data of the chunk, then rewrites the attributes that differ
+func (rr *rawxRequest) resyncChunk(fr *fileRepository) (*resyncReply, error) {
+	inChunk, err := fr.get(rr.chunkID)
+	if err != nil {
+		return nil, err
+	}
+	defer inChunk.Close()
+
+	// Whatever is left of the attributes
+	if err = rr.chunk.loadAttr(inChunk, rr.chunkID); err != nil {
+		LogInfo("Resync of %s with damaged attributes: %v", rr.chunkID, err)
+	}
+	rr.chunk.ChunkID = rr.chunkID
+	former := rr.chunk
+	if err = rr.chunk.retrieveResyncHeaders(&rr.req.Header); err != nil {
+		return nil, err
+	}
+
+	in, filter, err := rr.getChunkReader(inChunk, math.MaxInt64, rangeInfo{})
+	if filter != nil {
+		defer filter.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	h, err := rr.chunk.newHash()
+	if err != nil {
+		return nil, err
+	}
+	n, err := copyPooled(h, in)
+	if err != nil {
+		return nil, err
+	}
+	rr.chunk.size = n
+	rr.chunk.ChunkSize = strconv.FormatInt(n, 10)
+	rr.chunk.ChunkHash = strings.ToUpper(hex.EncodeToString(h.Sum(nil)))
+
+	reply := &resyncReply{
+		ChunkID:    rr.chunkID,
+		Size:       n,
+		HashAlgo:   rr.chunk.hashAlgo,
+		Hash:       rr.chunk.ChunkHash,
+		FormerSize: former.ChunkSize,
+		FormerHash: former.ChunkHash,
+		Restored:   []string{},
+	}
+	if reply.HashAlgo == "" {
+		reply.HashAlgo = hashAlgoMD5
+	}
+
+	attrs := &committedAttrs{repo: fr, name: rr.chunkID}
+	if rr.chunk.ContentFullpath != former.ContentFullpath {
+		if err = rr.chunk.saveContentFullpathAttr(attrs); err != nil {
+			return nil, err
+		}
+		reply.Restored = append(reply.Restored, "full path")
+	}
+	for _, attr := range []struct {
+		name     string
+		key      string
+		old, new string
+	}{
+		{"chunk hash", AttrNameChunkChecksum, former.ChunkHash, rr.chunk.ChunkHash},
+		{"chunk size", AttrNameChunkSize, former.ChunkSize, rr.chunk.ChunkSize},
+		{"hash algorithm", AttrNameHashAlgo, former.hashAlgo, rr.chunk.hashAlgo},
+		{"metachunk hash", AttrNameMetachunkChecksum, former.MetachunkHash, rr.chunk.MetachunkHash},
+		{"metachunk size", AttrNameMetachunkSize, former.MetachunkSize, rr.chunk.MetachunkSize},
+		{"chunk position", AttrNameChunkPosition, former.ChunkPosition, rr.chunk.ChunkPosition},
+		{"storage policy", AttrNameContentStgPol, former.ContentStgPol, rr.chunk.ContentStgPol},
+		{"chunk method", AttrNameContentChunkMethod, former.ContentChunkMethod, rr.chunk.ContentChunkMethod},
+	} {
+		if attr.new == attr.old || attr.new == "" {
+			continue
+		}
+		if err = attrs.setAttr(attr.key, []byte(attr.new)); err != nil {
+			return nil, err
+		}
+		reply.Restored = append(reply.Restored, attr.name)
+	}
+	return reply, nil
+}
+
+func (rr *rawxRequest) resync() {
+	fr := rr.volume()
+	if fr == nil {
+		rr.replyCode(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := fr.writable(); err != nil {
+		rr.replyError(err)
+		return
+	}
+	fr.waitThawed()
+
+	lock := chunkLock(rr.chunkID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	reply, err := rr.resyncChunk(fr)
+	if err != nil {
+		rr.replyError(err)
+		return
+	}
+	body, err := json.Marshal(reply)
+	if err != nil {
+		rr.replyError(err)
+		return
+	}
+	atomic.AddUint64(&counters.ChunksResynced, 1)
+	LogNotice("Admin resync of %s size=%d hash=%s restored=%v by %s reqid=%s",
+		rr.chunkID, reply.Size, reply.Hash, reply.Restored, rr.req.RemoteAddr, rr.reqid)
+
+	rr.rep.Header().Set("Content-Type", "application/json")
+	rr.replyCode(http.StatusOK)
+	rr.rep.Write(body)
+	rr.bytesOut = uint64(len(body))
+	if rr.chunk.ContainerID != "" && len(reply.Restored) > 0 {
+		NotifyNew(rr.rawx, rr.reqid, &rr.chunk)
+	}
+}
+
+func (rr *rawxRequest) serveResync(rep http.ResponseWriter, req *http.Request) {
+	if err := rr.drain(); err != nil {
+		rr.replyError(err)
+		return
+	}
+
+	id := strings.TrimPrefix(req.URL.Path, adminResyncPrefix)
+	if err := rr.authenticateAdmin(); err != nil {
+		rr.replyError(err)
+	} else if !isHexaString(id, 64) {
+		rr.replyError(errInvalidChunkID)
+	} else if req.Method != "POST" {
+		rr.replyCode(http.StatusMethodNotAllowed)
+	} else {
+		rr.chunkID = strings.ToUpper(id)
+		rr.resync()
+	}
+	spent := IncrementStatReqOther(rr)
+
+	if isVerbose() {
+		LogHttp(AccessLogEvent{
+			status:    rr.status,
+			timeSpent: spent,
+			bytesIn:   rr.bytesIn,
+			bytesOut:  rr.bytesOut,
+			method:    rr.req.Method,
+			local:     rr.rawx.url,
+			peer:      rr.req.RemoteAddr,
+			path:      rr.req.URL.Path,
+			reqId:     rr.reqid,
+		})
+	}
+}
@@ -0,0 +1,135 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+A minimal client of an S3-compatible object store: PUT, GET and DELETE of
+objects, addressed path-style (ENDPOINT/BUCKET/KEY) so that any endpoint
+works without DNS tricks. The requests are signed with SigV4 and the
+credentials come from the usual AWS_* environment variables, as for the
+AWS KMS. The payloads aren't hashed, the chunks carry their own checksum.
+*/
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	s3DefaultRegion   = "us-east-1"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3Timeout         = 30 * time.Second
+)
+
+type s3Store struct {
+	awsCredentials
+	region string
+	// ENDPOINT/BUCKET[/PREFIX], without any trailing slash
+	base   string
+	client http.Client
+}
+
+// Builds the client of "http(s)://ENDPOINT/BUCKET[/PREFIX]"
+func makeS3Store(config, region string) (*s3Store, error) {
+	u, err := url.Parse(config)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return nil, errors.New("Invalid S3 URL, http(s)://ENDPOINT/BUCKET[/PREFIX] expected")
+	}
+	creds, err := loadAwsCredentials()
+	if err != nil {
+		return nil, err
+	}
+	if region == "" {
+		region = s3DefaultRegion
+	}
+	return &s3Store{
+		awsCredentials: creds,
+		region:         region,
+		base:           u.Scheme + "://" + u.Host + "/" + strings.Trim(u.Path, "/"),
+		// No timeout for the whole transfer, only for its start
+		client: http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			ResponseHeaderTimeout: s3Timeout,
+			IdleConnTimeout:       90 * time.Second,
+		}},
+	}, nil
+}
+
+func (s *s3Store) do(method, key string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.base+"/"+key, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+	s.sign(req, s.region, "s3", s3UnsignedPayload, time.Now())
+	rep, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if rep.StatusCode/100 != 2 {
+		_, _ = io.Copy(ioutil.Discard, rep.Body)
+		rep.Body.Close()
+		if rep.StatusCode == http.StatusNotFound {
+			return nil, errS3NotFound
+		}
+		return nil, errors.New("S3 error: " + rep.Status)
+	}
+	return rep, nil
+}
+
+var errS3NotFound = errors.New("S3 object not found")
+
+func (s *s3Store) put(key string, body io.Reader, size int64) error {
+	rep, err := s.do("PUT", key, body, size)
+	if err == nil {
+		_, _ = io.Copy(ioutil.Discard, rep.Body)
+		rep.Body.Close()
+	}
+	return err
+}
+
+// Returns the content of the object, to be closed by the caller
+func (s *s3Store) get(key string) (io.ReadCloser, error) {
+	rep, err := s.do("GET", key, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return rep.Body, nil
+}
+
+func (s *s3Store) del(key string) error {
+	rep, err := s.do("DELETE", key, nil, 0)
+	if err == errS3NotFound {
+		return nil
+	}
+	if err == nil {
+		_, _ = io.Copy(ioutil.Discard, rep.Body)
+		rep.Body.Close()
+	}
+	return err
+}
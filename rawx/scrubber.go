@@ -0,0 +1,200 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The scrubber continuously walks the volume and verifies the MD5 and the
+size of each chunk against those stored in its attributes, so that the
+silent corruptions are detected even on the chunks never read. It runs with the
+idle IO priority, and its reads are capped to a configured bandwidth.
+
+A corrupted chunk is handled as upon a verified GET: it is moved to the
+quarantine, and a "storage.chunk.corrupted" event asks for its rebuild. The
+chunks sealed with a hash tree are verified block by block, possibly only a
+sample of their blocks (see hashtree.go).
+*/
+
+import (
+	"io"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+const (
+	scrubDefaultInterval = 86400
+
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+	ioprioWhoProcess = 1
+)
+
+type scrubber struct {
+	rawx      *rawxService
+	repo      *chunkRepository
+	bandwidth *tokenBucket
+	interval  time.Duration
+}
+
+// Builds a scrubber reading at most `bandwidth` bytes per second, then
+// waiting for `interval` between two passes on the volume.
+func makeScrubber(rawx *rawxService, bandwidth int, interval time.Duration) *scrubber {
+	return &scrubber{
+		rawx:      rawx,
+		repo:      rawx.repo.(*chunkRepository),
+		bandwidth: makeTokenBucket(float64(bandwidth), float64(bandwidth)),
+		interval:  interval,
+	}
+}
+
+func (s *scrubber) Start() {
+	go func() {
+		// The IO priority is a property of the thread
+		runtime.LockOSThread()
+		_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0,
+			ioprioClassIdle<<ioprioClassShift)
+		if errno != 0 {
+			LogWarning("Scrubber IO priority not lowered: %v", errno)
+		}
+		for {
+			s.pass(&s.repo.sub)
+			if s.repo.cold != nil {
+				s.pass(s.repo.cold)
+			}
+			time.Sleep(s.interval)
+		}
+	}()
+}
+
+func (s *scrubber) pass(repo *fileRepository) {
+	var count, corrupted uint64
+	err := repo.walkAll(func(name, relPath string, fi os.FileInfo) error {
+		switch err := s.scrub(repo, name); err {
+		case nil:
+			count++
+		case errCorruptedChunk:
+			corrupted++
+		default:
+			if !os.IsNotExist(err) {
+				LogWarning("Chunk %s not scrubbed: %v", name, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		LogWarning("Scrubbing error on %s: %v", repo.root, err)
+	}
+	LogInfo("Scrubbed %s: %d chunks verified, %d corrupted", repo.root,
+		count, corrupted)
+}
+
+// Verifies a single chunk, only the size of the chunks without a MD5
+func (s *scrubber) scrub(repo *fileRepository, name string) error {
+	r, err := repo.get(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if offloadedKey(r) != "" {
+		// Only the stub is on the volume
+		return nil
+	}
+	// Don't evict the hot data from the page cache
+	defer syscall.Fadvise(int(r.File().Fd()), 0, 0, syscall.FADV_DONTNEED)
+
+	rr := rawxRequest{rawx: s.rawx, chunkID: name}
+	if err = rr.chunk.loadAttr(r, name); err != nil {
+		return err
+	}
+	tree, err := loadHashTree(r)
+	if err != nil {
+		LogWarning("Hash tree of %s ignored: %v", name, err)
+	}
+	if tree != nil && scrubTreeBlocks > 0 && rr.chunk.clearSeekable() {
+		return s.scrubBlocks(&rr, r, tree)
+	}
+	in, filter, err := rr.getChunkReader(r, rr.chunk.size, rangeInfo{})
+	if filter != nil {
+		defer filter.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	h, err := rr.chunk.newHash()
+	if err != nil {
+		return err
+	}
+	var sink io.Writer = h
+	var th *treeHasher
+	if tree != nil {
+		th = makeTreeHasher(tree.blockSize)
+		sink = io.MultiWriter(h, th)
+	}
+	n, err := copyPooled(sink, &throttledReader{r: in, bandwidth: s.bandwidth})
+	atomic.AddUint64(&counters.ScrubBytes, uint64(n))
+	if err != nil && err != errCorruptedSegment {
+		return err
+	}
+	atomic.AddUint64(&counters.ScrubChunks, 1)
+	reason := rr.checkIntegrity(n, h.Sum(nil), err)
+	if reason == "" && th != nil {
+		if i := tree.mismatch(th.sum()); i >= 0 {
+			reason = badBlockReason(int64(i))
+		}
+	}
+	if reason != "" {
+		rr.reportCorruption(reason)
+		return errCorruptedChunk
+	}
+	return nil
+}
+
+// Verifies only some blocks of a sealed chunk
+func (s *scrubber) scrubBlocks(rr *rawxRequest, r fileReader, tree *hashTree) error {
+	blocks := tree.scrubbedBlocks()
+	if int64(len(tree.leaves)) != (rr.chunk.size+tree.blockSize-1)/tree.blockSize {
+		rr.reportCorruption(quarantineTruncated)
+		return errCorruptedChunk
+	}
+	for _, i := range blocks {
+		n, err := rr.verifyBlock(r, tree, int64(i), s.bandwidth)
+		atomic.AddUint64(&counters.ScrubBytes, uint64(n))
+		if err != nil {
+			return err
+		}
+	}
+	atomic.AddUint64(&counters.ScrubChunks, 1)
+	atomic.AddUint64(&counters.ScrubBlocks, uint64(len(blocks)))
+	return nil
+}
+
+type throttledReader struct {
+	r         io.Reader
+	bandwidth *tokenBucket
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p)
+	if n > 0 {
+		tr.bandwidth.wait(float64(n))
+	}
+	return n, err
+}
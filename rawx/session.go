@@ -0,0 +1,395 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The upload sessions, so that a network blip in the middle of the upload of
+a large chunk doesn't restart it from zero. The session is opened with the
+headers of a PUT, then the data is sent by ranges, each one written at its
+offset so that sending it again is harmless:
+
+	POST /session/<CHUNKID>                  opens the session, its ID is
+	                                         replied in X-oio-Upload-Session
+	PUT /session/<CHUNKID>/<SESSION>         writes the Content-Range sent
+	HEAD /session/<CHUNKID>/<SESSION>        tells in X-oio-Upload-Offset
+	                                         how many bytes were received
+	POST /session/<CHUNKID>/<SESSION>        commits the chunk, with its
+	                                         hash in X-oio-Chunk-Meta-Chunk-Hash
+	DELETE /session/<CHUNKID>/<SESSION>      aborts the upload
+
+A range must start within the bytes already received, so that the chunk
+has no gap, and must not go beyond the size announced upon the opening nor
+the largest size of the chunk (see maxsize.go). The chunks uploaded by
+sessions are neither compressed nor encrypted, and the sessions idle for
+session_timeout seconds are aborted. At most session_max sessions are open
+at once on the service. The sessions don't survive a restart of the service.
+*/
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+const (
+	sessionPathPrefix = "/session/"
+	sessionIDSize     = 16
+)
+
+var (
+	sessionTimeout = 3600 * time.Second
+	sessionMax     = 1024
+)
+
+type uploadSession struct {
+	lock     sync.Mutex
+	id       string
+	chunk    chunkInfo
+	out      *realFileWriter
+	received int64
+	timer    *time.Timer
+}
+
+var sessionLock sync.Mutex
+var sessions = make(map[string]*uploadSession)
+
+func sessionKey(rawx *rawxService, chunkID, id string) string {
+	return rawx.id + "/" + chunkID + "/" + id
+}
+
+// Removes the session from the registry, so that it is ended only once
+func takeSession(key string) *uploadSession {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	s := sessions[key]
+	delete(sessions, key)
+	return s
+}
+
+func lookupSession(key string) *uploadSession {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	return sessions[key]
+}
+
+func (s *uploadSession) abort() {
+	s.timer.Stop()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_ = s.out.abort()
+}
+
+// Writes the data at its offset in the chunk file
+func (fw *realFileWriter) writeAt(buffer []byte, offset int64) (int, error) {
+	fw.throttle(len(buffer))
+	n, err := fw.f.WriteAt(buffer, fw.base+offset)
+	if end := offset + int64(n); end > fw.written {
+		fw.written = end
+	}
+	return n, err
+}
+
+// Computes the hash of the data received, read back from the file
+func (fw *realFileWriter) digest(h hash.Hash) (string, error) {
+	fd, err := syscall.Openat(fw.repo.rootFd, fw.pathTemp, openFlagsROnly, 0)
+	if err != nil {
+		return "", err
+	}
+	f := os.NewFile(uintptr(fd), fw.pathTemp)
+	defer f.Close()
+	if _, err = io.Copy(h, io.NewSectionReader(f, fw.base, fw.written)); err != nil {
+		return "", err
+	}
+	return strings.ToUpper(hex.EncodeToString(h.Sum(nil))), nil
+}
+
+func (rr *rawxRequest) openSession(chunkID string) {
+	if err := rr.chunk.retrieveHeaders(&rr.req.Header, chunkID); err != nil {
+		rr.replyError(err)
+		return
+	}
+	size, err := strconv.ParseInt(rr.chunk.ChunkSize, 10, 64)
+	if err != nil {
+		size = -1
+	}
+	if max := rr.chunk.maxSize(); max > 0 && size > max {
+		atomic.AddUint64(&counters.ChunksTooLarge, 1)
+		rr.replyError(errChunkTooLarge)
+		return
+	}
+	if idx := rr.quotas(); idx != nil {
+		if err = idx.check(rr.chunk.ContainerID, size); err != nil {
+			rr.replyError(err)
+			return
+		}
+	}
+
+	out, err := rr.rawx.repo.put(rr.chunk.ChunkID)
+	if err != nil {
+		rr.replyError(err)
+		return
+	}
+	fw, ok := out.(*realFileWriter)
+	if !ok {
+		// Packed in a slab, the chunk isn't written at any offset
+		_ = out.abort()
+		rr.replyCode(http.StatusNotImplemented)
+		return
+	}
+	if fw.direct != nil {
+		// The ranges aren't aligned
+		fw.releaseDirect()
+		flags, err := syscall.FcntlInt(fw.f.Fd(), syscall.F_GETFL, 0)
+		if err == nil {
+			_, err = syscall.FcntlInt(fw.f.Fd(), syscall.F_SETFL, flags&^syscall.O_DIRECT)
+		}
+		if err != nil {
+			_ = fw.abort()
+			rr.replyError(err)
+			return
+		}
+	}
+	if size > 0 {
+		fw.Extend(size)
+	}
+
+	raw := make([]byte, sessionIDSize)
+	if _, err = rand.Read(raw); err != nil {
+		_ = fw.abort()
+		rr.replyError(err)
+		return
+	}
+	s := &uploadSession{id: hex.EncodeToString(raw), chunk: rr.chunk, out: fw}
+	key := sessionKey(rr.rawx, rr.chunk.ChunkID, s.id)
+	sessionLock.Lock()
+	if sessionMax > 0 && len(sessions) >= sessionMax {
+		sessionLock.Unlock()
+		_ = fw.abort()
+		rr.replyError(errTooBusy)
+		return
+	}
+	s.timer = time.AfterFunc(sessionTimeout, func() {
+		if takeSession(key) == s {
+			LogWarning("Upload session %s of %s expired", s.id, s.chunk.ChunkID)
+			s.abort()
+		}
+	})
+	sessions[key] = s
+	sessionLock.Unlock()
+
+	rr.rep.Header().Set(HeaderNameUploadSession, s.id)
+	rr.replyCode(http.StatusCreated)
+}
+
+// Parses "bytes <first>-<last>/<total or *>"
+func parseContentRange(v string) (int64, int64, error) {
+	var first, last int64
+	var total string
+	if n, err := fmt.Sscanf(v, "bytes %d-%d/%s", &first, &last, &total); err != nil || n != 3 {
+		return 0, 0, errInvalidHeader
+	}
+	if first < 0 || last < first {
+		return 0, 0, errInvalidHeader
+	}
+	return first, last - first + 1, nil
+}
+
+func (s *uploadSession) write(rr *rawxRequest) error {
+	offset, size, err := parseContentRange(rr.req.Header.Get("Content-Range"))
+	if err != nil {
+		return err
+	}
+	if rr.req.ContentLength >= 0 && rr.req.ContentLength != size {
+		return errInvalidHeader
+	}
+	end := offset + size
+	if declared, err := strconv.ParseInt(s.chunk.ChunkSize, 10, 64); err == nil && declared > 0 && end > declared {
+		return errInvalidRange
+	}
+	if max := s.chunk.maxSize(); max > 0 && end > max {
+		atomic.AddUint64(&counters.ChunksTooLarge, 1)
+		return errChunkTooLarge
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if offset > s.received {
+		return errInvalidRange
+	}
+	// The chunk grows, the volume must have room for it
+	if end > s.received {
+		if err = s.out.repo.checkSpace(); err != nil {
+			return err
+		}
+	}
+	s.timer.Reset(sessionTimeout)
+
+	buffer := getBuffer(rr.rawx.bufferSize)
+	defer putBuffer(buffer)
+	in := io.LimitReader(rr.req.Body, size)
+	at := offset
+	for {
+		n, er := in.Read(buffer)
+		if n > 0 {
+			if _, ew := s.out.writeAt(buffer[:n], at); ew != nil {
+				return ew
+			}
+			at += int64(n)
+			rr.bytesIn += uint64(n)
+			// Only the bytes actually written are received
+			if at > s.received {
+				s.received = at
+			}
+		}
+		if er == io.EOF {
+			break
+		} else if er != nil {
+			return er
+		}
+	}
+	if at != end {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func (s *uploadSession) commit(rr *rawxRequest) error {
+	s.timer.Stop()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	h, err := s.chunk.newHash()
+	if err != nil {
+		_ = s.out.abort()
+		return err
+	}
+	hash, err := s.out.digest(h)
+	if err == nil {
+		// The final hash is told upon the commit
+		ul := uploadInfo{hash: hash, length: s.received}
+		err = s.chunk.retrieveTrailers(&rr.req.Header, &ul)
+	}
+	if err == nil {
+		err = s.chunk.saveAttr(s.out)
+	}
+	if err != nil {
+		_ = s.out.abort()
+		return err
+	}
+	return s.out.commit()
+}
+
+func (rr *rawxRequest) serveSession(rep http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, sessionPathPrefix)
+	chunkID, id := path, ""
+	if idx := strings.IndexByte(path, '/'); idx >= 0 {
+		chunkID, id = path[:idx], path[idx+1:]
+	}
+	if !isHexaString(chunkID, 64) {
+		rr.drain()
+		rr.replyError(errInvalidChunkID)
+		return
+	}
+	chunkID = strings.ToUpper(chunkID)
+	key := sessionKey(rr.rawx, chunkID, id)
+
+	var spent uint64
+	switch {
+	case req.Method == "POST" && id == "":
+		if err := rr.drain(); err != nil {
+			rr.replyError(err)
+		} else {
+			rr.openSession(chunkID)
+		}
+		spent = IncrementStatReqOther(rr)
+	case req.Method == "PUT":
+		if s := lookupSession(key); s == nil {
+			rr.drain()
+			rr.replyError(os.ErrNotExist)
+		} else if err := s.write(rr); err != nil {
+			rr.req.Close = true
+			rr.replyError(err)
+		} else {
+			rr.rep.Header().Set(HeaderNameUploadOffset, strconv.FormatInt(s.received, 10))
+			rr.replyCode(http.StatusNoContent)
+		}
+		spent = IncrementStatReqPut(rr)
+	case req.Method == "HEAD":
+		rr.drain()
+		if s := lookupSession(key); s == nil {
+			rr.replyError(os.ErrNotExist)
+		} else {
+			s.lock.Lock()
+			received := s.received
+			s.lock.Unlock()
+			rr.rep.Header().Set(HeaderNameUploadOffset, strconv.FormatInt(received, 10))
+			rr.replyCode(http.StatusNoContent)
+		}
+		spent = IncrementStatReqHead(rr)
+	case req.Method == "POST":
+		rr.drain()
+		if s := takeSession(key); s == nil {
+			rr.replyError(os.ErrNotExist)
+		} else if err := s.commit(rr); err != nil {
+			LogError("Upload session %s of %s failed: %v", id, chunkID, err)
+			rr.replyError(err)
+		} else {
+			rr.accountChunk(&s.chunk, 1)
+			s.chunk.fillHeadersLight(rr.rep.Header())
+			rr.replyCode(http.StatusCreated)
+			NotifyNew(rr.rawx, rr.reqid, &s.chunk)
+		}
+		spent = IncrementStatReqOther(rr)
+	case req.Method == "DELETE":
+		rr.drain()
+		if s := takeSession(key); s == nil {
+			rr.replyError(os.ErrNotExist)
+		} else {
+			s.abort()
+			rr.replyCode(http.StatusNoContent)
+		}
+		spent = IncrementStatReqOther(rr)
+	default:
+		rr.drain()
+		rr.replyCode(http.StatusMethodNotAllowed)
+		spent = IncrementStatReqOther(rr)
+	}
+	if isVerbose() {
+		LogHttp(AccessLogEvent{
+			status:    rr.status,
+			timeSpent: spent,
+			bytesIn:   rr.bytesIn,
+			bytesOut:  rr.bytesOut,
+			method:    rr.req.Method,
+			local:     rr.rawx.url,
+			peer:      rr.req.RemoteAddr,
+			path:      rr.req.URL.Path,
+			reqId:     rr.reqid,
+		})
+	}
+}
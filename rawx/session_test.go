@@ -0,0 +1,146 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// Sets the headers of the upload of the chunk
+func setTestChunkHeaders(h http.Header, chunk *chunkInfo) {
+	h.Set(HeaderNameFullpath, chunk.ContentFullpath)
+	h.Set(HeaderNameContentStgPol, chunk.ContentStgPol)
+	h.Set(HeaderNameContentChunkMethod, chunk.ContentChunkMethod)
+	h.Set(HeaderNameChunkPosition, chunk.ChunkPosition)
+}
+
+func serveTestSession(rawx *rawxService, method, path string, body []byte, headers http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+	rep := httptest.NewRecorder()
+	rr := &rawxRequest{rawx: rawx, req: req, rep: rep}
+	rr.serveSession(rep, req)
+	return rep
+}
+
+func TestUploadSession(t *testing.T) {
+	defer func(max int) { sessionMax = max }(sessionMax)
+	defer func(max int64) { maxChunkSize = max }(maxChunkSize)
+	sessionMax, maxChunkSize = 0, 0
+
+	repo := makeTestRepository(t, optionsMap{})
+	inner := &recordNotifier{}
+	rawx := &rawxService{id: "RAWX", url: "127.0.0.1:6200", repo: repo, notifier: inner,
+		bufferSize: uploadBufferDefault * 1024}
+	data := bytes.Repeat([]byte("0123456789"), 10)
+	chunk := makeTestChunk(1, data)
+	// Beyond the data, the ranges are padded
+	padded := append(append([]byte{}, data...), make([]byte, len(data))...)
+
+	open := func(chunk *chunkInfo, size string) (string, int) {
+		h := make(http.Header)
+		setTestChunkHeaders(h, chunk)
+		if size != "" {
+			h.Set(HeaderNameChunkSize, size)
+		}
+		rep := serveTestSession(rawx, "POST", sessionPathPrefix+chunk.ChunkID, nil, h)
+		return sessionPathPrefix + chunk.ChunkID + "/" + rep.Header().Get(HeaderNameUploadSession), rep.Code
+	}
+	write := func(path string, first, last int) int {
+		h := make(http.Header)
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", first, last))
+		return serveTestSession(rawx, "PUT", path, padded[first:last+1], h).Code
+	}
+
+	path, code := open(&chunk, "100")
+	if code != http.StatusCreated {
+		t.Fatalf("session not opened: %d", code)
+	}
+	steps := []struct {
+		name        string
+		first, last int
+		status      int
+	}{
+		{"first range", 0, 49, http.StatusNoContent},
+		{"gap", 60, 69, http.StatusRequestedRangeNotSatisfiable},
+		{"beyond the size announced", 90, 109, http.StatusRequestedRangeNotSatisfiable},
+		{"range sent again", 40, 59, http.StatusNoContent},
+		{"last range", 60, 99, http.StatusNoContent},
+	}
+	for _, step := range steps {
+		if status := write(path, step.first, step.last); status != step.status {
+			t.Errorf("%s: status %d, expected %d", step.name, status, step.status)
+		}
+	}
+	rep := serveTestSession(rawx, "HEAD", path, nil, nil)
+	if offset := rep.Header().Get(HeaderNameUploadOffset); offset != strconv.Itoa(len(data)) {
+		t.Errorf("offset %s, expected %d", offset, len(data))
+	}
+
+	h := make(http.Header)
+	h.Set(HeaderNameChunkChecksum, chunk.ChunkHash)
+	if rep = serveTestSession(rawx, "POST", path, nil, h); rep.Code != http.StatusCreated {
+		t.Fatalf("session not committed: %d", rep.Code)
+	}
+	if got, info := getTestChunk(t, repo, chunk.ChunkID); !bytes.Equal(got, data) || info.ChunkHash != chunk.ChunkHash {
+		t.Errorf("chunk read back %q, hash %s", got, info.ChunkHash)
+	}
+	if inner.count() != 1 {
+		t.Errorf("%d events emitted, expected 1", inner.count())
+	}
+	if rep = serveTestSession(rawx, "HEAD", path, nil, nil); rep.Code != http.StatusNotFound {
+		t.Errorf("session still open after its commit: %d", rep.Code)
+	}
+
+	// The largest size of the chunks applies, announced or not
+	maxChunkSize = 64
+	other := makeTestChunk(2, data)
+	if _, code = open(&other, "100"); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("too large chunk announced: %d", code)
+	}
+	if path, code = open(&other, ""); code != http.StatusCreated {
+		t.Fatalf("session not opened: %d", code)
+	}
+	if status := write(path, 0, 99); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("too large range: %d", status)
+	}
+	serveTestSession(rawx, "DELETE", path, nil, nil)
+
+	// Beyond the open sessions allowed, the service is busy
+	maxChunkSize, sessionMax = 0, 1
+	if path, code = open(&other, ""); code != http.StatusCreated {
+		t.Fatalf("session not opened: %d", code)
+	}
+	third := makeTestChunk(3, data)
+	if _, code = open(&third, ""); code != http.StatusServiceUnavailable {
+		t.Errorf("session beyond the limit: %d", code)
+	}
+	if rep = serveTestSession(rawx, "DELETE", path, nil, nil); rep.Code != http.StatusNoContent {
+		t.Errorf("session not aborted: %d", rep.Code)
+	}
+	if path, code = open(&third, ""); code != http.StatusCreated {
+		t.Errorf("session refused once another one ended: %d", code)
+	}
+	serveTestSession(rawx, "DELETE", path, nil, nil)
+}
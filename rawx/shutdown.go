@@ -0,0 +1,73 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The graceful shutdown, upon SIGTERM or SIGINT: the listener is closed at
+once, the idle connections too, and the requests in progress are given
+shutdown_timeout seconds to finish, so that the uploads aren't cut in the
+middle. Only then the events queued are delivered and the service exits.
+The connections still active after the deadline, or upon a second signal,
+are closed.
+*/
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const shutdownDefaultTimeout = 30
+
+var shutdownTimeout = shutdownDefaultTimeout * time.Second
+
+type drainer struct {
+	srv     *http.Server
+	started int32
+	done    chan struct{}
+}
+
+func makeDrainer(srv *http.Server) *drainer {
+	return &drainer{srv: srv, done: make(chan struct{})}
+}
+
+// Starts draining the connections, or cuts them when already draining
+func (d *drainer) shutdown() {
+	if !atomic.CompareAndSwapInt32(&d.started, 0, 1) {
+		LogWarning("Shutdown forced, the active connections are closed")
+		_ = d.srv.Close()
+		return
+	}
+	LogInfo("Shutting down, the requests in progress have %v to finish", shutdownTimeout)
+	go func() {
+		defer close(d.done)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := d.srv.Shutdown(ctx); err != nil {
+			LogWarning("graceful shutdown error: %v", err)
+			_ = d.srv.Close()
+		}
+	}()
+}
+
+// Waits for the requests in progress, if the shutdown started
+func (d *drainer) wait() {
+	if atomic.LoadInt32(&d.started) != 0 {
+		<-d.done
+	}
+}
@@ -0,0 +1,117 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The sidecar store of the attributes, for the filesystems without extended
+attributes, or with too little room for them. The attributes of each chunk
+are saved in a small JSON file next to it, with the ".meta" suffix:
+
+	{"user.grid.chunk.hash":"...", "user.grid.chunk.size":"...", ...}
+
+The sidecar of a chunk is written before the chunk gets its final name, so
+that a chunk is never seen without its attributes. The attributes of the
+volume itself live in the ".volume.meta" file at the root of the volume.
+*/
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+const (
+	attrStoreXattr   = "xattr"
+	attrStoreSidecar = "sidecar"
+
+	metaSuffix = ".meta"
+)
+
+type sidecar map[string]string
+
+func (fr *fileRepository) loadSidecar(relPath string) (sidecar, error) {
+	fd, err := syscall.Openat(fr.rootFd, relPath+metaSuffix, openFlagsROnly, 0)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), relPath+metaSuffix)
+	defer f.Close()
+	encoded, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	meta := make(sidecar)
+	if err = json.Unmarshal(encoded, &meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// Replaces the sidecar atomically
+func (fr *fileRepository) saveSidecar(relPath string, meta sidecar) error {
+	encoded, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	pathTemp := relPath + metaSuffix + ".pending"
+	fd, err := syscall.Openat(fr.rootFd, pathTemp,
+		syscall.O_CREAT|syscall.O_TRUNC|openFlagsWOnly, fr.putOpenMode)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), pathTemp)
+	_, err = f.Write(encoded)
+	if err == nil && fr.syncFile {
+		err = syscall.Fdatasync(fd)
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = syscall.Renameat(fr.rootFd, pathTemp, fr.rootFd, relPath+metaSuffix)
+	}
+	if err != nil {
+		_ = syscall.Unlinkat(fr.rootFd, pathTemp, 0)
+	}
+	return err
+}
+
+func (fr *fileRepository) removeSidecar(relPath string) error {
+	err := syscall.Unlinkat(fr.rootFd, relPath+metaSuffix, 0)
+	if err == syscall.ENOENT {
+		return nil
+	}
+	return err
+}
+
+// Reads an attribute with the semantics of getxattr(): the size of the
+// value is returned when no buffer is given.
+func (meta sidecar) get(key string, value []byte) (int, error) {
+	v, ok := meta[key]
+	if !ok {
+		return 0, syscall.ENODATA
+	}
+	if len(value) == 0 {
+		return len(v), nil
+	}
+	if len(value) < len(v) {
+		return 0, syscall.ERANGE
+	}
+	return copy(value, v), nil
+}
@@ -0,0 +1,756 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The small chunks might be packed into slabs, to spare an inode (and its
+attributes) per chunk on the volumes holding many tiny chunks. The chunks of
+at most slab_max_chunk_size bytes are appended, with their attributes, to
+the current slab of the volume: a file of the ".slabs" directory, rotated
+every slab_size bytes. Each record of a slab describes itself:
+
+	"SLB1" | header length (u32) | data length (u64) | header (JSON) | data
+
+The header holds the name of the chunk, its attributes and its time, or
+tells the chunk has been deleted. The deletion of a chunk is recorded in the
+slab of the chunk, so that each slab can be read on its own: the index of
+the chunks is kept in memory, rebuilt from the slabs upon startup.
+
+The slabs are append-only, the room of the deleted (or rewritten) chunks is
+only reclaimed by the compaction: the live chunks of the slabs with at least
+slab_compact_ratio percents of dead space are moved to the current slab,
+then the old slab is removed. The chunks packed in slabs aren't trashed upon
+deletion, nor moved by the tiering or the offload.
+*/
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+const (
+	slabDir                    = ".slabs"
+	slabSuffix                 = ".slab"
+	slabMagic                  = "SLB1"
+	slabPrefixSize             = 16
+	slabDefaultSize            = 64 * 1024 * 1024
+	slabDefaultCompactRatio    = 50
+	slabDefaultCompactInterval = 3600
+)
+
+var errSlabRecord = errors.New("Invalid slab record")
+
+type slabHeader struct {
+	Name  string  `json:"name"`
+	Attrs sidecar `json:"attrs,omitempty"`
+	Time  int64   `json:"time,omitempty"`
+	Del   bool    `json:"del,omitempty"`
+}
+
+// Where a chunk lives. The attributes are never modified, a new entry is
+// built when the chunk is rewritten.
+type slabEntry struct {
+	slab uint32
+	// The whole record
+	record int64
+	size   int64
+	// The data of the chunk
+	offset int64
+	length int64
+	attrs  sidecar
+	mtime  int64
+}
+
+type slabFile struct {
+	size int64
+	dead int64
+}
+
+type slabStore struct {
+	lock         sync.Mutex
+	repo         *fileRepository
+	maxChunkSize int64
+	slabSize     int64
+	compactRatio int64
+	index        map[string]*slabEntry
+	slabs        map[uint32]*slabFile
+	// The slab where the records are appended, and its descriptor (-1 when
+	// not open yet).
+	current uint32
+	fd      int
+}
+
+func slabPath(id uint32) string {
+	return fmt.Sprintf("%s/%08X%s", slabDir, id, slabSuffix)
+}
+
+// Loads the slabs of the volume, if any
+func openSlabStore(fr *fileRepository, maxChunkSize, slabSize, compactRatio int64) (*slabStore, error) {
+	s := &slabStore{
+		repo:         fr,
+		maxChunkSize: maxChunkSize,
+		slabSize:     slabSize,
+		compactRatio: compactRatio,
+		index:        make(map[string]*slabEntry),
+		slabs:        make(map[uint32]*slabFile),
+		fd:           -1,
+	}
+	if err := syscall.Mkdirat(fr.rootFd, slabDir, uint32(fr.putMkdirMode)); err != nil && err != syscall.EEXIST {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(fr.root + "/" + slabDir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint32
+	for _, fi := range entries {
+		name := fi.Name()
+		if !strings.HasSuffix(name, slabSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, slabSuffix), 16, 32)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, uint32(id))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		if err = s.load(id); err != nil {
+			return nil, err
+		}
+		s.current = id
+	}
+	if len(ids) > 0 {
+		LogInfo("%d chunks in %d slabs of %s", len(s.index), len(ids), fr.root)
+	}
+	return s, nil
+}
+
+// Reads the records of the slab, in order, into the index. A record
+// partially written is truncated.
+func (s *slabStore) load(id uint32) error {
+	path := slabPath(id)
+	fd, err := syscall.Openat(s.repo.rootFd, path, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), path)
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	s.slabs[id] = &slabFile{}
+	var offset int64
+	for offset < fi.Size() {
+		h, e, err := readSlabRecord(f, offset, fi.Size())
+		if err != nil {
+			LogWarning("Slab %s/%s truncated at %d: %v", s.repo.root, path, offset, err)
+			if err = f.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		e.slab = id
+		s.slabs[id].size = offset + e.size
+		s.apply(h, e)
+		offset += e.size
+	}
+	return nil
+}
+
+func readSlabRecord(f *os.File, offset, end int64) (*slabHeader, *slabEntry, error) {
+	prefix := make([]byte, slabPrefixSize)
+	if _, err := f.ReadAt(prefix, offset); err != nil {
+		return nil, nil, err
+	}
+	if string(prefix[:4]) != slabMagic {
+		return nil, nil, errSlabRecord
+	}
+	headerLen := int64(binary.LittleEndian.Uint32(prefix[4:]))
+	dataLen := int64(binary.LittleEndian.Uint64(prefix[8:]))
+	if dataLen < 0 || offset+slabPrefixSize+headerLen+dataLen > end {
+		return nil, nil, errSlabRecord
+	}
+	header := make([]byte, headerLen)
+	if _, err := f.ReadAt(header, offset+slabPrefixSize); err != nil {
+		return nil, nil, err
+	}
+	h := new(slabHeader)
+	if err := json.Unmarshal(header, h); err != nil || h.Name == "" {
+		return nil, nil, errSlabRecord
+	}
+	e := &slabEntry{
+		record: offset,
+		size:   slabPrefixSize + headerLen + dataLen,
+		offset: offset + slabPrefixSize + headerLen,
+		length: dataLen,
+		attrs:  h.Attrs,
+		mtime:  h.Time,
+	}
+	return h, e, nil
+}
+
+// Applies a record to the index, in the order of the slabs then of their
+// records. A deletion only applies to the chunk in the same slab.
+func (s *slabStore) apply(h *slabHeader, e *slabEntry) {
+	if h.Del {
+		s.slabs[e.slab].dead += e.size
+		if old, ok := s.index[h.Name]; ok && old.slab == e.slab {
+			s.slabs[old.slab].dead += old.size
+			delete(s.index, h.Name)
+		}
+		return
+	}
+	if old, ok := s.index[h.Name]; ok {
+		s.slabs[old.slab].dead += old.size
+	}
+	s.index[h.Name] = e
+}
+
+func encodeSlabRecord(h *slabHeader, data []byte) ([]byte, error) {
+	header, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, slabPrefixSize, slabPrefixSize+len(header)+len(data))
+	copy(buf, slabMagic)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(header)))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(len(data)))
+	buf = append(buf, header...)
+	return append(buf, data...), nil
+}
+
+// Appends a record to the slab, through the given descriptor
+func (s *slabStore) appendTo(id uint32, fd int, h *slabHeader, data []byte) error {
+	sf := s.slabs[id]
+	buf, err := encodeSlabRecord(h, data)
+	if err != nil {
+		return err
+	}
+	// At the known end, overwriting the remains of a failed append
+	n, err := syscall.Pwrite(fd, buf, sf.size)
+	if err == nil && n < len(buf) {
+		err = io.ErrShortWrite
+	}
+	if err == nil && s.repo.syncFile {
+		err = syscall.Fdatasync(fd)
+	}
+	if err != nil {
+		return err
+	}
+	e := &slabEntry{
+		slab:   id,
+		record: sf.size,
+		size:   int64(len(buf)),
+		offset: sf.size + int64(len(buf)-len(data)),
+		length: int64(len(data)),
+		attrs:  h.Attrs,
+		mtime:  h.Time,
+	}
+	sf.size += e.size
+	s.apply(h, e)
+	return nil
+}
+
+// Appends a record to the current slab, a new one when the current one
+// is full.
+func (s *slabStore) appendCurrent(h *slabHeader, data []byte) error {
+	if sf, ok := s.slabs[s.current]; ok && sf.size > 0 && sf.size+int64(len(data)) > s.slabSize {
+		if s.fd >= 0 {
+			syscall.Close(s.fd)
+			s.fd = -1
+		}
+		s.current++
+	}
+	if s.fd < 0 {
+		fd, err := syscall.Openat(s.repo.rootFd, slabPath(s.current),
+			syscall.O_CREAT|syscall.O_WRONLY|syscall.O_CLOEXEC, s.repo.putOpenMode)
+		if err != nil {
+			return err
+		}
+		s.fd = fd
+		if _, ok := s.slabs[s.current]; !ok {
+			s.slabs[s.current] = &slabFile{}
+			if s.repo.syncDir {
+				_ = s.repo.syncRelDir(slabDir)
+			}
+		}
+	}
+	return s.appendTo(s.current, s.fd, h, data)
+}
+
+// Records the deletion of the chunk, in its slab
+func (s *slabStore) tombstone(name string, e *slabEntry) error {
+	h := &slabHeader{Name: name, Del: true}
+	if e.slab == s.current && s.fd >= 0 {
+		return s.appendTo(e.slab, s.fd, h, nil)
+	}
+	fd, err := syscall.Openat(s.repo.rootFd, slabPath(e.slab), syscall.O_WRONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	return s.appendTo(e.slab, fd, h, nil)
+}
+
+func (s *slabStore) read(e *slabEntry) ([]byte, error) {
+	fd, err := syscall.Openat(s.repo.rootFd, slabPath(e.slab), openFlagsROnly, 0)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), slabPath(e.slab))
+	defer f.Close()
+	data := make([]byte, e.length)
+	_, err = f.ReadAt(data, e.offset)
+	return data, err
+}
+
+// Appends a new version of the chunk to the current slab, the former one is
+// then dead.
+func (s *slabStore) rewrite(name string, e *slabEntry, attrs sidecar) error {
+	data, err := s.read(e)
+	if err != nil {
+		return err
+	}
+	return s.appendCurrent(&slabHeader{Name: name, Attrs: attrs, Time: e.mtime}, data)
+}
+
+func (s *slabStore) lookup(name string) *slabEntry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.index[name]
+}
+
+func (s *slabStore) put(name string, attrs sidecar, data []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.index[name]; ok {
+		return os.ErrExist
+	}
+	h := &slabHeader{Name: name, Attrs: attrs, Time: time.Now().Unix()}
+	if err := s.appendCurrent(h, data); err != nil {
+		return err
+	}
+	atomic.AddUint64(&counters.SlabPacked, 1)
+	return nil
+}
+
+func (s *slabStore) del(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, ok := s.index[name]
+	if !ok {
+		return os.ErrNotExist
+	}
+	return s.tombstone(name, e)
+}
+
+// Rewrites the chunk with its attributes modified
+func (s *slabStore) update(name string, modify func(attrs sidecar)) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, ok := s.index[name]
+	if !ok {
+		return os.ErrNotExist
+	}
+	attrs := make(sidecar, len(e.attrs))
+	for k, v := range e.attrs {
+		attrs[k] = v
+	}
+	modify(attrs)
+	if err := s.rewrite(name, e, attrs); err != nil {
+		return err
+	}
+	if e.slab != s.current {
+		return s.tombstone(name, e)
+	}
+	return nil
+}
+
+// Extracts the chunk into the quarantine directory, with its attributes
+func (s *slabStore) quarantine(name, reason string) error {
+	e := s.lookup(name)
+	if e == nil {
+		return os.ErrNotExist
+	}
+	data, err := s.read(e)
+	if err != nil {
+		return err
+	}
+	meta := make(sidecar, len(e.attrs)+2)
+	for k, v := range e.attrs {
+		meta[k] = v
+	}
+	meta[AttrNameQuarantineReason] = reason
+	meta[AttrNameQuarantineTime] = strconv.FormatInt(time.Now().Unix(), 10)
+	dest := quarantineDir + "/" + name
+	if err = s.repo.saveSidecar(dest, meta); err != nil {
+		return err
+	}
+	fd, err := syscall.Openat(s.repo.rootFd, dest,
+		syscall.O_CREAT|syscall.O_TRUNC|openFlagsWOnly, s.repo.putOpenMode)
+	if err == nil {
+		_, err = syscall.Write(fd, data)
+		syscall.Close(fd)
+	}
+	if err == nil {
+		err = s.del(name)
+	}
+	if err != nil {
+		_ = syscall.Unlinkat(s.repo.rootFd, dest, 0)
+		_ = s.repo.removeSidecar(dest)
+	}
+	return err
+}
+
+func (s *slabStore) startCompactor(interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			s.compact()
+		}
+	}()
+}
+
+func (s *slabStore) compact() {
+	s.lock.Lock()
+	var victims []uint32
+	for id, sf := range s.slabs {
+		if id != s.current && sf.dead*100 >= sf.size*s.compactRatio {
+			victims = append(victims, id)
+		}
+	}
+	s.lock.Unlock()
+	for _, id := range victims {
+		if err := s.compactSlab(id); err != nil {
+			LogWarning("Slab %s/%s not compacted: %v", s.repo.root, slabPath(id), err)
+		}
+	}
+}
+
+// Moves the live chunks of the slab to the current one, then removes it
+func (s *slabStore) compactSlab(id uint32) error {
+	s.lock.Lock()
+	var live []string
+	for name, e := range s.index {
+		if e.slab == id {
+			live = append(live, name)
+		}
+	}
+	s.lock.Unlock()
+
+	// One chunk at a time, not to hold the uploads for too long
+	for _, name := range live {
+		s.lock.Lock()
+		var err error
+		if e, ok := s.index[name]; ok && e.slab == id {
+			err = s.rewrite(name, e, e.attrs)
+		}
+		s.lock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := syscall.Unlinkat(s.repo.rootFd, slabPath(id), 0); err != nil {
+		return err
+	}
+	LogInfo("Slab %s/%s compacted, %d chunks moved", s.repo.root, slabPath(id), len(live))
+	delete(s.slabs, id)
+	atomic.AddUint64(&counters.SlabCompactions, 1)
+	return nil
+}
+
+// A chunk packed in a slab, as seen by the walks of the volume
+type slabChunkInfo struct {
+	name  string
+	size  int64
+	mtime int64
+}
+
+func (fi *slabChunkInfo) Name() string       { return fi.name }
+func (fi *slabChunkInfo) Size() int64        { return fi.size }
+func (fi *slabChunkInfo) Mode() os.FileMode  { return 0644 }
+func (fi *slabChunkInfo) ModTime() time.Time { return time.Unix(fi.mtime, 0) }
+func (fi *slabChunkInfo) IsDir() bool        { return false }
+func (fi *slabChunkInfo) Sys() interface{}   { return nil }
+
+// Walks all the chunks of the volume, the chunks packed in slabs having an
+// empty relative path.
+func (fr *fileRepository) walkAll(hook func(name, relPath string, fi os.FileInfo) error) error {
+	if err := fr.walk(hook); err != nil || fr.slabs == nil {
+		return err
+	}
+	s := fr.slabs
+	s.lock.Lock()
+	chunks := make([]*slabChunkInfo, 0, len(s.index))
+	for name, e := range s.index {
+		chunks = append(chunks, &slabChunkInfo{name: name, size: e.length, mtime: e.mtime})
+	}
+	s.lock.Unlock()
+	for _, fi := range chunks {
+		if err := hook(fi.name, "", fi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads a chunk from its slab, the slab being positioned on the data of
+// the chunk so that File() can be served as is.
+type slabReader struct {
+	f     *os.File
+	repo  *fileRepository
+	entry *slabEntry
+	pos   int64
+}
+
+func (s *slabStore) open(e *slabEntry) (fileReader, error) {
+	fd, err := syscall.Openat(s.repo.rootFd, slabPath(e.slab), openFlagsROnly, 0)
+	if err != nil {
+		return nil, err
+	}
+	r := &slabReader{f: os.NewFile(uintptr(fd), slabPath(e.slab)), repo: s.repo, entry: e}
+	if err = r.seek(0); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *slabReader) Read(buffer []byte) (int, error) {
+	remaining := r.entry.length - r.pos
+	if remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(buffer)) > remaining {
+		buffer = buffer[:remaining]
+	}
+	n, err := r.f.Read(buffer)
+	r.pos += int64(n)
+	r.throttle(int64(n))
+	return n, err
+}
+
+func (r *slabReader) Close() error {
+	return r.f.Close()
+}
+
+func (r *slabReader) File() *os.File {
+	return r.f
+}
+
+func (r *slabReader) size() int64 {
+	return r.entry.length
+}
+
+func (r *slabReader) seek(offset int64) error {
+	_, err := r.f.Seek(r.entry.offset+offset, os.SEEK_SET)
+	r.pos = offset
+	return err
+}
+
+func (r *slabReader) getAttr(key string, value []byte) (int, error) {
+	return r.entry.attrs.get(key, value)
+}
+
+func (r *slabReader) readAhead(offset int64) int64 {
+	return 0
+}
+
+func (r *slabReader) mapping() []byte {
+	return nil
+}
+
+func (r *slabReader) throttle(n int64) bool {
+	if r.repo.readBandwidth == nil {
+		return false
+	}
+	if n > 0 {
+		r.repo.readBandwidth.wait(float64(n))
+	}
+	return true
+}
+
+// Buffers the chunk until its commit into the current slab, unless it grows
+// beyond the size of the chunks packed: it is then spilled into its own file.
+type slabWriter struct {
+	store  *slabStore
+	name   string
+	data   []byte
+	attrs  sidecar
+	extent int64
+	spill  fileWriter
+}
+
+func (s *slabStore) writer(name string) (fileWriter, error) {
+	if s.lookup(name) != nil {
+		return nil, os.ErrExist
+	}
+	return &slabWriter{store: s, name: name, attrs: make(sidecar)}, nil
+}
+
+func (w *slabWriter) setAttr(key string, value []byte) error {
+	if w.spill != nil {
+		return w.spill.setAttr(key, value)
+	}
+	w.attrs[key] = string(value)
+	return nil
+}
+
+func (w *slabWriter) Extend(size int64) {
+	w.extent = size
+	if w.spill != nil {
+		w.spill.Extend(size)
+	} else if size <= w.store.maxChunkSize && w.data == nil {
+		w.data = getBuffer(int(size))[:0]
+	}
+}
+
+func (w *slabWriter) Write(buffer []byte) (int, error) {
+	if w.spill == nil && (w.extent > w.store.maxChunkSize ||
+		int64(len(w.data)+len(buffer)) > w.store.maxChunkSize) {
+		if err := w.spillOut(); err != nil {
+			return 0, err
+		}
+	}
+	if w.spill != nil {
+		return w.spill.Write(buffer)
+	}
+	w.data = append(w.data, buffer...)
+	return len(buffer), nil
+}
+
+func (w *slabWriter) spillOut() error {
+	fr := w.store.repo
+	out, err := fr.putRelPath(fr.locate(w.name))
+	if err != nil {
+		return err
+	}
+	if w.extent > 0 {
+		out.Extend(w.extent)
+	}
+	for k, v := range w.attrs {
+		if err = out.setAttr(k, []byte(v)); err != nil {
+			out.abort()
+			return err
+		}
+	}
+	if len(w.data) > 0 {
+		if _, err = out.Write(w.data); err != nil {
+			out.abort()
+			return err
+		}
+	}
+	putBuffer(w.data)
+	w.data = nil
+	w.spill = out
+	return nil
+}
+
+func (w *slabWriter) commit() error {
+	if w.spill != nil {
+		return w.spill.commit()
+	}
+	defer putBuffer(w.data)
+	fr := w.store.repo
+	if syscall.Faccessat(fr.rootFd, fr.locate(w.name), syscall.F_OK, 0) == nil {
+		return os.ErrExist
+	}
+	if err := w.store.put(w.name, w.attrs, w.data); err != nil {
+		return err
+	}
+	return fr.syncCommitted()
+}
+
+func (w *slabWriter) abort() error {
+	if w.spill != nil {
+		return w.spill.abort()
+	}
+	putBuffer(w.data)
+	w.data = nil
+	return nil
+}
+
+// Copies a chunk packed in a slab, as another packed chunk
+type slabLinkOp struct {
+	store *slabStore
+	src   string
+	dst   string
+	attrs sidecar
+}
+
+func (s *slabStore) link(src, dst string, e *slabEntry) (linkOperation, error) {
+	if s.lookup(dst) != nil {
+		return nil, os.ErrExist
+	}
+	// As with the reflinks, the copy has its own full path
+	attrs := make(sidecar, len(e.attrs))
+	for k, v := range e.attrs {
+		if !strings.HasPrefix(k, AttrNameFullPrefix) {
+			attrs[k] = v
+		}
+	}
+	return &slabLinkOp{store: s, src: src, dst: dst, attrs: attrs}, nil
+}
+
+func (lo *slabLinkOp) setAttr(key string, value []byte) error {
+	lo.attrs[key] = string(value)
+	return nil
+}
+
+func (lo *slabLinkOp) commit() error {
+	e := lo.store.lookup(lo.src)
+	if e == nil {
+		return os.ErrNotExist
+	}
+	data, err := lo.store.read(e)
+	if err != nil {
+		return err
+	}
+	return lo.store.put(lo.dst, lo.attrs, data)
+}
+
+func (lo *slabLinkOp) rollback() error {
+	return nil
+}
+
+// Tells where the chunk is packed, nil when it has its own file
+func (fr *fileRepository) slabEntry(name string) *slabEntry {
+	if fr.slabs == nil {
+		return nil
+	}
+	return fr.slabs.lookup(name)
+}
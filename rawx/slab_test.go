@@ -0,0 +1,110 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+func TestSlabStore(t *testing.T) {
+	repo := makeTestRepository(t, optionsMap{
+		"slab_max_chunk_size": "64",
+		"slab_size":           "2048",
+	})
+	fr := &repo.sub
+
+	// The small chunks are packed, the large one has its own file
+	var chunks []chunkInfo
+	var payloads [][]byte
+	for i := 0; i < 8; i++ {
+		size := 32
+		if i == 7 {
+			size = 128
+		}
+		data := bytes.Repeat([]byte{byte('a' + i)}, size)
+		chunk := makeTestChunk(i+1, data)
+		putTestChunk(t, fr, &chunk, data)
+		chunks = append(chunks, chunk)
+		payloads = append(payloads, data)
+	}
+	for i, chunk := range chunks {
+		if packed := fr.slabEntry(chunk.ChunkID) != nil; packed != (i != 7) {
+			t.Errorf("chunk %d: packed %v", i, packed)
+		}
+		data, info := getTestChunk(t, repo, chunk.ChunkID)
+		if !bytes.Equal(data, payloads[i]) || info.ChunkHash != chunk.ChunkHash {
+			t.Errorf("chunk %d: read back %q, hash %s", i, data, info.ChunkHash)
+		}
+	}
+	if _, err := fr.put(chunks[0].ChunkID); !os.IsExist(err) {
+		t.Errorf("packed chunk overwritten: %v", err)
+	}
+
+	// The first slab only holds deleted chunks
+	first := fr.slabEntry(chunks[0].ChunkID).slab
+	var deleted []int
+	for i, chunk := range chunks[:7] {
+		if fr.slabEntry(chunk.ChunkID).slab != first {
+			continue
+		}
+		if err := repo.del(chunk.ChunkID); err != nil {
+			t.Fatalf("chunk %d not deleted: %v", i, err)
+		}
+		deleted = append(deleted, i)
+		if _, err := repo.get(chunk.ChunkID); !os.IsNotExist(err) {
+			t.Errorf("deleted chunk %d still there: %v", i, err)
+		}
+	}
+
+	// The index is rebuilt from the slabs alone
+	reopened, err := openSlabStore(fr, 64, 2048, slabDefaultCompactRatio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, chunk := range chunks {
+		live := i != 7
+		for _, d := range deleted {
+			live = live && d != i
+		}
+		if found := reopened.lookup(chunk.ChunkID) != nil; found != live {
+			t.Errorf("chunk %d: reloaded %v, expected %v", i, found, live)
+		}
+	}
+
+	// The dead slab is reclaimed, the live chunks are still served
+	compactions := atomic.LoadUint64(&counters.SlabCompactions)
+	fr.slabs.compact()
+	if atomic.LoadUint64(&counters.SlabCompactions) == compactions {
+		t.Error("no slab compacted")
+	}
+	if syscall.Faccessat(fr.rootFd, slabPath(first), syscall.F_OK, 0) == nil {
+		t.Errorf("slab %s not removed", slabPath(first))
+	}
+	for i, chunk := range chunks {
+		if fr.slabEntry(chunk.ChunkID) == nil && i != 7 {
+			continue
+		}
+		if data, _ := getTestChunk(t, repo, chunk.ChunkID); !bytes.Equal(data, payloads[i]) {
+			t.Errorf("chunk %d: read back %q after the compaction", i, data)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The snapshots of a volume (LVM, ZFS, ...) taken while the RAWX keeps
+serving. Upon POST /snapshot, the new writes are frozen, the chunks already
+written and the journal of the uploads are flushed to the device, then the
+snapshot_command runs with the volume frozen:
+
+	snapshot_command       lvcreate -s -L 10G -n rawx-$OIO_SNAPSHOT vg0/rawx
+	snapshot_post_command  /usr/local/bin/backup-snapshot
+
+The commands run through "sh -c", with the path of the volume, the service
+ID and the name of the snapshot in $OIO_VOLUME, $OIO_SERVICE_ID and
+$OIO_SNAPSHOT. The name is the "name" in the query string, or the current
+time. The writes are frozen at most snapshot_timeout seconds, the command
+still running is then killed and the snapshot fails. The requests arriving
+meanwhile wait for the thaw, they aren't refused. The snapshot_post_command
+runs once the writes thawed, e.g. to mount and copy the snapshot, its
+failure is only logged.
+
+As it freezes the writes and runs a command, the snapshot is an admin verb:
+it requires auth_tokens_file and a token with the ADMIN scope, cf. admin.go.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+const snapshotDefaultTimeout = 30
+
+var (
+	snapshotCommand     string
+	snapshotPostCommand string
+	snapshotTimeout     = snapshotDefaultTimeout * time.Second
+)
+
+var errNoSnapshotCommand = errors.New("No snapshot_command configured")
+
+type snapshotReport struct {
+	Volume string `json:"volume"`
+	Name   string `json:"name"`
+	// How long the writes were frozen, in milliseconds
+	Frozen int64 `json:"frozen"`
+}
+
+// Waits for the end of the snapshot in progress, if any
+func (fr *fileRepository) waitThawed() {
+	fr.frozen.RLock()
+	fr.frozen.RUnlock()
+}
+
+// Flushes the whole filesystem of the volume
+func (fr *fileRepository) syncVolume() error {
+	fd, err := syscall.Openat(fr.rootFd, ".", syscall.O_DIRECTORY|openFlagsROnly, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	return syscall.Syncfs(fd)
+}
+
+func runSnapshotCommand(ctx context.Context, command string, env []string) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.CombinedOutput()
+	if err != nil && len(out) > 0 {
+		LogWarning("Snapshot command output: %s", out)
+	}
+	return err
+}
+
+// Runs the snapshot command with the writes of the volume frozen
+func (fr *fileRepository) snapshot(env []string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+	defer cancel()
+
+	fr.frozen.Lock()
+	start := time.Now()
+	defer func() {
+		fr.frozen.Unlock()
+		LogInfo("Volume %s thawed after %v", fr.root, time.Since(start))
+	}()
+
+	err := fr.syncVolume()
+	if err == nil && fr.journal != nil {
+		err = fr.journal.flush()
+	}
+	if err == nil {
+		err = runSnapshotCommand(ctx, snapshotCommand, env)
+		if ctx.Err() == context.DeadlineExceeded {
+			err = ctx.Err()
+		}
+	}
+	return time.Since(start), err
+}
+
+func doSnapshot(rr *rawxRequest) {
+	if snapshotCommand == "" {
+		LogWarning("Snapshot refused: %v", errNoSnapshotCommand)
+		rr.replyCode(http.StatusNotImplemented)
+		return
+	}
+	repo, ok := rr.rawx.repo.(*chunkRepository)
+	if !ok {
+		rr.replyCode(http.StatusNotImplemented)
+		return
+	}
+	if err := repo.sub.writable(); err != nil {
+		rr.replyError(err)
+		return
+	}
+
+	name := rr.req.URL.Query().Get("name")
+	if name == "" {
+		name = strconv.FormatInt(time.Now().Unix(), 10)
+	} else if !validTxnID(name) {
+		rr.replyCode(http.StatusBadRequest)
+		return
+	}
+	env := []string{
+		"OIO_VOLUME=" + repo.sub.root,
+		"OIO_SERVICE_ID=" + rr.rawx.id,
+		"OIO_SNAPSHOT=" + name,
+	}
+
+	frozen, err := repo.sub.snapshot(env)
+	if err != nil {
+		LogError("Snapshot %s of %s failed: %v", name, repo.sub.root, err)
+		atomic.AddUint64(&counters.SnapshotFailed, 1)
+		rr.replyCode(http.StatusInternalServerError)
+		return
+	}
+	atomic.AddUint64(&counters.SnapshotTaken, 1)
+	LogInfo("Snapshot %s of %s taken", name, repo.sub.root)
+
+	if snapshotPostCommand != "" {
+		go func() {
+			if err := runSnapshotCommand(context.Background(), snapshotPostCommand, env); err != nil {
+				LogWarning("Snapshot %s post command failed: %v", name, err)
+			}
+		}()
+	}
+
+	body, err := json.Marshal(snapshotReport{
+		Volume: repo.sub.root,
+		Name:   name,
+		Frozen: int64(frozen / time.Millisecond),
+	})
+	if err != nil {
+		rr.replyError(err)
+		return
+	}
+	rr.rep.Header().Set("Content-Type", "application/json")
+	rr.replyCode(http.StatusOK)
+	rr.rep.Write(body)
+}
+
+func (rr *rawxRequest) serveSnapshot(rep http.ResponseWriter, req *http.Request) {
+	if err := rr.drain(); err != nil {
+		rr.replyError(err)
+		return
+	}
+
+	var spent uint64
+	if err := rr.authenticateAdmin(); err != nil {
+		rr.replyError(err)
+		spent = IncrementStatReqOther(rr)
+	} else {
+		switch req.Method {
+		case "POST":
+			doSnapshot(rr)
+			spent = IncrementStatReqOther(rr)
+		default:
+			rr.replyCode(http.StatusMethodNotAllowed)
+			spent = IncrementStatReqOther(rr)
+		}
+	}
+	if isVerbose() {
+		LogHttp(AccessLogEvent{
+			status:    rr.status,
+			timeSpent: spent,
+			bytesIn:   rr.bytesIn,
+			bytesOut:  rr.bytesOut,
+			method:    rr.req.Method,
+			local:     rr.rawx.url,
+			peer:      rr.req.RemoteAddr,
+			path:      rr.req.URL.Path,
+			reqId:     rr.reqid,
+		})
+	}
+}
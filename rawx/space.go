@@ -0,0 +1,175 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Watermarks on the space used on each volume. Once the bytes used reach
+space_high_watermark percents of the volume, or the inodes used reach
+space_inodes_high_watermark percents, the new chunks are refused with a
+507, until the usage falls under the matching low watermark. The room left
+between the watermark and a full disk is kept for the uploads already in
+progress. The inodes matter with the small chunks, they are often exhausted
+long before the bytes.
+
+The usage is cached for statfs_ttl milliseconds, so that neither the
+uploads nor the /stat requests issue a statfs() each.
+*/
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+const statfsDefaultTTL = 1000
+
+var errInsufficientStorage = errors.New("Insufficient storage")
+
+// Why the volume refuses the new chunks
+const (
+	spaceFullBytes = 1 << iota
+	spaceFullInodes
+)
+
+type spaceUsage struct {
+	bytesUsed   uint64
+	bytesFree   uint64
+	bytesTotal  uint64
+	inodesUsed  uint64
+	inodesFree  uint64
+	inodesTotal uint64
+}
+
+// The last usage of the volume, and when it was read
+type usageCache struct {
+	lock  sync.Mutex
+	ttl   time.Duration
+	at    time.Time
+	usage spaceUsage
+	err   error
+}
+
+// Tells the usage of the volume, as read at most statfs_ttl ago
+func (fr *fileRepository) usage() (spaceUsage, error) {
+	c := &fr.usageCache
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if now := time.Now(); c.at.IsZero() || now.Sub(c.at) >= c.ttl {
+		c.usage, c.err = fr.statfs()
+		c.at = now
+	}
+	return c.usage, c.err
+}
+
+func (fr *fileRepository) statfs() (spaceUsage, error) {
+	atomic.AddUint64(&counters.StatfsCalls, 1)
+	var st syscall.Statfs_t
+	if err := syscall.Fstatfs(fr.rootFd, &st); err != nil {
+		return spaceUsage{}, err
+	}
+	bsize := uint64(st.Bsize)
+	return spaceUsage{
+		bytesUsed:   (st.Blocks - st.Bfree) * bsize,
+		bytesFree:   st.Bavail * bsize,
+		bytesTotal:  st.Blocks * bsize,
+		inodesUsed:  st.Files - st.Ffree,
+		inodesFree:  st.Ffree,
+		inodesTotal: st.Files,
+	}, nil
+}
+
+// As with df, the blocks reserved to root are not accounted
+func (u spaceUsage) bytesPercent() float64 {
+	if avail := u.bytesUsed + u.bytesFree; avail > 0 {
+		return 100 * float64(u.bytesUsed) / float64(avail)
+	}
+	return 0
+}
+
+// Some filesystems have no inode limit, they report no inode at all
+func (u spaceUsage) inodesPercent() float64 {
+	if u.inodesTotal > 0 {
+		return 100 * float64(u.inodesUsed) / float64(u.inodesTotal)
+	}
+	return 0
+}
+
+type watermark struct {
+	high int
+	low  int
+}
+
+// Tells if the fill ratio is above the watermark, the low one applying
+// once it has been exceeded.
+func (w watermark) exceeded(fill float64, already bool) bool {
+	if w.high <= 0 {
+		return false
+	}
+	if already {
+		return fill >= float64(w.low)
+	}
+	return fill >= float64(w.high)
+}
+
+// Tells if a new chunk may be written on the volume
+func (fr *fileRepository) checkSpace() error {
+	if fr.bytesWatermark.high <= 0 && fr.inodesWatermark.high <= 0 {
+		return nil
+	}
+	u, err := fr.usage()
+	if err != nil {
+		LogWarning("Space of %s unknown: %v", fr.root, err)
+		return nil
+	}
+
+	prev := atomic.LoadInt32(&fr.full)
+	var full int32
+	if fr.bytesWatermark.exceeded(u.bytesPercent(), prev&spaceFullBytes != 0) {
+		full |= spaceFullBytes
+	}
+	if fr.inodesWatermark.exceeded(u.inodesPercent(), prev&spaceFullInodes != 0) {
+		full |= spaceFullInodes
+	}
+	if prev = atomic.SwapInt32(&fr.full, full); prev != full {
+		if full == 0 {
+			LogInfo("Volume %s accepts chunks again, %.1f%% bytes and %.1f%% inodes used",
+				fr.root, u.bytesPercent(), u.inodesPercent())
+		} else {
+			LogWarning("Volume %s full, %.1f%% bytes and %.1f%% inodes used, chunks refused",
+				fr.root, u.bytesPercent(), u.inodesPercent())
+		}
+	}
+	if full != 0 {
+		return errInsufficientStorage
+	}
+	return nil
+}
+
+// Tells if the error is due to a lack of space on the volume
+func isNoSpace(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	return err == errInsufficientStorage || err == syscall.ENOSPC || err == syscall.EDQUOT
+}
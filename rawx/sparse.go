@@ -0,0 +1,164 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The sparse chunks, e.g. the images of block devices, keep their holes. On
+PUT, when the sparse option is set on the volume, the blocks of zeros
+aligned on the file are skipped, so that they occupy no space. The space
+isn't preallocated then, and the uploads with O_DIRECT are left as they
+are.
+
+On GET, a raw chunk with holes is served region by region, as told by
+SEEK_DATA and SEEK_HOLE: the data with sendfile() and the holes from a
+buffer of zeros, without any read.
+*/
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync/atomic"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+const sparseBlock = 4096
+
+var sparseZeros = make([]byte, 64*1024)
+
+func isZeroBlock(b []byte) bool {
+	return len(b) == sparseBlock && bytes.Equal(b, sparseZeros[:sparseBlock])
+}
+
+// Writes the runs of data, the runs of blocks of zeros being left as holes
+func (fw *realFileWriter) writeSparse(buffer []byte, offset int64) (int, error) {
+	done := 0
+	for done < len(buffer) {
+		// The blocks are aligned on the file, the partial ones hold data
+		end := done + sparseBlock - int((offset+int64(done))%sparseBlock)
+		if end > len(buffer) {
+			end = len(buffer)
+		}
+		zeros := isZeroBlock(buffer[done:end])
+		for end < len(buffer) {
+			next := end + sparseBlock
+			if next > len(buffer) {
+				next = len(buffer)
+			}
+			if isZeroBlock(buffer[end:next]) != zeros {
+				break
+			}
+			end = next
+		}
+
+		at := offset + int64(done)
+		run := buffer[done:end]
+		if zeros {
+			fw.holes += int64(len(run))
+			atomic.AddUint64(&counters.SparseBytes, uint64(len(run)))
+		} else {
+			var err error
+			if fileEngine != nil {
+				_, err = enginePwriteAll(fileEngine, fw.fd(), run, at)
+			} else {
+				_, err = fw.f.WriteAt(run, at)
+			}
+			if err != nil {
+				return done, err
+			}
+		}
+		done = end
+	}
+	return done, nil
+}
+
+// Tells if the file has holes, i.e. less blocks than its size requires
+func hasHoles(f *os.File) bool {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+		return false
+	}
+	return st.Blocks*512 < st.Size
+}
+
+// Copies the raw chunk to the client, the holes being sent from memory.
+// Tells false when the chunk isn't served that way.
+func copySparse(dst io.Writer, in *io.LimitedReader, chunk fileReader) (int64, bool, error) {
+	offset, raw := rawOffset(in, chunk)
+	if !raw || !hasHoles(chunk.File()) {
+		return 0, false, nil
+	}
+	f := chunk.File()
+	fd := int(f.Fd())
+	var total int64
+	for in.N > 0 {
+		data, err := syscall.Seek(fd, offset, syscall.SEEK_DATA)
+		if err == syscall.ENXIO {
+			// Only a hole up to the end of the file
+			data = offset + in.N
+		} else if err != nil {
+			return total, true, err
+		}
+
+		if data > offset {
+			hole := data - offset
+			if hole > in.N {
+				hole = in.N
+			}
+			for hole > 0 {
+				step := int64(len(sparseZeros))
+				if step > hole {
+					step = hole
+				}
+				n, err := dst.Write(sparseZeros[:step])
+				total += int64(n)
+				in.N -= int64(n)
+				offset += int64(n)
+				hole -= int64(n)
+				if err != nil {
+					return total, true, err
+				}
+			}
+			continue
+		}
+
+		end, err := syscall.Seek(fd, offset, syscall.SEEK_HOLE)
+		if err == nil {
+			_, err = f.Seek(offset, os.SEEK_SET)
+		}
+		if err != nil {
+			return total, true, err
+		}
+		step := &io.LimitedReader{R: f, N: end - offset}
+		if step.N > in.N {
+			step.N = in.N
+		}
+		chunk.throttle(step.N)
+		n, err := io.Copy(dst, step)
+		total += n
+		in.N -= n
+		offset += n
+		if err != nil {
+			return total, true, err
+		}
+		if n == 0 {
+			break
+		}
+	}
+	return total, true, nil
+}
@@ -0,0 +1,171 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Tiering between a fast volume (e.g. SSD) and a cold volume (e.g. HDD). The
+new chunks land on the fast volume, and a background mover demotes to the
+cold volume the chunks not accessed for a while. The demoted chunks keep
+their name: a request for a chunk absent from the fast volume is internally
+redirected to the cold volume, so the clients never notice the move. Each
+move is told with a "storage.chunk.relocated" event, from the "fast" tier
+to the "cold" tier of the same volume.
+*/
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+const (
+	tierDefaultDemoteAfter  = 30
+	tierDefaultScanInterval = 3600
+)
+
+const (
+	tierFast = "fast"
+	tierCold = "cold"
+)
+
+type tierMover struct {
+	rawx         *rawxService
+	repo         *chunkRepository
+	demoteAfter  time.Duration
+	scanInterval time.Duration
+}
+
+func makeTierMover(rawx *rawxService, demoteAfter, scanInterval time.Duration) *tierMover {
+	return &tierMover{
+		rawx:         rawx,
+		repo:         rawx.repo.(*chunkRepository),
+		demoteAfter:  demoteAfter,
+		scanInterval: scanInterval,
+	}
+}
+
+func (m *tierMover) Start() {
+	go func() {
+		for {
+			m.scan()
+			time.Sleep(m.scanInterval)
+		}
+	}()
+}
+
+func (m *tierMover) scan() {
+	limit := time.Now().Add(-m.demoteAfter).Unix()
+	var count uint64
+	err := m.repo.sub.walk(func(name, relPath string, fi os.FileInfo) error {
+		// The stubs of the offloaded chunks stay where they are
+		if fi.Size() == 0 {
+			return nil
+		}
+		var st syscall.Stat_t
+		if err := syscall.Stat(m.repo.sub.root+"/"+relPath, &st); err != nil {
+			return nil
+		}
+		if st.Atim.Sec > limit {
+			return nil
+		}
+		if err := m.repo.demote(m.rawx, name); err != nil {
+			LogWarning("Chunk %s not demoted: %v", name, err)
+		} else {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		LogWarning("Tiering scan error: %v", err)
+	}
+	if count > 0 {
+		LogInfo("%d chunks demoted to %s", count, m.repo.cold.root)
+	}
+}
+
+// Moves the chunk, with its attributes, from the fast volume to the cold
+// volume. The chunk is locked during the move, so that neither an append
+// nor an update of its attributes is lost.
+func (cr *chunkRepository) demote(rawx *rawxService, name string) error {
+	lock := chunkLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+	cr.sub.frozen.RLock()
+	defer cr.sub.frozen.RUnlock()
+
+	r, err := cr.sub.get(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	var chunk chunkInfo
+	if err = chunk.loadAttr(r, name); err != nil {
+		return err
+	}
+
+	w, err := cr.cold.put(name)
+	if err != nil {
+		return err
+	}
+	if err = copyAttrs(r, w); err == nil {
+		_, err = io.Copy(w, r)
+	}
+	if err != nil {
+		w.abort()
+		return err
+	}
+	if err = w.commit(); err != nil {
+		return err
+	}
+	// The location changes before the fast copy leaves
+	if err = NotifyTiered(rawx, tierFast, tierCold, &chunk); err != nil {
+		_ = cr.cold.remove(name)
+		return err
+	}
+
+	// The fast copy is not trashed, it would shadow the cold one once
+	// restored. The chunk has been deleted during the move, the deletion wins.
+	if err = cr.sub.remove(name); os.IsNotExist(err) {
+		return cr.cold.remove(name)
+	}
+	if err == nil {
+		atomic.AddUint64(&counters.TierDemoted, 1)
+	}
+	return err
+}
+
+// Copies the attributes of the chunk, where its metadata live
+func copyAttrs(r fileReader, w fileWriter) error {
+	rf, ok := r.(*realFileReader)
+	if !ok {
+		return errors.New("Attributes of the chunk not copyable")
+	}
+	attrs, err := rf.attrs()
+	if err != nil {
+		return err
+	}
+	for key, value := range attrs {
+		if err = w.setAttr(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
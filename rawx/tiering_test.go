@@ -0,0 +1,90 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+func TestTiering(t *testing.T) {
+	repo := makeTestRepository(t, optionsMap{"trash_retention": "3600"})
+	cold := makeTestRepository(t, optionsMap{})
+	repo.cold = &cold.sub
+	notifier := &recordNotifier{}
+	rawx := &rawxService{id: "RAWX", url: "127.0.0.1:6200", repo: repo, notifier: notifier}
+	mover := makeTierMover(rawx, time.Hour, time.Hour)
+
+	// Only the chunk whose data was read stays on the fast tier
+	var chunks []chunkInfo
+	var payloads [][]byte
+	old := syscall.NsecToTimespec(time.Now().Add(-2 * time.Hour).UnixNano())
+	for i := 0; i < 3; i++ {
+		data := bytes.Repeat([]byte{byte('a' + i)}, 256)
+		chunk := makeTestChunk(i+1, data)
+		putTestChunk(t, &repo.sub, &chunk, data)
+		relPath := repo.sub.nameToRelPath(chunk.ChunkID)
+		if err := syscall.UtimesNanoAt(repo.sub.rootFd, relPath, []syscall.Timespec{old, old}, 0); err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, chunk)
+		payloads = append(payloads, data)
+	}
+	r, err := repo.get(chunks[1].ChunkID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	repo.touch(chunks[2].ChunkID)
+	mover.scan()
+
+	for i, chunk := range chunks {
+		demoted := i != 2
+		if repo.sub.exists(chunk.ChunkID) == demoted || cold.sub.exists(chunk.ChunkID) != demoted {
+			t.Errorf("chunk %d: demoted %v expected", i, demoted)
+		}
+		data, info := getTestChunk(t, repo, chunk.ChunkID)
+		if !bytes.Equal(data, payloads[i]) || info.ContentID != chunk.ContentID {
+			t.Errorf("chunk %d: read back %q, content %s", i, data, info.ContentID)
+		}
+	}
+	if entries, _ := ioutil.ReadDir(repo.sub.root + "/" + trashDir); len(entries) > 0 {
+		t.Errorf("%d demoted chunks trashed", len(entries))
+	}
+	if notifier.count() != 2 {
+		t.Fatalf("%d events, expected 2", notifier.count())
+	}
+	for _, evt := range notifier.events {
+		if !strings.Contains(evt, `"from_tier":"fast"`) || !strings.Contains(evt, `"tier":"cold"`) {
+			t.Errorf("event without the tiers: %s", evt)
+		}
+	}
+
+	// The move not told, the chunk stays on the fast tier
+	rawx.notifier = failingNotifier{}
+	if err = repo.demote(rawx, chunks[2].ChunkID); err == nil {
+		t.Error("chunk demoted without its event")
+	}
+	if !repo.sub.exists(chunks[2].ChunkID) || cold.sub.exists(chunks[2].ChunkID) {
+		t.Error("chunk moved without its event")
+	}
+}
@@ -0,0 +1,172 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The timeouts proper to GET (and HEAD), PUT (and PATCH) and DELETE, so that
+a large upload may last long while a DELETE may not. For each of them, in
+seconds (0 keeps the timeouts of the server):
+	timeout_<VERB>_read    to read the body of the request
+	timeout_<VERB>_write   to write the reply
+	timeout_<VERB>_idle    the longest pause while reading or writing
+	timeout_<VERB>_request the whole request, bounding both the others
+
+They are applied as deadlines on the connection, from the handler of the
+request, and override the server-wide timeout_read_request and
+timeout_write_reply. The idle timeout pushes the deadline back upon each
+read of the body or write of the reply, except during the sendfile() of a
+chunk.
+*/
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+type verbTimeouts struct {
+	read    time.Duration
+	write   time.Duration
+	idle    time.Duration
+	request time.Duration
+}
+
+// The timeouts configured, by method
+var timeoutsByVerb = map[string]*verbTimeouts{}
+
+func loadVerbTimeouts(opts optionsMap) {
+	methods := map[string][]string{
+		"get":    {"GET", "HEAD"},
+		"put":    {"PUT", "PATCH"},
+		"delete": {"DELETE"},
+	}
+	for verb, names := range methods {
+		t := verbTimeouts{
+			read:    time.Duration(opts.getInt("timeout_"+verb+"_read", 0)) * time.Second,
+			write:   time.Duration(opts.getInt("timeout_"+verb+"_write", 0)) * time.Second,
+			idle:    time.Duration(opts.getInt("timeout_"+verb+"_idle", 0)) * time.Second,
+			request: time.Duration(opts.getInt("timeout_"+verb+"_request", 0)) * time.Second,
+		}
+		if t == (verbTimeouts{}) {
+			continue
+		}
+		for _, name := range names {
+			timeoutsByVerb[name] = &t
+		}
+	}
+}
+
+// The earliest of the deadlines set, zero if none
+func earliest(start time.Time, delays ...time.Duration) time.Time {
+	var when time.Time
+	for _, d := range delays {
+		if d <= 0 {
+			continue
+		}
+		if t := start.Add(d); when.IsZero() || t.Before(when) {
+			when = t
+		}
+	}
+	return when
+}
+
+type deadlines struct {
+	rc    *http.ResponseController
+	idle  time.Duration
+	read  time.Time
+	write time.Time
+}
+
+// The next deadline, after a progress at now
+func (d *deadlines) next(hard time.Time, now time.Time) time.Time {
+	if d.idle <= 0 {
+		return hard
+	}
+	if t := now.Add(d.idle); hard.IsZero() || t.Before(hard) {
+		return t
+	}
+	return hard
+}
+
+func (d *deadlines) extendRead() {
+	if when := d.next(d.read, time.Now()); !when.IsZero() {
+		_ = d.rc.SetReadDeadline(when)
+	}
+}
+
+func (d *deadlines) extendWrite() {
+	if when := d.next(d.write, time.Now()); !when.IsZero() {
+		_ = d.rc.SetWriteDeadline(when)
+	}
+}
+
+type idleBody struct {
+	io.ReadCloser
+	d *deadlines
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	b.d.extendRead()
+	return b.ReadCloser.Read(p)
+}
+
+type idleWriter struct {
+	http.ResponseWriter
+	d *deadlines
+}
+
+func (w *idleWriter) Write(p []byte) (int, error) {
+	w.d.extendWrite()
+	return w.ResponseWriter.Write(p)
+}
+
+// Keeps the sendfile() of the server, bounded by the hard deadline only
+func (w *idleWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !w.d.write.IsZero() {
+		_ = w.d.rc.SetWriteDeadline(w.d.write)
+	}
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(w.ResponseWriter, src)
+}
+
+func (w *idleWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Sets the deadlines proper to the method of the request
+func (rr *rawxRequest) applyTimeouts() {
+	t := timeoutsByVerb[rr.req.Method]
+	if t == nil {
+		return
+	}
+	d := &deadlines{
+		rc:    http.NewResponseController(rr.rep),
+		idle:  t.idle,
+		read:  earliest(rr.startTime, t.read, t.request),
+		write: earliest(rr.startTime, t.write, t.request),
+	}
+	d.extendRead()
+	d.extendWrite()
+	if d.idle > 0 {
+		if rr.req.Body != nil {
+			rr.req.Body = &idleBody{ReadCloser: rr.req.Body, d: d}
+		}
+		rr.rep = &idleWriter{ResponseWriter: rr.rep, d: d}
+	}
+}
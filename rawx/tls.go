@@ -0,0 +1,215 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The TLS termination of the listener, with tls_cert_file and tls_key_file.
+With tls_ca_file, the certificates of the clients are verified against the
+given authorities, and required with tls_client_auth. tls_ciphers restricts
+the cipher suites of TLS 1.2 to a comma-separated list of names (those of
+TLS 1.3 aren't configurable), and tls_min_version tells the oldest version
+accepted, "1.2" by default.
+
+The files are checked every tls_reload_interval seconds, and loaded again
+once one of them changed, so that a renewed certificate is served without
+a restart: the new connections get it, the established ones keep the
+previous one. A file that can't be loaded is logged and the previous
+certificate is kept.
+*/
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const tlsDefaultReloadInterval = 60
+
+var errInvalidCA = errors.New("No certificate found in the CA file")
+
+type tlsReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	base     *tls.Config
+
+	lock   sync.RWMutex
+	config *tls.Config
+	stamp  string
+}
+
+// Parses the TLS settings, then loads the files once
+func makeTLSReloader(opts optionsMap) (*tlsReloader, error) {
+	r := &tlsReloader{
+		certFile: opts["tls_cert_file"],
+		keyFile:  opts["tls_key_file"],
+		caFile:   opts["tls_ca_file"],
+		base:     &tls.Config{MinVersion: tls.VersionTLS12},
+	}
+	if r.certFile == "" || r.keyFile == "" {
+		return nil, errors.New("Both tls_cert_file and tls_key_file are required")
+	}
+
+	switch v := opts["tls_min_version"]; v {
+	case "", "1.2":
+	case "1.3":
+		r.base.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("Unexpected TLS version [%s]", v)
+	}
+
+	if v := opts["tls_ciphers"]; v != "" {
+		known := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			known[suite.Name] = suite.ID
+		}
+		for _, name := range strings.Split(v, ",") {
+			id, ok := known[strings.TrimSpace(name)]
+			if !ok {
+				return nil, fmt.Errorf("Unexpected cipher suite [%s]", name)
+			}
+			r.base.CipherSuites = append(r.base.CipherSuites, id)
+		}
+	}
+
+	if opts.getBool("tls_client_auth", false) {
+		if r.caFile == "" {
+			return nil, errors.New("tls_client_auth requires tls_ca_file")
+		}
+		r.base.ClientAuth = tls.RequireAndVerifyClientCert
+	} else if r.caFile != "" {
+		r.base.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	if opts.getBool("http2", true) {
+		r.base.NextProtos = []string{"h2", "http/1.1"}
+	} else {
+		r.base.NextProtos = []string{"http/1.1"}
+	}
+
+	r.stamp = r.fileStamp()
+	return r, r.load()
+}
+
+// Tells when and how the files were last modified
+func (r *tlsReloader) fileStamp() string {
+	sb := strings.Builder{}
+	for _, path := range []string{r.certFile, r.keyFile, r.caFile} {
+		if path == "" {
+			continue
+		}
+		if fi, err := os.Stat(path); err == nil {
+			fmt.Fprintf(&sb, "%d/%d;", fi.ModTime().UnixNano(), fi.Size())
+		} else {
+			sb.WriteString("-;")
+		}
+	}
+	return sb.String()
+}
+
+func (r *tlsReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	config := r.base.Clone()
+	config.Certificates = []tls.Certificate{cert}
+	if r.caFile != "" {
+		encoded, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(encoded) {
+			return errInvalidCA
+		}
+		config.ClientCAs = pool
+	}
+	r.lock.Lock()
+	r.config = config
+	r.lock.Unlock()
+	return nil
+}
+
+func (r *tlsReloader) current() *tls.Config {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.config
+}
+
+func (r *tlsReloader) Start(interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			stamp := r.fileStamp()
+			if stamp == r.stamp {
+				continue
+			}
+			if err := r.load(); err != nil {
+				LogWarning("TLS certificate not reloaded: %v", err)
+				continue
+			}
+			r.stamp = stamp
+			atomic.AddUint64(&counters.TLSReloads, 1)
+			LogInfo("TLS certificate reloaded from %s", r.certFile)
+		}
+	}()
+}
+
+// The configuration of the listener, each handshake gets the latest files
+func (r *tlsReloader) serverConfig() *tls.Config {
+	return &tls.Config{
+		NextProtos: r.base.NextProtos,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &r.current().Certificates[0], nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current(), nil
+		},
+	}
+}
+
+// Enables TLS on the listener, when a certificate is configured
+func configureTLS(srv *http.Server, opts optionsMap) error {
+	if opts["tls_cert_file"] == "" && opts["tls_key_file"] == "" {
+		return nil
+	}
+	r, err := makeTLSReloader(opts)
+	if err != nil {
+		return err
+	}
+	if interval := opts.getInt("tls_reload_interval", tlsDefaultReloadInterval); interval > 0 {
+		r.Start(time.Duration(interval) * time.Second)
+	}
+	srv.TLSConfig = r.serverConfig()
+	return nil
+}
+
+func listenAndServe(srv *http.Server) error {
+	if srv.TLSConfig != nil {
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServe()
+}
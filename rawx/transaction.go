@@ -0,0 +1,281 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The transactions let a client upload several related chunks, e.g. the
+fragments of a metachunk destined to this RAWX, then make them appear all
+at once, or none of them. Each PUT carrying the same transaction ID stages
+its chunk under its temporary name, with its data and its attributes
+already synced, then:
+
+	POST /transaction/<ID>     renames all the chunks staged
+	DELETE /transaction/<ID>   discards them
+
+A transaction neither committed nor aborted within txn_timeout seconds,
+e.g. because its client died, is discarded. With the journal of the
+uploads, the commit is recorded at once, so that a crash in the middle of
+the renames still ends with all the chunks upon the next startup. A rename
+failing takes back the chunks already renamed, the chunk that couldn't be
+taken back is accounted and announced as any chunk uploaded. A chunk is
+never renamed over another one that appeared meanwhile (e.g. by a COPY),
+the commit fails instead. The small chunks are staged in their own file
+rather than in a slab, so that they are renamed and journaled along with
+the others.
+
+At most txn_max_open transactions are open at once on the service, each
+one with at most txn_max_members chunks.
+
+The commit is refused, and the transaction discarded, when the volume
+doesn't accept the changes anymore (read-only, maintenance).
+*/
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+const (
+	txnPathPrefix  = "/transaction/"
+	txnMaxIDLength = 128
+)
+
+var (
+	txnTimeout    = 300 * time.Second
+	txnMaxOpen    = 1024
+	txnMaxMembers = 256
+)
+
+var errTxnTooLarge = errors.New("Too many chunks in the transaction")
+
+type txnMember struct {
+	chunk chunkInfo
+	out   *realFileWriter
+}
+
+type transaction struct {
+	id      string
+	rawx    *rawxService
+	members []*txnMember
+	timer   *time.Timer
+}
+
+var txnLock sync.Mutex
+var transactions = make(map[string]*transaction)
+
+func txnKey(rawx *rawxService, id string) string {
+	return rawx.id + "/" + id
+}
+
+func validTxnID(id string) bool {
+	if len(id) == 0 || len(id) > txnMaxIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= '0' && c <= '9', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Adds the chunk uploaded to the transaction, started upon its first chunk
+func stageChunk(rawx *rawxService, id string, chunk chunkInfo, out fileWriter) error {
+	if !validTxnID(id) {
+		return errInvalidHeader
+	}
+	if w, ok := out.(*slabWriter); ok {
+		if w.spill == nil {
+			if err := w.spillOut(); err != nil {
+				return err
+			}
+		}
+		out = w.spill
+	}
+	fw, ok := out.(*realFileWriter)
+	if !ok {
+		return errInvalidHeader
+	}
+	key := txnKey(rawx, id)
+	txnLock.Lock()
+	defer txnLock.Unlock()
+	txn, ok := transactions[key]
+	if !ok && txnMaxOpen > 0 && len(transactions) >= txnMaxOpen {
+		return errTooBusy
+	}
+	if ok && txnMaxMembers > 0 && len(txn.members) >= txnMaxMembers {
+		return errTxnTooLarge
+	}
+	if !ok {
+		txn = &transaction{id: id, rawx: rawx}
+		txn.timer = time.AfterFunc(txnTimeout, func() {
+			if takeTransaction(rawx, id) == txn {
+				LogWarning("Transaction %s expired", id)
+				txn.abort()
+			}
+		})
+		transactions[key] = txn
+	}
+	txn.members = append(txn.members, &txnMember{chunk: chunk, out: fw})
+	return nil
+}
+
+// Removes the transaction from the registry, so that it is ended only once
+func takeTransaction(rawx *rawxService, id string) *transaction {
+	key := txnKey(rawx, id)
+	txnLock.Lock()
+	defer txnLock.Unlock()
+	txn := transactions[key]
+	delete(transactions, key)
+	return txn
+}
+
+func (txn *transaction) abort() {
+	txn.timer.Stop()
+	for _, m := range txn.members {
+		_ = m.out.abort()
+	}
+	atomic.AddUint64(&counters.TxnAborted, 1)
+}
+
+// Makes all the chunks of the transaction visible, or none of them, then
+// tells which ones are visible.
+func (txn *transaction) commit() ([]*txnMember, error) {
+	txn.timer.Stop()
+	if repo, ok := txn.rawx.repo.(*chunkRepository); ok {
+		if err := repo.sub.writable(); err != nil {
+			txn.abort()
+			return nil, err
+		}
+	}
+
+	// First the files are prepared, a failure leaves all of them aside
+	writers := make([]*realFileWriter, 0, len(txn.members))
+	for _, m := range txn.members {
+		if err := m.out.prepare(); err != nil {
+			LogError("Transaction %s aborted: %v", txn.id, err)
+			txn.abort()
+			return nil, err
+		}
+		writers = append(writers, m.out)
+	}
+
+	// Then the commit is recorded at once, and the chunks renamed
+	if len(writers) > 0 && writers[0].repo.journal != nil {
+		if err := writers[0].repo.journal.commitGroup(txn.id, writers); err != nil {
+			LogError("Transaction %s aborted: %v", txn.id, err)
+			txn.abort()
+			return nil, err
+		}
+	}
+	var err error
+	for i, m := range txn.members {
+		if err = m.out.rename(syscall.RENAME_NOREPLACE); err != nil {
+			LogError("Transaction %s: chunk %s not renamed: %v",
+				txn.id, m.chunk.ChunkID, err)
+			for _, rest := range txn.members[i:] {
+				_ = rest.out.abort()
+			}
+			return txn.rollback(txn.members[:i]), err
+		}
+	}
+	if err = writers[0].repo.syncCommitted(); err != nil {
+		LogError("Transaction %s not durable: %v", txn.id, err)
+		return txn.rollback(txn.members), err
+	}
+	for _, m := range txn.members {
+		m.out.dedup()
+	}
+	atomic.AddUint64(&counters.TxnCommitted, 1)
+	return txn.members, nil
+}
+
+// Takes back the chunks renamed, then tells those still visible
+func (txn *transaction) rollback(renamed []*txnMember) []*txnMember {
+	var visible []*txnMember
+	for _, m := range renamed {
+		if err := m.out.unpublish(); err != nil {
+			LogError("Transaction %s: chunk %s left visible: %v",
+				txn.id, m.chunk.ChunkID, err)
+			visible = append(visible, m)
+		}
+	}
+	atomic.AddUint64(&counters.TxnAborted, 1)
+	return visible
+}
+
+func (rr *rawxRequest) serveTransaction(rep http.ResponseWriter, req *http.Request) {
+	if err := rr.drain(); err != nil {
+		rr.replyError(err)
+		return
+	}
+
+	id := strings.TrimPrefix(req.URL.Path, txnPathPrefix)
+	var spent uint64
+	switch req.Method {
+	case "POST":
+		if txn := takeTransaction(rr.rawx, id); txn == nil {
+			rr.replyError(os.ErrNotExist)
+		} else {
+			visible, err := txn.commit()
+			if err != nil {
+				rr.replyError(err)
+			} else {
+				rr.replyCode(http.StatusNoContent)
+			}
+			for _, m := range visible {
+				rr.accountChunk(&m.chunk, 1)
+				NotifyNew(rr.rawx, rr.reqid, &m.chunk)
+			}
+		}
+		spent = IncrementStatReqOther(rr)
+	case "DELETE":
+		if txn := takeTransaction(rr.rawx, id); txn == nil {
+			rr.replyError(os.ErrNotExist)
+		} else {
+			txn.abort()
+			rr.replyCode(http.StatusNoContent)
+		}
+		spent = IncrementStatReqOther(rr)
+	default:
+		rr.replyCode(http.StatusMethodNotAllowed)
+		spent = IncrementStatReqOther(rr)
+	}
+	if isVerbose() {
+		LogHttp(AccessLogEvent{
+			status:    rr.status,
+			timeSpent: spent,
+			bytesIn:   rr.bytesIn,
+			bytesOut:  rr.bytesOut,
+			method:    rr.req.Method,
+			local:     rr.rawx.url,
+			peer:      rr.req.RemoteAddr,
+			path:      rr.req.URL.Path,
+			reqId:     rr.reqid,
+		})
+	}
+}
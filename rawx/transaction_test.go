@@ -0,0 +1,120 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Uploads the chunk as a member of the transaction
+func stageTestChunk(t *testing.T, rawx *rawxService, id string, chunk *chunkInfo, data []byte) error {
+	out, err := rawx.repo.put(chunk.ChunkID)
+	if err != nil {
+		t.Fatalf("put %s: %v", chunk.ChunkID, err)
+	}
+	if _, err = out.Write(data); err == nil {
+		err = chunk.saveAttr(out)
+	}
+	if err == nil {
+		err = stageChunk(rawx, id, *chunk, out)
+	}
+	if err != nil {
+		out.abort()
+	}
+	return err
+}
+
+func TestTransaction(t *testing.T) {
+	defer func(open, members int) { txnMaxOpen, txnMaxMembers = open, members }(txnMaxOpen, txnMaxMembers)
+	txnMaxOpen, txnMaxMembers = 0, 0
+
+	repo := makeTestRepository(t, optionsMap{})
+	rawx := &rawxService{id: "RAWX", repo: repo}
+	visible := func(chunk *chunkInfo) bool {
+		_, err := repo.get(chunk.ChunkID)
+		return err == nil
+	}
+	data := bytes.Repeat([]byte{'a'}, 64)
+	var chunks []chunkInfo
+	for i := 0; i < 6; i++ {
+		chunks = append(chunks, makeTestChunk(i+1, data))
+	}
+
+	// All the chunks appear upon the commit
+	for i := 0; i < 3; i++ {
+		if err := stageTestChunk(t, rawx, "T1", &chunks[i], data); err != nil {
+			t.Fatalf("chunk %d not staged: %v", i, err)
+		}
+		if visible(&chunks[i]) {
+			t.Errorf("staged chunk %d visible", i)
+		}
+	}
+	committed, err := takeTransaction(rawx, "T1").commit()
+	if err != nil || len(committed) != 3 {
+		t.Fatalf("transaction not committed: %d chunks, %v", len(committed), err)
+	}
+	for i := 0; i < 3; i++ {
+		if !visible(&chunks[i]) {
+			t.Errorf("chunk %d not visible once committed", i)
+		}
+	}
+
+	// None upon the abort
+	if err = stageTestChunk(t, rawx, "T2", &chunks[3], data); err != nil {
+		t.Fatal(err)
+	}
+	takeTransaction(rawx, "T2").abort()
+	if visible(&chunks[3]) {
+		t.Error("chunk visible once its transaction aborted")
+	}
+
+	// A chunk appeared meanwhile is kept, the commit fails
+	for i := 3; i < 5; i++ {
+		if err = stageTestChunk(t, rawx, "T3", &chunks[i], data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	existing := repo.sub.root + "/" + repo.sub.locate(chunks[4].ChunkID)
+	if err = ioutil.WriteFile(existing, []byte("copy"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if committed, err = takeTransaction(rawx, "T3").commit(); !os.IsExist(err) || len(committed) != 0 {
+		t.Errorf("commit over an existing chunk: %d chunks, %v", len(committed), err)
+	}
+	if visible(&chunks[3]) {
+		t.Error("chunk of the failed transaction still visible")
+	}
+	if content, _ := ioutil.ReadFile(existing); string(content) != "copy" {
+		t.Errorf("existing chunk replaced by %q", content)
+	}
+
+	// The transactions and their members are bounded
+	txnMaxOpen, txnMaxMembers = 1, 1
+	if err = stageTestChunk(t, rawx, "T4", &chunks[3], data); err != nil {
+		t.Fatal(err)
+	}
+	if err = stageTestChunk(t, rawx, "T4", &chunks[5], data); err != errTxnTooLarge {
+		t.Errorf("member beyond the limit: %v", err)
+	}
+	if err = stageTestChunk(t, rawx, "T5", &chunks[5], data); err != errTooBusy {
+		t.Errorf("transaction beyond the limit: %v", err)
+	}
+	takeTransaction(rawx, "T4").abort()
+}
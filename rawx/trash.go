@@ -0,0 +1,108 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+The trash of a volume, where the deleted chunks stay for trash_retention
+seconds before being purged, so that an accidental mass deletion can still
+be undone. A trashed chunk keeps its attributes, and its name is suffixed
+with the time of its deletion:
+
+	.trash/<CHUNKID>.<TIMESTAMP>
+
+Restoring a chunk is a matter of moving it back to its place, without the
+suffix. The trash is neither walked nor watched, and the chunks are purged
+by a background task, every trash_purge_interval seconds.
+*/
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+const trashDefaultPurgeInterval = 3600
+
+// Moves the chunk to the trash, instead of unlinking it
+func (fr *fileRepository) trash(name, relPath string) error {
+	if err := syscall.Mkdirat(fr.rootFd, trashDir, uint32(fr.putMkdirMode)); err != nil && err != syscall.EEXIST {
+		return err
+	}
+	dest := trashDir + "/" + name + "." + strconv.FormatInt(time.Now().Unix(), 10)
+	if err := syscall.Renameat(fr.rootFd, relPath, fr.rootFd, dest); err != nil {
+		return err
+	}
+	if fr.sidecar {
+		err := syscall.Renameat(fr.rootFd, relPath+metaSuffix, fr.rootFd, dest+metaSuffix)
+		if err != nil && err != syscall.ENOENT {
+			LogWarning("Failed to trash the sidecar of %s: %v", name, err)
+		}
+	}
+	atomic.AddUint64(&counters.TrashChunks, 1)
+	return nil
+}
+
+func (fr *fileRepository) startPurger(interval time.Duration) {
+	go func() {
+		for {
+			fr.purgeTrash()
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// Unlinks the chunks trashed for longer than the retention
+func (fr *fileRepository) purgeTrash() {
+	entries, err := ioutil.ReadDir(fr.root + "/" + trashDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			LogWarning("Trash of %s not purged: %v", fr.root, err)
+		}
+		return
+	}
+	limit := time.Now().Add(-fr.trashRetention).Unix()
+	var purged uint64
+	for _, fi := range entries {
+		name := fi.Name()
+		idx := strings.IndexByte(name, '.')
+		if idx != 64 || !isHexaString(name[:idx], 64) || strings.HasSuffix(name, metaSuffix) {
+			continue
+		}
+		ts, err := strconv.ParseInt(name[idx+1:], 10, 64)
+		if err != nil || ts > limit {
+			continue
+		}
+		relPath := trashDir + "/" + name
+		if err = fr.unlinkDiscard(relPath); err != nil {
+			LogWarning("Trashed chunk %s not purged: %v", name, err)
+			continue
+		}
+		if fr.sidecar {
+			_ = fr.removeSidecar(relPath)
+		}
+		purged++
+	}
+	if purged > 0 {
+		atomic.AddUint64(&counters.TrashPurged, purged)
+		LogInfo("%d chunks purged from the trash of %s", purged, fr.root)
+	}
+}
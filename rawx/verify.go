@@ -0,0 +1,131 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Verification of the chunks upon GET. The MD5 of the chunk is recomputed and
+compared to the hash stored in its attributes, so that a silent corruption
+of the data is detected before the clients trust it:
+
+  - "strict": the chunk is hashed before the reply, and a corrupted chunk is
+    answered with a 500. The data is read twice, the second time from the
+    page cache.
+  - "stream": the chunk is hashed while it is transmitted, its last byte
+    is held back until the hash matches. The status is already sent, so
+    the transfer of a corrupted chunk is interrupted instead.
+
+A corrupted or truncated chunk is moved to the quarantine of its volume,
+listed by GET /quarantine, and a "storage.chunk.corrupted" event is
+emitted.
+*/
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+var errCorruptedChunk = errors.New("Corrupted chunk")
+
+// Tells if the hash of the chunk can be verified
+func (rr *rawxRequest) verifiable() bool {
+	return rr.rawx.verifyGet != verifyGetOff && isHexaString(rr.chunk.ChunkHash, 32)
+}
+
+func (rr *rawxRequest) hashMatches(sum []byte) bool {
+	return strings.EqualFold(hex.EncodeToString(sum), rr.chunk.ChunkHash)
+}
+
+// Hashes the whole content of the chunk, then rewinds it
+func (rr *rawxRequest) verifyChunk(inChunk fileReader) error {
+	in, filter, err := rr.getChunkReader(inChunk, rr.chunk.size, rangeInfo{})
+	if filter != nil {
+		defer filter.Close()
+	}
+	if err != nil {
+		return err
+	}
+	h, err := rr.chunk.newHash()
+	if err != nil {
+		return err
+	}
+	n, err := copyPooled(h, in)
+	if err != nil && err != errCorruptedSegment {
+		return err
+	}
+	if reason := rr.checkIntegrity(n, h.Sum(nil), err); reason != "" {
+		rr.reportCorruption(reason)
+		return errCorruptedChunk
+	}
+	return inChunk.seek(0)
+}
+
+// Tells why the data read doesn't match the chunk, if it doesn't
+func (rr *rawxRequest) checkIntegrity(n int64, sum []byte, err error) string {
+	switch {
+	case err == errCorruptedSegment:
+		return quarantineBadSegment
+	case n < rr.chunk.size:
+		return quarantineTruncated
+	case isHexaString(rr.chunk.ChunkHash, hashHexSize(rr.chunk.hashAlgo)) && !rr.hashMatches(sum):
+		return quarantineHashMismatch
+	}
+	return ""
+}
+
+// Transmits the whole chunk while hashing it, the last byte is only sent
+// once the hash matched.
+func (rr *rawxRequest) copyVerified(dst io.Writer, in *io.LimitedReader) (int64, error) {
+	if in.N <= 0 {
+		return 0, nil
+	}
+	h, err := rr.chunk.newHash()
+	if err != nil {
+		return 0, err
+	}
+	tee := io.TeeReader(in, h)
+	written, err := io.CopyN(dst, tee, in.N-1)
+	var tail bytes.Buffer
+	if err == nil {
+		_, err = io.Copy(&tail, tee)
+	}
+	if err == io.EOF {
+		// Truncated, as told by the size checked below
+		err = nil
+	} else if err != nil && err != errCorruptedSegment {
+		return written, err
+	}
+	if reason := rr.checkIntegrity(written+int64(tail.Len()), h.Sum(nil), err); reason != "" {
+		rr.reportCorruption(reason)
+		return written, errCorruptedChunk
+	}
+	nb, err := dst.Write(tail.Bytes())
+	return written + int64(nb), err
+}
+
+func (rr *rawxRequest) reportCorruption(reason string) {
+	atomic.AddUint64(&counters.ChunksCorrupted, 1)
+	LogError("Chunk %s corrupted, %s (expected %s, %d bytes)",
+		rr.chunkID, reason, rr.chunk.ChunkHash, rr.chunk.size)
+	if err := rr.rawx.repo.quarantine(rr.chunkID, reason); err != nil {
+		LogError("Failed to quarantine the chunk %s: %v", rr.chunkID, err)
+	}
+	NotifyCorrupt(rr.rawx, rr.reqid, &rr.chunk)
+}
@@ -0,0 +1,132 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Several volumes served by the same process, e.g. on dense JBOD servers.
+Each volume has its own service ID, and they all share the HTTP listener,
+the notifier and the logger. The additional volumes are declared as a list
+of "ID=PATH" pairs, each path being optionally followed by the storage
+settings proper to the volume:
+
+	volumes  OPENIO-rawx-2=/mnt/disk2,OPENIO-rawx-3=/mnt/disk3?hash_width=2&hash_depth=2
+
+A request is routed to the volume whose service ID is the first element of
+the path (e.g. "/OPENIO-rawx-2/" followed by the chunk ID), or whose service
+ID is the Host header. Any other request goes to the main volume.
+*/
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Builds the additional volumes, with the settings of the main volume
+func makeVolumes(config string, opts optionsMap, primary *rawxService) ([]*rawxService, error) {
+	ids := map[string]bool{primary.id: true}
+	var volumes []*rawxService
+	for _, item := range strings.Split(config, ",") {
+		if item == "" {
+			continue
+		}
+		idx := strings.IndexByte(item, '=')
+		if idx <= 0 || idx == len(item)-1 {
+			return nil, errors.New("Invalid volume, ID=PATH expected: " + item)
+		}
+		id, path := item[:idx], item[idx+1:]
+		if ids[id] {
+			return nil, errors.New("Duplicated volume ID: " + id)
+		}
+		ids[id] = true
+
+		volOpts := opts
+		if idx = strings.IndexByte(path, '?'); idx >= 0 {
+			var err error
+			if volOpts, err = overrideOpts(opts, path[idx+1:]); err != nil {
+				return nil, err
+			}
+			path = path[:idx]
+		}
+
+		repo := new(chunkRepository)
+		if err := configureRepository(repo, volOpts, path); err != nil {
+			return nil, err
+		}
+		vol := *primary
+		vol.id = id
+		vol.path = repo.sub.root
+		vol.repo = repo
+		volumes = append(volumes, &vol)
+	}
+	return volumes, nil
+}
+
+// Copies the options, overridden by those of the query string
+func overrideOpts(opts optionsMap, query string) (optionsMap, error) {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	result := make(optionsMap, len(opts))
+	for k, v := range opts {
+		result[k] = v
+	}
+	for k, v := range values {
+		name, ok := loadedOpts[k]
+		if !ok {
+			return nil, errors.New("Unknown volume option: " + k)
+		}
+		result[name] = v[len(v)-1]
+	}
+	return result, nil
+}
+
+type volumeRouter struct {
+	main    *rawxService
+	volumes map[string]*rawxService
+}
+
+func makeVolumeRouter(volumes []*rawxService) *volumeRouter {
+	router := &volumeRouter{
+		main:    volumes[0],
+		volumes: make(map[string]*rawxService),
+	}
+	for _, vol := range volumes {
+		router.volumes[vol.id] = vol
+	}
+	return router
+}
+
+func (router *volumeRouter) ServeHTTP(rep http.ResponseWriter, req *http.Request) {
+	// The prefix is checked first, the Host header is also the address
+	// of the main volume.
+	path := strings.TrimLeft(req.URL.Path, "/")
+	if idx := strings.IndexByte(path, '/'); idx > 0 {
+		if vol, ok := router.volumes[path[:idx]]; ok {
+			req.URL.Path = path[idx:]
+			vol.ServeHTTP(rep, req)
+			return
+		}
+	}
+	if vol, ok := router.volumes[req.Host]; ok {
+		vol.ServeHTTP(rep, req)
+		return
+	}
+	router.main.ServeHTTP(rep, req)
+}
@@ -0,0 +1,225 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+Watches the volume for modifications that were not performed by the RAWX
+itself (e.g. manual deletions, restorations from a backup). Such changes
+are logged then reported with reconciliation events.
+*/
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	syscall "golang.org/x/sys/unix"
+)
+
+const (
+	// How long a change made by the RAWX is expected to be reported
+	watcherExpectTTL = 10 * time.Second
+
+	watcherMask = syscall.IN_ONLYDIR | syscall.IN_CREATE |
+		syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO |
+		syscall.IN_DELETE | syscall.IN_MOVED_FROM
+)
+
+type volumeWatcher struct {
+	rawx *rawxService
+	repo *chunkRepository
+	fd   int
+
+	// The relative paths of the watched directories, by watch descriptor
+	dirs map[int]string
+
+	// The chunks recently modified by the RAWX itself
+	lock     sync.Mutex
+	expected map[string]time.Time
+}
+
+func makeVolumeWatcher(rawx *rawxService, repo *chunkRepository) (*volumeWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	w := &volumeWatcher{
+		rawx:     rawx,
+		repo:     repo,
+		fd:       fd,
+		dirs:     make(map[int]string),
+		expected: make(map[string]time.Time),
+	}
+	root := repo.sub.root
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.IsDir() {
+			return err
+		}
+		if path != root && strings.HasPrefix(fi.Name(), ".") {
+			return filepath.SkipDir
+		}
+		return w.addDir(path)
+	})
+	if err != nil {
+		_ = syscall.Close(fd)
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *volumeWatcher) addDir(path string) error {
+	wd, err := syscall.InotifyAddWatch(w.fd, path, watcherMask)
+	if err != nil {
+		return err
+	}
+	w.dirs[wd] = path
+	return nil
+}
+
+// Tells the watcher the chunk is about to be modified by the RAWX
+func (w *volumeWatcher) expect(name string) {
+	w.lock.Lock()
+	w.expected[name] = time.Now()
+	w.lock.Unlock()
+}
+
+func (w *volumeWatcher) isExpected(name string) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	now := time.Now()
+	for k, when := range w.expected {
+		if now.Sub(when) > watcherExpectTTL {
+			delete(w.expected, k)
+		}
+	}
+	_, ok := w.expected[name]
+	return ok
+}
+
+// Tells if the change on the chunk was expected, and forget the expectation
+func (w *volumeWatcher) consume(name string) bool {
+	ok := w.isExpected(name)
+	if ok {
+		w.lock.Lock()
+		delete(w.expected, name)
+		w.lock.Unlock()
+	}
+	return ok
+}
+
+func (w *volumeWatcher) Start() {
+	go func() {
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := syscall.Read(w.fd, buf)
+			if err != nil {
+				if err == syscall.EINTR {
+					continue
+				}
+				LogError("Volume watcher stopped: %v", err)
+				return
+			}
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				evt := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				start := offset + syscall.SizeofInotifyEvent
+				end := start + int(evt.Len)
+				name := string(bytes.TrimRight(buf[start:end], "\x00"))
+				w.handle(evt, name)
+				offset = end
+			}
+		}
+	}()
+}
+
+func (w *volumeWatcher) handle(evt *syscall.InotifyEvent, name string) {
+	dir, ok := w.dirs[int(evt.Wd)]
+	if !ok {
+		return
+	}
+	if evt.Mask&syscall.IN_IGNORED != 0 {
+		delete(w.dirs, int(evt.Wd))
+		return
+	}
+	if evt.Mask&syscall.IN_ISDIR != 0 {
+		if evt.Mask&syscall.IN_CREATE != 0 && !strings.HasPrefix(name, ".") {
+			w.addNewDir(dir + "/" + name)
+		}
+		return
+	}
+	w.handleFile(evt.Mask, dir, name)
+}
+
+// Watches a directory that appeared while running, then catches up with
+// the files created before the watch was in place.
+func (w *volumeWatcher) addNewDir(path string) {
+	if err := w.addDir(path); err != nil {
+		LogWarning("Failed to watch %s: %v", path, err)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	names, _ := f.Readdirnames(-1)
+	_ = f.Close()
+	for _, name := range names {
+		if !isHexaString(name, 64) {
+			continue
+		}
+		// The event of a chunk uploaded by the RAWX might still come, so
+		// the expectation is kept.
+		name = strings.ToUpper(name)
+		if !w.isExpected(name) {
+			w.reportAdded(path, name)
+		}
+	}
+}
+
+func (w *volumeWatcher) handleFile(mask uint32, dir, name string) {
+	if !isHexaString(name, 64) {
+		return
+	}
+	name = strings.ToUpper(name)
+	// The temporary files are not reported, so each operation of the RAWX
+	// produces exactly one event on the final name of the chunk.
+	if w.consume(name) {
+		return
+	}
+
+	switch {
+	case mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+		LogWarning("Chunk %s/%s removed out of band", dir, name)
+		chunk := chunkInfo{ChunkID: name}
+		NotifyLost(w.rawx, "", &chunk)
+	case mask&(syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO) != 0:
+		w.reportAdded(dir, name)
+	}
+}
+
+func (w *volumeWatcher) reportAdded(dir, name string) {
+	LogWarning("Chunk %s/%s added out of band", dir, name)
+	chunk := chunkInfo{}
+	if err := w.repo.loadInfo(name, &chunk); err != nil {
+		LogWarning("Chunk %s has invalid attributes: %v", name, err)
+		return
+	}
+	NotifyNew(w.rawx, "", &chunk)
+}
@@ -0,0 +1,141 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+/*
+XXH64, with a null seed, as a hash.Hash whose sum is the canonical (big
+endian) form of the 64 bits hash. Much faster than MD5, and good enough to
+detect the corruptions of the chunks of the ephemeral policies.
+*/
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+const (
+	xxhPrime1 uint64 = 11400714785074694791
+	xxhPrime2 uint64 = 14029467366897019727
+	xxhPrime3 uint64 = 1609587929392839161
+	xxhPrime4 uint64 = 9650029242287828579
+	xxhPrime5 uint64 = 2870177450012600261
+)
+
+type xxh64 struct {
+	v     [4]uint64
+	total uint64
+	buf   [32]byte
+	n     int
+}
+
+func newXXH64() *xxh64 {
+	x := &xxh64{}
+	x.Reset()
+	return x
+}
+
+func xxhRound(acc, input uint64) uint64 {
+	acc += input * xxhPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxhPrime1
+}
+
+func xxhMerge(acc, v uint64) uint64 {
+	acc ^= xxhRound(0, v)
+	return acc*xxhPrime1 + xxhPrime4
+}
+
+func (x *xxh64) Reset() {
+	// Wrapping around, as the seed is null
+	p1, p2 := xxhPrime1, xxhPrime2
+	x.v = [4]uint64{p1 + p2, p2, 0, -p1}
+	x.total = 0
+	x.n = 0
+}
+
+func (x *xxh64) Size() int      { return 8 }
+func (x *xxh64) BlockSize() int { return 32 }
+
+func (x *xxh64) stripe(p []byte) {
+	x.v[0] = xxhRound(x.v[0], binary.LittleEndian.Uint64(p[0:]))
+	x.v[1] = xxhRound(x.v[1], binary.LittleEndian.Uint64(p[8:]))
+	x.v[2] = xxhRound(x.v[2], binary.LittleEndian.Uint64(p[16:]))
+	x.v[3] = xxhRound(x.v[3], binary.LittleEndian.Uint64(p[24:]))
+}
+
+func (x *xxh64) Write(p []byte) (int, error) {
+	written := len(p)
+	x.total += uint64(written)
+	if x.n > 0 {
+		c := copy(x.buf[x.n:], p)
+		x.n += c
+		p = p[c:]
+		if x.n < len(x.buf) {
+			return written, nil
+		}
+		x.stripe(x.buf[:])
+		x.n = 0
+	}
+	for len(p) >= 32 {
+		x.stripe(p)
+		p = p[32:]
+	}
+	x.n = copy(x.buf[:], p)
+	return written, nil
+}
+
+func (x *xxh64) Sum64() uint64 {
+	var h uint64
+	if x.total >= 32 {
+		h = bits.RotateLeft64(x.v[0], 1) + bits.RotateLeft64(x.v[1], 7) +
+			bits.RotateLeft64(x.v[2], 12) + bits.RotateLeft64(x.v[3], 18)
+		for _, v := range x.v {
+			h = xxhMerge(h, v)
+		}
+	} else {
+		h = xxhPrime5
+	}
+	h += x.total
+
+	p := x.buf[:x.n]
+	for ; len(p) >= 8; p = p[8:] {
+		h ^= xxhRound(0, binary.LittleEndian.Uint64(p))
+		h = bits.RotateLeft64(h, 27)*xxhPrime1 + xxhPrime4
+	}
+	if len(p) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(p)) * xxhPrime1
+		h = bits.RotateLeft64(h, 23)*xxhPrime2 + xxhPrime3
+		p = p[4:]
+	}
+	for _, b := range p {
+		h ^= uint64(b) * xxhPrime5
+		h = bits.RotateLeft64(h, 11) * xxhPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxhPrime2
+	h ^= h >> 29
+	h *= xxhPrime3
+	h ^= h >> 32
+	return h
+}
+
+func (x *xxh64) Sum(b []byte) []byte {
+	var sum [8]byte
+	binary.BigEndian.PutUint64(sum[:], x.Sum64())
+	return append(b, sum[:]...)
+}
@@ -0,0 +1,60 @@
+// OpenIO SDS Go rawx
+// Copyright (C) 2015-2019 OpenIO SAS
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation; either
+// version 3.0 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public
+// License along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestXXH64(t *testing.T) {
+	cases := []struct {
+		input string
+		sum   string
+	}{
+		{"", "ef46db3751d8e999"},
+		{"a", "d24ec4f1a98c6e5b"},
+		{"abc", "44bc2cf5ad770999"},
+		{"Nobody inspects the spammish repetition", "fbcea83c8a378bf1"},
+		{strings.Repeat("0123456789", 10), "f80e7b96315afffa"},
+	}
+	for _, tc := range cases {
+		// At once, then byte after byte, then by pieces across the stripes
+		for _, piece := range []int{len(tc.input) + 1, 1, 7, 32, 33} {
+			x := newXXH64()
+			for input := tc.input; len(input) > 0; {
+				n := piece
+				if n > len(input) {
+					n = len(input)
+				}
+				x.Write([]byte(input[:n]))
+				input = input[n:]
+			}
+			if sum := hex.EncodeToString(x.Sum(nil)); sum != tc.sum {
+				t.Errorf("%q by %d: %s, expected %s", tc.input, piece, sum, tc.sum)
+			}
+		}
+	}
+
+	x := newXXH64()
+	x.Write([]byte("abc"))
+	x.Reset()
+	if sum := hex.EncodeToString(x.Sum(nil)); sum != "ef46db3751d8e999" {
+		t.Errorf("after Reset(): %s", sum)
+	}
+}
@@ -0,0 +1,45 @@
+#!/usr/bin/env bash
+
+# oio-check-go-deps.sh
+# Copyright (C) 2026 OpenIO SAS, as part of OpenIO SDS
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU Affero General Public License as
+# published by the Free Software Foundation, either version 3 of the
+# License, or (at your option) any later version.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU Affero General Public License for more details.
+#
+# You should have received a copy of the GNU Affero General Public License
+# along with this program.  If not, see <http://www.gnu.org/licenses/>.
+set -e
+
+BASEDIR=$1 ; [[ -n "$BASEDIR" ]] ; [[ -d "$BASEDIR" ]]
+
+# The minimal version of Go, as required by the top CMakeLists.txt
+GO_REQUIRED=1.24
+GO_VERSION=$(go env GOVERSION 2>/dev/null | sed -n 's/^go\([0-9]*\.[0-9]*\).*/\1/p')
+echo "Checking the version of Go: ${GO_VERSION:-unknown}, ${GO_REQUIRED} required."
+if [[ -z "$GO_VERSION" || "$(printf '%s\n' "$GO_REQUIRED" "$GO_VERSION" | sort -V | head -n 1)" != "$GO_REQUIRED" ]] ; then
+	echo "ERROR Go >= ${GO_REQUIRED} required" 1>&2
+	exit 1
+fi
+
+# Each package imported by the rawx from outside the standard library must
+# be fetched by the CI, in the same change as the import itself. The files
+# behind a build tag (optional features) are not built by the CI.
+echo "Checking the Go dependencies fetched by the CI."
+FETCHED=$(grep -E '^\s*-\s*go get ' "${BASEDIR}/.travis.yml" | tr ' ' '\n')
+SOURCES=$(grep -L -E '^//go:build ' "${BASEDIR}"/rawx/*.go)
+FAIL=0
+for PKG in $(sed -n '/^import (/,/^)/p; /^import "/p' $SOURCES \
+		| grep -o -E '"[a-z0-9.-]+\.[a-z]+/[^"]+"' | tr -d '"' | sort -u) ; do
+	if ! grep -q -x -F "$PKG" <<<"$FETCHED" ; then
+		echo "ERROR $PKG is imported but not fetched by .travis.yml" 1>&2
+		FAIL=1
+	fi
+done
+exit $FAIL
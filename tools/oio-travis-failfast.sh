@@ -31,6 +31,7 @@ fold() {
 fold SDK ./tools/oio-build-sdk.sh ${PWD}
 fold Release ./tools/oio-build-release.sh ${PWD}
 fold Copyright ./tools/oio-check-copyright.sh ${PWD}
+fold GoDeps ./tools/oio-check-go-deps.sh ${PWD}
 fold Virtualenv python ./setup.py develop
 fold Variables tox -e variables
 fold VariablesPy3 tox -e py3_variables